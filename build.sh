@@ -5,6 +5,8 @@ OUT_DIR=$(pwd)/bin
 
 echo "output: ${OUT_DIR}"
 mkdir -p "${OUT_DIR}"
+# Each directory is a command: the modules, and the tools such as check_ldap
+# and ngx_apikey that run without a module configuration.
 ls -1 src/ngx_auth/exec | while read d ; do
   echo -n "build ${d}: "
   (
@@ -0,0 +1,125 @@
+package admin
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/l4go/task"
+
+	"ngx_auth/health"
+	logger "ngx_auth/logger"
+	"ngx_auth/metrics"
+	"ngx_auth/server"
+)
+
+// Config is the optional [admin] listener, separated from the auth socket.
+type Config struct {
+	SocketType  string `toml:",omitempty" json:"socket_type,omitempty" yaml:"socket_type,omitempty"`
+	SocketPath  string `toml:",omitempty" json:"socket_path,omitempty" yaml:"socket_path,omitempty"`
+	SocketMode  string `toml:",omitempty" json:"socket_mode,omitempty" yaml:"socket_mode,omitempty"`
+	SocketOwner string `toml:",omitempty" json:"socket_owner,omitempty" yaml:"socket_owner,omitempty"`
+	SocketGroup string `toml:",omitempty" json:"socket_group,omitempty" yaml:"socket_group,omitempty"`
+	MetricsPath string `toml:",omitempty" json:"metrics_path,omitempty" yaml:"metrics_path,omitempty"`
+	HealthPath  string `toml:",omitempty" json:"health_path,omitempty" yaml:"health_path,omitempty"`
+	ReadyPath   string `toml:",omitempty" json:"ready_path,omitempty" yaml:"ready_path,omitempty"`
+
+	ProbeCacheSeconds uint32 `toml:",omitempty" json:"probe_cache_seconds,omitempty" yaml:"probe_cache_seconds,omitempty"`
+}
+
+// ProbeCacheTTL is how long a readiness probe result is reused.
+func (cfg *Config) ProbeCacheTTL() time.Duration {
+	return time.Duration(cfg.ProbeCacheSeconds) * time.Second
+}
+
+// DefaultSocketMode is the permission of the UNIX domain socket file.
+// Unlike the auth socket, other local users cannot read the metrics.
+const DefaultSocketMode = "0660"
+
+// Ownership is the permission and the owner of the UNIX domain socket file.
+func (cfg *Config) Ownership() *server.SocketOwnership {
+	return &server.SocketOwnership{
+		Mode:  cfg.SocketMode,
+		Owner: cfg.SocketOwner,
+		Group: cfg.SocketGroup,
+	}
+}
+
+func (cfg *Config) IsEnabled() bool {
+	return cfg.SocketPath != ""
+}
+
+func (cfg *Config) SetDefault() {
+	if cfg.SocketType == "" {
+		cfg.SocketType = "tcp"
+	}
+	if cfg.SocketType == "unix" && cfg.SocketMode == "" {
+		cfg.SocketMode = DefaultSocketMode
+	}
+	if cfg.MetricsPath == "" {
+		cfg.MetricsPath = "/metrics"
+	}
+	if cfg.HealthPath == "" {
+		cfg.HealthPath = "/healthz"
+	}
+	if cfg.ReadyPath == "" {
+		cfg.ReadyPath = "/readyz"
+	}
+	if cfg.ProbeCacheSeconds == 0 {
+		cfg.ProbeCacheSeconds = 10
+	}
+}
+
+func (cfg *Config) IsValid() bool {
+	if !cfg.IsEnabled() {
+		return true
+	}
+	return cfg.SocketType == "tcp" || cfg.SocketType == "unix"
+}
+
+var mux = http.NewServeMux()
+
+// Handle registers an additional handler on the admin listener.
+func Handle(pattern string, h http.Handler) {
+	mux.Handle(pattern, h)
+}
+
+// Start serves the admin listener in the background until cc is cancelled.
+// It does nothing if no socket_path is configured.
+func Start(cc task.Canceller, cfg *Config) error {
+	if !cfg.IsEnabled() {
+		return nil
+	}
+
+	mux.Handle(cfg.MetricsPath, metrics.Handler())
+	mux.Handle(cfg.HealthPath, health.LiveHandler())
+	mux.Handle(cfg.ReadyPath, health.ReadyHandler())
+
+	lstn, err := server.Listen(cc, server.NameAdmin, cfg.SocketType, cfg.SocketPath)
+	if err != nil {
+		return err
+	}
+	owned := cfg.SocketType == "unix" && !server.IsInherited(lstn)
+	if owned {
+		if err := cfg.Ownership().Apply(cfg.SocketPath); err != nil {
+			lstn.Close()
+			os.Remove(cfg.SocketPath)
+			return err
+		}
+	}
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if owned {
+			defer os.Remove(cfg.SocketPath)
+		}
+		serr := server.Serve(cc, srv, lstn, time.Second)
+		if serr != nil {
+			logger.Event(logger.LevelError, logger.EventAdminError, logger.Err(serr))
+		}
+	}()
+
+	logger.Event(logger.LevelNotice, logger.EventAdminStarted,
+		logger.SocketType(cfg.SocketType), logger.SocketPath(cfg.SocketPath))
+	return nil
+}
@@ -0,0 +1,85 @@
+package admin
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/l4go/task"
+)
+
+func TestStart(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "admin.sock")
+	cfg := &Config{SocketType: "unix", SocketPath: sock}
+	cfg.SetDefault()
+
+	cc := task.NewCancel()
+	defer cc.Cancel()
+	Handle("/extra", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "extra")
+	}))
+	if err := Start(cc, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(sock); err != nil || st.Mode().Perm() != 0660 {
+		t.Fatalf("socket mode = %v, %v, want 0660", st.Mode().Perm(), err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/metrics", http.StatusOK, "# TYPE ngx_auth_requests_total counter"},
+		{"/healthz", http.StatusOK, `{"status":"ok"}`},
+		{"/readyz", http.StatusOK, `{"status":"ok"}`},
+		{"/extra", http.StatusOK, "extra"},
+		{"/other", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			res, err := client.Get("http://admin" + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			if res.StatusCode != tt.code || !strings.Contains(string(body), tt.body) {
+				t.Errorf("GET %s = %d %q, want %d %q", tt.path, res.StatusCode, body, tt.code, tt.body)
+			}
+		})
+	}
+}
+
+func TestConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   Config
+		valid bool
+		mode  string
+	}{
+		{"disabled", Config{}, true, ""},
+		{"tcp", Config{SocketPath: "127.0.0.1:9100"}, true, ""},
+		{"unix", Config{SocketType: "unix", SocketPath: "/run/admin.sock"}, true, DefaultSocketMode},
+		{"unix with a mode", Config{SocketType: "unix", SocketPath: "/run/admin.sock", SocketMode: "0600"}, true, "0600"},
+		{"bad type", Config{SocketType: "udp", SocketPath: "127.0.0.1:9100"}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.SetDefault()
+			if tt.cfg.IsValid() != tt.valid || tt.cfg.SocketMode != tt.mode {
+				t.Errorf("IsValid() = %v, mode %q, want %v, %q", tt.cfg.IsValid(), tt.cfg.SocketMode, tt.valid, tt.mode)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+// Package apikey has the long-lived API keys of the machine clients.
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"ngx_auth/jwt"
+)
+
+// Prefix starts every key, so that a leaked key is easy to find.
+const Prefix = "ngxak_"
+
+const (
+	idLen     = 8
+	secretLen = 32
+)
+
+// Claims of a key for the group provider and the authorizer.
+const (
+	ClaimGroups = "groups"
+	ClaimPaths  = "paths"
+)
+
+var (
+	ErrMalformed = errors.New("malformed API key")
+	ErrUnknown   = errors.New("unknown API key")
+	ErrBadKey    = errors.New("bad API key")
+	ErrExpired   = errors.New("expired API key")
+)
+
+// Key is one line of the key file, with the SHA-256 hash of the key.
+type Key struct {
+	Id      string
+	Hash    []byte
+	Owner   string
+	Groups  []string
+	Expires time.Time
+	Paths   []string
+}
+
+// Mint returns a new key and its line for the key file.
+func Mint(owner string, groups []string, expires time.Time, paths []string) (string, *Key, error) {
+	id := make([]byte, idLen)
+	secret := make([]byte, secretLen)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	token := Prefix + hex.EncodeToString(id) + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	k := &Key{
+		Id:      hex.EncodeToString(id),
+		Hash:    Hash(token),
+		Owner:   owner,
+		Groups:  groups,
+		Expires: expires,
+		Paths:   paths,
+	}
+	if err := k.check(); err != nil {
+		return "", nil, err
+	}
+	return token, k, nil
+}
+
+func Hash(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// KeyId returns the key ID of a key.
+func KeyId(token string) (string, bool) {
+	rest, ok := strings.CutPrefix(token, Prefix)
+	if !ok {
+		return "", false
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || len(id) != idLen*2 || secret == "" {
+		return "", false
+	}
+	return id, true
+}
+
+// Matches reports whether token is the key, in constant time.
+func (k *Key) Matches(token string) bool {
+	return subtle.ConstantTimeCompare(Hash(token), k.Hash) == 1
+}
+
+func (k *Key) IsExpired(now time.Time) bool {
+	return !k.Expires.IsZero() && !now.Before(k.Expires)
+}
+
+// Claims returns the key as decoded JWT claims.
+func (k *Key) Claims() jwt.Claims {
+	claims := jwt.Claims{"sub": k.Owner, "jti": k.Id}
+	if len(k.Groups) > 0 {
+		claims[ClaimGroups] = to_values(k.Groups)
+	}
+	if len(k.Paths) > 0 {
+		claims[ClaimPaths] = to_values(k.Paths)
+	}
+	if !k.Expires.IsZero() {
+		claims["exp"] = json.Number(fmt.Sprint(k.Expires.Unix()))
+	}
+	return claims
+}
+
+func to_values(strs []string) []interface{} {
+	vals := make([]interface{}, len(strs))
+	for i, s := range strs {
+		vals[i] = s
+	}
+	return vals
+}
+
+func join_list(strs []string) string {
+	if len(strs) == 0 {
+		return "-"
+	}
+	return strings.Join(strs, ",")
+}
+
+func split_list(s string) []string {
+	if s == "-" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// String returns the line "ID SHA256 OWNER GROUPS EXPIRES PATHS" of the key file.
+func (k *Key) String() string {
+	expires := "-"
+	if !k.Expires.IsZero() {
+		expires = k.Expires.UTC().Format(time.RFC3339)
+	}
+	return strings.Join([]string{k.Id, hex.EncodeToString(k.Hash), k.Owner,
+		join_list(k.Groups), expires, join_list(k.Paths)}, " ")
+}
+
+func (k *Key) check() error {
+	if k.Owner == "" || k.Owner == "-" || strings.ContainsAny(k.Owner, " \t") {
+		return fmt.Errorf("bad owner: %q", k.Owner)
+	}
+	for _, g := range k.Groups {
+		if g == "" || strings.ContainsAny(g, " \t,") {
+			return fmt.Errorf("bad group: %q", g)
+		}
+	}
+	for _, p := range k.Paths {
+		if p == "" || strings.ContainsAny(p, " \t,") {
+			return fmt.Errorf("bad path: %q", p)
+		}
+	}
+	return nil
+}
+
+// ParseKey parses a line of the key file.
+func ParseKey(line string) (*Key, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 6 {
+		return nil, errors.New("must be ID, SHA256, OWNER, GROUPS, EXPIRES and PATHS")
+	}
+	k := &Key{
+		Id:     fields[0],
+		Owner:  fields[2],
+		Groups: split_list(fields[3]),
+		Paths:  split_list(fields[5]),
+	}
+	if len(k.Id) != idLen*2 {
+		return nil, fmt.Errorf("bad key ID: %q", k.Id)
+	}
+	hash, err := hex.DecodeString(fields[1])
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("bad SHA-256 hash: %q", fields[1])
+	}
+	k.Hash = hash
+	if fields[4] != "-" {
+		if k.Expires, err = time.Parse(time.RFC3339, fields[4]); err != nil {
+			return nil, fmt.Errorf("bad expiry: %w", err)
+		}
+	}
+	if err := k.check(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
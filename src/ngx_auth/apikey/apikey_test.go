@@ -0,0 +1,193 @@
+package apikey
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const test_id = "0123456789abcdef"
+
+var test_hash = strings.Repeat("ab", 32)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		ok   bool
+	}{
+		{"all fields", test_id + " " + test_hash + " ci db,web 2030-01-01T00:00:00Z app,api", true},
+		{"empty fields", test_id + " " + test_hash + " ci - - -", true},
+		{"five fields", test_id + " " + test_hash + " ci - -", false},
+		{"short id", "0123 " + test_hash + " ci - - -", false},
+		{"short hash", test_id + " abab ci - - -", false},
+		{"hash not hex", test_id + " " + strings.Repeat("zz", 32) + " ci - - -", false},
+		{"bad expiry", test_id + " " + test_hash + " ci - 2030-01-01 -", false},
+		{"no owner", test_id + " " + test_hash + " - - - -", false},
+		{"empty group", test_id + " " + test_hash + " ci db,,web - -", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := ParseKey(tt.line)
+			if (err == nil) != tt.ok {
+				t.Fatalf("ParseKey() error = %v, want ok %v", err, tt.ok)
+			}
+			if err == nil && k.String() != tt.line {
+				t.Errorf("String() = %q, want %q", k.String(), tt.line)
+			}
+		})
+	}
+}
+
+func TestKeyId(t *testing.T) {
+	tests := []struct {
+		token string
+		id    string
+		ok    bool
+	}{
+		{Prefix + test_id + "_secret", test_id, true},
+		{Prefix + test_id + "_", "", false},
+		{Prefix + test_id, "", false},
+		{Prefix + "0123_secret", "", false},
+		{"ghp_" + test_id + "_secret", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		id, ok := KeyId(tt.token)
+		if id != tt.id || ok != tt.ok {
+			t.Errorf("KeyId(%q) = %q, %v, want %q, %v", tt.token, id, ok, tt.id, tt.ok)
+		}
+	}
+}
+
+func TestFileVerify(t *testing.T) {
+	token, key, err := Mint("ci", []string{"deploy"}, time.Time{}, []string{"app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired_token, expired, err := Mint("old", nil, time.Now().Add(-time.Second), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown_token, _, err := Mint("ci", nil, time.Time{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, Prefix+key.Id+"_") || hex.EncodeToString(key.Hash) == "" {
+		t.Fatalf("Mint() = %q, %v", token, key)
+	}
+
+	file := filepath.Join(t.TempDir(), "keys")
+	for _, k := range []*Key{key, expired} {
+		if err := AddKey(file, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st, err := os.Stat(file); err != nil || st.Mode().Perm() != 0600 {
+		t.Fatalf("AddKey() file mode = %v, %v, want 0600", st.Mode().Perm(), err)
+	}
+	kf, err := LoadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The secret of the key with one character changed.
+	wrong := token[:len(token)-1] + "A"
+	if strings.HasSuffix(token, "A") {
+		wrong = token[:len(token)-1] + "B"
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		owner string
+		err   error
+	}{
+		{"ok", token, "ci", nil},
+		{"wrong secret", wrong, "", ErrBadKey},
+		{"unknown key ID", unknown_token, "", ErrUnknown},
+		{"expired", expired_token, "", ErrExpired},
+		{"no prefix", strings.TrimPrefix(token, Prefix), "", ErrMalformed},
+		{"empty", "", "", ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := kf.Verify(tt.token)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && k.Owner != tt.owner {
+				t.Errorf("Verify() owner = %q, want %q", k.Owner, tt.owner)
+			}
+		})
+	}
+
+	if err := RevokeKey(file, key.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeKey(file, key.Id); !errors.Is(err, ErrUnknown) {
+		t.Errorf("RevokeKey() again error = %v, want %v", err, ErrUnknown)
+	}
+	keys, err := ReadKeys(file)
+	if err != nil || len(keys) != 1 || keys[0].Id != expired.Id {
+		t.Errorf("ReadKeys() after RevokeKey() = %v, %v, want the expired key", keys, err)
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	line := test_id + " " + test_hash + " ci - - -"
+	tests := []struct {
+		name    string
+		content string
+		ok      bool
+	}{
+		{"comments", "# keys\n\n" + line + "\n", true},
+		{"duplicate key ID", line + "\n" + line + "\n", false},
+		{"bad line", line + "\nci\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "keys")
+			if err := os.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadFile(file); (err == nil) != tt.ok {
+				t.Errorf("LoadFile() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAddKeyConcurrent(t *testing.T) {
+	const n = 20
+	file := filepath.Join(t.TempDir(), "keys")
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, k, err := Mint("ci", nil, time.Time{}, nil)
+			if err == nil {
+				err = AddKey(file, k)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := ReadKeys(file)
+	if err != nil || len(keys) != n {
+		t.Errorf("ReadKeys() = %d keys, %v, want %d keys", len(keys), err, n)
+	}
+}
@@ -0,0 +1,37 @@
+//go:build !unix
+
+package apikey
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// LockTimeout is how long a command waits for the lock file of another one.
+const LockTimeout = 10 * time.Second
+
+var ErrLocked = errors.New("key file is locked by another command")
+
+// lock_file creates the lock file next to file, so that the commands updating
+// file at the same time do not lose their changes. Without flock, the lock
+// file exists only while it is locked.
+func lock_file(file string) (func(), error) {
+	lock := file + ".lock"
+	deadline := time.Now().Add(LockTimeout)
+	for {
+		f, err := os.OpenFile(lock, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLocked
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package apikey
+
+import (
+	"os"
+	"syscall"
+)
+
+// lock_file locks the lock file next to file, so that the commands updating
+// file at the same time do not lose their changes. The lock file is kept,
+// because removing it would let another command lock a new one.
+func lock_file(file string) (func(), error) {
+	f, err := os.OpenFile(file+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,266 @@
+package apikey
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	logger "ngx_auth/logger"
+	"ngx_auth/metrics"
+)
+
+// FileCheckInterval is how often the key file is checked for a change.
+const FileCheckInterval = 5 * time.Second
+
+// File is the key file, with a key on each line.
+type File struct {
+	file string
+
+	mu      sync.Mutex
+	mtime   time.Time
+	checked time.Time
+	keys    map[string]*Key
+}
+
+// LoadFile reads the key file, and reads it again when it is modified.
+func LoadFile(file string) (*File, error) {
+	kf := &File{file: file}
+	if err := kf.load(); err != nil {
+		return nil, err
+	}
+	return kf, nil
+}
+
+func parse_keys(r io.Reader) ([]*Key, error) {
+	keys := []*Key{}
+	ids := map[string]bool{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, err := ParseKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if ids[k.Id] {
+			return nil, fmt.Errorf("line %d: duplicate key ID: %s", n, k.Id)
+		}
+		ids[k.Id] = true
+		keys = append(keys, k)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (kf *File) load() error {
+	f, err := os.Open(kf.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	list, err := parse_keys(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", kf.file, err)
+	}
+
+	keys := map[string]*Key{}
+	for _, k := range list {
+		keys[k.Id] = k
+	}
+	kf.keys = keys
+	kf.mtime = st.ModTime()
+	kf.checked = time.Now()
+	return nil
+}
+
+func (kf *File) reload() {
+	if time.Since(kf.checked) < FileCheckInterval {
+		return
+	}
+	kf.checked = time.Now()
+	st, err := os.Stat(kf.file)
+	if err == nil && st.ModTime().Equal(kf.mtime) {
+		return
+	}
+	if err == nil {
+		err = kf.load()
+	}
+	if err != nil {
+		metrics.ConfigReloads.Inc("api_keys", "error")
+		logger.Event(logger.LevelError, logger.EventApiKeysError,
+			logger.File(kf.file), logger.Err(err))
+		return
+	}
+	metrics.ConfigReloads.Inc("api_keys", "ok")
+	logger.Event(logger.LevelNotice, logger.EventApiKeysReloaded,
+		logger.File(kf.file), logger.Entries(len(kf.keys)))
+}
+
+// Lookup returns the key of the key ID of token without checking the secret.
+func (kf *File) Lookup(token string) *Key {
+	id, ok := KeyId(token)
+	if !ok {
+		return nil
+	}
+	kf.mu.Lock()
+	defer kf.mu.Unlock()
+	kf.reload()
+
+	return kf.keys[id]
+}
+
+func result_of(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrUnknown):
+		return "unknown"
+	case errors.Is(err, ErrBadKey):
+		return "bad_key"
+	case errors.Is(err, ErrExpired):
+		return "expired"
+	}
+	return "malformed"
+}
+
+// Verify returns the key of token if it is a valid key.
+func (kf *File) Verify(token string) (*Key, error) {
+	k := kf.Lookup(token)
+	if err := VerifyKey(k, token); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// VerifyKey checks token against the key returned by Lookup, nil for an unknown key.
+func VerifyKey(k *Key, token string) error {
+	err := verify(k, token)
+	metrics.ApiKeys.Inc(result_of(err))
+	return err
+}
+
+func verify(k *Key, token string) error {
+	if _, ok := KeyId(token); !ok {
+		return ErrMalformed
+	}
+	if k == nil {
+		return ErrUnknown
+	}
+	if !k.Matches(token) {
+		return ErrBadKey
+	}
+	if k.IsExpired(time.Now()) {
+		return ErrExpired
+	}
+	return nil
+}
+
+// ReadKeys reads the keys of the key file for the management command.
+func ReadKeys(file string) ([]*Key, error) {
+	f, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []*Key{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys, err := parse_keys(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return keys, nil
+}
+
+// update replaces the key file at once, so that the modules never read a partial file.
+func update(file string, edit func(lines []string) ([]string, error)) error {
+	unlock, err := lock_file(file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var lines []string
+	mode := fs.FileMode(0600)
+	bin, err := os.ReadFile(file)
+	switch {
+	case err == nil:
+		if _, err := parse_keys(strings.NewReader(string(bin))); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if len(bin) > 0 {
+			lines = strings.Split(strings.TrimSuffix(string(bin), "\n"), "\n")
+		}
+		if st, err := os.Stat(file); err == nil {
+			mode = st.Mode().Perm()
+		}
+	case errors.Is(err, fs.ErrNotExist):
+	default:
+		return err
+	}
+
+	lines, err = edit(lines)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// AddKey appends a key to the key file.
+func AddKey(file string, k *Key) error {
+	return update(file, func(lines []string) ([]string, error) {
+		return append(lines, k.String()), nil
+	})
+}
+
+// RevokeKey removes the key of the key ID from the key file.
+func RevokeKey(file string, id string) error {
+	return update(file, func(lines []string) ([]string, error) {
+		kept := lines[:0]
+		found := false
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) > 0 && fields[0] == id {
+				found = true
+				continue
+			}
+			kept = append(kept, line)
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %s", ErrUnknown, id)
+		}
+		return kept, nil
+	})
+}
@@ -0,0 +1,167 @@
+// Package assertion signs the identity of an authorized request as a
+// short-lived JWT, which nginx forwards to the upstream applications.
+package assertion
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	"ngx_auth/jwt"
+	logger "ngx_auth/logger"
+	"ngx_auth/metrics"
+)
+
+const (
+	DefaultHeader     = "X-Auth-Assertion"
+	DefaultTtlSeconds = 60
+	DefaultJwksPath   = "/jwks.json"
+)
+
+// Methods of the identity other than those of the sessions.
+const (
+	MethodHeader = "header"
+	MethodBearer = "bearer"
+	MethodCert   = "cert"
+	MethodApiKey = "apikey"
+	MethodDigest = "digest"
+)
+
+// Config is the [assertion] part.
+type Config struct {
+	KeyFile    string `toml:"key_file,omitempty" json:"key_file,omitempty" yaml:"key_file,omitempty"`
+	KeyId      string `toml:"key_id,omitempty" json:"key_id,omitempty" yaml:"key_id,omitempty"`
+	Header     string `toml:"header,omitempty" json:"header,omitempty" yaml:"header,omitempty"`
+	Issuer     string `toml:"issuer,omitempty" json:"issuer,omitempty" yaml:"issuer,omitempty"`
+	Audience   string `toml:"audience,omitempty" json:"audience,omitempty" yaml:"audience,omitempty"`
+	TtlSeconds uint32 `toml:"ttl_seconds,omitempty" json:"ttl_seconds,omitempty" yaml:"ttl_seconds,omitempty"`
+	JwksPath   string `toml:"jwks_path,omitempty" json:"jwks_path,omitempty" yaml:"jwks_path,omitempty"`
+}
+
+func (cfg *Config) IsEnabled() bool {
+	return cfg.KeyFile != ""
+}
+
+func (cfg *Config) SetDefault() {
+	if cfg.Header == "" {
+		cfg.Header = DefaultHeader
+	}
+	if cfg.TtlSeconds == 0 {
+		cfg.TtlSeconds = DefaultTtlSeconds
+	}
+	if cfg.JwksPath == "" {
+		cfg.JwksPath = DefaultJwksPath
+	}
+}
+
+// Identity is what an assertion tells about an authorized request.
+type Identity struct {
+	User    string
+	Groups  []string
+	PathId  string
+	Method  string
+	Mfa     bool
+	Profile string
+}
+
+// Issuer signs the assertions.
+type Issuer struct {
+	Header   string
+	Issuer   string
+	Audience string
+	Ttl      time.Duration
+	JwksPath string
+
+	signer *jwt.Signer
+	jwks   []byte
+}
+
+func New(cfg *Config) (*Issuer, error) {
+	signer, err := jwt.LoadSigner(cfg.KeyFile, cfg.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	jwks, err := signer.PublicJWKS()
+	if err != nil {
+		return nil, err
+	}
+	return &Issuer{
+		Header:   cfg.Header,
+		Issuer:   cfg.Issuer,
+		Audience: cfg.Audience,
+		Ttl:      time.Duration(cfg.TtlSeconds) * time.Second,
+		JwksPath: cfg.JwksPath,
+		signer:   signer,
+		jwks:     jwks,
+	}, nil
+}
+
+func new_id() (string, error) {
+	bin := make([]byte, 16)
+	if _, err := rand.Read(bin); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bin), nil
+}
+
+// Sign returns the assertion of id.
+func (is *Issuer) Sign(id *Identity) (string, error) {
+	jti, err := new_id()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := jwt.Claims{
+		"sub":    id.User,
+		"method": id.Method,
+		"iat":    now.Unix(),
+		"exp":    now.Add(is.Ttl).Unix(),
+		"jti":    jti,
+	}
+	if is.Issuer != "" {
+		claims["iss"] = is.Issuer
+	}
+	if is.Audience != "" {
+		claims["aud"] = is.Audience
+	}
+	if id.Groups != nil {
+		claims["groups"] = id.Groups
+	}
+	if id.PathId != "" {
+		claims["path_id"] = id.PathId
+	}
+	if id.Mfa {
+		claims["mfa"] = true
+	}
+	if id.Profile != "" {
+		claims["profile"] = id.Profile
+	}
+	return is.signer.Sign(claims)
+}
+
+// Set sets the assertion header of the response. A nil Issuer does nothing.
+// A signing error is logged, and the response has no assertion.
+func (is *Issuer) Set(w http.ResponseWriter, id *Identity) {
+	if is == nil {
+		return
+	}
+	token, err := is.Sign(id)
+	if err != nil {
+		metrics.Assertions.Inc("error")
+		logger.Event(logger.LevelError, logger.EventAssertionError,
+			logger.User(id.User), logger.Err(err))
+		return
+	}
+	metrics.Assertions.Inc("ok")
+	w.Header().Set(is.Header, token)
+}
+
+// JwksHandler serves the JWKS of the public key, for the admin listener.
+func (is *Issuer) JwksHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.Write(is.jwks)
+	})
+}
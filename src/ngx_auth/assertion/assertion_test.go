@@ -0,0 +1,218 @@
+package assertion
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"ngx_auth/jwt"
+)
+
+func write_key(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	var block *pem.Block
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		bin, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: bin}
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	default:
+		bin, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: bin}
+	}
+	file := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func new_issuer(t *testing.T, key crypto.Signer) *Issuer {
+	t.Helper()
+	cfg := &Config{
+		KeyFile:    write_key(t, key),
+		Issuer:     "ngx_auth",
+		Audience:   "backend",
+		TtlSeconds: 60,
+	}
+	cfg.SetDefault()
+	is, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return is
+}
+
+func numeric(claims jwt.Claims, name string) int64 {
+	num, _ := claims[name].(json.Number)
+	n, _ := num.Int64()
+	return n
+}
+
+func TestRoundTrip(t *testing.T) {
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  crypto.Signer
+		alg  string
+	}{
+		{"ec", ec, jwt.AlgES256},
+		{"rsa", rs, jwt.AlgRS256},
+		{"ed25519", ed, jwt.AlgEdDSA},
+	}
+	id := &Identity{
+		User:    "alice",
+		Groups:  []string{"admin", "dev"},
+		PathId:  "/admin",
+		Method:  "basic",
+		Mfa:     true,
+		Profile: "intra",
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := new_issuer(t, tt.key)
+			srv := httptest.NewServer(is.JwksHandler())
+			defer srv.Close()
+			keys := jwt.NewRemoteKeys(srv.URL, time.Minute, time.Second)
+
+			before := time.Now().Unix()
+			token, err := is.Sign(id)
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+
+			v := &jwt.Verifier{
+				Keys:     keys,
+				Algs:     []string{tt.alg},
+				Issuer:   "ngx_auth",
+				Audience: []string{"backend"},
+			}
+			claims, err := v.Verify(token)
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			for name, want := range map[string]string{
+				"sub": "alice", "iss": "ngx_auth", "aud": "backend",
+				"method": "basic", "path_id": "/admin", "profile": "intra",
+			} {
+				if got := jwt.String(claims, name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if got := jwt.Strings(claims, "groups"); !reflect.DeepEqual(got, id.Groups) {
+				t.Errorf("groups = %v, want %v", got, id.Groups)
+			}
+			if claims["mfa"] != true {
+				t.Errorf("mfa = %v, want true", claims["mfa"])
+			}
+			if jwt.String(claims, "jti") == "" {
+				t.Errorf("jti is empty")
+			}
+			iat := numeric(claims, "iat")
+			exp := numeric(claims, "exp")
+			if iat < before || iat > time.Now().Unix() {
+				t.Errorf("iat = %v, want around %v", iat, before)
+			}
+			if exp-iat != 60 {
+				t.Errorf("exp - iat = %v, want 60", exp-iat)
+			}
+
+			v.Audience = []string{"other"}
+			if _, err := v.Verify(token); !errors.Is(err, jwt.ErrBadAudience) {
+				t.Errorf("Verify() other audience error = %v, want %v", err, jwt.ErrBadAudience)
+			}
+		})
+	}
+}
+
+func TestOtherKey(t *testing.T) {
+	_, k1, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, k2, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := new_issuer(t, k1)
+	other := new_issuer(t, k2)
+	srv := httptest.NewServer(is.JwksHandler())
+	defer srv.Close()
+
+	token, err := other.Sign(&Identity{User: "alice", Method: "basic"})
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	v := &jwt.Verifier{Keys: jwt.NewRemoteKeys(srv.URL, time.Minute, time.Second)}
+	if _, err := v.Verify(token); !errors.Is(err, jwt.ErrUnknownKeyId) {
+		t.Errorf("Verify() error = %v, want %v", err, jwt.ErrUnknownKeyId)
+	}
+}
+
+func TestJwksHandler(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := new_issuer(t, key)
+	w := httptest.NewRecorder()
+	is.JwksHandler().ServeHTTP(w, httptest.NewRequest("GET", is.JwksPath, nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/jwk-set+json" {
+		t.Errorf("Content-Type = %q, want %q", ct, "application/jwk-set+json")
+	}
+	if _, err := jwt.ParseJWKS(w.Body.Bytes()); err != nil {
+		t.Errorf("ParseJWKS() error = %v", err)
+	}
+}
+
+func TestSet(t *testing.T) {
+	var none *Issuer
+	w := httptest.NewRecorder()
+	none.Set(w, &Identity{User: "alice"})
+	if len(w.Header()) != 0 {
+		t.Errorf("nil Issuer set %v", w.Header())
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := new_issuer(t, key)
+	w = httptest.NewRecorder()
+	is.Set(w, &Identity{User: "alice", Method: "basic"})
+	if w.Header().Get(DefaultHeader) == "" {
+		t.Errorf("no %s header", DefaultHeader)
+	}
+}
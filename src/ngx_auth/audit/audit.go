@@ -0,0 +1,296 @@
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logger "ngx_auth/logger"
+	"ngx_auth/metrics"
+)
+
+const DefaultLogfileMode = 0600
+
+// Config is the [audit] part of the module configuration files.
+type Config struct {
+	Logfile     string `toml:"logfile,omitempty" json:"logfile,omitempty" yaml:"logfile,omitempty"`
+	LogfileMode string `toml:"logfile_mode,omitempty" json:"logfile_mode,omitempty" yaml:"logfile_mode,omitempty"`
+	HashUser    bool   `toml:"hash_user,omitempty" json:"hash_user,omitempty" yaml:"hash_user,omitempty"`
+	HashKey     string `toml:"hash_key,omitempty" json:"hash_key,omitempty" yaml:"hash_key,omitempty" secret:"true" expand:"true"`
+}
+
+var ErrBadLogfileMode = errors.New("bad audit logfile mode")
+
+func (cfg *Config) IsEnabled() bool {
+	return cfg.Logfile != ""
+}
+
+// FileMode parses LogfileMode as an octal permission such as "0640".
+func (cfg *Config) FileMode() (os.FileMode, error) {
+	if cfg.LogfileMode == "" {
+		return DefaultLogfileMode, nil
+	}
+
+	mode, err := strconv.ParseUint(cfg.LogfileMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, ErrBadLogfileMode
+	}
+	return os.FileMode(mode), nil
+}
+
+// Decisions.
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Reasons of the decisions.
+const (
+	ReasonGranted        = "granted"
+	ReasonOfflineCache   = "offline_cache"
+	ReasonEtagMatch      = "etag_match"
+	ReasonSession        = "session"
+	ReasonNoPath         = "no_path"
+	ReasonNoUser         = "no_user"
+	ReasonNoCredentials  = "no_credentials"
+	ReasonBadCredentials = "bad_credentials"
+	ReasonUnknownUser    = "unknown_user"
+	ReasonBackendError   = "backend_error"
+	ReasonAuthzFilter    = "authz_filter"
+	ReasonPathRight      = "path_right"
+	ReasonDefaultRight   = "default_right"
+	ReasonNomatchRight   = "nomatch_right"
+	ReasonBanNomatch     = "ban_nomatch"
+	ReasonBanDefault     = "ban_default"
+	ReasonTotp           = "totp"
+	ReasonBadSignature   = "bad_signature"
+	ReasonBadCert        = "bad_cert"
+	ReasonRevokedCert    = "revoked_cert"
+	ReasonKeyScope       = "key_scope"
+	ReasonStaleNonce     = "stale_nonce"
+	ReasonReplay         = "replay"
+	ReasonCsrf           = "csrf"
+	ReasonLogout         = "logout"
+)
+
+// Cache outcomes.
+const (
+	CacheOff  = "off"
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+// Record is one audit record. A handler fills it while deciding,
+// and writes it with Finish.
+type Record struct {
+	Time      string  `json:"time"`
+	Module    string  `json:"module"`
+	Profile   string  `json:"profile,omitempty"`
+	User      string  `json:"user,omitempty"`
+	ClientIP  string  `json:"client_ip,omitempty"`
+	Path      string  `json:"path,omitempty"`
+	NormPath  string  `json:"normalized_path,omitempty"`
+	PathId    *string `json:"path_id,omitempty"`
+	Right     *string `json:"right,omitempty"`
+	Filter    *string `json:"filter,omitempty"`
+	Decision  string  `json:"decision"`
+	Outcome   string  `json:"outcome"`
+	Reason    string  `json:"reason"`
+	Cache     string  `json:"cache"`
+	LatencyMs float64 `json:"latency_ms"`
+
+	start     time.Time
+	on_finish func(*Record)
+}
+
+// Begin starts a record of a request.
+func Begin(clientIP string) *Record {
+	return &Record{
+		ClientIP: clientIP,
+		Cache:    CacheOff,
+		start:    time.Now(),
+	}
+}
+
+// SetPath records the raw path and its normalized form.
+func (rec *Record) SetPath(rpath string) {
+	rec.Path = rpath
+	rec.NormPath = NormalizePath(rpath)
+}
+
+func (rec *Record) SetPathId(pathid string) {
+	rec.PathId = &pathid
+}
+
+// SetRight records the authorization right applied. An empty right is
+// recorded, because it grants every user.
+func (rec *Record) SetRight(right string) {
+	rec.Right = &right
+}
+
+func (rec *Record) SetFilter(flt string) {
+	rec.Filter = &flt
+}
+
+// OnFinish sets f called by Finish with the decided record, even if the
+// audit log is disabled. The user is not hashed yet.
+func (rec *Record) OnFinish(f func(*Record)) {
+	rec.on_finish = f
+}
+
+// Finish writes the record with the outcome of the request.
+// ok and not_modified outcomes are allowed, and the others are denied.
+func (rec *Record) Finish(outcome string, reason string) {
+	rec.Outcome = outcome
+	rec.Reason = reason
+	rec.Decision = Deny
+	if outcome == metrics.OutcomeOk || outcome == metrics.OutcomeNotModified {
+		rec.Decision = Allow
+	}
+	if rec.on_finish != nil {
+		rec.on_finish(rec)
+	}
+
+	w := current()
+	if w == nil {
+		return
+	}
+
+	rec.Time = rec.start.UTC().Format(time.RFC3339Nano)
+	rec.Module = w.module
+	rec.LatencyMs = float64(time.Since(rec.start).Microseconds()) / 1000
+	if w.hash_user && rec.User != "" {
+		rec.User = hash_user(w.hash_key, rec.User)
+	}
+
+	w.write(rec)
+}
+
+func hash_user(key []byte, user string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(user))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NormalizePath removes the query, decodes percent-encoding and
+// resolves "." and ".." elements. A trailing slash is kept.
+func NormalizePath(rpath string) string {
+	if rpath == "" {
+		return ""
+	}
+
+	if i := strings.IndexAny(rpath, "?#"); i >= 0 {
+		rpath = rpath[:i]
+	}
+	if dec, err := url.PathUnescape(rpath); err == nil {
+		rpath = dec
+	}
+
+	npath := path.Clean("/" + rpath)
+	if strings.HasSuffix(rpath, "/") && npath != "/" {
+		npath += "/"
+	}
+	return npath
+}
+
+type writer struct {
+	mu        sync.Mutex
+	module    string
+	path      string
+	mode      os.FileMode
+	file      *os.File
+	hash_user bool
+	hash_key  []byte
+}
+
+var (
+	writerMu sync.RWMutex
+	aw       *writer
+)
+
+func current() *writer {
+	writerMu.RLock()
+	defer writerMu.RUnlock()
+	return aw
+}
+
+func open_logfile(path string, mode os.FileMode) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, mode)
+}
+
+// Setup opens the audit log of module. It does nothing if no logfile is configured.
+// The audit log is reopened with the logfile on SIGUSR1.
+func Setup(module string, cfg *Config) error {
+	if !cfg.IsEnabled() {
+		return nil
+	}
+
+	mode, err := cfg.FileMode()
+	if err != nil {
+		return err
+	}
+	f, err := open_logfile(cfg.Logfile, mode)
+	if err != nil {
+		return err
+	}
+
+	writerMu.Lock()
+	aw = &writer{
+		module:    module,
+		path:      cfg.Logfile,
+		mode:      mode,
+		file:      f,
+		hash_user: cfg.HashUser,
+		hash_key:  []byte(cfg.HashKey),
+	}
+	writerMu.Unlock()
+
+	logger.AddReopener("audit", Reopen)
+	return nil
+}
+
+// Reopen reopens the audit log, for log rotation tools such as logrotate.
+func Reopen() error {
+	w := current()
+	if w == nil {
+		return nil
+	}
+
+	f, err := open_logfile(w.path, w.mode)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	old := w.file
+	w.file = f
+	w.mu.Unlock()
+
+	return old.Close()
+}
+
+func (w *writer) write(rec *Record) {
+	bin, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	bin = append(bin, '\n')
+
+	w.mu.Lock()
+	_, err = w.file.Write(bin)
+	w.mu.Unlock()
+
+	if err != nil {
+		logger.Event(logger.LevelError, logger.EventAuditWriteError,
+			logger.File(w.path), logger.Err(err))
+	}
+}
@@ -0,0 +1,191 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ngx_auth/metrics"
+)
+
+// read_records reads the JSON lines of an audit log.
+func read_records(t *testing.T, file string) []map[string]interface{} {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	recs := []map[string]interface{}{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		rec := map[string]interface{}{}
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("%q: %v", sc.Text(), err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestFinish(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	if err := Setup("ngx_test_auth", &Config{Logfile: file, HashUser: true, HashKey: "key1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { aw = nil }()
+	if st, err := os.Stat(file); err != nil || st.Mode().Perm() != DefaultLogfileMode {
+		t.Fatalf("audit log mode = %v, %v, want %v", st.Mode().Perm(), err, os.FileMode(DefaultLogfileMode))
+	}
+
+	var finished *Record
+	rec := Begin("192.0.2.1")
+	rec.OnFinish(func(rec *Record) {
+		copied := *rec
+		finished = &copied
+	})
+	rec.Profile = "web"
+	rec.User = "user1"
+	rec.Cache = CacheMiss
+	rec.SetPath("/app/../docs/%7Euser/?q=1")
+	rec.SetPathId("docs")
+	rec.SetRight("")
+	rec.Finish(metrics.OutcomeOk, ReasonPathRight)
+
+	denied := Begin("192.0.2.2")
+	denied.SetFilter("(uid=user2)")
+	denied.Finish(metrics.OutcomeForbidden, ReasonAuthzFilter)
+
+	if finished == nil || finished.User != "user1" || finished.Decision != Allow {
+		t.Errorf("OnFinish() record = %+v, want the allowed record of user1", finished)
+	}
+
+	mac := hmac.New(sha256.New, []byte("key1"))
+	mac.Write([]byte("user1"))
+	want := []map[string]interface{}{
+		{
+			"module":          "ngx_test_auth",
+			"profile":         "web",
+			"user":            "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)),
+			"client_ip":       "192.0.2.1",
+			"path":            "/app/../docs/%7Euser/?q=1",
+			"normalized_path": "/docs/~user/",
+			"path_id":         "docs",
+			"right":           "",
+			"decision":        Allow,
+			"outcome":         metrics.OutcomeOk,
+			"reason":          ReasonPathRight,
+			"cache":           CacheMiss,
+		},
+		{
+			"module":    "ngx_test_auth",
+			"client_ip": "192.0.2.2",
+			"filter":    "(uid=user2)",
+			"decision":  Deny,
+			"outcome":   metrics.OutcomeForbidden,
+			"reason":    ReasonAuthzFilter,
+			"cache":     CacheOff,
+		},
+	}
+	recs := read_records(t, file)
+	if len(recs) != len(want) {
+		t.Fatalf("records = %v, want %d records", recs, len(want))
+	}
+	for i, rec := range recs {
+		if _, err := time.Parse(time.RFC3339Nano, rec["time"].(string)); err != nil {
+			t.Errorf("record %d time: %v", i, err)
+		}
+		if _, ok := rec["latency_ms"].(float64); !ok {
+			t.Errorf("record %d has no latency_ms", i)
+		}
+		delete(rec, "time")
+		delete(rec, "latency_ms")
+		if len(rec) != len(want[i]) {
+			t.Errorf("record %d = %v, want %v", i, rec, want[i])
+		}
+		for k, v := range want[i] {
+			if rec[k] != v {
+				t.Errorf("record %d %s = %v, want %v", i, k, rec[k], v)
+			}
+		}
+	}
+
+	// A log rotation tool renames the audit log before the signal.
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	Begin("192.0.2.3").Finish(metrics.OutcomeUnauth, ReasonNoCredentials)
+	if n := len(read_records(t, file+".1")); n != 2 {
+		t.Errorf("rotated audit log has %d records, want 2", n)
+	}
+	if recs := read_records(t, file); len(recs) != 1 || recs[0]["reason"] != ReasonNoCredentials {
+		t.Errorf("reopened audit log = %v, want the record after the rotation", recs)
+	}
+}
+
+func TestFinishDisabled(t *testing.T) {
+	if err := Setup("ngx_test_auth", &Config{}); err != nil {
+		t.Fatal(err)
+	}
+	rec := Begin("192.0.2.1")
+	rec.User = "user1"
+	rec.Finish(metrics.OutcomeNotModified, ReasonEtagMatch)
+	if rec.Decision != Allow || rec.User != "user1" || rec.Time != "" {
+		t.Errorf("Finish() without the audit log = %+v, want an allowed record not written", rec)
+	}
+	if err := Reopen(); err != nil {
+		t.Errorf("Reopen() without the audit log error = %v", err)
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", ""},
+		{"/", "/"},
+		{"/a/b", "/a/b"},
+		{"/a/b/", "/a/b/"},
+		{"/a/./b/../c", "/a/c"},
+		{"/../../etc/passwd", "/etc/passwd"},
+		{"/a/%2e%2e/b", "/b"},
+		{"/a%20b?x=/../y#f", "/a b"},
+		{"a//b", "/a/b"},
+		{"/bad%zz", "/bad%zz"},
+	}
+	for _, tt := range tests {
+		if got := NormalizePath(tt.path); got != tt.want {
+			t.Errorf("NormalizePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		want os.FileMode
+		ok   bool
+	}{
+		{"", DefaultLogfileMode, true},
+		{"0640", 0640, true},
+		{"1777", 0, false},
+		{"rw", 0, false},
+	}
+	for _, tt := range tests {
+		mode, err := (&Config{LogfileMode: tt.mode}).FileMode()
+		if mode != tt.want || (err == nil) != tt.ok {
+			t.Errorf("FileMode(%q) = %v, %v, want %v, ok %v", tt.mode, mode, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 	"unicode"
 
@@ -273,6 +274,43 @@ func NewUserMap(file string, cfg *UserMapConfig) (*UserMap, error) {
 	return &UserMap{cfg: cfg, user: umap}, nil
 }
 
+// VerifyUserMap reports every bad line of the user map file.
+func VerifyUserMap(file string, cfg *UserMapConfig) []error {
+	bin, err := os.ReadFile(file)
+	if err != nil {
+		return []error{err}
+	}
+
+	errs := []error{}
+	lines := bytes.Split(bin, []byte{'\n'})
+	for i, ln := range lines {
+		if len(ln) == 0 {
+			continue
+		}
+		if _, _, err := cfg.SplitLine(string(ln)); err != nil {
+			errs = append(errs, fmt.Errorf("bad user map: %s:%d : %s", file, i+1, err))
+		}
+	}
+
+	return errs
+}
+
+// Count returns the number of users in the user map.
+func (az *UserMap) Count() int {
+	return len(az.user)
+}
+
+var ErrUserMapNotLoaded = errors.New("user map is not loaded")
+
+// HealthCheck reports whether the user map is loaded.
+// It matches health.CheckFunc.
+func (az *UserMap) HealthCheck() (string, error) {
+	if az == nil || az.user == nil {
+		return "", ErrUserMapNotLoaded
+	}
+	return fmt.Sprintf("users=%d", az.Count()), nil
+}
+
 func (az *UserMap) IsUserString(user string) bool {
 	return az.cfg.IsUser([]byte(user))
 }
@@ -297,9 +335,41 @@ func (az *UserMap) InGroup(user string, group string) bool {
 	return g_ok
 }
 
+// Groups returns the sorted groups of user, or nil for an unknown user.
+func (az *UserMap) Groups(user string) []string {
+	gmap, ok := az.user[user]
+	if !ok {
+		return nil
+	}
+	return sorted_keys(gmap)
+}
+
+func sorted_keys(gmap map[string]struct{}) []string {
+	groups := make([]string, 0, len(gmap))
+	for g := range gmap {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
 func (az *UserMap) Authz(tn_str string, user string) bool {
+	return Authorize(az, tn_str, user)
+}
+
+// Membership answers the questions of the authorization rights about a user.
+// UserMap is a Membership, and GroupSet is one from another group source.
+type Membership interface {
+	IsUserString(user string) bool
+	InUser(user string) bool
+	InGroup(user string, group string) bool
+	Groups(user string) []string
+}
+
+// Authorize checks the authorization right tn_str, such as "@admin|user1", for user.
+func Authorize(m Membership, tn_str string, user string) bool {
 	for _, tn := range strings.Split(tn_str, "|") {
-		if az.one_authz(tn, user) {
+		if one_authz(m, tn, user) {
 			return true
 		}
 	}
@@ -307,21 +377,21 @@ func (az *UserMap) Authz(tn_str string, user string) bool {
 	return false
 }
 
-func (az *UserMap) one_authz(tn string, user string) bool {
+func one_authz(m Membership, tn string, user string) bool {
 	switch {
 	case tn == "":
 		return true
 	case tn == "!":
 		return false
-	case !az.IsUserString(user):
+	case !m.IsUserString(user):
 		return false
 	case tn == "*":
 		return true
 	case tn == "@":
-		return az.InUser(user)
+		return m.InUser(user)
 	case tn[0] == '@':
-		return az.InGroup(user, tn[1:])
-	case az.InUser(tn):
+		return m.InGroup(user, tn[1:])
+	case m.InUser(tn):
 		return tn == user
 	default:
 	}
@@ -329,6 +399,45 @@ func (az *UserMap) one_authz(tn string, user string) bool {
 	return false
 }
 
+// GroupSet is the groups of one user looked up from a source other than a user map,
+// such as LDAP. The user is known with any groups, even none.
+type GroupSet struct {
+	user   string
+	groups map[string]struct{}
+}
+
+func NewGroupSet(user string, groups []string) *GroupSet {
+	gmap := map[string]struct{}{}
+	for _, g := range groups {
+		gmap[g] = struct{}{}
+	}
+	return &GroupSet{user: user, groups: gmap}
+}
+
+func (gs *GroupSet) IsUserString(user string) bool {
+	return IsValidIdString(user)
+}
+
+func (gs *GroupSet) InUser(user string) bool {
+	return user == gs.user
+}
+
+func (gs *GroupSet) InGroup(user string, group string) bool {
+	if user != gs.user {
+		return false
+	}
+	_, ok := gs.groups[group]
+	return ok
+}
+
+// Groups returns the sorted groups of user, or nil for another user.
+func (gs *GroupSet) Groups(user string) []string {
+	if user != gs.user {
+		return nil
+	}
+	return sorted_keys(gs.groups)
+}
+
 func VerifyAuthzType(tn_str string) bool {
 	for _, tn := range strings.Split(tn_str, "|") {
 		if !verify_type(tn) {
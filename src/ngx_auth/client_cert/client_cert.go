@@ -0,0 +1,337 @@
+// Package client_cert extracts the user of an X.509 client certificate,
+// which nginx verified and passed in a request header.
+package client_cert
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"ngx_auth/metrics"
+)
+
+// Formats of the certificate header.
+const (
+	FormatPem = "pem"
+	FormatDn  = "dn"
+)
+
+// Fields of the user.
+const (
+	FieldCn    = "cn"
+	FieldEmail = "email"
+	FieldUpn   = "upn"
+)
+
+// Actions of crl_stale for a CRL past its next update.
+const (
+	CrlStaleLog  = "log"
+	CrlStaleDeny = "deny"
+)
+
+const (
+	DefaultPemHeader    = "X-SSL-Client-Cert"
+	DefaultDnHeader     = "X-SSL-Client-DN"
+	DefaultIssuerHeader = "X-SSL-Client-Issuer-DN"
+)
+
+var (
+	ErrNoCert    = errors.New("no client certificate")
+	ErrMalformed = errors.New("malformed client certificate")
+	ErrExpired   = errors.New("client certificate is expired or not yet valid")
+	ErrBadIssuer = errors.New("client certificate issuer is not allowed")
+	ErrRevoked   = errors.New("client certificate is revoked")
+	ErrStaleCrl  = errors.New("CRL of the client certificate issuer is past its next update")
+	ErrNoUser    = errors.New("client certificate has no user field")
+)
+
+// Config is the [cert] part.
+type Config struct {
+	Format       string   `toml:"format,omitempty" json:"format,omitempty" yaml:"format,omitempty"`
+	Header       string   `toml:"header,omitempty" json:"header,omitempty" yaml:"header,omitempty"`
+	UserField    string   `toml:"user_field,omitempty" json:"user_field,omitempty" yaml:"user_field,omitempty"`
+	Issuers      []string `toml:"issuers,omitempty" json:"issuers,omitempty" yaml:"issuers,omitempty"`
+	IssuerHeader string   `toml:"issuer_header,omitempty" json:"issuer_header,omitempty" yaml:"issuer_header,omitempty"`
+	CrlFile      string   `toml:"crl_file,omitempty" json:"crl_file,omitempty" yaml:"crl_file,omitempty"`
+	CrlIssuers   string   `toml:"crl_issuers,omitempty" json:"crl_issuers,omitempty" yaml:"crl_issuers,omitempty"`
+	CrlStale     string   `toml:"crl_stale,omitempty" json:"crl_stale,omitempty" yaml:"crl_stale,omitempty"`
+}
+
+// IsSet reports whether any parameter is set.
+func (cfg *Config) IsSet() bool {
+	return cfg.Format != "" || cfg.Header != "" || cfg.UserField != "" ||
+		len(cfg.Issuers) > 0 || cfg.IssuerHeader != "" || cfg.CrlFile != "" ||
+		cfg.CrlIssuers != "" || cfg.CrlStale != ""
+}
+
+func (cfg *Config) SetDefault() {
+	if cfg.Format == "" {
+		cfg.Format = FormatPem
+	}
+	if cfg.Header == "" {
+		if cfg.Format == FormatDn {
+			cfg.Header = DefaultDnHeader
+		} else {
+			cfg.Header = DefaultPemHeader
+		}
+	}
+	if cfg.UserField == "" {
+		cfg.UserField = FieldCn
+	}
+	if cfg.Format == FormatDn && cfg.IssuerHeader == "" {
+		cfg.IssuerHeader = DefaultIssuerHeader
+	}
+	if cfg.CrlStale == "" {
+		cfg.CrlStale = CrlStaleLog
+	}
+}
+
+// Extractor returns the user of the certificate header. The certificate
+// is checked for its validity period, its issuer and the CRL.
+type Extractor struct {
+	Format       string
+	Header       string
+	UserField    string
+	IssuerHeader string
+
+	issuers map[string]bool
+	crl     *CrlFile
+}
+
+func New(cfg *Config) (*Extractor, error) {
+	ex := &Extractor{
+		Format:       cfg.Format,
+		Header:       cfg.Header,
+		UserField:    cfg.UserField,
+		IssuerHeader: cfg.IssuerHeader,
+	}
+
+	switch cfg.Format {
+	case FormatPem:
+	case FormatDn:
+		if cfg.UserField == FieldUpn {
+			return nil, fmt.Errorf("user_field %q needs the %q format", FieldUpn, FormatPem)
+		}
+		if cfg.CrlFile != "" {
+			return nil, fmt.Errorf("crl_file needs the %q format", FormatPem)
+		}
+	default:
+		return nil, fmt.Errorf("bad format: %q", cfg.Format)
+	}
+	switch cfg.UserField {
+	case FieldCn, FieldEmail, FieldUpn:
+	default:
+		return nil, fmt.Errorf("bad user_field: %q", cfg.UserField)
+	}
+
+	if len(cfg.Issuers) > 0 {
+		ex.issuers = map[string]bool{}
+		for _, s := range cfg.Issuers {
+			dn, err := ParseDN(s)
+			if err != nil {
+				return nil, fmt.Errorf("issuer %q: %w", s, err)
+			}
+			ex.issuers[dn.Key()] = true
+		}
+	}
+	switch cfg.CrlStale {
+	case CrlStaleLog, CrlStaleDeny:
+	default:
+		return nil, fmt.Errorf("bad crl_stale: %q", cfg.CrlStale)
+	}
+	if cfg.CrlFile != "" {
+		if cfg.CrlIssuers == "" {
+			return nil, errors.New("crl_file needs crl_issuers")
+		}
+		crl, err := LoadCrlFile(cfg.CrlFile, cfg.CrlIssuers, cfg.CrlStale == CrlStaleDeny)
+		if err != nil {
+			return nil, err
+		}
+		ex.crl = crl
+	}
+	return ex, nil
+}
+
+func result_of(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrNoCert):
+		return "missing"
+	case errors.Is(err, ErrExpired):
+		return "expired"
+	case errors.Is(err, ErrBadIssuer):
+		return "bad_issuer"
+	case errors.Is(err, ErrRevoked):
+		return "revoked"
+	case errors.Is(err, ErrStaleCrl):
+		return "stale_crl"
+	case errors.Is(err, ErrNoUser):
+		return "no_user"
+	}
+	return "malformed"
+}
+
+// User returns the user of the certificate header of r. The user is
+// also returned with the errors after the user field is found.
+func (ex *Extractor) User(r *http.Request) (string, error) {
+	val := r.Header.Get(ex.Header)
+	var user string
+	var err error
+	switch {
+	case val == "":
+		err = ErrNoCert
+	case ex.Format == FormatDn:
+		user, err = ex.user_of_dn(r, val)
+	default:
+		user, err = ex.user_of_pem(val)
+	}
+	metrics.ClientCerts.Inc(result_of(err))
+	return user, err
+}
+
+func (ex *Extractor) user_of_dn(r *http.Request, val string) (string, error) {
+	dn, err := ParseDN(val)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	var user string
+	switch ex.UserField {
+	case FieldEmail:
+		user = dn.Get(attrEmail)
+	default:
+		user = dn.Get(attrCn)
+	}
+	if user == "" {
+		return "", ErrNoUser
+	}
+
+	if ex.issuers != nil {
+		issuer, err := ParseDN(r.Header.Get(ex.IssuerHeader))
+		if err != nil || len(issuer) == 0 {
+			return user, fmt.Errorf("%w: no issuer header", ErrBadIssuer)
+		}
+		if !ex.issuers[issuer.Key()] {
+			return user, ErrBadIssuer
+		}
+	}
+	return user, nil
+}
+
+const (
+	pemBegin = "-----BEGIN CERTIFICATE-----"
+	pemEnd   = "-----END CERTIFICATE-----"
+)
+
+// parse_pem decodes the PEM certificate, which nginx passes escaped with
+// $ssl_client_escaped_cert, or with the line breaks replaced by the
+// deprecated $ssl_client_cert.
+func parse_pem(val string) (*x509.Certificate, error) {
+	if strings.Contains(val, "%") {
+		unescaped, err := url.PathUnescape(val)
+		if err != nil {
+			return nil, err
+		}
+		val = unescaped
+	}
+	_, body, ok := strings.Cut(val, pemBegin)
+	if ok {
+		body, _, ok = strings.Cut(body, pemEnd)
+	}
+	if !ok {
+		return nil, errors.New("no PEM certificate")
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func (ex *Extractor) user_of_pem(val string) (string, error) {
+	cert, err := parse_pem(val)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	var user string
+	switch ex.UserField {
+	case FieldEmail:
+		if len(cert.EmailAddresses) > 0 {
+			user = cert.EmailAddresses[0]
+		}
+	case FieldUpn:
+		user, err = upn_of(cert)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrMalformed, err)
+		}
+	default:
+		user = cert.Subject.CommonName
+	}
+	if user == "" {
+		return "", ErrNoUser
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return user, ErrExpired
+	}
+	if ex.issuers != nil && !ex.issuers[NameDN(cert.Issuer.Names).Key()] {
+		return user, ErrBadIssuer
+	}
+	if err := ex.crl.Check(cert); err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+var (
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidUpn            = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+)
+
+// upn_of returns the Microsoft UPN in the otherName of the subject
+// alternative names, or "" if there is none.
+func upn_of(cert *x509.Certificate) (string, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var names asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return "", err
+		}
+		rest := names.Bytes
+		for len(rest) > 0 {
+			var gn asn1.RawValue
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &gn); err != nil {
+				return "", err
+			}
+			// otherName [0] IMPLICIT SEQUENCE { type-id, [0] EXPLICIT value }
+			if gn.Class != asn1.ClassContextSpecific || gn.Tag != 0 {
+				continue
+			}
+			var id asn1.ObjectIdentifier
+			val, err := asn1.Unmarshal(gn.Bytes, &id)
+			if err != nil || !id.Equal(oidUpn) {
+				continue
+			}
+			var wrapped asn1.RawValue
+			if _, err := asn1.Unmarshal(val, &wrapped); err != nil {
+				return "", err
+			}
+			var upn string
+			if _, err := asn1.Unmarshal(wrapped.Bytes, &upn); err != nil {
+				return "", err
+			}
+			return upn, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,317 @@
+package client_cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCa is a certificate authority issuing the client certificates.
+type testCa struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func make_ca(t *testing.T, cn string) *testCa {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCa{cert: cert, key: key}
+}
+
+// issue returns the escaped PEM of a client certificate, as nginx passes
+// it with $ssl_client_escaped_cert.
+func (ca *testCa) issue(t *testing.T, tmpl *x509.Certificate) string {
+	t.Helper()
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return url.PathEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+}
+
+// write_crl writes the CRL of the serials, next updated at next, and
+// returns its file.
+func (ca *testCa) write_crl(t *testing.T, next time.Time, serials ...int64) string {
+	t.Helper()
+	var entries []x509.RevocationListEntry
+	for _, sn := range serials {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(sn), RevocationTime: time.Now()})
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		RevokedCertificateEntries: entries,
+		ThisUpdate:                time.Now().Add(-2 * time.Hour),
+		NextUpdate:                next,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "crl.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// write_cert writes the certificate of ca, and returns its file.
+func (ca *testCa) write_cert(t *testing.T) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// san_ext returns the subject alternative names of an email address and a
+// Microsoft UPN, which x509.CreateCertificate cannot make.
+func san_ext(t *testing.T, email string, upn string) pkix.Extension {
+	t.Helper()
+	val, err := asn1.MarshalWithParams(upn, "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := asn1.Marshal(oidUpn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0,
+		IsCompound: true, Bytes: val})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0,
+		IsCompound: true, Bytes: append(id, wrapped...)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfc822, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1,
+		Bytes: []byte(email)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence,
+		IsCompound: true, Bytes: append(rfc822, other...)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkix.Extension{Id: oidSubjectAltName, Value: names}
+}
+
+func TestUserOfPem(t *testing.T) {
+	ca := make_ca(t, "Test CA")
+	other_ca := make_ca(t, "Other CA")
+	ca_file := ca.write_cert(t)
+	crl := Config{CrlFile: ca.write_crl(t, time.Now().Add(time.Hour), 666), CrlIssuers: ca_file}
+	stale_crl := ca.write_crl(t, time.Now().Add(-time.Hour), 666)
+
+	user1 := ca.issue(t, &x509.Certificate{SerialNumber: big.NewInt(10),
+		Subject:         pkix.Name{CommonName: "user1", Organization: []string{"Example"}},
+		ExtraExtensions: []pkix.Extension{san_ext(t, "user1@example.com", "user1@corp.example.com")}})
+	issuers := []string{"O=Example,CN=Test CA"}
+
+	tests := []struct {
+		name  string
+		cfg   Config
+		value string
+		user  string
+		err   error
+	}{
+		{"cn", Config{}, user1, "user1", nil},
+		{"email", Config{UserField: FieldEmail}, user1, "user1@example.com", nil},
+		{"upn", Config{UserField: FieldUpn}, user1, "user1@corp.example.com", nil},
+		{"unescaped", Config{}, strings.ReplaceAll(must_unescape(t, user1), "\n", " "), "user1", nil},
+		{"allowed issuer", Config{Issuers: issuers}, user1, "user1", nil},
+		{"issuer in other order", Config{Issuers: []string{"cn=test ca, o=example"}}, user1, "user1", nil},
+		{"not in crl", crl, user1, "user1", nil},
+		{"stale crl logged", Config{CrlFile: stale_crl, CrlIssuers: ca_file}, user1, "user1", nil},
+		{"stale crl denied", Config{CrlFile: stale_crl, CrlIssuers: ca_file, CrlStale: CrlStaleDeny},
+			user1, "user1", ErrStaleCrl},
+		{"no header", Config{}, "", "", ErrNoCert},
+		{"not a certificate", Config{}, "garbage", "", ErrMalformed},
+		{"bad base64", Config{}, url.PathEscape(pemBegin + "\n!!!\n" + pemEnd), "", ErrMalformed},
+		{"no email", Config{UserField: FieldEmail},
+			ca.issue(t, &x509.Certificate{SerialNumber: big.NewInt(11), Subject: pkix.Name{CommonName: "user2"}}),
+			"", ErrNoUser},
+		{"no upn", Config{UserField: FieldUpn},
+			ca.issue(t, &x509.Certificate{SerialNumber: big.NewInt(12), Subject: pkix.Name{CommonName: "user2"},
+				EmailAddresses: []string{"user2@example.com"}}),
+			"", ErrNoUser},
+		{"expired", Config{},
+			ca.issue(t, &x509.Certificate{SerialNumber: big.NewInt(13), Subject: pkix.Name{CommonName: "user3"},
+				NotBefore: time.Now().Add(-2 * time.Hour), NotAfter: time.Now().Add(-time.Hour)}),
+			"user3", ErrExpired},
+		{"not yet valid", Config{},
+			ca.issue(t, &x509.Certificate{SerialNumber: big.NewInt(14), Subject: pkix.Name{CommonName: "user3"},
+				NotBefore: time.Now().Add(time.Hour), NotAfter: time.Now().Add(2 * time.Hour)}),
+			"user3", ErrExpired},
+		{"bad chain", Config{Issuers: issuers},
+			other_ca.issue(t, &x509.Certificate{SerialNumber: big.NewInt(10), Subject: pkix.Name{CommonName: "user1"}}),
+			"user1", ErrBadIssuer},
+		{"revoked", crl,
+			ca.issue(t, &x509.Certificate{SerialNumber: big.NewInt(666), Subject: pkix.Name{CommonName: "user4"}}),
+			"user4", ErrRevoked},
+		{"revoked with stale crl", Config{CrlFile: stale_crl, CrlIssuers: ca_file},
+			ca.issue(t, &x509.Certificate{SerialNumber: big.NewInt(666), Subject: pkix.Name{CommonName: "user4"}}),
+			"user4", ErrRevoked},
+		{"serial revoked by other issuer", crl,
+			other_ca.issue(t, &x509.Certificate{SerialNumber: big.NewInt(666), Subject: pkix.Name{CommonName: "user4"}}),
+			"user4", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.SetDefault()
+			ex, err := New(&cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.value != "" {
+				r.Header.Set(DefaultPemHeader, tt.value)
+			}
+			user, err := ex.User(r)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("User() error = %v, want %v", err, tt.err)
+			}
+			if user != tt.user {
+				t.Errorf("User() = %q, want %q", user, tt.user)
+			}
+		})
+	}
+}
+
+func must_unescape(t *testing.T, s string) string {
+	t.Helper()
+	u, err := url.PathUnescape(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestUserOfDn(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    Config
+		dn     string
+		issuer string
+		user   string
+		err    error
+	}{
+		{"cn", Config{}, "CN=user1,OU=Dev,O=Example", "", "user1", nil},
+		{"escaped comma", Config{}, `CN=Doe\, John,O=Example`, "", "Doe, John", nil},
+		{"hex escape", Config{}, `CN=J\C3\BCrgen,O=Example`, "", "Jürgen", nil},
+		{"email", Config{UserField: FieldEmail}, "emailAddress=user1@example.com,CN=user1", "", "user1@example.com", nil},
+		{"email alias", Config{UserField: FieldEmail}, "E=user1@example.com,CN=user1", "", "user1@example.com", nil},
+		{"no cn", Config{}, "O=Example", "", "", ErrNoUser},
+		{"malformed", Config{}, "user1", "", "", ErrMalformed},
+		{"allowed issuer", Config{Issuers: []string{"CN=Test CA,O=Example"}},
+			"CN=user1", "O=example, CN=test ca", "user1", nil},
+		{"other issuer", Config{Issuers: []string{"CN=Test CA,O=Example"}},
+			"CN=user1", "CN=Other CA,O=Example", "user1", ErrBadIssuer},
+		{"no issuer", Config{Issuers: []string{"CN=Test CA,O=Example"}},
+			"CN=user1", "", "user1", ErrBadIssuer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Format = FormatDn
+			cfg.SetDefault()
+			ex, err := New(&cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set(DefaultDnHeader, tt.dn)
+			if tt.issuer != "" {
+				r.Header.Set(DefaultIssuerHeader, tt.issuer)
+			}
+			user, err := ex.User(r)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("User() error = %v, want %v", err, tt.err)
+			}
+			if user != tt.user {
+				t.Errorf("User() = %q, want %q", user, tt.user)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	ca := make_ca(t, "Test CA")
+	// forged has the name of ca with another key.
+	forged := make_ca(t, "Test CA")
+	ca_file := ca.write_cert(t)
+	crl_file := ca.write_crl(t, time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"pem", Config{Format: FormatPem, UserField: FieldUpn}, true},
+		{"dn with upn", Config{Format: FormatDn, UserField: FieldUpn}, false},
+		{"dn with crl", Config{Format: FormatDn, CrlFile: "crl.pem"}, false},
+		{"bad format", Config{Format: "der"}, false},
+		{"bad user field", Config{UserField: "uid"}, false},
+		{"bad issuer", Config{Issuers: []string{"Test CA"}}, false},
+		{"crl", Config{CrlFile: crl_file, CrlIssuers: ca_file}, true},
+		{"no crl file", Config{CrlFile: filepath.Join(t.TempDir(), "none.pem"), CrlIssuers: ca_file}, false},
+		{"crl without issuers", Config{CrlFile: crl_file}, false},
+		{"crl of other issuer", Config{CrlFile: crl_file, CrlIssuers: make_ca(t, "Other CA").write_cert(t)}, false},
+		{"crl with bad signature", Config{CrlFile: forged.write_crl(t, time.Now().Add(time.Hour)), CrlIssuers: ca_file}, false},
+		{"issuers not certificates", Config{CrlFile: crl_file, CrlIssuers: crl_file}, false},
+		{"bad crl stale", Config{CrlStale: "ignore"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.SetDefault()
+			if _, err := New(&cfg); (err == nil) != tt.ok {
+				t.Errorf("New() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package client_cert
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	logger "ngx_auth/logger"
+	"ngx_auth/metrics"
+)
+
+// CrlCheckInterval is how often the CRL file is checked for a change.
+const CrlCheckInterval = 5 * time.Second
+
+// CrlFile is the file of the certificate revocation lists, in PEM with one
+// or more X509 CRL blocks, or in DER. Each list must be signed by one of
+// the issuer certificates.
+type CrlFile struct {
+	file       string
+	issuers    []*x509.Certificate
+	deny_stale bool
+
+	mu      sync.Mutex
+	mtime   time.Time
+	checked time.Time
+	revoked map[string]map[string]bool
+	// next is the earliest next update of the lists of each issuer.
+	next    map[string]time.Time
+	entries int
+	warned  time.Time
+}
+
+// LoadCrlFile reads the CRL file, and the certificates of its issuers in
+// issuer_file. The CRL file is read again when it is modified, and the
+// current lists are kept if it cannot be read. With deny_stale, the
+// certificates of an issuer whose list is past its next update are denied.
+func LoadCrlFile(file string, issuer_file string, deny_stale bool) (*CrlFile, error) {
+	issuers, err := load_issuers(issuer_file)
+	if err != nil {
+		return nil, err
+	}
+	cf := &CrlFile{file: file, issuers: issuers, deny_stale: deny_stale}
+	if err := cf.load(); err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
+func load_issuers(file string) ([]*x509.Certificate, error) {
+	bin, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var blk *pem.Block
+		blk, bin = pem.Decode(bin)
+		if blk == nil {
+			break
+		}
+		if blk.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(blk.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no CERTIFICATE block", file)
+	}
+	return certs, nil
+}
+
+// check_signature checks that an issuer certificate signed crl.
+func (cf *CrlFile) check_signature(crl *x509.RevocationList) error {
+	err := fmt.Errorf("CRL of %q has no issuer certificate", crl.Issuer)
+	for _, ca := range cf.issuers {
+		if !bytes.Equal(ca.RawSubject, crl.RawIssuer) {
+			continue
+		}
+		if err = crl.CheckSignatureFrom(ca); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func parse_crls(bin []byte) ([]*x509.RevocationList, error) {
+	if !bytes.Contains(bin, []byte("-----BEGIN")) {
+		crl, err := x509.ParseRevocationList(bin)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.RevocationList{crl}, nil
+	}
+
+	var crls []*x509.RevocationList
+	for {
+		var blk *pem.Block
+		blk, bin = pem.Decode(bin)
+		if blk == nil {
+			break
+		}
+		if blk.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(blk.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		return nil, errors.New("no X509 CRL block")
+	}
+	return crls, nil
+}
+
+func (cf *CrlFile) load() error {
+	st, err := os.Stat(cf.file)
+	if err != nil {
+		return err
+	}
+	bin, err := os.ReadFile(cf.file)
+	if err != nil {
+		return err
+	}
+	crls, err := parse_crls(bin)
+	if err != nil {
+		return fmt.Errorf("%s: %w", cf.file, err)
+	}
+
+	revoked := map[string]map[string]bool{}
+	next := map[string]time.Time{}
+	entries := 0
+	for _, crl := range crls {
+		if err := cf.check_signature(crl); err != nil {
+			return fmt.Errorf("%s: %w", cf.file, err)
+		}
+		issuer := string(crl.RawIssuer)
+		if tm, has := next[issuer]; !crl.NextUpdate.IsZero() && (!has || crl.NextUpdate.Before(tm)) {
+			next[issuer] = crl.NextUpdate
+		}
+		serials := revoked[issuer]
+		if serials == nil {
+			serials = map[string]bool{}
+			revoked[issuer] = serials
+		}
+		for _, ent := range crl.RevokedCertificateEntries {
+			serials[ent.SerialNumber.String()] = true
+			entries++
+		}
+	}
+
+	cf.revoked = revoked
+	cf.next = next
+	cf.entries = entries
+	cf.mtime = st.ModTime()
+	cf.checked = time.Now()
+	return nil
+}
+
+func (cf *CrlFile) reload() {
+	if time.Since(cf.checked) < CrlCheckInterval {
+		return
+	}
+	cf.checked = time.Now()
+	st, err := os.Stat(cf.file)
+	if err == nil && st.ModTime().Equal(cf.mtime) {
+		return
+	}
+	if err == nil {
+		err = cf.load()
+	}
+	if err != nil {
+		metrics.ConfigReloads.Inc("crl", "error")
+		logger.Event(logger.LevelError, logger.EventCrlError,
+			logger.File(cf.file), logger.Err(err))
+		return
+	}
+	metrics.ConfigReloads.Inc("crl", "ok")
+	logger.Event(logger.LevelNotice, logger.EventCrlReloaded,
+		logger.File(cf.file), logger.Entries(cf.entries))
+}
+
+// Check returns ErrRevoked if the CRL of the issuer lists the certificate.
+// A CRL past its next update returns ErrStaleCrl with deny_stale, and is
+// logged otherwise. A nil CrlFile revokes nothing.
+func (cf *CrlFile) Check(cert *x509.Certificate) error {
+	if cf == nil {
+		return nil
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	cf.reload()
+
+	issuer := string(cert.RawIssuer)
+	if cf.revoked[issuer][cert.SerialNumber.String()] {
+		return ErrRevoked
+	}
+	next, has := cf.next[issuer]
+	if !has || time.Now().Before(next) {
+		return nil
+	}
+	if cf.deny_stale {
+		metrics.CrlStale.Inc("denied")
+		return ErrStaleCrl
+	}
+	metrics.CrlStale.Inc("allowed")
+	if time.Since(cf.warned) >= CrlCheckInterval {
+		cf.warned = time.Now()
+		logger.Event(logger.LevelError, logger.EventCrlStale,
+			logger.File(cf.file), logger.Err(fmt.Errorf("%w: next update %s", ErrStaleCrl,
+				next.UTC().Format(time.RFC3339))))
+	}
+	return nil
+}
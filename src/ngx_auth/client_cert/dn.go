@@ -0,0 +1,179 @@
+package client_cert
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Attr is an attribute of a distinguished name. Type is the upper case
+// short name, or the dotted OID of an unknown type.
+type Attr struct {
+	Type  string
+	Value string
+}
+
+// DN is a distinguished name, in the order of the string representation.
+type DN []Attr
+
+const (
+	attrCn    = "CN"
+	attrEmail = "EMAILADDRESS"
+)
+
+var attr_names = map[string]string{
+	"2.5.4.3":                    "CN",
+	"2.5.4.5":                    "SERIALNUMBER",
+	"2.5.4.6":                    "C",
+	"2.5.4.7":                    "L",
+	"2.5.4.8":                    "ST",
+	"2.5.4.9":                    "STREET",
+	"2.5.4.10":                   "O",
+	"2.5.4.11":                   "OU",
+	"0.9.2342.19200300.100.1.1":  "UID",
+	"0.9.2342.19200300.100.1.25": "DC",
+	"1.2.840.113549.1.9.1":       "EMAILADDRESS",
+}
+
+var attr_aliases = map[string]string{
+	"E":     "EMAILADDRESS",
+	"EMAIL": "EMAILADDRESS",
+	"S":     "ST",
+}
+
+func attr_type(t string) string {
+	t = strings.ToUpper(strings.TrimSpace(t))
+	t = strings.TrimPrefix(t, "OID.")
+	if name, ok := attr_names[t]; ok {
+		return name
+	}
+	if name, ok := attr_aliases[t]; ok {
+		return name
+	}
+	return t
+}
+
+// NameDN returns the DN of the attributes of a certificate name.
+func NameDN(names []pkix.AttributeTypeAndValue) DN {
+	dn := make(DN, 0, len(names))
+	// The string representation lists the most specific attribute first.
+	for i := len(names) - 1; i >= 0; i-- {
+		dn = append(dn, Attr{
+			Type:  attr_type(names[i].Type.String()),
+			Value: fmt.Sprint(names[i].Value),
+		})
+	}
+	return dn
+}
+
+// ParseDN parses the RFC 4514 string representation, which nginx uses for
+// $ssl_client_s_dn and $ssl_client_i_dn.
+func ParseDN(s string) (DN, error) {
+	dn := DN{}
+	s = strings.TrimSpace(s)
+	for len(s) > 0 {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, errors.New("no attribute type")
+		}
+		typ := attr_type(s[:eq])
+		if typ == "" {
+			return nil, errors.New("empty attribute type")
+		}
+		val, rest, err := parse_value(strings.TrimLeft(s[eq+1:], " "))
+		if err != nil {
+			return nil, err
+		}
+		dn = append(dn, Attr{Type: typ, Value: val})
+		s = strings.TrimLeft(rest, " ")
+	}
+	return dn, nil
+}
+
+// parse_value returns the value up to the next unescaped separator, and the
+// rest after the separator.
+func parse_value(s string) (string, string, error) {
+	if strings.HasPrefix(s, "#") {
+		end := strings.IndexAny(s, ",;+")
+		if end < 0 {
+			end = len(s)
+		}
+		bin, err := hex.DecodeString(strings.TrimSpace(s[1:end]))
+		if err != nil {
+			return "", "", fmt.Errorf("bad hex value: %w", err)
+		}
+		// The hex value is the BER encoding of the value.
+		var str string
+		if _, err := asn1.Unmarshal(bin, &str); err == nil {
+			return str, next(s[end:]), nil
+		}
+		return string(bin), next(s[end:]), nil
+	}
+
+	var b strings.Builder
+	trail := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case ',', ';', '+':
+			return b.String()[:b.Len()-trail], s[i+1:], nil
+		case '\\':
+			if i+1 >= len(s) {
+				return "", "", errors.New("bad escape")
+			}
+			if i+2 < len(s) && is_hex(s[i+1]) && is_hex(s[i+2]) {
+				bin, _ := hex.DecodeString(s[i+1 : i+3])
+				b.WriteByte(bin[0])
+				i += 2
+			} else {
+				b.WriteByte(s[i+1])
+				i++
+			}
+			trail = 0
+		case ' ':
+			b.WriteByte(c)
+			trail++
+		default:
+			b.WriteByte(c)
+			trail = 0
+		}
+	}
+	return b.String()[:b.Len()-trail], "", nil
+}
+
+func next(s string) string {
+	if s == "" {
+		return s
+	}
+	return s[1:]
+}
+
+func is_hex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// Get returns the first value of the attribute type.
+func (dn DN) Get(typ string) string {
+	for _, a := range dn {
+		if a.Type == typ {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Key returns the comparison key of the DN. The types and the values are
+// compared case-insensitively, and the order of the attributes is ignored,
+// since the reversed and the certificate order are both in use.
+func (dn DN) Key() string {
+	attrs := make([]string, 0, len(dn))
+	for _, a := range dn {
+		attrs = append(attrs, a.Type+"="+strings.ToLower(a.Value))
+	}
+	sort.Strings(attrs)
+	return strings.Join(attrs, "\x00")
+}
@@ -0,0 +1,672 @@
+package config_check
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"ngx_auth/admin"
+	"ngx_auth/apikey"
+	"ngx_auth/assertion"
+	"ngx_auth/audit"
+	"ngx_auth/authz"
+	"ngx_auth/client_cert"
+	"ngx_auth/digest"
+	"ngx_auth/htstat"
+	"ngx_auth/jwt"
+	"ngx_auth/ldap_auth"
+	"ngx_auth/logger"
+	"ngx_auth/pipeline"
+	"ngx_auth/profile"
+	"ngx_auth/server"
+	"ngx_auth/session"
+	"ngx_auth/signed_header"
+	"ngx_auth/totp"
+)
+
+// Problem is one configuration error with the field path that caused it.
+type Problem struct {
+	Field   string
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Field == "" {
+		return p.Message
+	}
+	return p.Field + ": " + p.Message
+}
+
+// Checker collects every configuration problem instead of stopping at the first one.
+type Checker struct {
+	File     string
+	Problems []Problem
+}
+
+func New(file string) *Checker {
+	return &Checker{File: file}
+}
+
+func (c *Checker) Errorf(field string, format string, v ...interface{}) {
+	c.Problems = append(c.Problems, Problem{
+		Field:   field,
+		Message: fmt.Sprintf(format, v...),
+	})
+}
+
+func (c *Checker) Error(field string, err error) {
+	if err == nil {
+		return
+	}
+	c.Errorf(field, "%s", err)
+}
+
+func (c *Checker) HasError() bool {
+	return len(c.Problems) > 0
+}
+
+// Report writes every problem as "<file>: <field>: <message>".
+func (c *Checker) Report(w io.Writer) {
+	for _, p := range c.Problems {
+		fmt.Fprintf(w, "%s: %s\n", c.File, p)
+	}
+}
+
+// Exit reports the problems and exits with status 1 if there is any problem.
+func (c *Checker) Exit() {
+	if !c.HasError() {
+		return
+	}
+	c.Report(os.Stderr)
+	os.Exit(1)
+}
+
+func sorted_keys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func join(field string, name string) string {
+	if field == "" {
+		return name
+	}
+	return field + "." + name
+}
+
+func (c *Checker) SocketType(field string, stype string) {
+	if stype != "tcp" && stype != "unix" {
+		c.Errorf(field, "bad socket type: %q", stype)
+	}
+}
+
+// SocketOwnership checks socket_mode, socket_owner and socket_group.
+func (c *Checker) SocketOwnership(field string, so *server.SocketOwnership) {
+	if _, err := so.FileMode(); err != nil {
+		c.Errorf(join(field, "socket_mode"), "%s: %q", err, so.Mode)
+	}
+	if _, err := server.LookupUser(so.Owner); err != nil {
+		c.Error(join(field, "socket_owner"), err)
+	}
+	if _, err := server.LookupGroup(so.Group); err != nil {
+		c.Error(join(field, "socket_group"), err)
+	}
+}
+
+// Tls checks the [tls] part, and returns the server TLS configuration
+// if TLS is enabled and there is no problem.
+func (c *Checker) Tls(field string, stype string, cfg *server.TlsConfig) *tls.Config {
+	if !cfg.IsEnabled() {
+		if cfg.KeyFile != "" || len(cfg.ClientCaFiles) > 0 {
+			c.Errorf(join(field, "cert_file"), "is required")
+		}
+		return nil
+	}
+
+	n := len(c.Problems)
+	if stype != "tcp" {
+		c.Errorf(join(field, "cert_file"), "TLS is only for socket_type \"tcp\"")
+	}
+	if cfg.KeyFile == "" {
+		c.Errorf(join(field, "key_file"), "is required")
+	} else if _, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile); err != nil {
+		c.Error(join(field, "cert_file"), err)
+	}
+	if _, err := cfg.TlsVersion(); err != nil {
+		c.Errorf(join(field, "min_version"), "%s: %q", err, cfg.MinVersion)
+	}
+	for i, fn := range cfg.ClientCaFiles {
+		ca := server.TlsConfig{ClientCaFiles: []string{fn}}
+		if _, err := ca.ClientCaPool(); err != nil {
+			c.Error(fmt.Sprintf("%s[%d]", join(field, "client_ca_files"), i), err)
+		}
+	}
+	if len(cfg.ClientNames) > 0 && len(cfg.ClientCaFiles) == 0 {
+		c.Errorf(join(field, "client_ca_files"), "is required with client_names")
+	}
+	if len(c.Problems) > n {
+		return nil
+	}
+
+	tls_cfg, err := server.NewTlsConfig(cfg)
+	if err != nil {
+		c.Error(field, err)
+		return nil
+	}
+	return tls_cfg
+}
+
+// Session checks the [session] part, and returns its manager, or nil if
+// the sessions are disabled.
+func (c *Checker) Session(field string, cfg *session.Config) *session.Manager {
+	if !cfg.IsEnabled() {
+		return nil
+	}
+	if len(cfg.Secret) < session.MinSecretLen {
+		c.Error(join(field, "secret"), session.ErrShortSecret)
+		return nil
+	}
+	if cfg.IdleSeconds > cfg.MaxAgeSeconds {
+		c.Errorf(join(field, "idle_seconds"), "must not be longer than max_age_seconds: %d", cfg.IdleSeconds)
+	}
+	m, err := session.NewManager(cfg)
+	if err != nil {
+		c.Error(join(field, "revoke_file"), err)
+		return nil
+	}
+	return m
+}
+
+// Totp checks the [totp] part, and returns its verifier, or nil if the
+// second factor is disabled. ldap_cfg is the server of ldap_attr.
+func (c *Checker) Totp(field string, cfg *totp.Config, ldap_cfg *ldap_auth.Config,
+	sessions *session.Manager) *totp.Verifier {
+	if !cfg.IsEnabled() {
+		return nil
+	}
+	if sessions == nil {
+		c.Errorf(field, "the second factor needs the session settings")
+	}
+
+	var store totp.Store
+	switch {
+	case cfg.SecretFile != "" && cfg.LdapAttr != "":
+		c.Errorf(join(field, "ldap_attr"), "cannot be used with secret_file")
+		return nil
+	case cfg.SecretFile != "":
+		sf, err := totp.LoadSecretFile(cfg.SecretFile)
+		if err != nil {
+			c.Error(join(field, "secret_file"), err)
+			return nil
+		}
+		store = sf
+	default:
+		c.Required(join(field, "ldap_filter"), cfg.LdapFilter)
+		c.LdapFilter(join(field, "ldap_filter"), cfg.LdapFilter)
+		store = &totp.LdapSecrets{Config: ldap_cfg, Filter: cfg.LdapFilter, Attr: cfg.LdapAttr}
+	}
+	return totp.NewVerifier(store)
+}
+
+// Signature checks the [signature] part, and returns its verifier, or nil
+// if the user header is not signed.
+func (c *Checker) Signature(field string, cfg *signed_header.Config) *signed_header.Verifier {
+	if !cfg.IsEnabled() {
+		return nil
+	}
+	switch cfg.Format {
+	case signed_header.FormatHmac, signed_header.FormatJws:
+	default:
+		c.Errorf(join(field, "format"), "must be %q or %q: %q",
+			signed_header.FormatHmac, signed_header.FormatJws, cfg.Format)
+		return nil
+	}
+	if cfg.Format == signed_header.FormatHmac && cfg.JwksFile != "" {
+		c.Errorf(join(field, "jwks_file"), "is not used by the %q format", cfg.Format)
+	}
+	v, err := signed_header.NewVerifier(cfg)
+	if err != nil {
+		c.Error(field, err)
+		return nil
+	}
+	return v
+}
+
+// Digest checks the [digest] part, and returns its server, or nil if
+// only Basic authentication is offered.
+func (c *Checker) Digest(field string, cfg *digest.Config, realm string) *digest.Server {
+	if !cfg.IsEnabled() {
+		return nil
+	}
+	s, err := digest.New(cfg, realm)
+	switch {
+	case errors.Is(err, digest.ErrBadScheme), errors.Is(err, digest.ErrNoDigest):
+		c.Error(join(field, "schemes"), err)
+		return nil
+	case errors.Is(err, digest.ErrBadAlgorithm):
+		c.Error(join(field, "algorithms"), err)
+		return nil
+	case errors.Is(err, digest.ErrShortSecret):
+		c.Error(join(field, "secret"), err)
+		return nil
+	case err != nil:
+		c.Error(field, err)
+		return nil
+	}
+	return s
+}
+
+// Assertion checks the [assertion] part, and returns its issuer, or nil
+// if the identity assertions are disabled. The JWKS is served on the
+// admin listener, so its path must not be one of the admin paths.
+func (c *Checker) Assertion(field string, cfg *assertion.Config, admin_cfg *admin.Config) *assertion.Issuer {
+	if !cfg.IsEnabled() {
+		return nil
+	}
+	switch cfg.JwksPath {
+	case admin_cfg.MetricsPath, admin_cfg.HealthPath, admin_cfg.ReadyPath:
+		c.Errorf(join(field, "jwks_path"), "is used by the admin listener: %q", cfg.JwksPath)
+	}
+	if !strings.HasPrefix(cfg.JwksPath, "/") {
+		c.Errorf(join(field, "jwks_path"), "must start with /: %q", cfg.JwksPath)
+	}
+	is, err := assertion.New(cfg)
+	if err != nil {
+		c.Error(join(field, "key_file"), err)
+		return nil
+	}
+	return is
+}
+
+// AssertionCache checks that nginx does not reuse an assertion after it
+// expires. A revalidated response keeps the cached assertion.
+func (c *Checker) AssertionCache(field string, is *assertion.Issuer,
+	cache_seconds uint32, use_etag bool) {
+	if is == nil {
+		return
+	}
+	if time.Duration(cache_seconds)*time.Second >= is.Ttl {
+		c.Errorf(join(field, "cache_seconds"),
+			"must be shorter than ttl_seconds of the assertion: %d", cache_seconds)
+	}
+	if use_etag {
+		c.Errorf(join(field, "use_etag"), "cannot be used with the assertion")
+	}
+}
+
+// ClientCert checks the [cert] part, and returns its extractor. The dn
+// format has no SAN, so it cannot have the upn user field or the CRL.
+func (c *Checker) ClientCert(field string, cfg *client_cert.Config) *client_cert.Extractor {
+	ok := true
+	switch cfg.Format {
+	case client_cert.FormatPem, client_cert.FormatDn:
+	default:
+		c.Errorf(join(field, "format"), "must be %q or %q: %q",
+			client_cert.FormatPem, client_cert.FormatDn, cfg.Format)
+		ok = false
+	}
+	switch cfg.UserField {
+	case client_cert.FieldCn, client_cert.FieldEmail, client_cert.FieldUpn:
+	default:
+		c.Errorf(join(field, "user_field"), "must be %q, %q or %q: %q",
+			client_cert.FieldCn, client_cert.FieldEmail, client_cert.FieldUpn, cfg.UserField)
+		ok = false
+	}
+	if cfg.Format == client_cert.FormatDn {
+		if cfg.UserField == client_cert.FieldUpn {
+			c.Errorf(join(field, "user_field"), "%q is not in the %q format",
+				cfg.UserField, cfg.Format)
+			ok = false
+		}
+		if cfg.CrlFile != "" {
+			c.Errorf(join(field, "crl_file"), "is not used by the %q format", cfg.Format)
+			ok = false
+		}
+	}
+	switch cfg.CrlStale {
+	case client_cert.CrlStaleLog, client_cert.CrlStaleDeny:
+	default:
+		c.Errorf(join(field, "crl_stale"), "must be %q or %q: %q",
+			client_cert.CrlStaleLog, client_cert.CrlStaleDeny, cfg.CrlStale)
+		ok = false
+	}
+	if cfg.CrlFile != "" && cfg.CrlIssuers == "" {
+		c.Errorf(join(field, "crl_issuers"), "is required with crl_file")
+		ok = false
+	}
+	for i, s := range cfg.Issuers {
+		if _, err := client_cert.ParseDN(s); err != nil {
+			c.Error(fmt.Sprintf("%s[%d]", join(field, "issuers"), i), err)
+			ok = false
+		}
+	}
+	if !ok {
+		return nil
+	}
+
+	ex, err := client_cert.New(cfg)
+	if err != nil {
+		c.Error(join(field, "crl_file"), err)
+		return nil
+	}
+	return ex
+}
+
+// Mfa checks that the paths requiring the second factor have the [totp]
+// and the [session] parts. Without a session, a code is used only once, so
+// every request after the first is rejected. Totp reports the missing
+// sessions of an enabled [totp].
+func (c *Checker) Mfa(field string, rights *profile.PathRights, cfg *totp.Config,
+	sessions *session.Manager) {
+	if !rights.UsesMfa() || cfg.IsEnabled() {
+		return
+	}
+	c.Errorf(field, "the second factor needs the totp settings")
+	if sessions == nil {
+		c.Errorf(field, "the second factor needs the session settings")
+	}
+}
+
+// MfaCache checks that nginx does not reuse the answer of a request with a
+// second factor, which would accept the code again.
+func (c *Checker) MfaCache(field string, rights *profile.PathRights,
+	cache_seconds uint32, use_etag bool) {
+	if !rights.UsesMfa() {
+		return
+	}
+	if cache_seconds > 0 {
+		c.Errorf(join(field, "cache_seconds"),
+			"must be 0 with the second factor: %d", cache_seconds)
+	}
+	if use_etag {
+		c.Errorf(join(field, "use_etag"), "cannot be used with the second factor")
+	}
+}
+
+// Login checks the [login] part, and returns the login form template,
+// or nil if the form is disabled.
+func (c *Checker) Login(field string, cfg *profile.LoginConfig, sessions *session.Manager) *template.Template {
+	if !cfg.IsEnabled() {
+		return nil
+	}
+
+	if u, err := url.Parse(cfg.LoginUrl); err != nil || !strings.HasPrefix(u.Path, "/") ||
+		(u.IsAbs() && u.Scheme != "https" && u.Scheme != "http") {
+		c.Errorf(join(field, "login_url"), "must be a path or an http(s) URL: %q", cfg.LoginUrl)
+	}
+	c.UrlPrefix(join(field, "prefix"), cfg.Prefix)
+	if sessions == nil {
+		c.Errorf(join(field, "login_url"), "the login form needs the session settings")
+	}
+	form, err := profile.LoadLoginForm(cfg.Template)
+	if err != nil {
+		c.Error(join(field, "template"), err)
+		return nil
+	}
+	return form
+}
+
+// LoginFilters checks that a session can keep the results of all the path
+// filters, which are evaluated at the form login.
+func (c *Checker) LoginFilters(field string, pf *profile.PathFilters) {
+	if n := len(pf.Filters()); n > session.MaxAuthz {
+		c.Errorf(field, "the login form supports up to %d distinct path filters: %d", session.MaxAuthz, n)
+	}
+}
+
+func (c *Checker) RunUser(user_field string, user string, group_field string, group string) {
+	if _, err := server.LookupUser(user); err != nil {
+		c.Error(user_field, err)
+	}
+	if _, err := server.LookupGroup(group); err != nil {
+		c.Error(group_field, err)
+	}
+}
+
+func (c *Checker) Required(field string, val string) {
+	if val == "" {
+		c.Errorf(field, "is required")
+	}
+}
+
+func (c *Checker) Regexp(field string, pat string) *regexp.Regexp {
+	re, err := regexp.Compile(pat)
+	if err != nil {
+		c.Error(field, err)
+		return nil
+	}
+	return re
+}
+
+// PathPattern compiles a path pattern, which must have a subexpression
+// to extract the path ID.
+func (c *Checker) PathPattern(field string, pat string) *regexp.Regexp {
+	re := c.Regexp(field, pat)
+	if re == nil {
+		return nil
+	}
+	if re.NumSubexp() < 1 {
+		c.Errorf(field, "no subexpression to extract the path ID: %q", pat)
+		return nil
+	}
+	return re
+}
+
+func (c *Checker) AuthzRight(field string, right string) {
+	if !authz.VerifyAuthzType(right) {
+		c.Errorf(field, "bad authorization right: %q", right)
+	}
+}
+
+func (c *Checker) PathRight(field string, rights map[string]string) {
+	for _, p := range sorted_keys(rights) {
+		c.AuthzRight(join(field, p), rights[p])
+	}
+}
+
+// UserMap loads the user map config and the user map, and reports every bad line.
+func (c *Checker) UserMap(cfg_field string, cfg_file string,
+	map_field string, map_file string) *authz.UserMap {
+	umap_cfg, err := authz.NewUserMapConfig(cfg_file)
+	if err != nil {
+		c.Error(cfg_field, err)
+		return nil
+	}
+
+	if map_file == "" {
+		c.Errorf(map_field, "is required")
+		return nil
+	}
+
+	errs := authz.VerifyUserMap(map_file, umap_cfg)
+	for _, e := range errs {
+		c.Error(map_field, e)
+	}
+	if len(errs) > 0 {
+		return nil
+	}
+
+	umap, err := authz.NewUserMap(map_file, umap_cfg)
+	if err != nil {
+		c.Error(map_field, err)
+		return nil
+	}
+
+	return umap
+}
+
+// Htpasswd checks every line of an htpasswd file, and returns the
+// authenticator if there is no problem.
+func (c *Checker) Htpasswd(field string, file string) *pipeline.Htpasswd {
+	if file == "" {
+		c.Errorf(field, "is required")
+		return nil
+	}
+
+	errs := pipeline.VerifyHtpasswd(file)
+	for _, e := range errs {
+		c.Error(field, e)
+	}
+	if len(errs) > 0 {
+		return nil
+	}
+
+	hp, err := pipeline.NewHtpasswd(file)
+	if err != nil {
+		c.Error(field, err)
+		return nil
+	}
+	return hp
+}
+
+// ApiKeys loads an API key file, and returns its keys if there is no problem.
+func (c *Checker) ApiKeys(field string, file string) *apikey.File {
+	if file == "" {
+		c.Errorf(field, "is required")
+		return nil
+	}
+	kf, err := apikey.LoadFile(file)
+	if err != nil {
+		c.Error(field, err)
+		return nil
+	}
+	return kf
+}
+
+// Jwks loads a JWKS file, and returns its keys if there is no problem.
+func (c *Checker) Jwks(field string, file string) *jwt.KeySet {
+	ks, err := jwt.LoadJWKSFile(file)
+	if err != nil {
+		c.Error(field, err)
+		return nil
+	}
+	return ks
+}
+
+// JwksUrl checks the URL of a JWKS. It is fetched later, because the
+// server may not be up yet.
+func (c *Checker) JwksUrl(field string, u string) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		c.Error(field, err)
+		return
+	}
+	if pu.Scheme != "https" && pu.Scheme != "http" {
+		c.Errorf(field, "must be an http or https URL: %q", u)
+	}
+}
+
+func (c *Checker) CaFiles(field string, files []string) {
+	for i, fn := range files {
+		if err := ldap_auth.CheckCaFiles([]string{fn}); err != nil {
+			c.Error(fmt.Sprintf("%s[%d]", field, i), err)
+		}
+	}
+}
+
+func (c *Checker) LdapFilter(field string, flt string) {
+	if flt == "" {
+		return
+	}
+	c.Error(field, ldap_auth.VerifyFilter(flt))
+}
+
+func (c *Checker) LdapFilterMap(field string, flts map[string]string) {
+	for _, p := range sorted_keys(flts) {
+		c.LdapFilter(join(field, p), flts[p])
+	}
+}
+
+func (c *Checker) Ldap(field string, cfg *ldap_auth.Config) {
+	if cfg.HostUrl == "" {
+		c.Errorf(join(field, "host_url"), "is required")
+	}
+	if cfg.BindDn == "" {
+		c.Errorf(join(field, "bind_dn"), "is required")
+	}
+	c.CaFiles(join(field, "root_ca_files"), cfg.RootCaFiles)
+	c.LdapFilter(join(field, "uniq_filter"), cfg.UniqueFilter)
+	if cfg.PoolSize < 0 {
+		c.Errorf(join(field, "pool_size"), "must not be negative: %d", cfg.PoolSize)
+	}
+	if cfg.OfflineCacheSeconds < 0 {
+		c.Errorf(join(field, "offline_cache_seconds"), "must not be negative: %d", cfg.OfflineCacheSeconds)
+	}
+}
+
+var prefixReg = regexp.MustCompile(`^(/[^/{}\s]+)+/?$`)
+
+// UrlPrefix checks a URL path prefix to route requests, such as "/auth/ldap".
+func (c *Checker) UrlPrefix(field string, prefix string) {
+	if prefix != "" && !prefixReg.MatchString(prefix) {
+		c.Errorf(field, "bad URL prefix: %q", prefix)
+	}
+}
+
+func (c *Checker) Response(field string, st *htstat.HttpStatusTbl) {
+	for _, m := range []struct {
+		name string
+		msg  *htstat.HttpStatusMsg
+	}{
+		{"ok", &st.Ok},
+		{"unauth", &st.Unauth},
+		{"forbidden", &st.Forbidden},
+		{"nopath", &st.Nopath},
+		{"nouser", &st.Nouser},
+	} {
+		if !m.msg.IsValid() {
+			c.Errorf(join(field, m.name+".code"), "bad HTTP status code: %d", m.msg.Code)
+		}
+	}
+}
+
+func (c *Checker) Admin(field string, cfg *admin.Config) {
+	if !cfg.IsValid() {
+		c.Errorf(join(field, "socket_type"), "bad socket type: %q", cfg.SocketType)
+	}
+	if cfg.IsEnabled() {
+		c.SocketOwnership(field, cfg.Ownership())
+	}
+}
+
+func (c *Checker) Logging(field string, cfg *logger.Config) {
+	if !logger.IsValidLoggingLevel(cfg.LoggingLevel) {
+		c.Errorf(join(field, "logging_level"), "bad logging level: %q", cfg.LoggingLevel)
+	}
+	if _, err := cfg.FileMode(); err != nil {
+		c.Errorf(join(field, "logfile_mode"), "%s: %q", err, cfg.LogfileMode)
+	}
+	if !logger.IsValidFormat(cfg.Format) {
+		c.Errorf(join(field, "format"), "bad log format: %q", cfg.Format)
+	}
+	if !logger.IsValidFacility(cfg.SyslogFacility) {
+		c.Errorf(join(field, "syslog_facility"), "bad syslog facility: %q", cfg.SyslogFacility)
+	}
+}
+
+func (c *Checker) Audit(field string, cfg *audit.Config) {
+	if _, err := cfg.FileMode(); err != nil {
+		c.Errorf(join(field, "logfile_mode"), "%s: %q", err, cfg.LogfileMode)
+	}
+	if cfg.HashUser && cfg.HashKey == "" {
+		c.Errorf(join(field, "hash_key"), "is required with hash_user")
+	}
+}
+
+// LdapDial connects to the LDAP server with cfg and reads the root DSE.
+func (c *Checker) LdapDial(field string, cfg *ldap_auth.Config) {
+	if _, err := ldap_auth.Probe(cfg); err != nil {
+		c.Error(join(field, "host_url"), err)
+	}
+}
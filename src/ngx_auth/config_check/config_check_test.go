@@ -0,0 +1,52 @@
+package config_check
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ngx_auth/profile"
+	"ngx_auth/session"
+	"ngx_auth/totp"
+)
+
+func TestMfaSessions(t *testing.T) {
+	secret_file := filepath.Join(t.TempDir(), "totp")
+	if err := os.WriteFile(secret_file, []byte("user1 JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := session.Config{Secret: "0123456789abcdef0123456789abcdef"}
+	cfg.SetDefault()
+	sessions, err := session.NewManager(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enabled := totp.Config{SecretFile: secret_file}
+	mfa := profile.PathRights{PathMfa: map[string]bool{"admin": true}}
+	no_mfa := profile.PathRights{PathMfa: map[string]bool{"admin": false}}
+
+	tests := []struct {
+		name     string
+		rights   profile.PathRights
+		totp     totp.Config
+		sessions *session.Manager
+		problems int
+	}{
+		{"totp and sessions", mfa, enabled, sessions, 0},
+		{"no sessions", mfa, enabled, nil, 1},
+		{"no totp", mfa, totp.Config{}, sessions, 1},
+		{"no totp nor sessions", mfa, totp.Config{}, nil, 2},
+		{"no mfa path", no_mfa, totp.Config{}, nil, 0},
+		{"totp without mfa path", no_mfa, enabled, nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New("test.conf")
+			c.Totp("totp", &tt.totp, nil, tt.sessions)
+			c.Mfa("authz", &tt.rights, &tt.totp, tt.sessions)
+			if len(c.Problems) != tt.problems {
+				t.Errorf("Totp() and Mfa() problems = %v, want %d", c.Problems, tt.problems)
+			}
+		})
+	}
+}
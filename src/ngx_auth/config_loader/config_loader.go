@@ -11,6 +11,9 @@ import (
 	"github.com/naoina/toml"
 )
 
+// LoadConfig parses a TOML, YAML or JSON configuration file by its extension,
+// and resolves environment variables and file references in the secret
+// values. See Expand and ResolveValue.
 func LoadConfig(file io.Reader, filename string, cfg interface{}) error {
 	ext := strings.ToLower(filepath.Ext(filename))
 
@@ -34,5 +37,9 @@ func LoadConfig(file io.Reader, filename string, cfg interface{}) error {
 		}
 	}
 
+	if err := Expand(cfg); err != nil {
+		return fmt.Errorf("config value error: %w", err)
+	}
+
 	return nil
 }
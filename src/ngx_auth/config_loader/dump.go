@@ -0,0 +1,72 @@
+package config_loader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+const RedactedValue = "********"
+
+// Dump writes the effective configuration as indented JSON.
+// Values of fields tagged `secret:"true"` are redacted.
+// For a secret map, the keys are kept and the values are redacted.
+func Dump(w io.Writer, cfg interface{}) error {
+	bin, err := json.MarshalIndent(redact(reflect.ValueOf(cfg), false), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(bin))
+	return err
+}
+
+func redact(v reflect.Value, secret bool) interface{} {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return redact(v.Elem(), secret)
+	case reflect.Struct:
+		t := v.Type()
+		m := map[string]interface{}{}
+		for i := 0; i < v.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			m[field_name(f)] = redact(v.Field(i), secret || f.Tag.Get("secret") == "true")
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		sl := make([]interface{}, v.Len())
+		for i := range sl {
+			sl[i] = redact(v.Index(i), secret)
+		}
+		return sl
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		m := map[string]interface{}{}
+		iter := v.MapRange()
+		for iter.Next() {
+			m[fmt.Sprint(iter.Key())] = redact(iter.Value(), secret)
+		}
+		return m
+	}
+
+	if secret {
+		if v.IsZero() {
+			return v.Interface()
+		}
+		return RedactedValue
+	}
+	return v.Interface()
+}
@@ -0,0 +1,193 @@
+package config_loader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const FilePrefix = "file:"
+
+var (
+	ErrUnsetVariable  = errors.New("environment variable is not set")
+	ErrBadVariable    = errors.New("bad variable reference")
+	ErrEmptyReference = errors.New("empty file reference")
+)
+
+// ExpandString expands "${NAME}" and "${NAME:-default}" with environment variables.
+// "$$" is a literal "$". A "$" not followed by "{" or "$" is kept as is,
+// so regular expressions such as "^/([^/]+)/$" need no escaping.
+func ExpandString(str string) (string, error) {
+	if !strings.Contains(str, "$") {
+		return str, nil
+	}
+
+	var b strings.Builder
+	for {
+		f := strings.IndexByte(str, '$')
+		if f < 0 || f+1 >= len(str) {
+			b.WriteString(str)
+			break
+		}
+		b.WriteString(str[:f])
+		str = str[f:]
+
+		switch str[1] {
+		case '$':
+			b.WriteByte('$')
+			str = str[2:]
+			continue
+		case '{':
+		default:
+			b.WriteByte('$')
+			str = str[1:]
+			continue
+		}
+
+		e := strings.IndexByte(str, '}')
+		if e < 0 {
+			return "", fmt.Errorf("%w: %s", ErrBadVariable, str)
+		}
+		val, err := lookup_var(str[2:e])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(val)
+		str = str[e+1:]
+	}
+
+	return b.String(), nil
+}
+
+func lookup_var(ref string) (string, error) {
+	name, def, has_def := strings.Cut(ref, ":-")
+	if name == "" {
+		return "", fmt.Errorf("%w: ${%s}", ErrBadVariable, ref)
+	}
+
+	val, ok := os.LookupEnv(name)
+	if has_def && val == "" {
+		return def, nil
+	}
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnsetVariable, name)
+	}
+
+	return val, nil
+}
+
+// ResolveValue expands variables, and reads the file if the value is
+// a "file:<path>" reference. A trailing newline of the file is removed.
+func ResolveValue(str string) (string, error) {
+	str, err := ExpandString(str)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasPrefix(str, FilePrefix) {
+		return str, nil
+	}
+
+	fn := strings.TrimPrefix(str, FilePrefix)
+	if fn == "" {
+		return "", ErrEmptyReference
+	}
+	bin, err := os.ReadFile(fn)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(bin), "\r\n"), nil
+}
+
+// Expand resolves the string values of the fields of cfg tagged
+// `expand:"true"` with ResolveValue, including the strings in their
+// pointers, slices and map values. The other values are kept literally,
+// so a password or a regular expression never changes its meaning.
+func Expand(cfg interface{}) error {
+	return expand_value(reflect.ValueOf(cfg), "", false)
+}
+
+func join_field(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func expand_value(v reflect.Value, path string, tagged bool) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return expand_value(v.Elem(), path, tagged)
+	case reflect.String:
+		if !tagged || !v.CanSet() {
+			return nil
+		}
+		s, err := ResolveValue(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		v.SetString(s)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			err := expand_value(v.Field(i), join_field(path, field_name(t.Field(i))),
+				tagged || t.Field(i).Tag.Get("expand") == "true")
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := expand_value(v.Index(i), fmt.Sprintf("%s[%d]", path, i), tagged); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			ev := reflect.New(v.Type().Elem()).Elem()
+			ev.Set(iter.Value())
+			err := expand_value(ev, join_field(path, fmt.Sprint(iter.Key())), tagged)
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(iter.Key(), ev)
+		}
+	}
+
+	return nil
+}
+
+// field_name returns the configuration key of a struct field.
+func field_name(f reflect.StructField) string {
+	for _, tag := range []string{"json", "yaml", "toml"} {
+		name, _, _ := strings.Cut(f.Tag.Get(tag), ",")
+		if name != "" && name != "-" {
+			return name
+		}
+	}
+	return to_snake(f.Name)
+}
+
+func to_snake(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
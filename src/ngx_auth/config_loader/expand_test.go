@@ -0,0 +1,101 @@
+package config_loader
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveValue(t *testing.T) {
+	dir := t.TempDir()
+	secret_file := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret_file, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_SECRET", "env-secret")
+	t.Setenv("TEST_DIR", dir)
+	t.Setenv("TEST_EMPTY", "")
+
+	tests := []struct {
+		name string
+		val  string
+		want string
+		err  error
+	}{
+		{"literal", "pass1", "pass1", nil},
+		{"env", "${TEST_SECRET}", "env-secret", nil},
+		{"env in text", "a-${TEST_SECRET}-b", "a-env-secret-b", nil},
+		{"default", "${TEST_EMPTY:-def}", "def", nil},
+		{"unset", "${TEST_UNSET}", "", ErrUnsetVariable},
+		{"unset with default", "${TEST_UNSET:-def}", "def", nil},
+		{"no name", "${}", "", ErrBadVariable},
+		{"unterminated", "${TEST_SECRET", "", ErrBadVariable},
+		{"escaped dollar", "$${TEST_SECRET}", "${TEST_SECRET}", nil},
+		{"escaped dollars", "a$$$$b", "a$$b", nil},
+		{"lone dollar", "^/([^/]+)/$", "^/([^/]+)/$", nil},
+		{"file", "file:" + secret_file, "s3cret", nil},
+		{"file in env dir", "file:${TEST_DIR}/secret", "s3cret", nil},
+		{"missing file", "file:" + filepath.Join(dir, "none"), "", fs.ErrNotExist},
+		{"empty file reference", "file:", "", ErrEmptyReference},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveValue(tt.val)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ResolveValue() error = %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("ResolveValue() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpand(t *testing.T) {
+	t.Setenv("TEST_SECRET", "env-secret")
+
+	type inner struct {
+		Secret string `json:"secret" expand:"true"`
+		Regexp string `json:"regexp"`
+	}
+	type config struct {
+		Password map[string]string `json:"password" expand:"true"`
+		Users    map[string]string `json:"users"`
+		Inner    *inner            `json:"inner"`
+		Secrets  []string          `json:"secrets" expand:"true"`
+	}
+
+	cfg := config{
+		Password: map[string]string{"user1": "${TEST_SECRET}", "user2": "pa$$s"},
+		Users:    map[string]string{"user1": "${TEST_SECRET}"},
+		Inner:    &inner{Secret: "${TEST_SECRET}", Regexp: "${1}"},
+		Secrets:  []string{"${TEST_SECRET}"},
+	}
+	if err := Expand(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"map value", cfg.Password["user1"], "env-secret"},
+		{"escaped map value", cfg.Password["user2"], "pa$s"},
+		{"untagged map value", cfg.Users["user1"], "${TEST_SECRET}"},
+		{"pointer field", cfg.Inner.Secret, "env-secret"},
+		{"untagged field", cfg.Inner.Regexp, "${1}"},
+		{"slice", cfg.Secrets[0], "env-secret"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("Expand() %s = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+
+	bad := config{Password: map[string]string{"user1": "file:"}}
+	if err := Expand(&bad); !errors.Is(err, ErrEmptyReference) || err.Error() != "password.user1: "+ErrEmptyReference.Error() {
+		t.Errorf("Expand() error = %v, want %v at password.user1", err, ErrEmptyReference)
+	}
+}
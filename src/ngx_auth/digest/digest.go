@@ -0,0 +1,350 @@
+// Package digest has HTTP Digest access authentication of RFC 7616, with
+// qop=auth, for the modules holding the passwords of the users.
+package digest
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ngx_auth/metrics"
+)
+
+// Algorithms of the digest.
+const (
+	AlgSha256 = "SHA-256"
+	AlgMd5    = "MD5"
+)
+
+// Schemes of the 401 challenges.
+const (
+	SchemeDigest = "digest"
+	SchemeBasic  = "basic"
+)
+
+const DefaultNonceSeconds = 300
+
+// MinSecretLen is the minimum length of the nonce secret.
+const MinSecretLen = 32
+
+const QopAuth = "auth"
+
+var (
+	ErrMalformed    = errors.New("malformed digest credentials")
+	ErrAlgorithm    = errors.New("unsupported digest algorithm")
+	ErrMismatch     = errors.New("digest is for another realm or URI")
+	ErrUnknownUser  = errors.New("unknown user")
+	ErrBadResponse  = errors.New("bad digest response")
+	ErrStale        = errors.New("stale nonce")
+	ErrReplay       = errors.New("nonce count is already used")
+	ErrShortSecret  = errors.New("secret is shorter than 32 bytes")
+	ErrNoDigest     = errors.New("must have \"digest\"")
+	ErrBadScheme    = errors.New("bad scheme")
+	ErrBadAlgorithm = errors.New("bad algorithm")
+)
+
+// Config is the [digest] part. The challenges offer Schemes in order,
+// and Digest authentication is disabled without them.
+type Config struct {
+	Schemes      []string `toml:"schemes,omitempty" json:"schemes,omitempty" yaml:"schemes,omitempty"`
+	Algorithms   []string `toml:"algorithms,omitempty" json:"algorithms,omitempty" yaml:"algorithms,omitempty"`
+	NonceSeconds uint32   `toml:"nonce_seconds,omitempty" json:"nonce_seconds,omitempty" yaml:"nonce_seconds,omitempty"`
+	Secret       string   `toml:"secret,omitempty" json:"secret,omitempty" yaml:"secret,omitempty" secret:"true" expand:"true"`
+}
+
+func (cfg *Config) IsEnabled() bool {
+	return len(cfg.Schemes) > 0
+}
+
+func (cfg *Config) SetDefault() {
+	if !cfg.IsEnabled() {
+		return
+	}
+	if len(cfg.Algorithms) == 0 {
+		cfg.Algorithms = []string{AlgSha256, AlgMd5}
+	}
+	if cfg.NonceSeconds == 0 {
+		cfg.NonceSeconds = DefaultNonceSeconds
+	}
+}
+
+// Server issues the nonces of the challenges and verifies the digests.
+// A nonce is bound to the secret and its time, and each nonce count of a
+// nonce is accepted only once, in any order within NonceWindow.
+type Server struct {
+	Realm      string
+	Schemes    []string
+	Algorithms []string
+	NonceTtl   time.Duration
+
+	secret []byte
+
+	mu     sync.Mutex
+	counts map[string]*nonce_count
+	pruned int64
+}
+
+// NonceWindow is the number of the nonce counts below the largest one of a
+// nonce, which are still accepted once, for the requests sent in parallel.
+const NonceWindow = 64
+
+// nonce_count has the largest nonce count of a nonce, and the bit i of seen
+// for the count high-i.
+type nonce_count struct {
+	high    uint64
+	seen    uint64
+	expires int64
+}
+
+// New returns the server of realm. Without the secret, a random secret is
+// used, so the nonces are stale after a restart.
+func New(cfg *Config, realm string) (*Server, error) {
+	s := &Server{
+		Realm:      realm,
+		Schemes:    cfg.Schemes,
+		Algorithms: cfg.Algorithms,
+		NonceTtl:   time.Duration(cfg.NonceSeconds) * time.Second,
+		counts:     map[string]*nonce_count{},
+	}
+
+	has_digest := false
+	for _, sc := range cfg.Schemes {
+		switch sc {
+		case SchemeDigest:
+			has_digest = true
+		case SchemeBasic:
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrBadScheme, sc)
+		}
+	}
+	if !has_digest {
+		return nil, ErrNoDigest
+	}
+	for _, alg := range cfg.Algorithms {
+		if new_hash(alg) == nil {
+			return nil, fmt.Errorf("%w: %q", ErrBadAlgorithm, alg)
+		}
+	}
+
+	if cfg.Secret == "" {
+		s.secret = make([]byte, MinSecretLen)
+		if _, err := rand.Read(s.secret); err != nil {
+			return nil, err
+		}
+	} else {
+		if len(cfg.Secret) < MinSecretLen {
+			return nil, ErrShortSecret
+		}
+		s.secret = []byte(cfg.Secret)
+	}
+	return s, nil
+}
+
+// OffersBasic reports whether Basic authentication is accepted. A nil
+// Server accepts only Basic authentication.
+func (s *Server) OffersBasic() bool {
+	if s == nil {
+		return true
+	}
+	for _, sc := range s.Schemes {
+		if sc == SchemeBasic {
+			return true
+		}
+	}
+	return false
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// Challenge adds the WWW-Authenticate headers of the schemes, with a
+// Digest challenge for each algorithm. With stale, the client may retry
+// with the new nonce without asking the user again.
+func (s *Server) Challenge(hd http.Header, stale bool) {
+	realm := quote(s.Realm)
+	nonce := s.nonce(time.Now())
+	for _, sc := range s.Schemes {
+		if sc == SchemeBasic {
+			hd.Add("WWW-Authenticate", "Basic realm="+realm)
+			continue
+		}
+		for _, alg := range s.Algorithms {
+			ch := "Digest realm=" + realm + `, qop="auth", algorithm=` + alg +
+				", nonce=" + quote(nonce)
+			if stale {
+				ch += ", stale=true"
+			}
+			hd.Add("WWW-Authenticate", ch)
+		}
+	}
+}
+
+// IsDigest reports whether the Authorization header has Digest credentials.
+func IsDigest(auth string) bool {
+	scheme, _, _ := strings.Cut(auth, " ")
+	return strings.EqualFold(scheme, "Digest")
+}
+
+func new_hash(alg string) hash.Hash {
+	switch alg {
+	case AlgSha256:
+		return sha256.New()
+	case AlgMd5:
+		return md5.New()
+	}
+	return nil
+}
+
+func hash_hex(alg string, parts ...string) string {
+	h := new_hash(alg)
+	h.Write([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Credentials is the parameters of the Digest credentials.
+type Credentials struct {
+	User      string
+	Realm     string
+	Nonce     string
+	Uri       string
+	Algorithm string
+	Qop       string
+	Nc        string
+	Cnonce    string
+	Response  string
+}
+
+// Digest returns the response of the request of method and uri with pass.
+func (c *Credentials) Digest(method string, pass string) string {
+	ha1 := hash_hex(c.Algorithm, c.User, c.Realm, pass)
+	ha2 := hash_hex(c.Algorithm, method, c.Uri)
+	return hash_hex(c.Algorithm, ha1, c.Nonce, c.Nc, c.Cnonce, c.Qop, ha2)
+}
+
+func count(result string) {
+	metrics.Digests.Inc(result)
+}
+
+func result_of(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrAlgorithm):
+		return "bad_algorithm"
+	case errors.Is(err, ErrMismatch):
+		return "mismatch"
+	case errors.Is(err, ErrUnknownUser):
+		return "unknown_user"
+	case errors.Is(err, ErrBadResponse):
+		return "bad_response"
+	case errors.Is(err, ErrStale):
+		return "stale"
+	case errors.Is(err, ErrReplay):
+		return "replay"
+	}
+	return "malformed"
+}
+
+// Verify checks the Digest credentials of the Authorization header auth
+// for the request of method and uri, with the password of password. An
+// empty uri is not compared. It returns the user, if the credentials
+// are parsed, with an error if they are not accepted.
+func (s *Server) Verify(auth string, method string, uri string,
+	password func(user string) (string, bool)) (string, error) {
+	c, err := Parse(auth)
+	if err != nil {
+		count(result_of(err))
+		return "", err
+	}
+	err = s.verify(c, method, uri, password)
+	count(result_of(err))
+	return c.User, err
+}
+
+func (s *Server) verify(c *Credentials, method string, uri string,
+	password func(user string) (string, bool)) error {
+	if !s.has_algorithm(c.Algorithm) {
+		return fmt.Errorf("%w: %q", ErrAlgorithm, c.Algorithm)
+	}
+	if c.Realm != s.Realm || (uri != "" && c.Uri != uri) {
+		return ErrMismatch
+	}
+	pass, ok := password(c.User)
+	if !ok {
+		return ErrUnknownUser
+	}
+	want := c.Digest(method, pass)
+	if subtle.ConstantTimeCompare([]byte(want), []byte(strings.ToLower(c.Response))) != 1 {
+		return ErrBadResponse
+	}
+
+	// The digest is checked first, so that only a client knowing the
+	// password is told that the nonce is stale.
+	now := time.Now()
+	issued, ok := s.check_nonce(c.Nonce)
+	if !ok || now.Sub(issued) > s.NonceTtl || issued.After(now) {
+		return ErrStale
+	}
+	nc, err := strconv.ParseUint(c.Nc, 16, 32)
+	if err != nil || nc == 0 {
+		return fmt.Errorf("%w: bad nc", ErrMalformed)
+	}
+	return s.check_count(c.Nonce, nc, issued.Add(s.NonceTtl), now)
+}
+
+func (s *Server) has_algorithm(alg string) bool {
+	for _, a := range s.Algorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// check_count accepts a nonce count not seen for the nonce. The counts are
+// forgotten when their nonces become stale.
+func (s *Server) check_count(nonce string, nc uint64, expires time.Time, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pruned != now.Unix() {
+		for k, cnt := range s.counts {
+			if cnt.expires < now.Unix() {
+				delete(s.counts, k)
+			}
+		}
+		s.pruned = now.Unix()
+	}
+
+	cnt, has := s.counts[nonce]
+	if !has {
+		cnt = &nonce_count{expires: expires.Unix()}
+		s.counts[nonce] = cnt
+	}
+	switch {
+	case nc > cnt.high:
+		if d := nc - cnt.high; d < NonceWindow {
+			cnt.seen = cnt.seen<<d | 1
+		} else {
+			cnt.seen = 1
+		}
+		cnt.high = nc
+	case cnt.high-nc >= NonceWindow:
+		return ErrReplay
+	case cnt.seen&(1<<(cnt.high-nc)) != 0:
+		return ErrReplay
+	default:
+		cnt.seen |= 1 << (cnt.high - nc)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package digest
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// The example of RFC 7616 Section 3.9.1.
+var rfc7616 = Credentials{
+	User:   "Mufasa",
+	Realm:  "http-auth@example.org",
+	Nonce:  "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+	Uri:    "/dir/index.html",
+	Qop:    QopAuth,
+	Nc:     "00000001",
+	Cnonce: "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+}
+
+const rfc7616_pass = "Circle of Life"
+
+func TestDigestRfc7616(t *testing.T) {
+	tests := []struct {
+		alg  string
+		want string
+	}{
+		{AlgMd5, "8ca523f5e9506fed4657c9700eebdbec"},
+		{AlgSha256, "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.alg, func(t *testing.T) {
+			c := rfc7616
+			c.Algorithm = tt.alg
+			if got := c.Digest("GET", rfc7616_pass); got != tt.want {
+				t.Errorf("Digest() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	// The credentials of RFC 7616 Section 3.9.1, with SHA-256.
+	rfc_auth := `Digest username="Mufasa", realm="http-auth@example.org",` +
+		` uri="/dir/index.html", algorithm=SHA-256,` +
+		` nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", nc=00000001,` +
+		` cnonce="f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", qop=auth,` +
+		` response="753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",` +
+		` opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS", userhash=false`
+	c, err := Parse(rfc_auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.User != "Mufasa" || c.Algorithm != AlgSha256 || c.Nonce != rfc7616.Nonce ||
+		c.Cnonce != rfc7616.Cnonce || c.Uri != rfc7616.Uri {
+		t.Errorf("Parse() = %+v", c)
+	}
+	if got := c.Digest("GET", rfc7616_pass); got != c.Response {
+		t.Errorf("Digest() = %s, want %s", got, c.Response)
+	}
+
+	c, err = Parse(`Digest username="a\"b", nonce=n, uri=/, nc=00000001, cnonce=c, qop=auth, response=r`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.User != `a"b` || c.Algorithm != AlgMd5 {
+		t.Errorf("Parse() user = %q, algorithm = %q, want %q, %q", c.User, c.Algorithm, `a"b`, AlgMd5)
+	}
+
+	const rest = ` nonce=n, uri=/, cnonce=c, response=r`
+	errs := []struct {
+		name string
+		auth string
+	}{
+		{"basic", "Basic dXNlcjpwYXNz"},
+		{"no username", "Digest nc=00000001, qop=auth," + rest},
+		{"no response", `Digest username=u, nonce=n, uri=/, nc=00000001, cnonce=c, qop=auth`},
+		{"no qop", "Digest username=u, nc=00000001," + rest},
+		{"qop auth-int", "Digest username=u, nc=00000001, qop=auth-int," + rest},
+		{"userhash", "Digest username=u, nc=00000001, qop=auth, userhash=true," + rest},
+		{"short nc", "Digest username=u, nc=1, qop=auth," + rest},
+		{"duplicate", "Digest username=u, username=v, nc=00000001, qop=auth," + rest},
+		{"unterminated", `Digest username="u, nc=00000001, qop=auth,` + rest},
+		{"no comma", "Digest username=u nc=00000001, qop=auth," + rest},
+	}
+	for _, tt := range errs {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.auth); !errors.Is(err, ErrMalformed) {
+				t.Errorf("Parse() error = %v, want %v", err, ErrMalformed)
+			}
+		})
+	}
+}
+
+const test_secret = "0123456789abcdef0123456789abcdef"
+
+// authorization returns the Authorization header of c, with the response
+// of GET with pass.
+func authorization(c Credentials, pass string) string {
+	if c.Response == "" {
+		c.Response = c.Digest("GET", pass)
+	}
+	return "Digest username=" + quote(c.User) + ", realm=" + quote(c.Realm) +
+		", uri=" + quote(c.Uri) + ", algorithm=" + c.Algorithm +
+		", nonce=" + quote(c.Nonce) + ", nc=" + c.Nc + ", cnonce=" + quote(c.Cnonce) +
+		", qop=" + c.Qop + ", response=" + quote(c.Response)
+}
+
+func TestVerify(t *testing.T) {
+	cfg := Config{Schemes: []string{SchemeDigest}, Secret: test_secret}
+	cfg.SetDefault()
+	other_cfg := cfg
+	other_cfg.Secret = test_secret + "x"
+	s, err := New(&cfg, rfc7616.Realm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := New(&other_cfg, rfc7616.Realm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Algorithms = []string{AlgSha256}
+	password := func(user string) (string, bool) {
+		return rfc7616_pass, user == rfc7616.User
+	}
+
+	now := time.Now()
+	creds := func(f func(c *Credentials)) Credentials {
+		c := rfc7616
+		c.Algorithm = AlgSha256
+		c.Nonce = s.nonce(now)
+		if f != nil {
+			f(&c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name string
+		c    Credentials
+		pass string
+		uri  string
+		err  error
+	}{
+		{"ok", creds(nil), rfc7616_pass, rfc7616.Uri, nil},
+		{"any uri", creds(nil), rfc7616_pass, "", nil},
+		{"wrong password", creds(nil), "circle of life", rfc7616.Uri, ErrBadResponse},
+		{"upper case response", creds(func(c *Credentials) {
+			c.Response = "0123456789ABCDEF"
+		}), rfc7616_pass, rfc7616.Uri, ErrBadResponse},
+		{"unknown user", creds(func(c *Credentials) { c.User = "Simba" }), rfc7616_pass, rfc7616.Uri, ErrUnknownUser},
+		{"other realm", creds(func(c *Credentials) { c.Realm = "example.org" }), rfc7616_pass, rfc7616.Uri, ErrMismatch},
+		{"other uri", creds(nil), rfc7616_pass, "/dir/other.html", ErrMismatch},
+		{"disallowed algorithm", creds(func(c *Credentials) { c.Algorithm = AlgMd5 }), rfc7616_pass, rfc7616.Uri, ErrAlgorithm},
+		{"unknown algorithm", creds(func(c *Credentials) {
+			c.Algorithm, c.Response = "SHA-512-256", "0123456789abcdef"
+		}), rfc7616_pass, rfc7616.Uri, ErrAlgorithm},
+		{"nonce of rfc", creds(func(c *Credentials) { c.Nonce = rfc7616.Nonce }), rfc7616_pass, rfc7616.Uri, ErrStale},
+		{"old nonce", creds(func(c *Credentials) {
+			c.Nonce = s.nonce(now.Add(-s.NonceTtl - time.Second))
+		}), rfc7616_pass, rfc7616.Uri, ErrStale},
+		{"future nonce", creds(func(c *Credentials) {
+			c.Nonce = s.nonce(now.Add(time.Minute))
+		}), rfc7616_pass, rfc7616.Uri, ErrStale},
+		{"nonce of other secret", creds(func(c *Credentials) {
+			c.Nonce = other.nonce(now)
+		}), rfc7616_pass, rfc7616.Uri, ErrStale},
+		{"zero nc", creds(func(c *Credentials) { c.Nc = "00000000" }), rfc7616_pass, rfc7616.Uri, ErrMalformed},
+		{"malformed", creds(func(c *Credentials) { c.Qop = "auth-int" }), rfc7616_pass, rfc7616.Uri, ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := s.Verify(authorization(tt.c, tt.pass), "GET", tt.uri, password)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.err)
+			}
+			if !errors.Is(err, ErrMalformed) && user != tt.c.User {
+				t.Errorf("Verify() user = %q, want %q", user, tt.c.User)
+			}
+		})
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	cfg := Config{Schemes: []string{SchemeDigest}, Secret: test_secret}
+	cfg.SetDefault()
+	s, err := New(&cfg, rfc7616.Realm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	password := func(user string) (string, bool) {
+		return rfc7616_pass, true
+	}
+	nonce := s.nonce(time.Now())
+	other := s.nonce(time.Now())
+
+	steps := []struct {
+		name  string
+		nonce string
+		nc    string
+		err   error
+	}{
+		{"first use", nonce, "00000001", nil},
+		{"same nc", nonce, "00000001", ErrReplay},
+		{"next nc", nonce, "00000002", nil},
+		{"skipped nc", nonce, "0000000a", nil},
+		{"out of order nc", nonce, "00000009", nil},
+		{"out of order nc again", nonce, "00000009", ErrReplay},
+		{"skipped nc before", nonce, "00000003", nil},
+		{"largest nc again", nonce, "0000000a", ErrReplay},
+		{"nc far ahead", nonce, "00000100", nil},
+		{"nc out of window", nonce, "00000009", ErrReplay},
+		{"nc at window edge", nonce, "000000c1", nil},
+		{"other nonce", other, "00000001", nil},
+	}
+	for _, st := range steps {
+		c := rfc7616
+		c.Algorithm = AlgSha256
+		c.Nonce, c.Nc = st.nonce, st.nc
+		if _, err := s.Verify(authorization(c, rfc7616_pass), "GET", c.Uri, password); !errors.Is(err, st.err) {
+			t.Errorf("%s: Verify() error = %v, want %v", st.name, err, st.err)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		err  error
+	}{
+		{"digest", Config{Schemes: []string{SchemeDigest, SchemeBasic}}, nil},
+		{"no digest", Config{Schemes: []string{SchemeBasic}}, ErrNoDigest},
+		{"bad scheme", Config{Schemes: []string{SchemeDigest, "bearer"}}, ErrBadScheme},
+		{"bad algorithm", Config{Schemes: []string{SchemeDigest}, Algorithms: []string{"SHA-1"}}, ErrBadAlgorithm},
+		{"short secret", Config{Schemes: []string{SchemeDigest}, Secret: "secret"}, ErrShortSecret},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.SetDefault()
+			if _, err := New(&cfg, "realm"); !errors.Is(err, tt.err) {
+				t.Errorf("New() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package digest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	nonceRandLen = 8
+	nonceMacLen  = 16
+	nonceLen     = 8 + nonceRandLen + nonceMacLen
+)
+
+func (s *Server) mac(bin []byte) []byte {
+	hm := hmac.New(sha256.New, s.secret)
+	hm.Write(bin)
+	return hm.Sum(nil)[:nonceMacLen]
+}
+
+// nonce returns a nonce of the time now and random bytes, signed with
+// the secret.
+func (s *Server) nonce(now time.Time) string {
+	bin := make([]byte, 8+nonceRandLen, nonceLen)
+	binary.BigEndian.PutUint64(bin, uint64(now.Unix()))
+	rand.Read(bin[8:])
+	return base64.RawURLEncoding.EncodeToString(append(bin, s.mac(bin)...))
+}
+
+// check_nonce returns the time of a nonce issued by the server.
+func (s *Server) check_nonce(nonce string) (time.Time, bool) {
+	bin, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(bin) != nonceLen {
+		return time.Time{}, false
+	}
+	data := bin[:8+nonceRandLen]
+	if !hmac.Equal(s.mac(data), bin[len(data):]) {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(data)), 0), true
+}
+
+// parse_params parses the comma separated parameters of a challenge or
+// credentials, whose values are tokens or quoted strings.
+func parse_params(s string) (map[string]string, error) {
+	params := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params, nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("%w: no value", ErrMalformed)
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("%w: unterminated quoted string", ErrMalformed)
+			}
+			val = b.String()
+			s = s[i+1:]
+		} else {
+			end := strings.IndexAny(s, ", \t")
+			if end < 0 {
+				end = len(s)
+			}
+			val = s[:end]
+			s = s[end:]
+		}
+		if _, dup := params[key]; dup {
+			return nil, fmt.Errorf("%w: duplicate %s", ErrMalformed, key)
+		}
+		params[key] = val
+
+		s = strings.TrimLeft(s, " \t")
+		if s != "" && s[0] != ',' {
+			return nil, fmt.Errorf("%w: no comma after %s", ErrMalformed, key)
+		}
+	}
+}
+
+// Parse parses the Digest credentials of an Authorization header.
+// The algorithm is MD5 if it is not sent.
+func Parse(auth string) (*Credentials, error) {
+	scheme, rest, _ := strings.Cut(auth, " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, fmt.Errorf("%w: not Digest", ErrMalformed)
+	}
+	params, err := parse_params(rest)
+	if err != nil {
+		return nil, err
+	}
+	c := &Credentials{
+		User:      params["username"],
+		Realm:     params["realm"],
+		Nonce:     params["nonce"],
+		Uri:       params["uri"],
+		Algorithm: params["algorithm"],
+		Qop:       params["qop"],
+		Nc:        params["nc"],
+		Cnonce:    params["cnonce"],
+		Response:  params["response"],
+	}
+	if c.Algorithm == "" {
+		c.Algorithm = AlgMd5
+	}
+	for _, req := range []struct{ name, val string }{
+		{"username", c.User}, {"nonce", c.Nonce}, {"uri", c.Uri},
+		{"nc", c.Nc}, {"cnonce", c.Cnonce}, {"response", c.Response},
+	} {
+		if req.val == "" {
+			return nil, fmt.Errorf("%w: no %s", ErrMalformed, req.name)
+		}
+	}
+	if c.Qop != QopAuth {
+		return nil, fmt.Errorf("%w: qop must be %q", ErrMalformed, QopAuth)
+	}
+	if strings.EqualFold(params["userhash"], "true") {
+		return nil, fmt.Errorf("%w: userhash is not supported", ErrMalformed)
+	}
+	if len(c.Nc) != 8 {
+		return nil, fmt.Errorf("%w: bad nc", ErrMalformed)
+	}
+	return c, nil
+}
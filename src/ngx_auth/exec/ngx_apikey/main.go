@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"ngx_auth/apikey"
+)
+
+func die(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+	os.Exit(1)
+}
+
+func warn(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+}
+
+const (
+	CmdMint   = "mint"
+	CmdRevoke = "revoke"
+	CmdList   = "list"
+)
+
+var Command string
+var KeyFile string
+var Owner string
+var KeyId string
+var Groups []string
+var Paths []string
+var Expires time.Time
+
+func usage() {
+	prog := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s mint [options ...] <key_file> <owner>\n", prog)
+	fmt.Fprintf(os.Stderr, "       %s revoke <key_file> <key_id>\n", prog)
+	fmt.Fprintf(os.Stderr, "       %s list <key_file>\n", prog)
+}
+
+func split_list(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// parse_expires reads a number of days such as "90d", a duration such as
+// "12h", a date or an RFC 3339 time.
+func parse_expires(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return time.Time{}, fmt.Errorf("bad number of days: %q", s)
+		}
+		return time.Now().AddDate(0, 0, n), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("bad duration: %q", s)
+		}
+		return time.Now().Add(d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func init() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+	Command = os.Args[1]
+
+	fs := flag.NewFlagSet(Command, flag.ExitOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		usage()
+		fs.PrintDefaults()
+	}
+
+	var groups, paths, expires string
+	nargs := 1
+	switch Command {
+	case CmdMint:
+		fs.StringVar(&groups, "groups", "", "comma separated groups of the key")
+		fs.StringVar(&paths, "paths", "", "comma separated path IDs allowed for the key (default all)")
+		fs.StringVar(&expires, "expires", "", "expiry: days such as 90d, a duration, a date or an RFC 3339 time (default never)")
+		nargs = 2
+	case CmdRevoke:
+		nargs = 2
+	case CmdList:
+	default:
+		usage()
+		os.Exit(1)
+	}
+	fs.Parse(os.Args[2:])
+	if fs.NArg() != nargs {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	KeyFile = fs.Arg(0)
+	switch Command {
+	case CmdMint:
+		Owner = fs.Arg(1)
+	case CmdRevoke:
+		KeyId = fs.Arg(1)
+	}
+
+	Groups = split_list(groups)
+	Paths = split_list(paths)
+	var err error
+	if Expires, err = parse_expires(expires); err != nil {
+		die("Bad expiry: %s", err)
+	}
+}
+
+func list() {
+	keys, err := apikey.ReadKeys(KeyFile)
+	if err != nil {
+		die("Key file read error: %s", err)
+	}
+	now := time.Now()
+	for _, k := range keys {
+		expires := "-"
+		if !k.Expires.IsZero() {
+			expires = k.Expires.UTC().Format(time.RFC3339)
+			if k.IsExpired(now) {
+				expires += " (expired)"
+			}
+		}
+		fmt.Printf("%s owner=%s groups=%s paths=%s expires=%s\n", k.Id, k.Owner,
+			strings.Join(k.Groups, ","), strings.Join(k.Paths, ","), expires)
+	}
+}
+
+func main() {
+	switch Command {
+	case CmdMint:
+		token, k, err := apikey.Mint(Owner, Groups, Expires, Paths)
+		if err != nil {
+			die("Key mint error: %s", err)
+		}
+		if err := apikey.AddKey(KeyFile, k); err != nil {
+			die("Key file write error: %s", err)
+		}
+		warn("Key ID %s for %s is added. The key is not stored, so keep it now.", k.Id, k.Owner)
+		fmt.Println(token)
+	case CmdRevoke:
+		if err := apikey.RevokeKey(KeyFile, KeyId); err != nil {
+			die("Key revoke error: %s", err)
+		}
+		warn("Key ID %s is revoked.", KeyId)
+	case CmdList:
+		list()
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/l4go/task"
+
+	"ngx_auth/admin"
+	"ngx_auth/assertion"
+	"ngx_auth/audit"
+	"ngx_auth/authz"
+	"ngx_auth/client_cert"
+	"ngx_auth/health"
+	"ngx_auth/htstat"
+	"ngx_auth/profile"
+	"ngx_auth/server"
+
+	cfgcheck "ngx_auth/config_check"
+	cfgloader "ngx_auth/config_loader"
+	logger "ngx_auth/logger"
+	"ngx_auth/metrics"
+)
+
+func die(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+	os.Exit(1)
+}
+
+func warn(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+}
+
+type NgxClientCertAuthConfig struct {
+	SocketType      string `json:"socket_type" yaml:"socket_type"`
+	SocketPath      string `json:"socket_path" yaml:"socket_path"`
+	SocketMode      string `toml:",omitempty" json:"socket_mode,omitempty" yaml:"socket_mode,omitempty"`
+	SocketOwner     string `toml:",omitempty" json:"socket_owner,omitempty" yaml:"socket_owner,omitempty"`
+	SocketGroup     string `toml:",omitempty" json:"socket_group,omitempty" yaml:"socket_group,omitempty"`
+	RunUser         string `toml:",omitempty" json:"run_user,omitempty" yaml:"run_user,omitempty"`
+	RunGroup        string `toml:",omitempty" json:"run_group,omitempty" yaml:"run_group,omitempty"`
+	DrainSeconds    uint32 `toml:",omitempty" json:"drain_seconds,omitempty" yaml:"drain_seconds,omitempty"`
+	CacheSeconds    uint32 `toml:",omitempty" json:"cache_seconds,omitempty" yaml:"cache_seconds,omitempty"`
+	NegCacheSeconds uint32 `toml:",omitempty" json:"neg_cache_seconds,omitempty" yaml:"neg_cache_seconds,omitempty"`
+	UseEtag         bool   `toml:",omitempty" json:"use_etag,omitempty" yaml:"use_etag,omitempty"`
+	PathHeader      string `toml:",omitempty" json:"path_header,omitempty" yaml:"path_header,omitempty"`
+
+	Authz struct {
+		UserMapConfig string            `toml:",omitempty" json:"usermap_config,omitempty" yaml:"usermap_config,omitempty"`
+		UserMap       string            `json:"usermap" yaml:"usermap"`
+		PathPattern   string            `json:"path_pattern" yaml:"path_pattern"`
+		NomatchRight  string            `toml:",omitempty" json:"nomatch_right,omitempty" yaml:"nomatch_right,omitempty"`
+		DefaultRight  string            `toml:",omitempty" json:"default_right,omitempty" yaml:"default_right,omitempty"`
+		PathRight     map[string]string `toml:",omitempty" json:"path_right,omitempty" yaml:"path_right,omitempty"`
+	} `json:"authz" yaml:"authz"`
+
+	Response htstat.HttpStatusTbl `toml:",omitempty" json:"response,omitempty" yaml:"response,omitempty"`
+	Admin    admin.Config         `toml:",omitempty" json:"admin,omitempty" yaml:"admin,omitempty"`
+	Tls      server.TlsConfig     `toml:"tls,omitempty" json:"tls,omitempty" yaml:"tls,omitempty"`
+
+	Cert      client_cert.Config `toml:"cert,omitempty" json:"cert,omitempty" yaml:"cert,omitempty"`
+	Assertion assertion.Config   `toml:"assertion,omitempty" json:"assertion,omitempty" yaml:"assertion,omitempty"`
+
+	Logging logger.Config `toml:"logging,omitempty" json:"logging,omitempty" yaml:"logging,omitempty"`
+	Audit   audit.Config  `toml:"audit,omitempty" json:"audit,omitempty" yaml:"audit,omitempty"`
+}
+
+var SocketType string
+var SocketPath string
+var SocketOwnership server.SocketOwnership
+var RunUser string
+var RunGroup string
+var DrainTimeout time.Duration
+var TlsConfig *tls.Config
+var CacheSeconds uint32
+var NegCacheSeconds uint32
+var UseEtag bool
+
+var PathHeader = "X-Authz-Path"
+var PathPatternReg *regexp.Regexp
+
+var UserMap *authz.UserMap = nil
+var NomatchRight string
+var DefaultRight string
+var PathRight map[string]string
+
+var HttpResponse htstat.HttpStatusTbl
+var AdminConfig admin.Config
+var Assertion *assertion.Issuer
+var Cert *client_cert.Extractor
+
+var Handler http.Handler
+
+var CheckOnly bool
+var CheckDump bool
+
+func init() {
+	flag.CommandLine.SetOutput(os.Stderr)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [options ...] <config_file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.SetOutput(os.Stderr)
+
+	progName := filepath.Base(os.Args[0])
+	log.SetFlags(0)
+	logger.SetProgramName(progName)
+
+	flag.BoolVar(&CheckOnly, "t", false, "test the configuration file and exit")
+	flag.BoolVar(&CheckDump, "T", false, "test the configuration file, dump the effective configuration and exit")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	cfg_f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		die("Config file open error: %s", err)
+	}
+	defer cfg_f.Close()
+
+	cfg := &NgxClientCertAuthConfig{}
+	chk := cfgcheck.New(flag.Arg(0))
+	if err := cfgloader.LoadConfig(cfg_f, flag.Arg(0), cfg); err != nil {
+		chk.Errorf("", "Config file parse error: %s", err)
+		chk.Exit()
+	}
+
+	chk.Logging("logging", &cfg.Logging)
+	chk.Audit("audit", &cfg.Audit)
+
+	SocketType = cfg.SocketType
+	SocketPath = cfg.SocketPath
+	DrainTimeout = server.DrainTimeout(cfg.DrainSeconds)
+	chk.SocketType("socket_type", SocketType)
+	chk.Required("socket_path", SocketPath)
+
+	SocketOwnership = server.SocketOwnership{
+		Mode:  cfg.SocketMode,
+		Owner: cfg.SocketOwner,
+		Group: cfg.SocketGroup,
+	}
+	chk.SocketOwnership("", &SocketOwnership)
+
+	RunUser = cfg.RunUser
+	RunGroup = cfg.RunGroup
+	chk.RunUser("run_user", RunUser, "run_group", RunGroup)
+
+	TlsConfig = chk.Tls("tls", SocketType, &cfg.Tls)
+
+	CacheSeconds = cfg.CacheSeconds
+	NegCacheSeconds = cfg.NegCacheSeconds
+	UseEtag = cfg.UseEtag
+
+	if cfg.PathHeader != "" {
+		PathHeader = cfg.PathHeader
+	}
+
+	UserMap = chk.UserMap("authz.user_map_config", cfg.Authz.UserMapConfig,
+		"authz.user_map", cfg.Authz.UserMap)
+	PathPatternReg = chk.PathPattern("authz.path_pattern", cfg.Authz.PathPattern)
+
+	NomatchRight = cfg.Authz.NomatchRight
+	chk.AuthzRight("authz.nomatch_right", NomatchRight)
+
+	DefaultRight = cfg.Authz.DefaultRight
+	chk.AuthzRight("authz.default_right", DefaultRight)
+
+	PathRight = cfg.Authz.PathRight
+	chk.PathRight("authz.path_right", PathRight)
+
+	cfg.Response.SetDefault()
+	chk.Response("response", &cfg.Response)
+	HttpResponse = cfg.Response
+
+	cfg.Admin.SetDefault()
+	chk.Admin("admin", &cfg.Admin)
+	AdminConfig = cfg.Admin
+
+	cfg.Assertion.SetDefault()
+	Assertion = chk.Assertion("assertion", &cfg.Assertion, &cfg.Admin)
+	chk.AssertionCache("", Assertion, CacheSeconds, UseEtag)
+
+	cfg.Cert.SetDefault()
+	Cert = chk.ClientCert("cert", &cfg.Cert)
+
+	chk.Exit()
+	if CheckDump {
+		if err := cfgloader.Dump(os.Stdout, cfg); err != nil {
+			die("Config dump error: %s", err)
+		}
+	}
+	if CheckOnly || CheckDump {
+		fmt.Fprintf(os.Stderr, "%s: configuration file test is successful\n", flag.Arg(0))
+		os.Exit(0)
+	}
+	metrics.ConfigReloads.Inc("config", "ok")
+
+	if err := logger.Setup(&cfg.Logging); err != nil {
+		die("logfile setting error: %s", err)
+	}
+	if err := audit.Setup(progName, &cfg.Audit); err != nil {
+		die("audit log setting error: %s", err)
+	}
+
+	health.Register("usermap", UserMap.HealthCheck)
+
+	if Assertion != nil {
+		admin.Handle(Assertion.JwksPath, Assertion.JwksHandler())
+	}
+
+	Handler = profile.NewClientCert(profile.Common{
+		CacheSeconds:    CacheSeconds,
+		NegCacheSeconds: NegCacheSeconds,
+		UseEtag:         UseEtag,
+		Response:        HttpResponse,
+		Assertion:       Assertion,
+	}, PathHeader, Cert, profile.PathRights{
+		PathPatternReg: PathPatternReg,
+		UserMap:        UserMap,
+		NomatchRight:   NomatchRight,
+		DefaultRight:   DefaultRight,
+		PathRight:      PathRight,
+	})
+}
+
+func main() {
+	signal_chan := make(chan os.Signal, 1)
+	signal.Notify(signal_chan, syscall.SIGINT, syscall.SIGTERM)
+
+	srv := &http.Server{Addr: SocketPath}
+
+	cc := task.NewCancel()
+	defer cc.Cancel()
+	go func() {
+		select {
+		case <-cc.RecvCancel():
+		case <-signal_chan:
+			server.Stopping()
+			logger.Event(logger.LevelNotice, logger.EventServerStopping,
+				logger.SocketType(SocketType), logger.SocketPath(SocketPath))
+			cc.Cancel()
+		}
+	}()
+
+	logger.ReopenOnSignal(cc)
+
+	http.Handle("/", Handler)
+
+	if err := admin.Start(cc, &AdminConfig); err != nil {
+		die("admin socket listen error: %v.", err)
+	}
+
+	lstn, lerr := server.Listen(cc, server.NameAuth, SocketType, SocketPath)
+	switch lerr {
+	case nil:
+	case context.Canceled:
+	default:
+		die("socket listen error: %v.", lerr)
+	}
+	if SocketType == "unix" && !server.IsInherited(lstn) {
+		defer os.Remove(SocketPath)
+		if err := SocketOwnership.Apply(SocketPath); err != nil {
+			die("socket permission error: %v.", err)
+		}
+	}
+	if err := server.DropPrivileges(RunUser, RunGroup); err != nil {
+		die("privilege drop error: %v.", err)
+	}
+
+	if TlsConfig != nil {
+		lstn = tls.NewListener(lstn, TlsConfig)
+	}
+
+	logger.Event(logger.LevelNotice, logger.EventServerStarted,
+		logger.SocketType(SocketType), logger.SocketPath(SocketPath))
+	server.Ready(cc)
+
+	if serr := server.Serve(cc, srv, lstn, DrainTimeout); serr != nil {
+		die("HTTP server error: %v.", serr)
+	}
+}
@@ -2,11 +2,10 @@ package main
 
 import (
 	"context"
-	"errors"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -17,11 +16,20 @@ import (
 
 	"github.com/l4go/task"
 
+	"ngx_auth/admin"
+	"ngx_auth/assertion"
+	"ngx_auth/audit"
 	"ngx_auth/authz"
+	"ngx_auth/health"
 	"ngx_auth/htstat"
+	"ngx_auth/profile"
+	"ngx_auth/server"
+	"ngx_auth/signed_header"
 
+	cfgcheck "ngx_auth/config_check"
 	cfgloader "ngx_auth/config_loader"
 	logger "ngx_auth/logger"
+	"ngx_auth/metrics"
 )
 
 func die(format string, v ...interface{}) {
@@ -36,6 +44,12 @@ func warn(format string, v ...interface{}) {
 type NgxHeaderPathAuthConfig struct {
 	SocketType      string `json:"socket_type" yaml:"socket_type"`
 	SocketPath      string `json:"socket_path" yaml:"socket_path"`
+	SocketMode      string `toml:",omitempty" json:"socket_mode,omitempty" yaml:"socket_mode,omitempty"`
+	SocketOwner     string `toml:",omitempty" json:"socket_owner,omitempty" yaml:"socket_owner,omitempty"`
+	SocketGroup     string `toml:",omitempty" json:"socket_group,omitempty" yaml:"socket_group,omitempty"`
+	RunUser         string `toml:",omitempty" json:"run_user,omitempty" yaml:"run_user,omitempty"`
+	RunGroup        string `toml:",omitempty" json:"run_group,omitempty" yaml:"run_group,omitempty"`
+	DrainSeconds    uint32 `toml:",omitempty" json:"drain_seconds,omitempty" yaml:"drain_seconds,omitempty"`
 	CacheSeconds    uint32 `toml:",omitempty" json:"cache_seconds,omitempty" yaml:"cache_seconds,omitempty"`
 	NegCacheSeconds uint32 `toml:",omitempty" json:"neg_cache_seconds,omitempty" yaml:"neg_cache_seconds,omitempty"`
 	UseEtag         bool   `toml:",omitempty" json:"use_etag,omitempty" yaml:"use_etag,omitempty"`
@@ -52,16 +66,23 @@ type NgxHeaderPathAuthConfig struct {
 	} `json:"authz" yaml:"authz"`
 
 	Response htstat.HttpStatusTbl `toml:",omitempty" json:"response,omitempty" yaml:"response,omitempty"`
+	Admin    admin.Config         `toml:",omitempty" json:"admin,omitempty" yaml:"admin,omitempty"`
+	Tls      server.TlsConfig     `toml:"tls,omitempty" json:"tls,omitempty" yaml:"tls,omitempty"`
 
-	Logging struct {
-		EnableConsole bool   `toml:"enable_console,omitempty" json:"enable_console,omitempty" yaml:"enable_console,omitempty"`
-		Logfile       string `toml:"logfile,omitempty" json:"logfile,omitempty" yaml:"logfile,omitempty"`
-		LoggingLevel  string `toml:"logging_level,omitempty" json:"logging_level,omitempty" yaml:"logging_level,omitempty"`
-	} `toml:"logging,omitempty" json:"logging,omitempty" yaml:"logging,omitempty"`
+	Signature signed_header.Config `toml:"signature,omitempty" json:"signature,omitempty" yaml:"signature,omitempty"`
+	Assertion assertion.Config     `toml:"assertion,omitempty" json:"assertion,omitempty" yaml:"assertion,omitempty"`
+
+	Logging logger.Config `toml:"logging,omitempty" json:"logging,omitempty" yaml:"logging,omitempty"`
+	Audit   audit.Config  `toml:"audit,omitempty" json:"audit,omitempty" yaml:"audit,omitempty"`
 }
 
 var SocketType string
 var SocketPath string
+var SocketOwnership server.SocketOwnership
+var RunUser string
+var RunGroup string
+var DrainTimeout time.Duration
+var TlsConfig *tls.Config
 var CacheSeconds uint32
 var NegCacheSeconds uint32
 var UseEtag bool
@@ -76,8 +97,14 @@ var DefaultRight string
 var PathRight map[string]string
 
 var HttpResponse htstat.HttpStatusTbl
+var AdminConfig admin.Config
+var Assertion *assertion.Issuer
+var Signature *signed_header.Verifier
+
+var Handler http.Handler
 
-var StartTimeMS int64
+var CheckOnly bool
+var CheckDump bool
 
 func init() {
 	flag.CommandLine.SetOutput(os.Stderr)
@@ -92,6 +119,8 @@ func init() {
 	log.SetFlags(0)
 	logger.SetProgramName(progName)
 
+	flag.BoolVar(&CheckOnly, "t", false, "test the configuration file and exit")
+	flag.BoolVar(&CheckDump, "T", false, "test the configuration file, dump the effective configuration and exit")
 	flag.Parse()
 
 	if flag.NArg() != 1 {
@@ -106,19 +135,33 @@ func init() {
 	defer cfg_f.Close()
 
 	cfg := &NgxHeaderPathAuthConfig{}
+	chk := cfgcheck.New(flag.Arg(0))
 	if err := cfgloader.LoadConfig(cfg_f, flag.Arg(0), cfg); err != nil {
-		die("Config file parse error: %s", err)
+		chk.Errorf("", "Config file parse error: %s", err)
+		chk.Exit()
 	}
 
-	// Configure logging
-	logger.SetLoggingLevel(cfg.Logging.LoggingLevel)
+	chk.Logging("logging", &cfg.Logging)
+	chk.Audit("audit", &cfg.Audit)
 
 	SocketType = cfg.SocketType
 	SocketPath = cfg.SocketPath
-
-	if SocketType != "tcp" && SocketType != "unix" {
-		die("Bad socket type: %s", SocketType)
+	DrainTimeout = server.DrainTimeout(cfg.DrainSeconds)
+	chk.SocketType("socket_type", SocketType)
+	chk.Required("socket_path", SocketPath)
+
+	SocketOwnership = server.SocketOwnership{
+		Mode:  cfg.SocketMode,
+		Owner: cfg.SocketOwner,
+		Group: cfg.SocketGroup,
 	}
+	chk.SocketOwnership("", &SocketOwnership)
+
+	RunUser = cfg.RunUser
+	RunGroup = cfg.RunGroup
+	chk.RunUser("run_user", RunUser, "run_group", RunGroup)
+
+	TlsConfig = chk.Tls("tls", SocketType, &cfg.Tls)
 
 	CacheSeconds = cfg.CacheSeconds
 	NegCacheSeconds = cfg.NegCacheSeconds
@@ -132,66 +175,72 @@ func init() {
 		UserHeader = cfg.UserHeader
 	}
 
-	var user_map_cfg *authz.UserMapConfig
-	user_map_cfg, err = authz.NewUserMapConfig(cfg.Authz.UserMapConfig)
-	if err != nil {
-		die("user map config parse error: %s: %s",
-			cfg.Authz.UserMapConfig, err)
-		return
-	}
-
-	UserMap, err = authz.NewUserMap(cfg.Authz.UserMap, user_map_cfg)
-	if err != nil {
-		die("user map parse error: %s: %s", cfg.Authz.UserMap, err)
-		return
-	}
-
-	PathPatternReg, err = regexp.Compile(cfg.Authz.PathPattern)
-	if err != nil {
-		die("path pattern error: %s", cfg.Authz.PathPattern)
-		return
-	}
+	UserMap = chk.UserMap("authz.user_map_config", cfg.Authz.UserMapConfig,
+		"authz.user_map", cfg.Authz.UserMap)
+	PathPatternReg = chk.PathPattern("authz.path_pattern", cfg.Authz.PathPattern)
 
 	NomatchRight = cfg.Authz.NomatchRight
-	if !authz.VerifyAuthzType(NomatchRight) {
-		die("bad nomatch_right parameter: %s", NomatchRight)
-	}
+	chk.AuthzRight("authz.nomatch_right", NomatchRight)
 
 	DefaultRight = cfg.Authz.DefaultRight
-	if !authz.VerifyAuthzType(DefaultRight) {
-		die("bad default_path_right parameter: %s", DefaultRight)
-	}
+	chk.AuthzRight("authz.default_right", DefaultRight)
 
 	PathRight = cfg.Authz.PathRight
-	for p, r := range PathRight {
-		if !authz.VerifyAuthzType(r) {
-			die("bad path_right parameter: %s -> %s", p, r)
-		}
-	}
+	chk.PathRight("authz.path_right", PathRight)
 
 	cfg.Response.SetDefault()
-	if !cfg.Response.IsValid() {
-		die("response code config error.")
-		return
-	}
+	chk.Response("response", &cfg.Response)
 	HttpResponse = cfg.Response
 
-	StartTimeMS = time.Now().UnixMicro()
-}
+	cfg.Admin.SetDefault()
+	chk.Admin("admin", &cfg.Admin)
+	AdminConfig = cfg.Admin
 
-var ErrUnsupportedSocketType = errors.New("unsupported socket type.")
+	cfg.Assertion.SetDefault()
+	Assertion = chk.Assertion("assertion", &cfg.Assertion, &cfg.Admin)
+	chk.AssertionCache("", Assertion, CacheSeconds, UseEtag)
 
-func listen(cc task.Canceller, stype string, spath string) (net.Listener, error) {
-	lcnf := &net.ListenConfig{}
+	cfg.Signature.SetDefault()
+	Signature = chk.Signature("signature", &cfg.Signature)
 
-	switch stype {
-	default:
-		return nil, ErrUnsupportedSocketType
-	case "unix":
-	case "tcp":
+	chk.Exit()
+	if CheckDump {
+		if err := cfgloader.Dump(os.Stdout, cfg); err != nil {
+			die("Config dump error: %s", err)
+		}
+	}
+	if CheckOnly || CheckDump {
+		fmt.Fprintf(os.Stderr, "%s: configuration file test is successful\n", flag.Arg(0))
+		os.Exit(0)
+	}
+	metrics.ConfigReloads.Inc("config", "ok")
+
+	if err := logger.Setup(&cfg.Logging); err != nil {
+		die("logfile setting error: %s", err)
+	}
+	if err := audit.Setup(progName, &cfg.Audit); err != nil {
+		die("audit log setting error: %s", err)
+	}
+
+	health.Register("usermap", UserMap.HealthCheck)
+
+	if Assertion != nil {
+		admin.Handle(Assertion.JwksPath, Assertion.JwksHandler())
 	}
 
-	return lcnf.Listen(cc.AsContext(), stype, spath)
+	Handler = profile.NewHeaderPath(profile.Common{
+		CacheSeconds:    CacheSeconds,
+		NegCacheSeconds: NegCacheSeconds,
+		UseEtag:         UseEtag,
+		Response:        HttpResponse,
+		Assertion:       Assertion,
+	}, PathHeader, UserHeader, profile.PathRights{
+		PathPatternReg: PathPatternReg,
+		UserMap:        UserMap,
+		NomatchRight:   NomatchRight,
+		DefaultRight:   DefaultRight,
+		PathRight:      PathRight,
+	}, Signature)
 }
 
 func main() {
@@ -206,36 +255,47 @@ func main() {
 		select {
 		case <-cc.RecvCancel():
 		case <-signal_chan:
+			server.Stopping()
+			logger.Event(logger.LevelNotice, logger.EventServerStopping,
+				logger.SocketType(SocketType), logger.SocketPath(SocketPath))
 			cc.Cancel()
 		}
-		srv.Close()
 	}()
 
-	http.HandleFunc("/", TestAuthHandler)
+	logger.ReopenOnSignal(cc)
+
+	http.Handle("/", Handler)
 
-	lstn, lerr := listen(cc, SocketType, SocketPath)
+	if err := admin.Start(cc, &AdminConfig); err != nil {
+		die("admin socket listen error: %v.", err)
+	}
+
+	lstn, lerr := server.Listen(cc, server.NameAuth, SocketType, SocketPath)
 	switch lerr {
 	case nil:
 	case context.Canceled:
 	default:
 		die("socket listen error: %v.", lerr)
 	}
-	if SocketType == "unix" {
+	if SocketType == "unix" && !server.IsInherited(lstn) {
 		defer os.Remove(SocketPath)
-		os.Chmod(SocketPath, 0777)
+		if err := SocketOwnership.Apply(SocketPath); err != nil {
+			die("socket permission error: %v.", err)
+		}
+	}
+	if err := server.DropPrivileges(RunUser, RunGroup); err != nil {
+		die("privilege drop error: %v.", err)
 	}
 
-	if SocketType == "unix" {
-		logger.LogWithTime("Server started: socket_type=unix socket_path=%s", SocketPath)
-	} else {
-		logger.LogWithTime("Server started: socket_type=tcp socket_path=%s", SocketPath)
+	if TlsConfig != nil {
+		lstn = tls.NewListener(lstn, TlsConfig)
 	}
 
-	serr := srv.Serve(lstn)
-	switch serr {
-	case nil:
-	case http.ErrServerClosed:
-	default:
+	logger.Event(logger.LevelNotice, logger.EventServerStarted,
+		logger.SocketType(SocketType), logger.SocketPath(SocketPath))
+	server.Ready(cc)
+
+	if serr := server.Serve(cc, srv, lstn, DrainTimeout); serr != nil {
 		die("HTTP server error: %v.", serr)
 	}
 }
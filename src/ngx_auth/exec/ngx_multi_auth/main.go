@@ -0,0 +1,937 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/l4go/task"
+
+	"ngx_auth/admin"
+	"ngx_auth/apikey"
+	"ngx_auth/assertion"
+	"ngx_auth/audit"
+	"ngx_auth/authz"
+	"ngx_auth/health"
+	"ngx_auth/jwt"
+	"ngx_auth/ldap_auth"
+	"ngx_auth/oidc"
+	"ngx_auth/pipeline"
+	"ngx_auth/profile"
+	"ngx_auth/server"
+	"ngx_auth/session"
+
+	cfgcheck "ngx_auth/config_check"
+	cfgloader "ngx_auth/config_loader"
+	logger "ngx_auth/logger"
+	"ngx_auth/metrics"
+)
+
+func die(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+	os.Exit(1)
+}
+
+func warn(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+}
+
+type ListenerConfig struct {
+	SocketType  string `json:"socket_type" yaml:"socket_type"`
+	SocketPath  string `json:"socket_path" yaml:"socket_path"`
+	SocketMode  string `toml:",omitempty" json:"socket_mode,omitempty" yaml:"socket_mode,omitempty"`
+	SocketOwner string `toml:",omitempty" json:"socket_owner,omitempty" yaml:"socket_owner,omitempty"`
+	SocketGroup string `toml:",omitempty" json:"socket_group,omitempty" yaml:"socket_group,omitempty"`
+
+	Tls server.TlsConfig `toml:"tls,omitempty" json:"tls,omitempty" yaml:"tls,omitempty"`
+}
+
+type NgxMultiAuthConfig struct {
+	RunUser      string `toml:",omitempty" json:"run_user,omitempty" yaml:"run_user,omitempty"`
+	RunGroup     string `toml:",omitempty" json:"run_group,omitempty" yaml:"run_group,omitempty"`
+	DrainSeconds uint32 `toml:",omitempty" json:"drain_seconds,omitempty" yaml:"drain_seconds,omitempty"`
+
+	Listeners map[string]ListenerConfig     `json:"listeners" yaml:"listeners"`
+	Ldap      map[string]profile.LdapConfig `toml:",omitempty" json:"ldap,omitempty" yaml:"ldap,omitempty"`
+	Profiles  map[string]profile.Config     `json:"profiles" yaml:"profiles"`
+
+	Admin   admin.Config  `toml:",omitempty" json:"admin,omitempty" yaml:"admin,omitempty"`
+	Logging logger.Config `toml:"logging,omitempty" json:"logging,omitempty" yaml:"logging,omitempty"`
+	Audit   audit.Config  `toml:"audit,omitempty" json:"audit,omitempty" yaml:"audit,omitempty"`
+
+	Assertion assertion.Config `toml:"assertion,omitempty" json:"assertion,omitempty" yaml:"assertion,omitempty"`
+}
+
+// Listener is one socket and the profiles routed on it by URL prefix.
+type Listener struct {
+	Name            string
+	SocketType      string
+	SocketPath      string
+	SocketOwnership server.SocketOwnership
+	TlsConfig       *tls.Config
+
+	// Routes maps a URL prefix to a profile name. "" is the default profile.
+	Routes map[string]string
+	Mux    *http.ServeMux
+}
+
+var Listeners []*Listener
+var RunUser string
+var RunGroup string
+var DrainTimeout time.Duration
+
+var LdapAuthConfigs = map[string]*ldap_auth.Config{}
+var Handlers = map[string]http.Handler{}
+var UserMaps = map[string]*authz.UserMap{}
+var JwksSources = map[string]*jwt.RemoteKeys{}
+var OidcProviders = map[string]*oidc.RelyingParty{}
+
+var AdminConfig admin.Config
+var Assertion *assertion.Issuer
+
+var CheckOnly bool
+var CheckDump bool
+var CheckDial bool
+
+func sorted_names[T any](m map[string]T) []string {
+	names := make([]string, 0, len(m))
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func check_listener(chk *cfgcheck.Checker, name string, lc *ListenerConfig) *Listener {
+	field := "listeners." + name
+
+	chk.SocketType(field+".socket_type", lc.SocketType)
+	chk.Required(field+".socket_path", lc.SocketPath)
+
+	lstn := &Listener{
+		Name:       name,
+		SocketType: lc.SocketType,
+		SocketPath: lc.SocketPath,
+		SocketOwnership: server.SocketOwnership{
+			Mode:  lc.SocketMode,
+			Owner: lc.SocketOwner,
+			Group: lc.SocketGroup,
+		},
+		Routes: map[string]string{},
+	}
+	chk.SocketOwnership(field, &lstn.SocketOwnership)
+	lstn.TlsConfig = chk.Tls(field+".tls", lc.SocketType, &lc.Tls)
+
+	return lstn
+}
+
+func check_rights(chk *cfgcheck.Checker, field string, az *profile.AuthzConfig) profile.PathRights {
+	rights := profile.PathRights{
+		UserMap: chk.UserMap(field+".usermap_config", az.UserMapConfig,
+			field+".usermap", az.UserMap),
+		PathPatternReg: chk.PathPattern(field+".path_pattern", az.PathPattern),
+		NomatchRight:   az.NomatchRight,
+		DefaultRight:   az.DefaultRight,
+		PathRight:      az.PathRight,
+		NomatchMfa:     az.NomatchMfa,
+		DefaultMfa:     az.DefaultMfa,
+		PathMfa:        az.PathMfa,
+	}
+	chk.AuthzRight(field+".nomatch_right", rights.NomatchRight)
+	chk.AuthzRight(field+".default_right", rights.DefaultRight)
+	chk.PathRight(field+".path_right", rights.PathRight)
+
+	return rights
+}
+
+func check_filters(chk *cfgcheck.Checker, field string, az *profile.AuthzConfig) profile.PathFilters {
+	filters := profile.PathFilters{
+		PathPatternReg: chk.PathPattern(field+".path_pattern", az.PathPattern),
+		BanNomatch:     az.BanNomatch,
+		NomatchFilter:  az.NomatchFilter,
+		BanDefault:     az.BanDefault,
+		DefaultFilter:  az.DefaultFilter,
+		PathFilter:     az.PathFilter,
+	}
+	if filters.BanNomatch && filters.NomatchFilter != "" {
+		warn("%s: nomatch_filter is not used because ban_nomatch is true.", field)
+	}
+	chk.LdapFilter(field+".nomatch_filter", filters.NomatchFilter)
+	if filters.BanDefault && filters.DefaultFilter != "" {
+		warn("%s: default_filter is not used because ban_default is true.", field)
+	}
+	chk.LdapFilter(field+".default_filter", filters.DefaultFilter)
+	chk.LdapFilterMap(field+".path_filter", filters.PathFilter)
+
+	return filters
+}
+
+// check_chain checks the steps of the chain authenticator.
+func check_chain(chk *cfgcheck.Checker, name string, pc *profile.Config) *pipeline.Chain {
+	field := "profiles." + name + ".pipeline.chain"
+	if len(pc.Pipeline.Chain) == 0 {
+		chk.Errorf(field, "is required by the %q authenticator", pipeline.AuthChain)
+	}
+
+	chain := &pipeline.Chain{}
+	for i := range pc.Pipeline.Chain {
+		sc := &pc.Pipeline.Chain[i]
+		step_field := fmt.Sprintf("%s[%d]", field, i)
+
+		st := pipeline.ChainStep{
+			Name:              fmt.Sprintf("%d:%s", i, sc.Authenticator),
+			Suffix:            sc.Suffix,
+			Realm:             sc.Realm,
+			Strip:             sc.Strip,
+			ContinueOnUnknown: sc.OnUnknown == profile.ChainContinue,
+			ContinueOnError:   sc.OnError == profile.ChainContinue,
+		}
+		switch sc.Authenticator {
+		case pipeline.AuthPassword:
+			if len(pc.Password) == 0 {
+				chk.Errorf("profiles."+name+".password", "is required")
+			}
+			st.Authenticator = pipeline.PasswordMap(pc.Password)
+		case pipeline.AuthHtpasswd:
+			st.Authenticator = chk.Htpasswd(step_field+".htpasswd", sc.Htpasswd)
+		case pipeline.AuthLdap:
+			chk.Required(step_field+".ldap", sc.Ldap)
+			ldap_cfg := LdapAuthConfigs[sc.Ldap]
+			if sc.Ldap != "" && ldap_cfg == nil {
+				chk.Errorf(step_field+".ldap", "unknown LDAP server: %q", sc.Ldap)
+			}
+			chk.LdapFilter(step_field+".user_filter", sc.UserFilter)
+			if sc.UserFilter == "" && sc.OnUnknown == profile.ChainContinue {
+				warn("%s.user_filter: without it, an LDAP bind cannot tell an unknown user from a wrong password.",
+					step_field)
+			}
+			st.Authenticator = &pipeline.LdapBind{Config: ldap_cfg, UserFilter: sc.UserFilter}
+		case "":
+			chk.Errorf(step_field+".authenticator", "is required")
+		default:
+			chk.Errorf(step_field+".authenticator", "bad chain authenticator: %q", sc.Authenticator)
+		}
+		if sc.Suffix != "" && sc.Realm != "" {
+			chk.Errorf(step_field+".realm", "cannot be used with suffix")
+		}
+		for _, act := range []struct{ field, v string }{
+			{".on_unknown", sc.OnUnknown}, {".on_error", sc.OnError},
+		} {
+			if act.v != profile.ChainContinue && act.v != profile.ChainStop {
+				chk.Errorf(step_field+act.field, "must be %q or %q: %q",
+					profile.ChainContinue, profile.ChainStop, act.v)
+			}
+		}
+		if st.Authenticator != nil {
+			chain.Steps = append(chain.Steps, st)
+		}
+	}
+
+	return chain
+}
+
+// check_path_right checks the rights of the path_right authorizer.
+func check_path_right(chk *cfgcheck.Checker, az_field string, az *profile.AuthzConfig) *pipeline.PathRight {
+	pr := &pipeline.PathRight{
+		PathPatternReg: chk.PathPattern(az_field+".path_pattern", az.PathPattern),
+		NomatchRight:   az.NomatchRight,
+		DefaultRight:   az.DefaultRight,
+		PathRight:      az.PathRight,
+	}
+	chk.AuthzRight(az_field+".nomatch_right", pr.NomatchRight)
+	chk.AuthzRight(az_field+".default_right", pr.DefaultRight)
+	chk.PathRight(az_field+".path_right", pr.PathRight)
+	return pr
+}
+
+// check_oidc checks the provider and the session of an oidc profile, and
+// returns its handler if there is no problem.
+func check_oidc(chk *cfgcheck.Checker, name string, pc *profile.Config,
+	common profile.Common) http.Handler {
+	field := "profiles." + name + ".oidc"
+	oc := &pc.Oidc
+
+	chk.Required(field+".issuer", oc.Issuer)
+	chk.Required(field+".client_id", oc.ClientId)
+	chk.Required(field+".redirect_url", oc.RedirectUrl)
+	if oc.Issuer != "" {
+		if err := oidc.CheckUrl(oc.Issuer); err != nil {
+			chk.Error(field+".issuer", err)
+		}
+	}
+	var callback_path string
+	if oc.RedirectUrl != "" {
+		if err := oidc.CheckUrl(oc.RedirectUrl); err != nil {
+			chk.Error(field+".redirect_url", err)
+		} else if u, err := url.Parse(oc.RedirectUrl); err == nil {
+			callback_path = u.Path
+		}
+		if !strings.HasSuffix(callback_path, profile.OidcCallbackPath) {
+			warn("%s.redirect_url: the path should end with %q to reach the callback.",
+				field, profile.OidcCallbackPath)
+		}
+	}
+
+	sessions, err := session.NewCodec(oc.SessionSecret)
+	if err != nil {
+		chk.Error(field+".session_secret", err)
+	}
+	if oc.InsecureCookie {
+		warn("%s.insecure_cookie: the session cookie is sent without TLS.", field)
+	}
+	cookie := session.CookieConfig{
+		Name:     oc.Cookie,
+		Domain:   oc.CookieDomain,
+		Insecure: oc.InsecureCookie,
+	}
+	login_cookie := cookie
+	login_cookie.Name = oc.Cookie + "_login"
+	login_cookie.Path = callback_path
+
+	var authzr pipeline.Authorizer = pipeline.AllowAll{}
+	if pc.Authz.PathPattern != "" {
+		authzr = check_path_right(chk, "profiles."+name+".authz", &pc.Authz)
+	}
+
+	timeout := time.Duration(oc.TimeoutSeconds) * time.Second
+	rp := oidc.NewRelyingParty(oidc.RelyingParty{
+		Issuer:       oc.Issuer,
+		ClientId:     oc.ClientId,
+		ClientSecret: oc.ClientSecret,
+		RedirectUrl:  oc.RedirectUrl,
+		Scopes:       oc.Scopes,
+		UserClaim:    oc.UserClaim,
+		GroupsClaim:  oc.GroupsClaim,
+		Codec:        sessions,
+		LoginCookie:  login_cookie,
+	}, timeout, time.Duration(profile.DefaultJwksCacheSeconds)*time.Second)
+	OidcProviders[name] = rp
+
+	return profile.NewOidc(common, pc.Prefix, pc.PathHeader, oc.LoginUrl,
+		rp, sessions, cookie, oc.SessionSeconds, authzr)
+}
+
+// check_jwt checks the keys and the claims of the jwt authenticator, and
+// returns its verifier if there is no problem.
+func check_jwt(chk *cfgcheck.Checker, name string, jc *profile.JwtConfig) *jwt.Verifier {
+	field := "profiles." + name + ".pipeline.jwt"
+
+	var keys jwt.KeySource
+	n_keys := 0
+	if jc.JwksFile != "" {
+		n_keys++
+		if ks := chk.Jwks(field+".jwks_file", jc.JwksFile); ks != nil {
+			keys = &jwt.StaticKeys{Keys: ks}
+		}
+	}
+	if jc.JwksUrl != "" {
+		n_keys++
+		chk.JwksUrl(field+".jwks_url", jc.JwksUrl)
+		rk := jwt.NewRemoteKeys(jc.JwksUrl,
+			time.Duration(jc.JwksCacheSeconds)*time.Second, jwt.DefaultFetchTimeout)
+		JwksSources[name] = rk
+		keys = rk
+	}
+	if jc.HmacSecret != "" {
+		n_keys++
+		if len(jc.HmacSecret) < 32 {
+			chk.Errorf(field+".hmac_secret", "must be at least 32 bytes")
+		}
+		keys = &jwt.StaticKeys{Keys: &jwt.KeySet{Keys: []jwt.Key{
+			{Alg: jwt.AlgHS256, Public: []byte(jc.HmacSecret)},
+		}}}
+	}
+	switch n_keys {
+	case 0:
+		chk.Errorf(field+".jwks_file", "one of jwks_file, jwks_url and hmac_secret is required")
+	case 1:
+	default:
+		chk.Errorf(field+".jwks_file", "only one of jwks_file, jwks_url and hmac_secret can be used")
+	}
+
+	for _, alg := range jc.Algorithms {
+		switch alg {
+		case jwt.AlgHS256, jwt.AlgRS256, jwt.AlgES256, jwt.AlgEdDSA:
+		default:
+			chk.Errorf(field+".algorithms", "unsupported algorithm: %q", alg)
+		}
+	}
+	if jc.Issuer == "" && len(jc.Audience) == 0 && jc.HmacSecret == "" {
+		warn("%s: without issuer or audience, a token issued for any service is accepted.", field)
+	}
+
+	if jc.AllowNoExp {
+		warn("%s.allow_no_exp: a token without exp is valid forever.", field)
+	}
+
+	if keys == nil {
+		return nil
+	}
+	return &jwt.Verifier{
+		Keys:       keys,
+		Algs:       jc.Algorithms,
+		Issuer:     jc.Issuer,
+		Audience:   jc.Audience,
+		Leeway:     time.Duration(jc.LeewaySeconds) * time.Second,
+		AllowNoExp: jc.AllowNoExp,
+	}
+}
+
+// check_pipeline checks the parts of a pipeline profile, and returns its
+// handler if there is no problem.
+func check_pipeline(chk *cfgcheck.Checker, name string, pc *profile.Config,
+	common profile.Common, ldap_cfg *ldap_auth.Config) http.Handler {
+	field := "profiles." + name + ".pipeline"
+	pl := &pc.Pipeline
+
+	var ext pipeline.CredentialExtractor
+	var keys *apikey.File
+	switch pl.Credentials {
+	case pipeline.CredentialsBasic:
+		ext = pipeline.BasicCredentials{}
+	case pipeline.CredentialsHeader:
+		user_header := pc.UserHeader
+		if user_header == "" {
+			user_header = profile.DefaultUserHeader
+		}
+		ext = pipeline.HeaderUser{Header: user_header}
+	case pipeline.CredentialsBearer:
+		ext = pipeline.Bearer{UserClaim: pl.Jwt.UserClaim, Cookie: pl.Jwt.Cookie}
+	case pipeline.CredentialsApiKey:
+		keys = chk.ApiKeys(field+".apikey.key_file", pl.ApiKey.KeyFile)
+		ext = pipeline.ApiKeyCredentials{Header: pl.ApiKey.Header, Keys: keys}
+	default:
+		chk.Errorf(field+".credentials", "bad credential extractor: %q", pl.Credentials)
+	}
+
+	var authn pipeline.Authenticator
+	switch pl.Authenticator {
+	case pipeline.AuthPassword:
+		if len(pc.Password) == 0 {
+			chk.Errorf("profiles."+name+".password", "is required")
+		}
+		authn = pipeline.PasswordMap(pc.Password)
+	case pipeline.AuthHtpasswd:
+		if hp := chk.Htpasswd(field+".htpasswd", pl.Htpasswd); hp != nil {
+			authn = hp
+		}
+	case pipeline.AuthLdap:
+		authn = &pipeline.LdapBind{Config: ldap_cfg}
+	case pipeline.AuthNone:
+		authn = pipeline.Trusted{}
+	case pipeline.AuthChain:
+		authn = check_chain(chk, name, pc)
+	case pipeline.AuthJwt:
+		if v := check_jwt(chk, name, &pl.Jwt); v != nil {
+			authn = &pipeline.Jwt{Verifier: v, UserClaim: pl.Jwt.UserClaim}
+		}
+	case pipeline.AuthApiKey:
+		authn = &pipeline.ApiKey{Keys: keys}
+	case "":
+		chk.Errorf(field+".authenticator", "is required")
+	default:
+		chk.Errorf(field+".authenticator", "bad authenticator: %q", pl.Authenticator)
+	}
+	// Only the jwt authenticator verifies the user read from a bearer token.
+	if (pl.Credentials == pipeline.CredentialsBearer) != (pl.Authenticator == pipeline.AuthJwt) {
+		chk.Errorf(field+".authenticator", "%q must be used with %q credentials",
+			pipeline.AuthJwt, pipeline.CredentialsBearer)
+	}
+	// Likewise, only the apikey authenticator verifies the owner of a key.
+	if (pl.Credentials == pipeline.CredentialsApiKey) != (pl.Authenticator == pipeline.AuthApiKey) {
+		chk.Errorf(field+".authenticator", "%q must be used with %q credentials",
+			pipeline.AuthApiKey, pipeline.CredentialsApiKey)
+	}
+	if ext != nil && authn != nil {
+		if authn.NeedsPassword() && !ext.HasPassword() {
+			chk.Errorf(field+".authenticator", "%q needs the password of %q credentials",
+				pl.Authenticator, pipeline.CredentialsBasic)
+		}
+		if !authn.NeedsPassword() && ext.HasPassword() {
+			chk.Errorf(field+".authenticator", "%q does not check the password of %q credentials",
+				pl.Authenticator, pl.Credentials)
+		}
+	}
+
+	var groups pipeline.GroupProvider
+	switch pl.Groups {
+	case "":
+	case pipeline.GroupsUserMap:
+		az := &pc.Authz
+		umap := chk.UserMap("profiles."+name+".authz.usermap_config", az.UserMapConfig,
+			"profiles."+name+".authz.usermap", az.UserMap)
+		if umap != nil {
+			UserMaps[name] = umap
+			groups = &pipeline.UserMapGroups{UserMap: umap}
+		}
+	case pipeline.GroupsLdap:
+		chk.Required(field+".group_filter", pl.GroupFilter)
+		chk.LdapFilter(field+".group_filter", pl.GroupFilter)
+		groups = &pipeline.LdapGroups{Config: ldap_cfg, Filter: pl.GroupFilter, Attr: pl.GroupAttr}
+	case pipeline.GroupsClaims:
+		if pl.Credentials != pipeline.CredentialsBearer {
+			chk.Errorf(field+".groups", "%q needs %q credentials",
+				pipeline.GroupsClaims, pipeline.CredentialsBearer)
+		}
+		groups = &pipeline.ClaimGroups{Claim: pl.Jwt.GroupsClaim}
+	case pipeline.GroupsApiKey:
+		if pl.Credentials != pipeline.CredentialsApiKey {
+			chk.Errorf(field+".groups", "%q needs %q credentials",
+				pipeline.GroupsApiKey, pipeline.CredentialsApiKey)
+		}
+		groups = &pipeline.ClaimGroups{Claim: apikey.ClaimGroups}
+	default:
+		chk.Errorf(field+".groups", "bad group provider: %q", pl.Groups)
+	}
+
+	var authzr pipeline.Authorizer
+	az_field := "profiles." + name + ".authz"
+	switch pl.Authorizer {
+	case pipeline.AuthzNone:
+		authzr = pipeline.AllowAll{}
+	case pipeline.AuthzPathRight:
+		if pl.Groups == "" {
+			chk.Errorf(field+".groups", "is required by the %q authorizer", pl.Authorizer)
+		}
+		authzr = check_path_right(chk, az_field, &pc.Authz)
+	case pipeline.AuthzLdapFilter:
+		filters := check_filters(chk, az_field, &pc.Authz)
+		authzr = &pipeline.LdapFilter{
+			Config:         ldap_cfg,
+			PathPatternReg: filters.PathPatternReg,
+			BanNomatch:     filters.BanNomatch,
+			NomatchFilter:  filters.NomatchFilter,
+			BanDefault:     filters.BanDefault,
+			DefaultFilter:  filters.DefaultFilter,
+			PathFilter:     filters.PathFilter,
+		}
+	default:
+		chk.Errorf(field+".authorizer", "bad authorizer: %q", pl.Authorizer)
+	}
+	if groups != nil && pl.Authorizer != pipeline.AuthzPathRight {
+		warn("%s.groups: is not used by the %q authorizer.", field, pl.Authorizer)
+	}
+	if pl.Credentials == pipeline.CredentialsApiKey && authzr != nil {
+		authzr = &pipeline.KeyScope{
+			PathPatternReg: key_scope_pattern(chk, az_field, &pc.Authz, authzr),
+			Next:           authzr,
+		}
+	}
+
+	return profile.NewPipeline(common, pc.PathHeader, pc.UseSerializedAuth,
+		ext, authn, groups, authzr)
+}
+
+// key_scope_pattern returns the path pattern of the path lists of the API
+// keys, which is the one of the authorizer if it has one.
+func key_scope_pattern(chk *cfgcheck.Checker, field string, az *profile.AuthzConfig,
+	authzr pipeline.Authorizer) *regexp.Regexp {
+	switch a := authzr.(type) {
+	case *pipeline.PathRight:
+		return a.PathPatternReg
+	case *pipeline.LdapFilter:
+		return a.PathPatternReg
+	}
+	if az.PathPattern == "" {
+		return nil
+	}
+	return chk.PathPattern(field+".path_pattern", az.PathPattern)
+}
+
+// check_profile checks a profile, and returns its handler if there is no problem.
+func check_profile(chk *cfgcheck.Checker, name string, pc *profile.Config) http.Handler {
+	field := "profiles." + name
+
+	if !profile.IsValidType(pc.Type) {
+		chk.Errorf(field+".type", "bad module type: %q", pc.Type)
+		return nil
+	}
+	switch pc.Type {
+	case profile.TypePipeline:
+		pc.Pipeline.SetDefault()
+	case profile.TypeOidc:
+		pc.Oidc.SetDefault()
+	}
+	if pc.UsesRealm() {
+		chk.Required(field+".auth_realm", pc.AuthRealm)
+	}
+	chk.UrlPrefix(field+".prefix", pc.Prefix)
+
+	pc.Response.SetDefault()
+	chk.Response(field+".response", &pc.Response)
+
+	var ldap_cfg *ldap_auth.Config
+	if pc.UsesLdap() {
+		chk.Required(field+".ldap", pc.Ldap)
+		if pc.Ldap != "" {
+			ldap_cfg = LdapAuthConfigs[pc.Ldap]
+			if ldap_cfg == nil {
+				chk.Errorf(field+".ldap", "unknown LDAP server: %q", pc.Ldap)
+			}
+		}
+	}
+
+	common := profile.Common{
+		Name:            name,
+		CacheSeconds:    pc.CacheSeconds,
+		NegCacheSeconds: pc.NegCacheSeconds,
+		UseEtag:         pc.UseEtag,
+		AuthRealm:       pc.AuthRealm,
+		Response:        pc.Response,
+		Assertion:       Assertion,
+	}
+	chk.AssertionCache(field, Assertion, pc.CacheSeconds, pc.UseEtag)
+	if pc.Session.IsEnabled() {
+		if !pc.UsesSession() {
+			chk.Errorf(field+".session", "is not used by the %q type", pc.Type)
+		}
+		pc.Session.SetDefault()
+		common.Sessions = chk.Session(field+".session", &pc.Session)
+		if common.Sessions != nil {
+			common.Sessions.Profile = name
+		}
+		if pc.Session.InsecureCookie {
+			warn("%s.session.insecure_cookie: the session cookie is sent without TLS.", field)
+		}
+	}
+
+	common.LoginUrl = pc.Login.LoginUrl
+	form := chk.Login(field+".login", &pc.Login, common.Sessions)
+	if pc.Login.IsEnabled() && !pc.UsesSession() {
+		chk.Errorf(field+".login", "is not used by the %q type", pc.Type)
+	}
+
+	if pc.Type != profile.TypeLdapPath {
+		if pc.Totp.IsEnabled() {
+			chk.Errorf(field+".totp", "is not used by the %q type", pc.Type)
+		}
+		if pc.Type != profile.TypeHeaderPath && pc.Signature.IsEnabled() {
+			chk.Errorf(field+".signature", "is not used by the %q type", pc.Type)
+		}
+		if pc.Type != profile.TypeClientCert && pc.Cert.IsSet() {
+			chk.Errorf(field+".cert", "is not used by the %q type", pc.Type)
+		}
+		if pc.Type != profile.TypeSimple && pc.Digest.IsEnabled() {
+			chk.Errorf(field+".digest", "is not used by the %q type", pc.Type)
+		}
+		if az := &pc.Authz; az.NomatchMfa || az.DefaultMfa || len(az.PathMfa) > 0 {
+			chk.Errorf(field+".authz", "the second factor is not used by the %q type", pc.Type)
+		}
+	}
+	common.Totp = chk.Totp(field+".totp", &pc.Totp, ldap_cfg, common.Sessions)
+
+	var handler http.Handler
+	switch pc.Type {
+	case profile.TypeSimple:
+		pc.Digest.SetDefault()
+		dg := chk.Digest(field+".digest", &pc.Digest, pc.AuthRealm)
+		handler = profile.NewSimple(common, pc.Password, dg)
+	case profile.TypeLdap:
+		handler = profile.NewLdap(common, ldap_cfg, pc.UseSerializedAuth)
+	case profile.TypeLdapPath:
+		rights := check_rights(chk, field+".authz", &pc.Authz)
+		chk.Mfa(field+".authz", &rights, &pc.Totp, common.Sessions)
+		chk.MfaCache(field, &rights, pc.CacheSeconds, pc.UseEtag)
+		UserMaps[name] = rights.UserMap
+		handler = profile.NewLdapPath(common, ldap_cfg, pc.UseSerializedAuth,
+			pc.PathHeader, rights)
+	case profile.TypeHeaderPath:
+		rights := check_rights(chk, field+".authz", &pc.Authz)
+		UserMaps[name] = rights.UserMap
+		pc.Signature.SetDefault()
+		sig := chk.Signature(field+".signature", &pc.Signature)
+		return profile.NewHeaderPath(common, pc.PathHeader, pc.UserHeader, rights, sig)
+	case profile.TypeClientCert:
+		rights := check_rights(chk, field+".authz", &pc.Authz)
+		UserMaps[name] = rights.UserMap
+		pc.Cert.SetDefault()
+		cert := chk.ClientCert(field+".cert", &pc.Cert)
+		return profile.NewClientCert(common, pc.PathHeader, cert, rights)
+	case profile.TypeLdapPath2Ldap:
+		filters := check_filters(chk, field+".authz", &pc.Authz)
+		if pc.Login.IsEnabled() {
+			chk.LoginFilters(field+".authz", &filters)
+		}
+		handler = profile.NewLdapPath2Ldap(common, ldap_cfg, pc.UseSerializedAuth,
+			pc.PathHeader, filters)
+	case profile.TypePipeline:
+		return check_pipeline(chk, name, pc, common, ldap_cfg)
+	case profile.TypeOidc:
+		return check_oidc(chk, name, pc, common)
+	default:
+		return nil
+	}
+
+	// The login form is under the prefix of the profile.
+	if form == nil || common.Sessions == nil {
+		return handler
+	}
+	login, err := profile.NewLogin(common, pc.Prefix, form, handler)
+	if err != nil {
+		chk.Error(field+".login", err)
+		return nil
+	}
+	return login
+}
+
+// route_profile adds a profile to the routes of its listeners.
+// A profile without listeners is routed on every listener.
+func route_profile(chk *cfgcheck.Checker, name string, pc *profile.Config,
+	by_name map[string]*Listener) {
+	field := "profiles." + name
+	prefix := strings.TrimSuffix(pc.Prefix, "/")
+
+	targets := pc.Listeners
+	if len(targets) == 0 {
+		targets = sorted_names(by_name)
+	}
+	for i, lname := range targets {
+		lstn, ok := by_name[lname]
+		if !ok {
+			chk.Errorf(fmt.Sprintf("%s.listeners[%d]", field, i), "unknown listener: %q", lname)
+			continue
+		}
+		if other, dup := lstn.Routes[prefix]; dup {
+			chk.Errorf(field+".prefix", "%q on listener %q is also used by profile %q",
+				prefix, lname, other)
+			continue
+		}
+		lstn.Routes[prefix] = name
+	}
+}
+
+func init() {
+	flag.CommandLine.SetOutput(os.Stderr)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [options ...] <config_file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.SetOutput(os.Stderr)
+
+	progName := filepath.Base(os.Args[0])
+	log.SetFlags(0)
+	logger.SetProgramName(progName)
+
+	flag.BoolVar(&CheckOnly, "t", false, "test the configuration file and exit")
+	flag.BoolVar(&CheckDump, "T", false, "test the configuration file, dump the effective configuration and exit")
+	flag.BoolVar(&CheckDial, "dial", false, "with -t or -T, also test the connection to the LDAP servers")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	cfg_f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		die("Config file open error: %s", err)
+	}
+	defer cfg_f.Close()
+
+	cfg := &NgxMultiAuthConfig{}
+	chk := cfgcheck.New(flag.Arg(0))
+	if err := cfgloader.LoadConfig(cfg_f, flag.Arg(0), cfg); err != nil {
+		chk.Errorf("", "Config file parse error: %s", err)
+		chk.Exit()
+	}
+
+	chk.Logging("logging", &cfg.Logging)
+	chk.Audit("audit", &cfg.Audit)
+
+	RunUser = cfg.RunUser
+	RunGroup = cfg.RunGroup
+	chk.RunUser("run_user", RunUser, "run_group", RunGroup)
+	DrainTimeout = server.DrainTimeout(cfg.DrainSeconds)
+
+	if len(cfg.Listeners) == 0 {
+		chk.Errorf("listeners", "is required")
+	}
+	by_name := map[string]*Listener{}
+	for _, name := range sorted_names(cfg.Listeners) {
+		lc := cfg.Listeners[name]
+		lstn := check_listener(chk, name, &lc)
+		Listeners = append(Listeners, lstn)
+		by_name[name] = lstn
+	}
+
+	for _, name := range sorted_names(cfg.Ldap) {
+		lc := cfg.Ldap[name]
+		ldap_cfg := lc.AuthConfig()
+		chk.Ldap("ldap."+name, ldap_cfg)
+		LdapAuthConfigs[name] = ldap_cfg
+	}
+
+	cfg.Admin.SetDefault()
+	chk.Admin("admin", &cfg.Admin)
+	AdminConfig = cfg.Admin
+
+	// The profiles are built with the issuer of the assertions.
+	cfg.Assertion.SetDefault()
+	Assertion = chk.Assertion("assertion", &cfg.Assertion, &cfg.Admin)
+
+	if len(cfg.Profiles) == 0 {
+		chk.Errorf("profiles", "is required")
+	}
+	used_ldap := map[string]bool{}
+	for _, name := range sorted_names(cfg.Profiles) {
+		pc := cfg.Profiles[name]
+		if h := check_profile(chk, name, &pc); h != nil {
+			Handlers[name] = h
+		}
+		route_profile(chk, name, &pc, by_name)
+		if pc.UsesLdap() && LdapAuthConfigs[pc.Ldap] != nil {
+			used_ldap[pc.Ldap] = true
+		}
+		for _, ln := range pc.Pipeline.LdapNames() {
+			if LdapAuthConfigs[ln] != nil {
+				used_ldap[ln] = true
+			}
+		}
+		cfg.Profiles[name] = pc
+	}
+	for name := range cfg.Ldap {
+		if !used_ldap[name] {
+			warn("ldap.%s: is not used by any profile.", name)
+		}
+	}
+
+	if (CheckOnly || CheckDump) && CheckDial && !chk.HasError() {
+		for _, name := range sorted_names(used_ldap) {
+			chk.LdapDial("ldap."+name, LdapAuthConfigs[name])
+		}
+	}
+	chk.Exit()
+	if CheckDump {
+		if err := cfgloader.Dump(os.Stdout, cfg); err != nil {
+			die("Config dump error: %s", err)
+		}
+	}
+	if CheckOnly || CheckDump {
+		fmt.Fprintf(os.Stderr, "%s: configuration file test is successful\n", flag.Arg(0))
+		os.Exit(0)
+	}
+	metrics.ConfigReloads.Inc("config", "ok")
+
+	if err := logger.Setup(&cfg.Logging); err != nil {
+		die("logfile setting error: %s", err)
+	}
+	if err := audit.Setup(progName, &cfg.Audit); err != nil {
+		die("audit log setting error: %s", err)
+	}
+
+	for _, name := range sorted_names(used_ldap) {
+		ldap_auth.RegisterNamedHealthChecks(name, LdapAuthConfigs[name], AdminConfig.ProbeCacheTTL())
+	}
+	for _, name := range sorted_names(UserMaps) {
+		health.Register("usermap."+name, UserMaps[name].HealthCheck)
+	}
+	for _, name := range sorted_names(JwksSources) {
+		health.Register("jwks."+name, JwksSources[name].Check)
+	}
+	for _, name := range sorted_names(OidcProviders) {
+		health.Register("oidc."+name, OidcProviders[name].Check)
+	}
+
+	if Assertion != nil {
+		admin.Handle(Assertion.JwksPath, Assertion.JwksHandler())
+	}
+
+	for _, lstn := range Listeners {
+		lstn.Mux = http.NewServeMux()
+		for prefix, name := range lstn.Routes {
+			if prefix == "" {
+				lstn.Mux.Handle("/", Handlers[name])
+				continue
+			}
+			lstn.Mux.Handle(prefix, Handlers[name])
+			lstn.Mux.Handle(prefix+"/", Handlers[name])
+		}
+	}
+}
+
+func main() {
+	signal_chan := make(chan os.Signal, 1)
+	signal.Notify(signal_chan, syscall.SIGINT, syscall.SIGTERM)
+
+	cc := task.NewCancel()
+	defer cc.Cancel()
+	go func() {
+		select {
+		case <-cc.RecvCancel():
+		case <-signal_chan:
+			server.Stopping()
+			logger.Event(logger.LevelNotice, logger.EventServerStopping)
+			cc.Cancel()
+		}
+	}()
+
+	logger.ReopenOnSignal(cc)
+
+	if err := admin.Start(cc, &AdminConfig); err != nil {
+		die("admin socket listen error: %v.", err)
+	}
+
+	lstns := make([]net.Listener, len(Listeners))
+	for i, l := range Listeners {
+		lstn, lerr := server.Listen(cc, l.Name, l.SocketType, l.SocketPath)
+		switch lerr {
+		case nil:
+		case context.Canceled:
+			return
+		default:
+			die("socket listen error: %s: %v.", l.Name, lerr)
+		}
+		if l.SocketType == "unix" && !server.IsInherited(lstn) {
+			defer os.Remove(l.SocketPath)
+			if err := l.SocketOwnership.Apply(l.SocketPath); err != nil {
+				die("socket permission error: %s: %v.", l.Name, err)
+			}
+		}
+		if l.TlsConfig != nil {
+			lstn = tls.NewListener(lstn, l.TlsConfig)
+		}
+		lstns[i] = lstn
+	}
+	if err := server.DropPrivileges(RunUser, RunGroup); err != nil {
+		die("privilege drop error: %v.", err)
+	}
+
+	serr_chan := make(chan error, len(Listeners))
+	for i, l := range Listeners {
+		srv := &http.Server{Addr: l.SocketPath, Handler: l.Mux}
+		go func(lstn net.Listener) {
+			serr_chan <- server.Serve(cc, srv, lstn, DrainTimeout)
+		}(lstns[i])
+
+		logger.Event(logger.LevelNotice, logger.EventServerStarted,
+			logger.SocketType(l.SocketType), logger.SocketPath(l.SocketPath))
+	}
+	server.Ready(cc)
+
+	// A failed listener stops the others, so the process does not
+	// keep serving only a part of the profiles.
+	var serr error
+	for range Listeners {
+		if err := <-serr_chan; err != nil && serr == nil {
+			serr = err
+			cc.Cancel()
+		}
+	}
+	if serr != nil {
+		die("HTTP server error: %v.", serr)
+	}
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"context"
-	"errors"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"html/template"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -16,10 +16,19 @@ import (
 
 	"github.com/l4go/task"
 
+	"ngx_auth/admin"
+	"ngx_auth/assertion"
+	"ngx_auth/audit"
+	"ngx_auth/digest"
 	"ngx_auth/htstat"
+	"ngx_auth/profile"
+	"ngx_auth/server"
+	"ngx_auth/session"
 
+	cfgcheck "ngx_auth/config_check"
 	cfgloader "ngx_auth/config_loader"
 	logger "ngx_auth/logger"
+	"ngx_auth/metrics"
 )
 
 func die(format string, v ...interface{}) {
@@ -34,33 +43,58 @@ func warn(format string, v ...interface{}) {
 type TestAuthConfig struct {
 	SocketType      string            `json:"socket_type" yaml:"socket_type"`
 	SocketPath      string            `json:"socket_path" yaml:"socket_path"`
+	SocketMode      string            `toml:",omitempty" json:"socket_mode,omitempty" yaml:"socket_mode,omitempty"`
+	SocketOwner     string            `toml:",omitempty" json:"socket_owner,omitempty" yaml:"socket_owner,omitempty"`
+	SocketGroup     string            `toml:",omitempty" json:"socket_group,omitempty" yaml:"socket_group,omitempty"`
+	RunUser         string            `toml:",omitempty" json:"run_user,omitempty" yaml:"run_user,omitempty"`
+	RunGroup        string            `toml:",omitempty" json:"run_group,omitempty" yaml:"run_group,omitempty"`
+	DrainSeconds    uint32            `toml:",omitempty" json:"drain_seconds,omitempty" yaml:"drain_seconds,omitempty"`
 	CacheSeconds    uint              `toml:",omitempty" json:"cache_seconds,omitempty" yaml:"cache_seconds,omitempty"`
 	NegCacheSeconds uint              `toml:",omitempty" json:"neg_cache_seconds,omitempty" yaml:"neg_cache_seconds,omitempty"`
 	UseEtag         bool              `toml:",omitempty" json:"use_etag,omitempty" yaml:"use_etag,omitempty"`
-	Password        map[string]string `json:"password" yaml:"password"`
+	Password        map[string]string `json:"password" yaml:"password" secret:"true" expand:"true"`
 	AuthRealm       string            `json:"auth_realm" yaml:"auth_realm"`
 
 	Response htstat.HttpStatusTbl `toml:",omitempty" json:"response,omitempty" yaml:"response,omitempty"`
+	Admin    admin.Config         `toml:",omitempty" json:"admin,omitempty" yaml:"admin,omitempty"`
+	Session  session.Config       `toml:"session,omitempty" json:"session,omitempty" yaml:"session,omitempty"`
+	Login    profile.LoginConfig  `toml:"login,omitempty" json:"login,omitempty" yaml:"login,omitempty"`
+	Tls      server.TlsConfig     `toml:"tls,omitempty" json:"tls,omitempty" yaml:"tls,omitempty"`
 
-	Logging struct {
-		EnableConsole bool   `toml:"enable_console,omitempty" json:"enable_console,omitempty" yaml:"enable_console,omitempty"`
-		Logfile       string `toml:"logfile,omitempty" json:"logfile,omitempty" yaml:"logfile,omitempty"`
-		LoggingLevel  string `toml:"logging_level,omitempty" json:"logging_level,omitempty" yaml:"logging_level,omitempty"`
-	} `toml:"logging,omitempty" json:"logging,omitempty" yaml:"logging,omitempty"`
+	Logging logger.Config `toml:"logging,omitempty" json:"logging,omitempty" yaml:"logging,omitempty"`
+	Audit   audit.Config  `toml:"audit,omitempty" json:"audit,omitempty" yaml:"audit,omitempty"`
+
+	Assertion assertion.Config `toml:"assertion,omitempty" json:"assertion,omitempty" yaml:"assertion,omitempty"`
+
+	Digest digest.Config `toml:"digest,omitempty" json:"digest,omitempty" yaml:"digest,omitempty"`
 }
 
 var SocketType string
 var SocketPath string
+var SocketOwnership server.SocketOwnership
+var RunUser string
+var RunGroup string
+var DrainTimeout time.Duration
+var TlsConfig *tls.Config
 var CacheSeconds uint = 0
 var NegCacheSeconds uint = 0
 var UseEtag bool
 
 var Password map[string]string
 var AuthRealm string
+var Digest *digest.Server
 
 var HttpResponse htstat.HttpStatusTbl
+var AdminConfig admin.Config
+var Assertion *assertion.Issuer
+var Sessions *session.Manager
+var LoginConfig profile.LoginConfig
+var LoginForm *template.Template
 
-var StartTimeMS int64
+var Handler http.Handler
+
+var CheckOnly bool
+var CheckDump bool
 
 func init() {
 	flag.CommandLine.SetOutput(os.Stderr)
@@ -75,6 +109,8 @@ func init() {
 	log.SetFlags(0)
 	logger.SetProgramName(progName)
 
+	flag.BoolVar(&CheckOnly, "t", false, "test the configuration file and exit")
+	flag.BoolVar(&CheckDump, "T", false, "test the configuration file, dump the effective configuration and exit")
 	flag.Parse()
 
 	if flag.NArg() != 1 {
@@ -89,53 +125,107 @@ func init() {
 	defer cfg_f.Close()
 
 	cfg := &TestAuthConfig{}
+	chk := cfgcheck.New(flag.Arg(0))
 	if err := cfgloader.LoadConfig(cfg_f, flag.Arg(0), cfg); err != nil {
-		die("Config file parse error: %s", err)
+		chk.Errorf("", "Config file parse error: %s", err)
+		chk.Exit()
 	}
 
-	// Configure logging
-	logger.SetLoggingLevel(cfg.Logging.LoggingLevel)
+	chk.Logging("logging", &cfg.Logging)
+	chk.Audit("audit", &cfg.Audit)
 
 	SocketType = cfg.SocketType
 	SocketPath = cfg.SocketPath
-
-	if SocketType != "tcp" && SocketType != "unix" {
-		die("Bad socket type: %s", SocketType)
+	DrainTimeout = server.DrainTimeout(cfg.DrainSeconds)
+	chk.SocketType("socket_type", SocketType)
+	chk.Required("socket_path", SocketPath)
+
+	SocketOwnership = server.SocketOwnership{
+		Mode:  cfg.SocketMode,
+		Owner: cfg.SocketOwner,
+		Group: cfg.SocketGroup,
 	}
+	chk.SocketOwnership("", &SocketOwnership)
+
+	RunUser = cfg.RunUser
+	RunGroup = cfg.RunGroup
+	chk.RunUser("run_user", RunUser, "run_group", RunGroup)
+
+	TlsConfig = chk.Tls("tls", SocketType, &cfg.Tls)
 
 	CacheSeconds = cfg.CacheSeconds
 	NegCacheSeconds = cfg.NegCacheSeconds
 	UseEtag = cfg.UseEtag
 
-	if cfg.AuthRealm == "" {
-		die("relm is required")
-	}
+	chk.Required("auth_realm", cfg.AuthRealm)
 	AuthRealm = cfg.AuthRealm
 	Password = cfg.Password
 
+	cfg.Digest.SetDefault()
+	Digest = chk.Digest("digest", &cfg.Digest, AuthRealm)
+
 	cfg.Response.SetDefault()
-	if !cfg.Response.IsValid() {
-		die("response code config error.")
-		return
-	}
+	chk.Response("response", &cfg.Response)
 	HttpResponse = cfg.Response
 
-	StartTimeMS = time.Now().UnixMicro()
-}
+	cfg.Admin.SetDefault()
+	chk.Admin("admin", &cfg.Admin)
+	AdminConfig = cfg.Admin
 
-var ErrUnsupportedSocketType = errors.New("unsupported socket type.")
+	cfg.Assertion.SetDefault()
+	Assertion = chk.Assertion("assertion", &cfg.Assertion, &cfg.Admin)
+	chk.AssertionCache("", Assertion, uint32(CacheSeconds), UseEtag)
 
-func listen(cc task.Canceller, stype string, spath string) (net.Listener, error) {
-	lcnf := &net.ListenConfig{}
+	cfg.Session.SetDefault()
+	Sessions = chk.Session("session", &cfg.Session)
+	if cfg.Session.IsEnabled() && cfg.Session.InsecureCookie {
+		warn("session.insecure_cookie: the session cookie is sent without TLS.")
+	}
+	LoginConfig = cfg.Login
+	LoginForm = chk.Login("login", &LoginConfig, Sessions)
 
-	switch stype {
-	default:
-		return nil, ErrUnsupportedSocketType
-	case "unix":
-	case "tcp":
+	chk.Exit()
+	if CheckDump {
+		if err := cfgloader.Dump(os.Stdout, cfg); err != nil {
+			die("Config dump error: %s", err)
+		}
+	}
+	if CheckOnly || CheckDump {
+		fmt.Fprintf(os.Stderr, "%s: configuration file test is successful\n", flag.Arg(0))
+		os.Exit(0)
 	}
+	metrics.ConfigReloads.Inc("config", "ok")
 
-	return lcnf.Listen(cc.AsContext(), stype, spath)
+	if err := logger.Setup(&cfg.Logging); err != nil {
+		die("logfile setting error: %s", err)
+	}
+	if err := audit.Setup(progName, &cfg.Audit); err != nil {
+		die("audit log setting error: %s", err)
+	}
+
+	if Assertion != nil {
+		admin.Handle(Assertion.JwksPath, Assertion.JwksHandler())
+	}
+
+	common := profile.Common{
+		CacheSeconds:    uint32(CacheSeconds),
+		NegCacheSeconds: uint32(NegCacheSeconds),
+		UseEtag:         UseEtag,
+		AuthRealm:       AuthRealm,
+		Response:        HttpResponse,
+		Sessions:        Sessions,
+		LoginUrl:        LoginConfig.LoginUrl,
+		Assertion:       Assertion,
+	}
+	Handler = profile.NewSimple(common, Password, Digest)
+
+	if LoginForm != nil {
+		login, err := profile.NewLogin(common, LoginConfig.Prefix, LoginForm, Handler)
+		if err != nil {
+			die("login form setting error: %s", err)
+		}
+		Handler = login
+	}
 }
 
 func main() {
@@ -150,36 +240,47 @@ func main() {
 		select {
 		case <-cc.RecvCancel():
 		case <-signal_chan:
+			server.Stopping()
+			logger.Event(logger.LevelNotice, logger.EventServerStopping,
+				logger.SocketType(SocketType), logger.SocketPath(SocketPath))
 			cc.Cancel()
 		}
-		srv.Close()
 	}()
 
-	http.HandleFunc("/", TestAuthHandler)
+	logger.ReopenOnSignal(cc)
+
+	http.Handle("/", Handler)
 
-	lstn, lerr := listen(cc, SocketType, SocketPath)
+	if err := admin.Start(cc, &AdminConfig); err != nil {
+		die("admin socket listen error: %v.", err)
+	}
+
+	lstn, lerr := server.Listen(cc, server.NameAuth, SocketType, SocketPath)
 	switch lerr {
 	case nil:
 	case context.Canceled:
 	default:
 		die("socket listen error: %v.", lerr)
 	}
-	if SocketType == "unix" {
+	if SocketType == "unix" && !server.IsInherited(lstn) {
 		defer os.Remove(SocketPath)
-		os.Chmod(SocketPath, 0777)
+		if err := SocketOwnership.Apply(SocketPath); err != nil {
+			die("socket permission error: %v.", err)
+		}
+	}
+	if err := server.DropPrivileges(RunUser, RunGroup); err != nil {
+		die("privilege drop error: %v.", err)
 	}
 
-	if SocketType == "unix" {
-		logger.LogWithTime("Server started: socket_type=unix socket_path=%s", SocketPath)
-	} else {
-		logger.LogWithTime("Server started: socket_type=tcp socket_path=%s", SocketPath)
+	if TlsConfig != nil {
+		lstn = tls.NewListener(lstn, TlsConfig)
 	}
 
-	serr := srv.Serve(lstn)
-	switch serr {
-	case nil:
-	case http.ErrServerClosed:
-	default:
+	logger.Event(logger.LevelNotice, logger.EventServerStarted,
+		logger.SocketType(SocketType), logger.SocketPath(SocketPath))
+	server.Ready(cc)
+
+	if serr := server.Serve(cc, srv, lstn, DrainTimeout); serr != nil {
 		die("HTTP server error: %v.", serr)
 	}
 }
@@ -4,17 +4,18 @@ go 1.24.0
 
 require (
 	github.com/bgentry/speakeasy v0.2.0
+	github.com/go-asn1-ber/asn1-ber v1.5.5
 	github.com/go-ldap/ldap/v3 v3.4.8
 	github.com/goccy/go-yaml v1.19.0
 	github.com/l4go/task v1.20220225.0
 	github.com/l4go/var_mtx v1.20220131.0
 	github.com/naoina/toml v0.1.2-0.20220808084321-5b37ad7d4c47
+	golang.org/x/crypto v0.45.0
 )
 
 require (
 	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
-	github.com/go-asn1-ber/asn1-ber v1.5.5 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/naoina/go-stringutil v0.1.0 // indirect
-	golang.org/x/crypto v0.45.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
 )
@@ -0,0 +1,114 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CheckFunc reports the readiness of one dependency.
+// The returned string is a short detail shown in the readiness JSON.
+type CheckFunc func() (string, error)
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+var (
+	mu     sync.Mutex
+	checks []check
+)
+
+// Register adds a readiness check. Checks are reported in registration order.
+func Register(name string, fn CheckFunc) {
+	mu.Lock()
+	checks = append(checks, check{name: name, fn: fn})
+	mu.Unlock()
+}
+
+// Cached wraps fn so that it runs at most once per ttl.
+// It is used for probes that talk to an external server, such as LDAP.
+func Cached(ttl time.Duration, fn CheckFunc) CheckFunc {
+	var c_mu sync.Mutex
+	var last time.Time
+	var detail string
+	var err error
+
+	return func() (string, error) {
+		c_mu.Lock()
+		defer c_mu.Unlock()
+
+		if !last.IsZero() && time.Since(last) < ttl {
+			return detail, err
+		}
+		detail, err = fn()
+		last = time.Now()
+		return detail, err
+	}
+}
+
+type CheckResult struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Result struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+const (
+	StatusOk   = "ok"
+	StatusFail = "fail"
+)
+
+// Run executes all registered checks.
+func Run() *Result {
+	mu.Lock()
+	cs := make([]check, len(checks))
+	copy(cs, checks)
+	mu.Unlock()
+
+	res := &Result{Status: StatusOk, Checks: map[string]CheckResult{}}
+	for _, c := range cs {
+		detail, err := c.fn()
+		cr := CheckResult{Status: StatusOk, Detail: detail}
+		if err != nil {
+			cr.Status = StatusFail
+			cr.Error = err.Error()
+			res.Status = StatusFail
+		}
+		res.Checks[c.name] = cr
+	}
+
+	return res
+}
+
+func write_json(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// LiveHandler answers 200 while the process is serving.
+func LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		write_json(w, http.StatusOK, &Result{Status: StatusOk})
+	})
+}
+
+// ReadyHandler answers 200 if all checks pass, and 503 otherwise.
+func ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		res := Run()
+		code := http.StatusOK
+		if res.Status != StatusOk {
+			code = http.StatusServiceUnavailable
+		}
+		write_json(w, code, res)
+	})
+}
@@ -0,0 +1,102 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"ngx_auth/jwt"
+)
+
+func get(t *testing.T, h http.Handler) (int, *Result) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	res := &Result{}
+	if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+		t.Fatalf("body %q: %v", w.Body.String(), err)
+	}
+	return w.Code, res
+}
+
+func TestHandlers(t *testing.T) {
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer jwks.Close()
+
+	var ldap_err error
+	Register("ldap", func() (string, error) {
+		return "host=ldap://127.0.0.1:389", ldap_err
+	})
+
+	steps := []struct {
+		name   string
+		setup  func()
+		code   int
+		status string
+		failed []string
+	}{
+		{"ready", func() {}, http.StatusOK, StatusOk, nil},
+		{"ldap fails", func() { ldap_err = errors.New("connection refused") },
+			http.StatusServiceUnavailable, StatusFail, []string{"ldap"}},
+		{"ldap is back", func() { ldap_err = nil }, http.StatusOK, StatusOk, nil},
+		{"jwks fails", func() {
+			Register("jwks", jwt.NewRemoteKeys(jwks.URL, time.Hour, time.Second).Check)
+		}, http.StatusServiceUnavailable, StatusFail, []string{"jwks"}},
+	}
+	for _, st := range steps {
+		st.setup()
+		code, res := get(t, ReadyHandler())
+		if code != st.code || res.Status != st.status {
+			t.Errorf("%s: ReadyHandler() = %d %q, want %d %q", st.name, code, res.Status, st.code, st.status)
+		}
+		for _, name := range st.failed {
+			if cr := res.Checks[name]; cr.Status != StatusFail || cr.Error == "" {
+				t.Errorf("%s: check %s = %+v, want a failure", st.name, name, cr)
+			}
+		}
+		if cr := res.Checks["ldap"]; cr.Detail != "host=ldap://127.0.0.1:389" {
+			t.Errorf("%s: check ldap detail = %q", st.name, cr.Detail)
+		}
+
+		// The liveness does not depend on the checks.
+		code, res = get(t, LiveHandler())
+		if code != http.StatusOK || res.Status != StatusOk || len(res.Checks) != 0 {
+			t.Errorf("%s: LiveHandler() = %d %+v, want %d %q", st.name, code, res, http.StatusOK, StatusOk)
+		}
+	}
+}
+
+func TestCached(t *testing.T) {
+	calls := 0
+	fn := Cached(time.Hour, func() (string, error) {
+		calls++
+		return "", errors.New("down")
+	})
+	for i := 0; i < 3; i++ {
+		if _, err := fn(); err == nil {
+			t.Errorf("Cached() error = nil, want the cached error")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+
+	calls = 0
+	fn = Cached(0, func() (string, error) {
+		calls++
+		return "", nil
+	})
+	fn()
+	fn()
+	if calls != 2 {
+		t.Errorf("calls without a TTL = %d, want 2", calls)
+	}
+}
@@ -0,0 +1,69 @@
+package jwt
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// lookup returns the claim of name. A name with dots, such as
+// "realm_access.roles", is a path in nested objects, unless a claim has
+// the whole name, such as "https://example.com/groups".
+func lookup(claims Claims, name string) (interface{}, bool) {
+	if v, ok := claims[name]; ok {
+		return v, true
+	}
+
+	var cur interface{} = map[string]interface{}(claims)
+	for _, key := range strings.Split(name, ".") {
+		obj, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		cur, ok = obj[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// String returns a string claim, or "" if it is not a string.
+func String(claims Claims, name string) string {
+	v, _ := lookup(claims, name)
+	s, _ := v.(string)
+	return s
+}
+
+// Strings returns a claim of a string or an array of strings.
+// The other values in an array are skipped.
+func Strings(claims Claims, name string) []string {
+	v, _ := lookup(claims, name)
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		strs := []string{}
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	}
+	return nil
+}
+
+// Expired reports whether the exp claim is past. Unlike Verify, it does not
+// check the signature, and allows no leeway.
+func Expired(claims Claims) bool {
+	num, ok := claims["exp"].(json.Number)
+	if !ok {
+		return false
+	}
+	exp, err := num.Float64()
+	if err != nil {
+		return false
+	}
+	return !time.Now().Before(time.Unix(int64(exp), 0))
+}
@@ -0,0 +1,279 @@
+// Package jwt verifies JSON Web Tokens signed with HS256, RS256, ES256 or
+// EdDSA, with the keys of a JWKS file or a JWKS URL, and signs the
+// identity assertions with a private key.
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	logger "ngx_auth/logger"
+)
+
+var (
+	ErrNoKeys       = errors.New("no usable key in JWKS")
+	ErrJwksFetch    = errors.New("JWKS fetch error")
+	ErrUnknownKeyId = errors.New("unknown key ID")
+)
+
+// Key is one verification key. Public is *rsa.PublicKey, *ecdsa.PublicKey,
+// ed25519.PublicKey or []byte of a HMAC secret.
+type Key struct {
+	Id     string
+	Alg    string
+	Public interface{}
+}
+
+// KeySet is the keys of a JWKS.
+type KeySet struct {
+	Keys []Key
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func b64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func (k *jwk) public() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64(k.E)
+		if err != nil {
+			return nil, err
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key %q is shorter than 2048 bits", k.Kid)
+		}
+		return pub, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(),
+			X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("EC key %q is not on the curve", k.Kid)
+		}
+		return pub, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("bad Ed25519 key %q", k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		return b64(k.K)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// ParseJWKS parses a JWKS. Keys of other uses than signatures, and keys of
+// unsupported types or curves, are skipped.
+func ParseJWKS(bin []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(bin, &doc); err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{}
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.public()
+		if err != nil {
+			continue
+		}
+		ks.Keys = append(ks.Keys, Key{Id: k.Kid, Alg: k.Alg, Public: pub})
+	}
+	if len(ks.Keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	return ks, nil
+}
+
+func LoadJWKSFile(file string) (*KeySet, error) {
+	bin, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(bin)
+}
+
+// KeySource returns the current keys.
+type KeySource interface {
+	// KeySet returns the keys. refresh asks for a new JWKS, because a token
+	// has an unknown key ID.
+	KeySet(refresh bool) (*KeySet, error)
+}
+
+// StaticKeys is keys loaded at startup, such as a JWKS file or a HMAC secret.
+type StaticKeys struct {
+	Keys *KeySet
+}
+
+func (sk *StaticKeys) KeySet(bool) (*KeySet, error) {
+	return sk.Keys, nil
+}
+
+// MinRefreshInterval limits the fetches for unknown key IDs.
+const MinRefreshInterval = 30 * time.Second
+
+// DefaultFetchTimeout is the timeout of a JWKS fetch.
+const DefaultFetchTimeout = 10 * time.Second
+
+// RemoteKeys fetches a JWKS URL, and caches it for CacheTTL.
+// The last JWKS is kept if a fetch fails, and used while a fetch is running.
+type RemoteKeys struct {
+	Url      string
+	CacheTTL time.Duration
+	Client   *http.Client
+
+	mu       sync.Mutex
+	keys     *KeySet
+	fetched  time.Time
+	failed   time.Time
+	fail_err error
+	fetching chan struct{}
+}
+
+func NewRemoteKeys(url string, ttl time.Duration, timeout time.Duration) *RemoteKeys {
+	return &RemoteKeys{
+		Url:      url,
+		CacheTTL: ttl,
+		Client:   &http.Client{Timeout: timeout},
+	}
+}
+
+func (rk *RemoteKeys) fetch() (*KeySet, error) {
+	res, err := rk.Client.Get(rk.Url)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrJwksFetch, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrJwksFetch, res.Status)
+	}
+	bin, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrJwksFetch, err)
+	}
+	ks, err := ParseJWKS(bin)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrJwksFetch, err)
+	}
+	return ks, nil
+}
+
+func (rk *RemoteKeys) needs_fetch(refresh bool) bool {
+	age := time.Since(rk.fetched)
+	stale := rk.keys == nil || age >= rk.CacheTTL
+	if !stale && !(refresh && age >= MinRefreshInterval) {
+		return false
+	}
+
+	// A failing URL is not fetched again for every request.
+	return time.Since(rk.failed) >= MinRefreshInterval
+}
+
+func (rk *RemoteKeys) KeySet(refresh bool) (*KeySet, error) {
+	rk.mu.Lock()
+	if !rk.needs_fetch(refresh) {
+		defer rk.mu.Unlock()
+		return rk.last()
+	}
+
+	// One request fetches the JWKS without the lock. The others use the last
+	// JWKS meanwhile, or wait for the fetch if there is none yet.
+	if done := rk.fetching; done != nil {
+		if rk.keys == nil {
+			rk.mu.Unlock()
+			<-done
+			rk.mu.Lock()
+		}
+		defer rk.mu.Unlock()
+		return rk.last()
+	}
+	done := make(chan struct{})
+	rk.fetching = done
+	rk.mu.Unlock()
+
+	ks, err := rk.fetch()
+
+	rk.mu.Lock()
+	defer rk.mu.Unlock()
+	rk.fetching = nil
+	close(done)
+	if err != nil {
+		logger.Event(logger.LevelWarn, logger.EventJwksFetchError,
+			logger.Target(rk.Url), logger.Err(err))
+		rk.failed = time.Now()
+		rk.fail_err = err
+		return rk.last()
+	}
+	rk.keys = ks
+	rk.fetched = time.Now()
+	rk.failed = time.Time{}
+	return ks, nil
+}
+
+func (rk *RemoteKeys) last() (*KeySet, error) {
+	if rk.keys != nil {
+		return rk.keys, nil
+	}
+	return nil, rk.fail_err
+}
+
+// Check fetches the JWKS for the readiness check.
+func (rk *RemoteKeys) Check() (string, error) {
+	ks, err := rk.KeySet(false)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d keys", len(ks.Keys)), nil
+}
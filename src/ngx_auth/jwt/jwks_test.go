@@ -0,0 +1,119 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testJwks serves a JWKS, and holds the fetches while block is set.
+type testJwks struct {
+	*httptest.Server
+	fetches atomic.Int32
+	block   chan struct{}
+	entered chan struct{}
+}
+
+func newTestJwks(t *testing.T) *testJwks {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"k1","x":%q}]}`, b64url(pub))
+	tj := &testJwks{}
+	tj.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tj.fetches.Add(1)
+		if tj.block != nil {
+			tj.entered <- struct{}{}
+			<-tj.block
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(tj.Close)
+	return tj
+}
+
+func (tj *testJwks) hold() {
+	tj.block = make(chan struct{})
+	tj.entered = make(chan struct{}, 10)
+}
+
+func TestRemoteKeysFetching(t *testing.T) {
+	tj := newTestJwks(t)
+	rk := NewRemoteKeys(tj.URL, 0, DefaultFetchTimeout)
+	if ks, err := rk.KeySet(false); err != nil || len(ks.Keys) != 1 {
+		t.Fatalf("KeySet() = %v, %v, want 1 key", ks, err)
+	}
+
+	// The cache TTL is 0, so every request fetches unless a fetch is running.
+	tj.hold()
+	fetched := make(chan error)
+	go func() {
+		_, err := rk.KeySet(false)
+		fetched <- err
+	}()
+	<-tj.entered
+
+	last := make(chan error)
+	go func() {
+		_, err := rk.KeySet(true)
+		last <- err
+	}()
+	select {
+	case err := <-last:
+		if err != nil {
+			t.Errorf("KeySet() during a fetch error = %v, want the last JWKS", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("KeySet() during a fetch waits for it, want the last JWKS")
+	}
+
+	close(tj.block)
+	if err := <-fetched; err != nil {
+		t.Errorf("KeySet() fetching error = %v", err)
+	}
+	if n := tj.fetches.Load(); n != 2 {
+		t.Errorf("fetches = %d, want 2", n)
+	}
+}
+
+func TestRemoteKeysFirstFetch(t *testing.T) {
+	tj := newTestJwks(t)
+	tj.hold()
+	rk := NewRemoteKeys(tj.URL, time.Hour, DefaultFetchTimeout)
+
+	const n = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ks, err := rk.KeySet(false)
+			if err == nil && len(ks.Keys) != 1 {
+				err = fmt.Errorf("%d keys", len(ks.Keys))
+			}
+			errs <- err
+		}()
+	}
+	<-tj.entered
+	// The other requests have no last JWKS, so they wait for the fetch.
+	time.Sleep(50 * time.Millisecond)
+	close(tj.block)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("KeySet() error = %v, want 1 key", err)
+		}
+	}
+	if got := tj.fetches.Load(); got != 1 {
+		t.Errorf("fetches = %d, want 1", got)
+	}
+}
@@ -0,0 +1,165 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+var ErrBadKey = errors.New("unsupported private key")
+
+// Signer signs tokens with a private key. The algorithm follows the key:
+// RS256 for RSA, ES256 for P-256 and EdDSA for Ed25519.
+type Signer struct {
+	Id  string
+	Alg string
+	key crypto.Signer
+}
+
+// NewSigner returns a signer of key. An empty kid is replaced with the
+// RFC 7638 thumbprint of the public key.
+func NewSigner(key crypto.Signer, kid string) (*Signer, error) {
+	s := &Signer{Id: kid, key: key}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("%w: RSA key is shorter than 2048 bits", ErrBadKey)
+		}
+		s.Alg = AlgRS256
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%w: EC key is not P-256", ErrBadKey)
+		}
+		s.Alg = AlgES256
+	case ed25519.PrivateKey:
+		s.Alg = AlgEdDSA
+	default:
+		return nil, ErrBadKey
+	}
+	if s.Id == "" {
+		s.Id = s.Thumbprint()
+	}
+	return s, nil
+}
+
+// LoadSigner reads a PEM private key of PKCS #8, PKCS #1 or SEC 1.
+func LoadSigner(file string, kid string) (*Signer, error) {
+	bin, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(bin)
+	if blk == nil {
+		return nil, fmt.Errorf("%s: no PEM block", file)
+	}
+
+	var key interface{}
+	switch blk.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(blk.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(blk.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(blk.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", file, ErrBadKey)
+	}
+	return NewSigner(signer, kid)
+}
+
+// Sign returns the compact JWS of claims.
+func (s *Signer) Sign(claims Claims) (string, error) {
+	hd, err := json.Marshal(header{Alg: s.Alg, Kid: s.Id, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(hd) + "." +
+		base64.RawURLEncoding.EncodeToString(body)
+
+	sig, err := s.sign([]byte(signed))
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (s *Signer) sign(signed []byte) ([]byte, error) {
+	switch k := s.key.(type) {
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256(signed)
+		return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256(signed)
+		r, sv, err := ecdsa.Sign(rand.Reader, k, sum[:])
+		if err != nil {
+			return nil, err
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		sv.FillBytes(sig[32:])
+		return sig, nil
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, signed), nil
+	}
+	return nil, ErrBadKey
+}
+
+func b64enc(bin []byte) string {
+	return base64.RawURLEncoding.EncodeToString(bin)
+}
+
+// public_jwk returns the members of the public key, without kid, use and alg.
+func (s *Signer) public_jwk() map[string]string {
+	switch k := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA",
+			"n": b64enc(k.N.Bytes()), "e": b64enc(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		k.X.FillBytes(x)
+		k.Y.FillBytes(y)
+		return map[string]string{"kty": "EC", "crv": "P-256", "x": b64enc(x), "y": b64enc(y)}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "crv": "Ed25519", "x": b64enc(k)}
+	}
+	return nil
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the public key.
+func (s *Signer) Thumbprint() string {
+	// json.Marshal sorts the members as RFC 7638 requires.
+	bin, _ := json.Marshal(s.public_jwk())
+	sum := sha256.Sum256(bin)
+	return b64enc(sum[:])
+}
+
+// PublicJWKS returns the JWKS of the public key.
+func (s *Signer) PublicJWKS() ([]byte, error) {
+	k := s.public_jwk()
+	k["kid"] = s.Id
+	k["use"] = "sig"
+	k["alg"] = s.Alg
+	return json.Marshal(map[string]interface{}{"keys": []map[string]string{k}})
+}
@@ -0,0 +1,275 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Signature algorithms.
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+var (
+	ErrMalformed    = errors.New("malformed token")
+	ErrBadAlg       = errors.New("unsupported or disallowed algorithm")
+	ErrBadSignature = errors.New("bad signature")
+	ErrExpired      = errors.New("token is expired")
+	ErrNoExp        = errors.New("no exp claim")
+	ErrNotYetValid  = errors.New("token is not valid yet")
+	ErrBadIssuer    = errors.New("bad issuer")
+	ErrBadAudience  = errors.New("bad audience")
+	ErrNoUser       = errors.New("no user claim")
+)
+
+// Claims is the payload of a token.
+type Claims map[string]interface{}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// Verifier checks the signature and the registered claims of tokens.
+type Verifier struct {
+	Keys KeySource
+	// Algs is the allowed algorithms. Empty allows all supported ones.
+	Algs []string
+	// Issuer is the required iss claim, if not empty.
+	Issuer string
+	// Audience is the accepted aud claims. The token must have one of them,
+	// if not empty.
+	Audience []string
+	// Leeway is the allowed clock skew for exp and nbf.
+	Leeway time.Duration
+	// AllowNoExp accepts a token without the exp claim, which is valid
+	// forever. It is only for tokens whose freshness is checked otherwise.
+	AllowNoExp bool
+}
+
+// Parse decodes the claims without verification. The claims must not be
+// trusted before Verify succeeds.
+func Parse(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var claims Claims
+	if err := decode_part(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decode_part(part string, v interface{}) error {
+	bin, err := b64(part)
+	if err != nil {
+		return ErrMalformed
+	}
+	dec := json.NewDecoder(strings.NewReader(string(bin)))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
+
+func (v *Verifier) alg_allowed(alg string) bool {
+	switch alg {
+	case AlgHS256, AlgRS256, AlgES256, AlgEdDSA:
+	default:
+		return false
+	}
+	if len(v.Algs) == 0 {
+		return true
+	}
+	for _, a := range v.Algs {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify checks the token, and returns its claims.
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var hd header
+	if err := decode_part(parts[0], &hd); err != nil {
+		return nil, err
+	}
+	if !v.alg_allowed(hd.Alg) {
+		return nil, fmt.Errorf("%w: %q", ErrBadAlg, hd.Alg)
+	}
+	sig, err := b64(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	if err := v.verify_signature(hd, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decode_part(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.check_claims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *Verifier) verify_signature(hd header, signed []byte, sig []byte) error {
+	ks, err := v.Keys.KeySet(false)
+	if err != nil {
+		return err
+	}
+	if hd.Kid != "" && find_key(ks, hd.Kid) == nil {
+		ks, err = v.Keys.KeySet(true)
+		if err != nil {
+			return err
+		}
+		if find_key(ks, hd.Kid) == nil {
+			return fmt.Errorf("%w: %q", ErrUnknownKeyId, hd.Kid)
+		}
+	}
+
+	for _, k := range ks.Keys {
+		if hd.Kid != "" && k.Id != hd.Kid {
+			continue
+		}
+		if k.Alg != "" && k.Alg != hd.Alg {
+			continue
+		}
+		if verify_with(hd.Alg, k.Public, signed, sig) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+func find_key(ks *KeySet, kid string) *Key {
+	for i := range ks.Keys {
+		if ks.Keys[i].Id == kid {
+			return &ks.Keys[i]
+		}
+	}
+	return nil
+}
+
+// verify_with checks the signature only with a key of the type of alg,
+// so that a public key is never used as a HMAC secret.
+func verify_with(alg string, pub interface{}, signed []byte, sig []byte) bool {
+	switch alg {
+	case AlgHS256:
+		secret, ok := pub.([]byte)
+		if !ok || len(secret) == 0 {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case AlgRS256:
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		sum := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil
+	case AlgES256:
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		sum := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key, sum[:], r, s)
+	case AlgEdDSA:
+		key, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(key, signed, sig)
+	}
+	return false
+}
+
+func numeric_date(claims Claims, name string) (time.Time, bool, error) {
+	raw, has := claims[name]
+	if !has {
+		return time.Time{}, false, nil
+	}
+	num, ok := raw.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("%w: %s is not a number", ErrMalformed, name)
+	}
+	f, err := num.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%w: %s is not a number", ErrMalformed, name)
+	}
+	return time.Unix(int64(f), 0), true, nil
+}
+
+func (v *Verifier) check_claims(claims Claims, now time.Time) error {
+	exp, has, err := numeric_date(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !has && !v.AllowNoExp {
+		return ErrNoExp
+	}
+	if has && !now.Before(exp.Add(v.Leeway)) {
+		return ErrExpired
+	}
+
+	nbf, has, err := numeric_date(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if has && now.Add(v.Leeway).Before(nbf) {
+		return ErrNotYetValid
+	}
+
+	if v.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.Issuer {
+			return ErrBadIssuer
+		}
+	}
+
+	if len(v.Audience) > 0 {
+		if !has_audience(Strings(claims, "aud"), v.Audience) {
+			return ErrBadAudience
+		}
+	}
+	return nil
+}
+
+func has_audience(auds []string, accepted []string) bool {
+	for _, aud := range auds {
+		for _, a := range accepted {
+			if aud == a {
+				return true
+			}
+		}
+	}
+	return false
+}
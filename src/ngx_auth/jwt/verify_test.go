@@ -0,0 +1,202 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var hmac_secret = []byte("0123456789abcdef0123456789abcdef")
+
+// sign returns a token of a header and claims signed with key, which is an
+// HMAC secret, a P-256 key or an Ed25519 key.
+func sign(t *testing.T, hd header, claims Claims, key interface{}) string {
+	t.Helper()
+	hbin, err := json.Marshal(hd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cbin, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := b64url(hbin) + "." + b64url(cbin)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		hm := hmac.New(sha256.New, k)
+		hm.Write([]byte(signed))
+		sig = hm.Sum(nil)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	return signed + "." + b64url(sig)
+}
+
+func b64url(bin []byte) string {
+	return base64.RawURLEncoding.EncodeToString(bin)
+}
+
+// tamper replaces the payload of a token, keeping its signature.
+func tamper(token string, claims Claims) string {
+	parts := strings.Split(token, ".")
+	bin, _ := json.Marshal(claims)
+	return parts[0] + "." + b64url(bin) + "." + parts[2]
+}
+
+func TestVerifySignature(t *testing.T) {
+	ec_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := header{Alg: AlgES256, Kid: "ec"}
+	ed := header{Alg: AlgEdDSA, Kid: "ed"}
+	hs := header{Alg: AlgHS256, Kid: "hs"}
+
+	keys := &StaticKeys{Keys: &KeySet{Keys: []Key{
+		{Id: "ec", Alg: AlgES256, Public: ec_key.Public()},
+		{Id: "ed", Alg: AlgEdDSA, Public: ed_key.Public()},
+		{Id: "hs", Alg: AlgHS256, Public: hmac_secret},
+	}}}
+	ec_only := &StaticKeys{Keys: &KeySet{Keys: []Key{
+		{Id: "ec", Public: ec_key.Public()},
+	}}}
+
+	exp := json.Number(strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	claims := Claims{"sub": "user1", "exp": exp}
+	forged := Claims{"sub": "admin", "exp": exp}
+	es_token := sign(t, es, claims, ec_key)
+
+	tests := []struct {
+		name  string
+		keys  KeySource
+		algs  []string
+		token string
+		err   error
+	}{
+		{"es256", keys, nil, es_token, nil},
+		{"eddsa", keys, nil, sign(t, ed, claims, ed_key), nil},
+		{"hs256", keys, nil, sign(t, hs, claims, hmac_secret), nil},
+		{"hs256 without kid", keys, nil, sign(t, header{Alg: AlgHS256}, claims, hmac_secret), nil},
+		{"allowed alg", keys, []string{AlgES256}, sign(t, es, claims, ec_key), nil},
+		{"disallowed alg", keys, []string{AlgES256}, sign(t, ed, claims, ed_key), ErrBadAlg},
+		{"alg none", keys, nil, sign(t, header{Alg: "none"}, claims, []byte(nil)), ErrBadAlg},
+		{"tampered payload", keys, nil, tamper(sign(t, es, claims, ec_key), forged), ErrBadSignature},
+		{"tampered hs256", keys, nil,
+			tamper(sign(t, hs, claims, hmac_secret), forged), ErrBadSignature},
+		{"other key of same kid", keys, nil, sign(t, es, claims, other_key), ErrBadSignature},
+		{"wrong hmac secret", keys, nil,
+			sign(t, hs, claims, []byte("another secret of 32 bytes......")), ErrBadSignature},
+		{"public key as hmac secret", ec_only, nil,
+			sign(t, header{Alg: AlgHS256, Kid: "ec"}, claims, []byte("ec")), ErrBadSignature},
+		{"unknown kid", keys, nil, sign(t, header{Alg: AlgES256, Kid: "nokey"}, claims, ec_key), ErrUnknownKeyId},
+		{"two parts", keys, nil, "e30.e30", ErrMalformed},
+		{"bad base64", keys, nil, es_token[:strings.LastIndex(es_token, ".")+1] + "!!", ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &Verifier{Keys: tt.keys, Algs: tt.algs}
+			got, err := v.Verify(tt.token)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && String(got, "sub") != "user1" {
+				t.Errorf("Verify() sub = %q, want %q", String(got, "sub"), "user1")
+			}
+		})
+	}
+}
+
+func num(tm time.Time) json.Number {
+	return json.Number(strconv.FormatInt(tm.Unix(), 10))
+}
+
+func TestCheckClaims(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	future := num(now.Add(time.Minute))
+
+	tests := []struct {
+		name   string
+		v      Verifier
+		claims Claims
+		err    error
+	}{
+		{"valid", Verifier{}, Claims{"exp": future}, nil},
+		{"no exp", Verifier{}, Claims{}, ErrNoExp},
+		{"no exp allowed", Verifier{AllowNoExp: true}, Claims{}, nil},
+		{"expired", Verifier{}, Claims{"exp": num(now)}, ErrExpired},
+		{"expired within leeway", Verifier{Leeway: time.Minute},
+			Claims{"exp": num(now.Add(-30 * time.Second))}, nil},
+		{"expired past leeway", Verifier{Leeway: time.Minute},
+			Claims{"exp": num(now.Add(-time.Minute))}, ErrExpired},
+		{"exp not a number", Verifier{}, Claims{"exp": "tomorrow"}, ErrMalformed},
+		{"not yet valid", Verifier{},
+			Claims{"exp": future, "nbf": num(now.Add(time.Second))}, ErrNotYetValid},
+		{"nbf within leeway", Verifier{Leeway: time.Minute},
+			Claims{"exp": future, "nbf": num(now.Add(30 * time.Second))}, nil},
+		{"issuer", Verifier{Issuer: "https://idp"},
+			Claims{"exp": future, "iss": "https://idp"}, nil},
+		{"bad issuer", Verifier{Issuer: "https://idp"},
+			Claims{"exp": future, "iss": "https://other"}, ErrBadIssuer},
+		{"no issuer", Verifier{Issuer: "https://idp"}, Claims{"exp": future}, ErrBadIssuer},
+		{"audience string", Verifier{Audience: []string{"api"}},
+			Claims{"exp": future, "aud": "api"}, nil},
+		{"audience array", Verifier{Audience: []string{"api", "web"}},
+			Claims{"exp": future, "aud": []interface{}{"other", "web"}}, nil},
+		{"bad audience", Verifier{Audience: []string{"api"}},
+			Claims{"exp": future, "aud": []interface{}{"other"}}, ErrBadAudience},
+		{"no audience", Verifier{Audience: []string{"api"}}, Claims{"exp": future}, ErrBadAudience},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.v.check_claims(tt.claims, now); !errors.Is(err, tt.err) {
+				t.Errorf("check_claims() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestExpired(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims Claims
+		want   bool
+	}{
+		{"past", Claims{"exp": num(time.Now().Add(-time.Second))}, true},
+		{"future", Claims{"exp": num(time.Now().Add(time.Minute))}, false},
+		{"no exp", Claims{}, false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Expired(tt.claims); got != tt.want {
+				t.Errorf("Expired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
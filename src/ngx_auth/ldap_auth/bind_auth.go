@@ -3,13 +3,16 @@ package ldap_auth
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"io/ioutil"
+	"net"
 	"regexp"
 	"strings"
 	"time"
 	"unicode"
 
 	logger "ngx_auth/logger"
+	"ngx_auth/metrics"
 
 	ldap "github.com/go-ldap/ldap/v3"
 )
@@ -31,12 +34,29 @@ type Config struct {
 	UniqueFilter string
 	AuthzFilter  string
 
+	// SearchBindDn and SearchPassword are the account for searches
+	// without the user password. Without them, searches are anonymous.
+	SearchBindDn   string
+	SearchPassword string
+
 	Timeout int
+
+	// PoolSize is the number of idle connections kept for reuse.
+	// 0 disables the pool, and each request dials a new connection.
+	PoolSize int
+
+	// OfflineCacheSeconds is the maximum age of the credentials kept for
+	// the outages of the server. 0 disables the offline cache.
+	OfflineCacheSeconds int
 }
 
 type LdapAuth struct {
 	cfg  *Config
 	conn *ldap.Conn
+	pool *connPool
+
+	reused bool
+	broken bool
 }
 
 var paramReg = regexp.MustCompile(`%[a-z%]`)
@@ -77,21 +97,63 @@ func replace_user(val_fmt string, user string) string {
 	})
 }
 
-// logIfLevel logs the message only if the current level >= requiredLevel
-func logIfLevel(requiredLevel int, format string, v ...interface{}) {
-	if logger.GetLoggingLevel() >= requiredLevel {
-		logger.LogWithTime(format, v...)
+// error_class returns the metrics label of an LDAP operation error.
+func error_class(err error) string {
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return "timeout"
+	}
+
+	var lerr *ldap.Error
+	if !errors.As(err, &lerr) {
+		return "other"
+	}
+
+	switch lerr.ResultCode {
+	case ldap.LDAPResultInvalidCredentials:
+		return "invalid_credentials"
+	case ldap.LDAPResultTimeLimitExceeded:
+		return "timeout"
+	case ldap.ErrorNetwork, ldap.LDAPResultConnectError,
+		ldap.LDAPResultBusy, ldap.LDAPResultUnavailable:
+		return "unavailable"
+	case ldap.ErrorFilterCompile, ldap.LDAPResultFilterError:
+		return "filter"
 	}
+
+	return "other"
+}
+
+func count_error(class string) {
+	metrics.LdapErrors.Inc(class)
+}
+
+func observe(op string, start time.Time) {
+	metrics.LdapDuration.Observe(time.Since(start).Seconds(), op)
 }
 
 func NewLdapAuth(cfg *Config) (*LdapAuth, error) {
+	pool := get_pool(cfg)
+	if conn := pool.get(); conn != nil {
+		return &LdapAuth{cfg: cfg, conn: conn, pool: pool, reused: true}, nil
+	}
 
+	conn, err := dial(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &LdapAuth{cfg: cfg, conn: conn, pool: pool}, nil
+}
+
+func dial(cfg *Config) (*ldap.Conn, error) {
 	ca_pool := x509.NewCertPool()
 	if len(cfg.RootCaFiles) > 0 {
 		for _, fn := range cfg.RootCaFiles {
 			ca_pem, e := ioutil.ReadFile(fn)
 			if e != nil {
-				logger.LogWithTime("LDAP CA file read error: file=%s err=%v", fn, e)
+				logger.Event(logger.LevelError, logger.EventLdapCaFileError,
+					logger.File(fn), logger.Err(e))
+				count_error("ca_file")
 				return nil, e
 			}
 			ca_pool.AppendCertsFromPEM(ca_pem)
@@ -100,7 +162,8 @@ func NewLdapAuth(cfg *Config) (*LdapAuth, error) {
 		var e error
 		ca_pool, e = x509.SystemCertPool()
 		if e != nil {
-			logger.LogWithTime("LDAP system cert pool error: err=%v", e)
+			logger.Event(logger.LevelError, logger.EventLdapSystemCaError, logger.Err(e))
+			count_error("ca_file")
 			return nil, e
 		}
 	}
@@ -110,16 +173,22 @@ func NewLdapAuth(cfg *Config) (*LdapAuth, error) {
 		RootCAs:            ca_pool,
 	}
 
+	dial_start := time.Now()
 	l, lerr := ldap.DialURL(cfg.HostUrl, ldap.DialWithTLSConfig(tls_cfg))
+	observe("dial", dial_start)
 	if lerr != nil {
-		logger.LogWithTime("LDAP dial error: host=%s err=%v", cfg.HostUrl, lerr)
+		logger.Event(logger.LevelError, logger.EventLdapDialError,
+			logger.Host(cfg.HostUrl), logger.Err(lerr))
+		count_error("dial")
 		return nil, lerr
 	}
 
 	if cfg.StartTls {
 		e := l.StartTLS(tls_cfg)
 		if e != nil {
-			logger.LogWithTime("LDAP StartTLS error: host=%s err=%v", cfg.HostUrl, e)
+			logger.Event(logger.LevelError, logger.EventLdapStartTlsError,
+				logger.Host(cfg.HostUrl), logger.Err(e))
+			count_error("starttls")
 			return nil, e
 		}
 	}
@@ -130,15 +199,62 @@ func NewLdapAuth(cfg *Config) (*LdapAuth, error) {
 
 	l.SetTimeout(time.Duration(tout) * time.Millisecond)
 
-	return &LdapAuth{cfg: cfg, conn: l}, nil
+	return l, nil
 }
+
+// Close returns the connection to the pool, or closes it.
+// A connection with a network error is never reused.
 func (lba *LdapAuth) Close() {
-	if lba.conn != nil {
-		lba.conn.Close()
+	if lba.conn == nil {
+		return
+	}
+	if !lba.broken && lba.pool.put(lba.conn) {
+		return
+	}
+	lba.conn.Close()
+}
+
+// is_conn_error reports whether err means the connection is unusable.
+func is_conn_error(err error) bool {
+	switch error_class(err) {
+	case "timeout", "unavailable":
+		return true
 	}
+	return false
 }
 
-func (lba *LdapAuth) new_search_param(flt_pat string, user string) *ldap.SearchRequest {
+// bind binds the connection. A pooled connection may have been closed by
+// the server while idle, so it is dialed again once on a network error.
+func (lba *LdapAuth) bind(bind_dn string, pass string) error {
+	err := lba.conn.Bind(bind_dn, pass)
+	if err == nil || !is_conn_error(err) {
+		return err
+	}
+	lba.broken = true
+	if !lba.reused {
+		return err
+	}
+
+	conn, derr := dial(lba.cfg)
+	if derr != nil {
+		return err
+	}
+	lba.conn.Close()
+	lba.conn = conn
+	lba.reused = false
+	lba.broken = false
+
+	err = lba.conn.Bind(bind_dn, pass)
+	if err != nil && is_conn_error(err) {
+		lba.broken = true
+	}
+	return err
+}
+
+func (lba *LdapAuth) new_search_param(flt_pat string, user string, attrs ...string) *ldap.SearchRequest {
+	if len(attrs) == 0 {
+		attrs = []string{"dn"}
+	}
 	filter := replace_user(flt_pat, ldap.EscapeFilter(user))
 	return ldap.NewSearchRequest(
 		lba.cfg.BaseDn,
@@ -148,51 +264,164 @@ func (lba *LdapAuth) new_search_param(flt_pat string, user string) *ldap.SearchR
 		lba.cfg.Timeout,
 		false,
 		filter,
-		[]string{"dn"},
+		attrs,
 		nil)
 }
 
+func (lba *LdapAuth) search(flt_pat string, user string, attrs ...string) (*ldap.SearchResult, error) {
+	start := time.Now()
+	res, err := lba.conn.Search(lba.new_search_param(flt_pat, user, attrs...))
+	observe("search", start)
+	if err != nil {
+		count_error("search_" + error_class(err))
+		if is_conn_error(err) {
+			lba.broken = true
+		}
+	}
+	return res, err
+}
+
 func (lba *LdapAuth) Authenticate(user, pass, clientIP string) (bool, bool, error) {
 	bind_dn := replace_user(lba.cfg.BindDn, user)
-	if err := lba.conn.Bind(bind_dn, pass); err != nil {
+	bind_start := time.Now()
+	err := lba.bind(bind_dn, pass)
+	bind_time := time.Since(bind_start)
+	metrics.LdapDuration.Observe(bind_time.Seconds(), "bind")
+	if err != nil {
+		count_error(error_class(err))
 		// Bind failures are always logged (minimum level)
-		logger.LogWithTime("LDAP bind failed: bind_dn=%s user=%s client_ip=%s err=%v", bind_dn, user, clientIP, err)
+		logger.Event(logger.LevelWarn, logger.EventLdapBindFailed,
+			logger.BindDn(bind_dn), logger.User(user), logger.ClientIP(clientIP),
+			logger.LatencyMs(bind_time), logger.Err(err))
+		// An unavailable server is not a wrong password.
+		if is_conn_error(err) {
+			return false, false, err
+		}
 		return false, false, nil
 	}
 
 	// Bind success is logged at normal level
-	logIfLevel(LogLevelNormal, "LDAP bind succeeded: bind_dn=%s user=%s client_ip=%s", bind_dn, user, clientIP)
+	logger.Event(logger.LevelInfo, logger.EventLdapBindSucceeded,
+		logger.BindDn(bind_dn), logger.User(user), logger.ClientIP(clientIP),
+		logger.LatencyMs(bind_time))
 
 	if lba.cfg.UniqueFilter != "" {
-		res, e := lba.conn.Search(lba.new_search_param(lba.cfg.UniqueFilter, user))
+		res, e := lba.search(lba.cfg.UniqueFilter, user)
 		if e != nil {
 			// Filter errors are always logged
-			logger.LogWithTime("LDAP unique filter search error: user=%s filter=%s client_ip=%s err=%v", user, lba.cfg.UniqueFilter, clientIP, e)
+			logger.Event(logger.LevelError, logger.EventLdapFilterError,
+				logger.FilterType("unique"), logger.User(user),
+				logger.Filter(lba.cfg.UniqueFilter), logger.ClientIP(clientIP), logger.Err(e))
 			return false, false, e
 		}
 		if len(res.Entries) != 1 {
 			// Filter mismatches are always logged
-			logger.LogWithTime("LDAP unique filter no match: user=%s filter=%s client_ip=%s entries=%d", user, lba.cfg.UniqueFilter, clientIP, len(res.Entries))
+			logger.Event(logger.LevelWarn, logger.EventLdapFilterNoMatch,
+				logger.FilterType("unique"), logger.User(user),
+				logger.Filter(lba.cfg.UniqueFilter), logger.ClientIP(clientIP),
+				logger.Entries(len(res.Entries)))
 			return false, false, nil
 		}
 		// Unique filter success is logged at maximum level
-		logIfLevel(LogLevelMaximum, "LDAP unique filter succeeded: user=%s filter=%s client_ip=%s", user, lba.cfg.UniqueFilter, clientIP)
+		logger.Event(logger.LevelDebug, logger.EventLdapFilterSucceeded,
+			logger.FilterType("unique"), logger.User(user),
+			logger.Filter(lba.cfg.UniqueFilter), logger.ClientIP(clientIP))
 	}
 	if lba.cfg.AuthzFilter != "" {
-		res, e := lba.conn.Search(lba.new_search_param(lba.cfg.AuthzFilter, user))
+		res, e := lba.search(lba.cfg.AuthzFilter, user)
 		if e != nil {
 			// Filter errors are always logged
-			logger.LogWithTime("LDAP authz filter search error: user=%s filter=%s client_ip=%s err=%v", user, lba.cfg.AuthzFilter, clientIP, e)
+			logger.Event(logger.LevelError, logger.EventLdapFilterError,
+				logger.FilterType("authz"), logger.User(user),
+				logger.Filter(lba.cfg.AuthzFilter), logger.ClientIP(clientIP), logger.Err(e))
 			return true, false, e
 		}
 		if len(res.Entries) != 1 {
 			// Filter mismatches are always logged
-			logger.LogWithTime("LDAP authz filter no match: user=%s filter=%s client_ip=%s entries=%d", user, lba.cfg.AuthzFilter, clientIP, len(res.Entries))
+			logger.Event(logger.LevelWarn, logger.EventLdapFilterNoMatch,
+				logger.FilterType("authz"), logger.User(user),
+				logger.Filter(lba.cfg.AuthzFilter), logger.ClientIP(clientIP),
+				logger.Entries(len(res.Entries)))
 			return true, false, nil
 		}
 		// Authz filter success is logged at maximum level
-		logIfLevel(LogLevelMaximum, "LDAP authz filter succeeded: user=%s filter=%s client_ip=%s", user, lba.cfg.AuthzFilter, clientIP)
+		logger.Event(logger.LevelDebug, logger.EventLdapFilterSucceeded,
+			logger.FilterType("authz"), logger.User(user),
+			logger.Filter(lba.cfg.AuthzFilter), logger.ClientIP(clientIP))
 	}
 
 	return true, true, nil
 }
+
+// BindService binds with the search account, or anonymously without it.
+// A pooled connection may be bound as another user, so it is always bound again.
+func (lba *LdapAuth) BindService() error {
+	bind_start := time.Now()
+	var err error
+	if lba.cfg.SearchBindDn == "" {
+		err = lba.conn.UnauthenticatedBind("")
+	} else {
+		err = lba.bind(lba.cfg.SearchBindDn, lba.cfg.SearchPassword)
+	}
+	observe("bind", bind_start)
+	if err != nil {
+		count_error(error_class(err))
+		if is_conn_error(err) {
+			lba.broken = true
+		}
+		logger.Event(logger.LevelError, logger.EventLdapBindFailed,
+			logger.BindDn(lba.cfg.SearchBindDn), logger.Err(err))
+	}
+	return err
+}
+
+// MatchFilter reports whether the search filter matches exactly one entry
+// for user. It is used after BindService.
+func (lba *LdapAuth) MatchFilter(flt_pat string, user string, clientIP string) (bool, error) {
+	return lba.match_filter("authz", flt_pat, user, clientIP)
+}
+
+// FindUser reports whether the search filter finds the entry of user, to
+// tell an unknown user from a wrong password. It is used after BindService.
+func (lba *LdapAuth) FindUser(flt_pat string, user string, clientIP string) (bool, error) {
+	return lba.match_filter("user", flt_pat, user, clientIP)
+}
+
+func (lba *LdapAuth) match_filter(flt_type string, flt_pat string, user string, clientIP string) (bool, error) {
+	res, err := lba.search(flt_pat, user)
+	if err != nil {
+		logger.Event(logger.LevelError, logger.EventLdapFilterError,
+			logger.FilterType(flt_type), logger.User(user),
+			logger.Filter(flt_pat), logger.ClientIP(clientIP), logger.Err(err))
+		return false, err
+	}
+	if len(res.Entries) != 1 {
+		logger.Event(logger.LevelWarn, logger.EventLdapFilterNoMatch,
+			logger.FilterType(flt_type), logger.User(user),
+			logger.Filter(flt_pat), logger.ClientIP(clientIP),
+			logger.Entries(len(res.Entries)))
+		return false, nil
+	}
+	logger.Event(logger.LevelDebug, logger.EventLdapFilterSucceeded,
+		logger.FilterType(flt_type), logger.User(user),
+		logger.Filter(flt_pat), logger.ClientIP(clientIP))
+	return true, nil
+}
+
+// SearchValues returns the values of attr of all entries matching the
+// search filter for user, such as the group names of the user.
+func (lba *LdapAuth) SearchValues(flt_pat string, user string, attr string) ([]string, error) {
+	res, err := lba.search(flt_pat, user, attr)
+	if err != nil {
+		logger.Event(logger.LevelError, logger.EventLdapFilterError,
+			logger.FilterType("group"), logger.User(user),
+			logger.Filter(flt_pat), logger.Err(err))
+		return nil, err
+	}
+
+	vals := []string{}
+	for _, ent := range res.Entries {
+		vals = append(vals, ent.GetAttributeValues(attr)...)
+	}
+	return vals, nil
+}
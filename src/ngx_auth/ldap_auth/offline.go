@@ -0,0 +1,295 @@
+package ldap_auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+
+	logger "ngx_auth/logger"
+	"ngx_auth/metrics"
+)
+
+// Parameters of the argon2id hash of the offline cache.
+const (
+	offline_time    = 2
+	offline_memory  = 19 * 1024
+	offline_threads = 1
+	offline_keylen  = 32
+	offline_saltlen = 16
+)
+
+// MaxOfflineEntries is the number of users kept in an offline cache.
+// The oldest entry is dropped for a new user.
+const MaxOfflineEntries = 10000
+
+type offlineEntry struct {
+	salt []byte
+	hash []byte
+	// mark is the keyed fingerprint of the password checked at each bind
+	// instead of the slow hash.
+	mark     []byte
+	verified time.Time
+	// authz is the result of each authorization filter. "" is no filter.
+	authz map[string]bool
+}
+
+// offlineCache keeps a slow hash of the credentials recently verified by
+// the LDAP server, only in memory.
+type offlineCache struct {
+	mu      sync.Mutex
+	max_age time.Duration
+	entries map[string]*offlineEntry
+}
+
+var (
+	offlinesMu sync.Mutex
+	offlines   = map[string]*offlineCache{}
+)
+
+// offline_key identifies the configurations giving the same authentication
+// result, so they share one cache.
+func offline_key(cfg *Config) string {
+	return fmt.Sprintf("%s|%s|%s", pool_key(cfg), cfg.BindDn, cfg.UniqueFilter)
+}
+
+// get_offline returns the offline cache of cfg, or nil if it is disabled.
+func get_offline(cfg *Config) *offlineCache {
+	if cfg.OfflineCacheSeconds <= 0 {
+		return nil
+	}
+
+	offlinesMu.Lock()
+	defer offlinesMu.Unlock()
+
+	key := offline_key(cfg)
+	oc, ok := offlines[key]
+	if !ok {
+		oc = &offlineCache{entries: map[string]*offlineEntry{}}
+		offlines[key] = oc
+	}
+	max_age := time.Duration(cfg.OfflineCacheSeconds) * time.Second
+	if oc.max_age < max_age {
+		oc.max_age = max_age
+	}
+	return oc
+}
+
+// offline_sem limits the concurrent hashes, so that the requests during an
+// outage cannot exhaust the memory and the CPUs.
+var offline_sem = make(chan struct{}, runtime.NumCPU())
+
+func offline_hash(pass string, salt []byte) []byte {
+	offline_sem <- struct{}{}
+	defer func() { <-offline_sem }()
+	return argon2.IDKey([]byte(pass), salt, offline_time, offline_memory,
+		offline_threads, offline_keylen)
+}
+
+// offline_mark_key is the random key of the fingerprints, which never
+// leaves the process.
+var offline_mark_key = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+func offline_mark(user string, pass string) []byte {
+	hm := hmac.New(sha256.New, offline_mark_key)
+	hm.Write([]byte(user))
+	hm.Write([]byte{0})
+	hm.Write([]byte(pass))
+	return hm.Sum(nil)
+}
+
+func (ent *offlineEntry) match(pass string) bool {
+	return subtle.ConstantTimeCompare(offline_hash(pass, ent.salt), ent.hash) == 1
+}
+
+func count_offline(result string) {
+	metrics.LdapOffline.Inc(result)
+}
+
+// store records a result verified by the LDAP server. The slow hash is
+// computed only for a new user or a changed password, outside of the lock,
+// so that an old password is never accepted after a change.
+func (oc *offlineCache) store(user string, pass string, flt string, ok_authz bool) {
+	mark := offline_mark(user, pass)
+
+	oc.mu.Lock()
+	if ent := oc.entries[user]; ent != nil && hmac.Equal(ent.mark, mark) {
+		ent.verified = time.Now()
+		ent.authz[flt] = ok_authz
+		oc.mu.Unlock()
+		return
+	}
+	oc.mu.Unlock()
+
+	salt := make([]byte, offline_saltlen)
+	if _, err := rand.Read(salt); err != nil {
+		return
+	}
+	ent := &offlineEntry{
+		salt:     salt,
+		hash:     offline_hash(pass, salt),
+		mark:     mark,
+		verified: time.Now(),
+		authz:    map[string]bool{flt: ok_authz},
+	}
+
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	if _, has := oc.entries[user]; !has && len(oc.entries) >= MaxOfflineEntries {
+		oc.drop_oldest()
+	}
+	oc.entries[user] = ent
+	count_offline("stored")
+}
+
+func (oc *offlineCache) drop_oldest() {
+	var oldest string
+	var oldest_tm time.Time
+	for user, ent := range oc.entries {
+		if oldest == "" || ent.verified.Before(oldest_tm) {
+			oldest, oldest_tm = user, ent.verified
+		}
+	}
+	delete(oc.entries, oldest)
+}
+
+// evict drops the entry of a user rejected by the LDAP server.
+func (oc *offlineCache) evict(user string) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	if _, has := oc.entries[user]; has {
+		delete(oc.entries, user)
+		count_offline("evicted")
+	}
+}
+
+// lookup decides with the cache while the LDAP server is unavailable.
+// It returns false in ok if the cache cannot decide.
+func (oc *offlineCache) lookup(user string, pass string, flt string) (bool, string, bool) {
+	oc.mu.Lock()
+	ent := oc.entries[user]
+	if ent != nil && time.Since(ent.verified) > oc.max_age {
+		delete(oc.entries, user)
+		oc.mu.Unlock()
+		return false, "expired", false
+	}
+	oc.mu.Unlock()
+
+	if ent == nil {
+		return false, "miss", false
+	}
+	if !ent.match(pass) {
+		return false, "mismatch", false
+	}
+
+	oc.mu.Lock()
+	ok_authz, has := ent.authz[flt]
+	oc.mu.Unlock()
+	if !has {
+		return false, "no_authz", false
+	}
+	return ok_authz, "hit", true
+}
+
+// IsUnavailable reports whether err means the server is unavailable,
+// such as a network error or a timeout.
+func IsUnavailable(err error) bool {
+	return is_conn_error(err)
+}
+
+// AuthenticateUser authenticates user like LdapAuth.Authenticate with a
+// new connection. With OfflineCacheSeconds, the results verified by the
+// server are cached, and used only while the server is unavailable.
+// A user rejected by the server is removed from the cache.
+// The third result is true if the cache decided.
+func AuthenticateUser(cfg *Config, user, pass, clientIP string) (bool, bool, bool, error) {
+	oc := get_offline(cfg)
+
+	ok_auth, ok_authz, err := authenticate_online(cfg, user, pass, clientIP)
+	if oc == nil {
+		return ok_auth, ok_authz, false, err
+	}
+	if is_conn_error(err) {
+		return oc.fallback(user, pass, cfg.AuthzFilter, clientIP, err)
+	}
+	if err != nil {
+		return ok_auth, ok_authz, false, err
+	}
+
+	if !ok_auth {
+		oc.evict(user)
+		return ok_auth, ok_authz, false, err
+	}
+	oc.store(user, pass, cfg.AuthzFilter, ok_authz)
+	return ok_auth, ok_authz, false, err
+}
+
+func authenticate_online(cfg *Config, user, pass, clientIP string) (bool, bool, error) {
+	la, err := NewLdapAuth(cfg)
+	if err != nil {
+		return false, false, err
+	}
+	defer la.Close()
+
+	return la.Authenticate(user, pass, clientIP)
+}
+
+func (oc *offlineCache) fallback(user, pass, flt, clientIP string, err error) (bool, bool, bool, error) {
+	ok_authz, result, ok := oc.lookup(user, pass, flt)
+	count_offline(result)
+	if !ok {
+		logger.Event(logger.LevelWarn, logger.EventLdapOfflineMiss,
+			logger.User(user), logger.ClientIP(clientIP),
+			logger.Result(result), logger.Err(err))
+		return false, false, false, err
+	}
+
+	logger.Event(logger.LevelWarn, logger.EventLdapOfflineUsed,
+		logger.User(user), logger.ClientIP(clientIP),
+		logger.Filter(flt), logger.Authz(ok_authz), logger.Err(err))
+	return true, ok_authz, true, nil
+}
+
+// AuthenticateFilters authenticates user without the authorization filter,
+// and evaluates each of filters on the same connection. An empty filter
+// matches every user. The offline cache is not used.
+func AuthenticateFilters(cfg *Config, user, pass, clientIP string, filters []string) (bool, map[string]bool, error) {
+	auth_cfg := *cfg
+	auth_cfg.AuthzFilter = ""
+	la, err := NewLdapAuth(&auth_cfg)
+	if err != nil {
+		return false, nil, err
+	}
+	defer la.Close()
+
+	ok_auth, _, err := la.Authenticate(user, pass, clientIP)
+	if err != nil || !ok_auth {
+		return false, nil, err
+	}
+
+	authz := make(map[string]bool, len(filters))
+	for _, flt := range filters {
+		if flt == "" {
+			authz[flt] = true
+			continue
+		}
+		ok, err := la.MatchFilter(flt, user, clientIP)
+		if err != nil {
+			return true, nil, err
+		}
+		authz[flt] = ok
+	}
+	return true, authz, nil
+}
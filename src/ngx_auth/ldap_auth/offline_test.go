@@ -0,0 +1,68 @@
+package ldap_auth
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOfflineStore(t *testing.T) {
+	oc := &offlineCache{max_age: time.Hour, entries: map[string]*offlineEntry{}}
+
+	steps := []struct {
+		name   string
+		store  string
+		hashed bool
+		pass   string
+		ok     bool
+		result string
+	}{
+		{"stored", "pass1", true, "pass1", true, "hit"},
+		{"other password", "", false, "pass2", false, "mismatch"},
+		{"same password again", "pass1", false, "pass1", true, "hit"},
+		{"changed password", "pass2", true, "pass2", true, "hit"},
+		{"old password", "", false, "pass1", false, "mismatch"},
+	}
+	var salt []byte
+	for _, st := range steps {
+		if st.store != "" {
+			oc.store("user1", st.store, "", true)
+		}
+		if hashed := !bytes.Equal(oc.entries["user1"].salt, salt); hashed != st.hashed {
+			t.Errorf("%s: store() hashed %v, want %v", st.name, hashed, st.hashed)
+		}
+		salt = oc.entries["user1"].salt
+		ok, result, _ := oc.lookup("user1", st.pass, "")
+		if ok != st.ok || result != st.result {
+			t.Errorf("%s: lookup() = %v, %q, want %v, %q", st.name, ok, result, st.ok, st.result)
+		}
+	}
+}
+
+func TestOfflineFallback(t *testing.T) {
+	oc := &offlineCache{max_age: time.Hour, entries: map[string]*offlineEntry{}}
+	oc.store("user1", "pass1", "", true)
+	down := errors.New("connection refused")
+
+	tests := []struct {
+		name    string
+		user    string
+		pass    string
+		ok      bool
+		offline bool
+		err     error
+	}{
+		{"hit", "user1", "pass1", true, true, nil},
+		{"mismatch", "user1", "pass2", false, false, down},
+		{"miss", "user2", "pass1", false, false, down},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, _, offline, err := oc.fallback(tt.user, tt.pass, "", "127.0.0.1", down)
+			if ok != tt.ok || offline != tt.offline || err != tt.err {
+				t.Errorf("fallback() = %v, %v, %v, want %v, %v, %v", ok, offline, err, tt.ok, tt.offline, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package ldap_auth
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+// PoolIdleTimeout is how long an idle connection is kept in the pool.
+// It is shorter than the idle timeout of common LDAP servers.
+const PoolIdleTimeout = 30 * time.Second
+
+type idleConn struct {
+	conn *ldap.Conn
+	used time.Time
+}
+
+// connPool keeps idle connections to one LDAP server.
+// Every request binds again, so a connection is reused for any user.
+type connPool struct {
+	mu   sync.Mutex
+	size int
+	idle []idleConn
+}
+
+var (
+	poolsMu sync.Mutex
+	pools   = map[string]*connPool{}
+)
+
+// pool_key identifies the connections that are interchangeable,
+// so the configurations of the same server share one pool.
+func pool_key(cfg *Config) string {
+	return fmt.Sprintf("%s|%t|%t|%s|%d", cfg.HostUrl, cfg.StartTls,
+		cfg.SkipCertVerify, strings.Join(cfg.RootCaFiles, ","), cfg.Timeout)
+}
+
+// get_pool returns the pool of cfg, or nil if the pool is disabled.
+func get_pool(cfg *Config) *connPool {
+	if cfg.PoolSize <= 0 {
+		return nil
+	}
+
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+
+	key := pool_key(cfg)
+	p, ok := pools[key]
+	if !ok {
+		p = &connPool{}
+		pools[key] = p
+	}
+	p.mu.Lock()
+	if p.size < cfg.PoolSize {
+		p.size = cfg.PoolSize
+	}
+	p.mu.Unlock()
+
+	return p
+}
+
+// get returns an idle connection, or nil if there is none.
+func (p *connPool) get() *ldap.Conn {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.idle) > 0 {
+		ic := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(ic.used) < PoolIdleTimeout && !ic.conn.IsClosing() {
+			return ic.conn
+		}
+		ic.conn.Close()
+	}
+	return nil
+}
+
+// put keeps conn for reuse. It returns false if the pool is full.
+func (p *connPool) put(conn *ldap.Conn) bool {
+	if p == nil || conn.IsClosing() {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// The oldest connections are at the head.
+	for len(p.idle) > 0 && time.Since(p.idle[0].used) >= PoolIdleTimeout {
+		p.idle[0].conn.Close()
+		p.idle = p.idle[1:]
+	}
+	if len(p.idle) >= p.size {
+		return false
+	}
+	p.idle = append(p.idle, idleConn{conn: conn, used: time.Now()})
+	return true
+}
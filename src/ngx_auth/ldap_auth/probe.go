@@ -0,0 +1,87 @@
+package ldap_auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+
+	"ngx_auth/health"
+)
+
+var ErrNoCertificate = errors.New("no PEM certificate found")
+
+// CheckCaFiles verifies that every root CA file is readable and holds
+// at least one PEM certificate.
+func CheckCaFiles(files []string) error {
+	for _, fn := range files {
+		ca_pem, err := os.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(ca_pem) {
+			return fmt.Errorf("%s: %w", fn, ErrNoCertificate)
+		}
+	}
+
+	return nil
+}
+
+// VerifyFilter compiles a search filter pattern with a sample user name.
+func VerifyFilter(flt_pat string) error {
+	_, err := ldap.CompileFilter(replace_user(flt_pat, "user"))
+	return err
+}
+
+// Probe connects to the LDAP server and reads the root DSE.
+// The root DSE is readable without a bind on common LDAP servers,
+// so it checks connectivity without any account.
+func Probe(cfg *Config) (time.Duration, error) {
+	start := time.Now()
+
+	la, err := NewLdapAuth(cfg)
+	if err != nil {
+		return time.Since(start), err
+	}
+	defer la.Close()
+
+	req := ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+		0, cfg.Timeout/1000, false, "(objectClass=*)",
+		[]string{"supportedLDAPVersion"}, nil)
+	if _, err := la.conn.Search(req); err != nil {
+		count_error("probe_" + error_class(err))
+		la.broken = true
+		return time.Since(start), err
+	}
+
+	return time.Since(start), nil
+}
+
+// RegisterHealthChecks registers the "ldap" and "ca_files" readiness checks.
+// The LDAP probe result is cached for ttl.
+func RegisterHealthChecks(cfg *Config, ttl time.Duration) {
+	register_health_checks("ldap", "ca_files", cfg, ttl)
+}
+
+// RegisterNamedHealthChecks registers the "ldap.NAME" and "ca_files.NAME"
+// readiness checks, for a process using several LDAP servers.
+func RegisterNamedHealthChecks(name string, cfg *Config, ttl time.Duration) {
+	register_health_checks("ldap."+name, "ca_files."+name, cfg, ttl)
+}
+
+func register_health_checks(ldap_name string, ca_name string, cfg *Config, ttl time.Duration) {
+	health.Register(ldap_name, health.Cached(ttl, func() (string, error) {
+		d, err := Probe(cfg)
+		return fmt.Sprintf("host=%s latency_ms=%d", cfg.HostUrl, d.Milliseconds()), err
+	}))
+
+	health.Register(ca_name, health.Cached(ttl, func() (string, error) {
+		if len(cfg.RootCaFiles) == 0 {
+			return "system", nil
+		}
+		return fmt.Sprintf("files=%d", len(cfg.RootCaFiles)), CheckCaFiles(cfg.RootCaFiles)
+	}))
+}
@@ -0,0 +1,114 @@
+package ldap_auth
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+
+	"ngx_auth/health"
+)
+
+// The LDAP protocol operations of the test server.
+const (
+	ldap_search_request = 3
+	ldap_search_done    = 5
+)
+
+// testLdap answers the root DSE search of Probe, with no entries.
+type testLdap struct {
+	lstn net.Listener
+	addr string
+}
+
+func newTestLdap(t *testing.T) *testLdap {
+	tl := &testLdap{}
+	tl.start(t, "127.0.0.1:0")
+	t.Cleanup(tl.stop)
+	return tl
+}
+
+func (tl *testLdap) start(t *testing.T, addr string) {
+	lstn, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.lstn = lstn
+	tl.addr = lstn.Addr().String()
+	go func() {
+		for {
+			conn, err := lstn.Accept()
+			if err != nil {
+				return
+			}
+			go tl.serve(conn)
+		}
+	}()
+}
+
+func (tl *testLdap) stop() {
+	tl.lstn.Close()
+}
+
+func (tl *testLdap) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		req, err := ber.ReadPacket(conn)
+		if err != nil || len(req.Children) < 2 {
+			return
+		}
+		if req.Children[1].Tag != ldap_search_request {
+			return
+		}
+		res := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, req.Children[0].Value, ""))
+		done := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap_search_done, nil, "")
+		done.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, 0, ""))
+		done.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+		done.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+		res.AppendChild(done)
+		if _, err := conn.Write(res.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	tl := newTestLdap(t)
+	ca_file := filepath.Join(t.TempDir(), "ca.pem")
+	cfg := &Config{HostUrl: "ldap://" + tl.addr, Timeout: 1000}
+	RegisterNamedHealthChecks("test", cfg, 0)
+
+	steps := []struct {
+		name   string
+		setup  func()
+		ldap   string
+		ca     string
+		status string
+	}{
+		{"ready", func() {}, health.StatusOk, health.StatusOk, health.StatusOk},
+		{"ldap down", tl.stop, health.StatusFail, health.StatusOk, health.StatusFail},
+		{"ldap back", func() { tl.start(t, tl.addr) }, health.StatusOk, health.StatusOk, health.StatusOk},
+		{"ca file missing", func() { cfg.RootCaFiles = []string{ca_file} }, health.StatusFail, health.StatusFail, health.StatusFail},
+		{"ca file without certificate", func() {
+			if err := os.WriteFile(ca_file, []byte("no certificate\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, health.StatusOk, health.StatusFail, health.StatusFail},
+	}
+	for _, st := range steps {
+		st.setup()
+		res := health.Run()
+		if res.Status != st.status {
+			t.Errorf("%s: Run() = %q, want %q", st.name, res.Status, st.status)
+		}
+		if got := res.Checks["ldap.test"].Status; got != st.ldap {
+			t.Errorf("%s: ldap.test = %q, want %q", st.name, got, st.ldap)
+		}
+		if got := res.Checks["ca_files.test"].Status; got != st.ca {
+			t.Errorf("%s: ca_files.test = %q, want %q", st.name, got, st.ca)
+		}
+	}
+}
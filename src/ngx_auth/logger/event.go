@@ -0,0 +1,178 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Log levels of the structured logger.
+// LevelNotice is for lifecycle events, which are logged at every logging level.
+const (
+	LevelDebug  = slog.LevelDebug
+	LevelInfo   = slog.LevelInfo
+	LevelNotice = slog.Level(2)
+	LevelWarn   = slog.LevelWarn
+	LevelError  = slog.LevelError
+)
+
+// Stable event names. Log parsers should match on these names,
+// not on the human readable messages.
+const (
+	EventServerStarted      = "server_started"
+	EventServerStopping     = "server_stopping"
+	EventServerDrainTimeout = "server_drain_timeout"
+	EventAdminStarted       = "admin_started"
+	EventAdminError         = "admin_error"
+	EventLogfileReopened    = "logfile_reopened"
+	EventLogfileReopenError = "logfile_reopen_error"
+	EventAuditWriteError    = "audit_write_error"
+	EventTlsCertReloaded    = "tls_cert_reloaded"
+	EventTlsCertReloadError = "tls_cert_reload_error"
+
+	EventLdapCaFileError     = "ldap_ca_file_error"
+	EventLdapSystemCaError   = "ldap_system_ca_error"
+	EventLdapDialError       = "ldap_dial_error"
+	EventLdapStartTlsError   = "ldap_starttls_error"
+	EventLdapBindFailed      = "ldap_bind_failed"
+	EventLdapBindSucceeded   = "ldap_bind_succeeded"
+	EventLdapFilterError     = "ldap_filter_error"
+	EventLdapFilterNoMatch   = "ldap_filter_no_match"
+	EventLdapFilterSucceeded = "ldap_filter_succeeded"
+	EventLdapOfflineUsed     = "ldap_offline_used"
+	EventLdapOfflineMiss     = "ldap_offline_miss"
+
+	EventPathAuthzDenied  = "path_authz_denied"
+	EventPathAuthzGranted = "path_authz_granted"
+	EventAuthChainNext    = "auth_chain_next"
+	EventJwtRejected      = "jwt_rejected"
+	EventJwksFetchError   = "jwks_fetch_error"
+	EventOidcLogin        = "oidc_login"
+	EventOidcLoginFailed  = "oidc_login_failed"
+
+	EventFormLogin             = "form_login"
+	EventFormLoginFailed       = "form_login_failed"
+	EventFormLogout            = "form_logout"
+	EventSessionRevokeReloaded = "session_revoke_reloaded"
+	EventSessionRevokeError    = "session_revoke_error"
+	EventTotpRejected          = "totp_rejected"
+	EventTotpLocked            = "totp_locked"
+	EventTotpSecretsReloaded   = "totp_secrets_reloaded"
+	EventTotpSecretsError      = "totp_secrets_error"
+	EventSignedHeaderRejected  = "signed_header_rejected"
+	EventAssertionError        = "assertion_error"
+	EventClientCertRejected    = "client_cert_rejected"
+	EventCrlReloaded           = "crl_reloaded"
+	EventCrlError              = "crl_error"
+	EventCrlStale              = "crl_stale"
+	EventApiKeyRejected        = "api_key_rejected"
+	EventApiKeysReloaded       = "api_keys_reloaded"
+	EventApiKeysError          = "api_keys_error"
+	EventDigestRejected        = "digest_rejected"
+
+	EventMessage = "message"
+)
+
+var eventMessages = map[string]string{
+	EventServerStarted:      "Server started",
+	EventServerStopping:     "Server stopping",
+	EventServerDrainTimeout: "Server drain timeout",
+	EventAdminStarted:       "Admin server started",
+	EventAdminError:         "Admin server error",
+	EventLogfileReopened:    "Logfile reopened",
+	EventLogfileReopenError: "Logfile reopen error",
+	EventAuditWriteError:    "Audit log write error",
+	EventTlsCertReloaded:    "TLS certificate reloaded",
+	EventTlsCertReloadError: "TLS certificate reload error",
+
+	EventLdapCaFileError:     "LDAP CA file read error",
+	EventLdapSystemCaError:   "LDAP system cert pool error",
+	EventLdapDialError:       "LDAP dial error",
+	EventLdapStartTlsError:   "LDAP StartTLS error",
+	EventLdapBindFailed:      "LDAP bind failed",
+	EventLdapBindSucceeded:   "LDAP bind succeeded",
+	EventLdapFilterError:     "LDAP filter search error",
+	EventLdapFilterNoMatch:   "LDAP filter no match",
+	EventLdapFilterSucceeded: "LDAP filter succeeded",
+	EventLdapOfflineUsed:     "LDAP offline cache used",
+	EventLdapOfflineMiss:     "LDAP offline cache miss",
+
+	EventPathAuthzDenied:  "Path authorization denied",
+	EventPathAuthzGranted: "Path authorization granted",
+	EventAuthChainNext:    "Authentication chain next step",
+	EventJwtRejected:      "JWT rejected",
+	EventJwksFetchError:   "JWKS fetch error",
+	EventOidcLogin:        "OIDC login",
+	EventOidcLoginFailed:  "OIDC login failed",
+
+	EventFormLogin:             "Form login",
+	EventFormLoginFailed:       "Form login failed",
+	EventFormLogout:            "Form logout",
+	EventSessionRevokeReloaded: "Session revocation list reloaded",
+	EventSessionRevokeError:    "Session revocation list reload error",
+	EventTotpRejected:          "TOTP code rejected",
+	EventTotpLocked:            "TOTP codes of the user locked after failures",
+	EventTotpSecretsReloaded:   "TOTP secret file reloaded",
+	EventTotpSecretsError:      "TOTP secret file reload error",
+	EventSignedHeaderRejected:  "Signed user header rejected",
+	EventAssertionError:        "Identity assertion signing error",
+	EventClientCertRejected:    "Client certificate rejected",
+	EventCrlReloaded:           "CRL file reloaded",
+	EventCrlError:              "CRL file reload error",
+	EventCrlStale:              "CRL past its next update",
+	EventApiKeyRejected:        "API key rejected",
+	EventApiKeysReloaded:       "API key file reloaded",
+	EventApiKeysError:          "API key file reload error",
+	EventDigestRejected:        "Digest credentials rejected",
+}
+
+const EventKey = "event"
+
+// Typed fields shared by the events.
+func User(v string) slog.Attr       { return slog.String("user", v) }
+func ClientIP(v string) slog.Attr   { return slog.String("client_ip", v) }
+func BindDn(v string) slog.Attr     { return slog.String("bind_dn", v) }
+func Host(v string) slog.Attr       { return slog.String("host", v) }
+func File(v string) slog.Attr       { return slog.String("file", v) }
+func Filter(v string) slog.Attr     { return slog.String("filter", v) }
+func FilterType(v string) slog.Attr { return slog.String("filter_type", v) }
+func PathId(v string) slog.Attr     { return slog.String("path_id", v) }
+func Outcome(v string) slog.Attr    { return slog.String("outcome", v) }
+func Entries(n int) slog.Attr       { return slog.Int("entries", n) }
+func Failures(n int) slog.Attr      { return slog.Int("failures", n) }
+func SocketType(v string) slog.Attr { return slog.String("socket_type", v) }
+func SocketPath(v string) slog.Attr { return slog.String("socket_path", v) }
+func Target(v string) slog.Attr     { return slog.String("target", v) }
+func Step(v string) slog.Attr       { return slog.String("step", v) }
+func Result(v string) slog.Attr     { return slog.String("result", v) }
+func Authz(v bool) slog.Attr        { return slog.Bool("authz", v) }
+
+func LatencyMs(d time.Duration) slog.Attr {
+	return slog.Float64("latency_ms", float64(d.Microseconds())/1000)
+}
+
+func Err(err error) slog.Attr {
+	if err == nil {
+		return slog.String("err", "")
+	}
+	return slog.String("err", err.Error())
+}
+
+// Event logs a structured event with the stable name and typed fields.
+func Event(level slog.Level, event string, attrs ...slog.Attr) {
+	l := current()
+	ctx := context.Background()
+	if !l.Enabled(ctx, level) {
+		return
+	}
+
+	msg, ok := eventMessages[event]
+	if !ok {
+		msg = event
+	}
+
+	all := make([]slog.Attr, 0, len(attrs)+1)
+	all = append(all, slog.String(EventKey, event))
+	all = append(all, attrs...)
+	l.LogAttrs(ctx, level, msg, all...)
+}
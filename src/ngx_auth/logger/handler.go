@@ -0,0 +1,210 @@
+package logger
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+const (
+	FormatText   = "text"
+	FormatJson   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+var ErrBadFormat = errors.New("bad log format")
+
+func IsValidFormat(format string) bool {
+	switch format {
+	case "", FormatText, FormatJson, FormatLogfmt:
+		return true
+	}
+	return false
+}
+
+var levelVar = &slog.LevelVar{}
+
+var (
+	slogMu  sync.RWMutex
+	slogger = slog.New(newTextHandler(out, levelVar))
+)
+
+func current() *slog.Logger {
+	slogMu.RLock()
+	defer slogMu.RUnlock()
+	return slogger
+}
+
+func setLogger(l *slog.Logger) {
+	slogMu.Lock()
+	slogger = l
+	slogMu.Unlock()
+}
+
+func levelOf(level int) slog.Level {
+	switch level {
+	case LevelMinimum:
+		return LevelNotice
+	case LevelMaximum:
+		return LevelDebug
+	}
+	return LevelInfo
+}
+
+// newHandler returns the handler of a format, writing to w.
+func newHandler(format string, w io.Writer, lv slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: lv, ReplaceAttr: replace_level}
+
+	switch format {
+	case "", FormatText:
+		return newTextHandler(w, lv), nil
+	case FormatJson:
+		return slog.NewJSONHandler(w, opts), nil
+	case FormatLogfmt:
+		return slog.NewTextHandler(w, opts), nil
+	}
+
+	return nil, ErrBadFormat
+}
+
+// replace_level names LevelNotice "NOTICE" instead of "INFO+2".
+func replace_level(_ []string, a slog.Attr) slog.Attr {
+	if a.Key != slog.LevelKey {
+		return a
+	}
+	if lv, ok := a.Value.Any().(slog.Level); ok && lv == LevelNotice {
+		a.Value = slog.StringValue("NOTICE")
+	}
+	return a
+}
+
+// textHandler writes the traditional ngx_auth_mod log lines:
+// "2006/01/02 15:04:05 [program] message: key=value ...".
+type textHandler struct {
+	w     io.Writer
+	lv    slog.Leveler
+	attrs []slog.Attr
+}
+
+func newTextHandler(w io.Writer, lv slog.Leveler) *textHandler {
+	return &textHandler{w: w, lv: lv}
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.lv.Level()
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Time.Format("2006/01/02 15:04:05"))
+	b.WriteByte(' ')
+
+	mu.RLock()
+	pname := progName
+	mu.RUnlock()
+	if pname != "" {
+		b.WriteString("[" + pname + "] ")
+	}
+	b.WriteString(r.Message)
+
+	sep := ": "
+	write_attr := func(a slog.Attr) bool {
+		if a.Key == EventKey || a.Key == ProgramKey {
+			return true
+		}
+		b.WriteString(sep)
+		b.WriteString(a.Key + "=" + a.Value.String())
+		sep = " "
+		return true
+	}
+	for _, a := range h.attrs {
+		write_attr(a)
+	}
+	r.Attrs(write_attr)
+	b.WriteByte('\n')
+
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &nh
+}
+
+func (h *textHandler) WithGroup(_ string) slog.Handler {
+	return h
+}
+
+// multiHandler sends each record to all handlers.
+type multiHandler []slog.Handler
+
+func (mh multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range mh {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (mh multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	for _, h := range mh {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if e := h.Handle(ctx, r.Clone()); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (mh multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nmh := make(multiHandler, len(mh))
+	for i, h := range mh {
+		nmh[i] = h.WithAttrs(attrs)
+	}
+	return nmh
+}
+
+func (mh multiHandler) WithGroup(name string) slog.Handler {
+	nmh := make(multiHandler, len(mh))
+	for i, h := range mh {
+		nmh[i] = h.WithGroup(name)
+	}
+	return nmh
+}
+
+const ProgramKey = "program"
+
+func build_logger(cfg *Config) (*slog.Logger, error) {
+	h, err := newHandler(cfg.Format, out, levelVar)
+	if err != nil {
+		return nil, err
+	}
+	hs := multiHandler{h}
+
+	if cfg.Syslog != "" {
+		sh, err := newSyslogHandler(cfg.Syslog, cfg.SyslogFacility, levelVar)
+		if err != nil {
+			return nil, err
+		}
+		hs = append(hs, sh)
+	}
+
+	mu.RLock()
+	pname := progName
+	mu.RUnlock()
+
+	l := slog.New(hs)
+	if pname != "" {
+		l = l.With(slog.String(ProgramKey, pname))
+	}
+	return l, nil
+}
@@ -0,0 +1,136 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// capture sends the events to a buffer in format, with the program name.
+func capture(t *testing.T, format string, level string) *bytes.Buffer {
+	t.Helper()
+	var b bytes.Buffer
+	h, err := newHandler(format, &b, levelVar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := current()
+	SetProgramName("ngx_test")
+	SetLoggingLevel(level)
+	setLogger(slog.New(h).With(slog.String(ProgramKey, "ngx_test")))
+	t.Cleanup(func() {
+		setLogger(old)
+		SetProgramName("")
+		SetLoggingLevel("")
+	})
+	return &b
+}
+
+func TestFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{FormatText, `[ngx_test] LDAP bind failed: user=user 1 err=invalid "credentials"`},
+		{FormatLogfmt, `level=WARN msg="LDAP bind failed" program=ngx_test event=ldap_bind_failed user="user 1" err="invalid \"credentials\""`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			b := capture(t, tt.format, "normal")
+			Event(LevelWarn, EventLdapBindFailed, User("user 1"), Err(errors.New(`invalid "credentials"`)))
+
+			// The lines start with the time.
+			line := strings.TrimSuffix(b.String(), "\n")
+			_, line, _ = strings.Cut(line, " ")
+			if tt.format == FormatText {
+				_, line, _ = strings.Cut(line, " ")
+			}
+			if line != tt.want {
+				t.Errorf("Event() = %q, want %q", line, tt.want)
+			}
+		})
+	}
+
+	t.Run(FormatJson, func(t *testing.T) {
+		b := capture(t, FormatJson, "normal")
+		Event(LevelNotice, EventLdapOfflineUsed, User("user1"), Entries(3))
+
+		got := map[string]interface{}{}
+		if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+			t.Fatalf("Event() = %q: %v", b.String(), err)
+		}
+		if _, ok := got["time"]; !ok {
+			t.Errorf("Event() has no time: %v", got)
+		}
+		delete(got, "time")
+		want := map[string]interface{}{
+			"level":   "NOTICE",
+			"msg":     "LDAP offline cache used",
+			"program": "ngx_test",
+			"event":   "ldap_offline_used",
+			"user":    "user1",
+			"entries": float64(3),
+		}
+		if len(got) != len(want) {
+			t.Errorf("Event() = %v, want %v", got, want)
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("Event() %s = %v, want %v", k, got[k], v)
+			}
+		}
+	})
+
+	if _, err := newHandler("xml", &bytes.Buffer{}, levelVar); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("newHandler() error = %v, want %v", err, ErrBadFormat)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	tests := []struct {
+		level  string
+		logged []slog.Level
+		hidden []slog.Level
+	}{
+		{"minimum", []slog.Level{LevelNotice, LevelError}, []slog.Level{LevelDebug, LevelInfo}},
+		{"normal", []slog.Level{LevelInfo, LevelNotice}, []slog.Level{LevelDebug}},
+		{"maximum", []slog.Level{LevelDebug, LevelInfo}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			b := capture(t, FormatLogfmt, tt.level)
+			for _, lv := range tt.logged {
+				b.Reset()
+				Event(lv, EventLdapBindSucceeded)
+				if b.Len() == 0 {
+					t.Errorf("Event(%v) is not logged", lv)
+				}
+			}
+			for _, lv := range tt.hidden {
+				b.Reset()
+				Event(lv, EventLdapBindSucceeded)
+				if b.Len() != 0 {
+					t.Errorf("Event(%v) = %q, want nothing", lv, b.String())
+				}
+			}
+		})
+	}
+}
+
+func TestMultiHandler(t *testing.T) {
+	var text, json_b bytes.Buffer
+	th, _ := newHandler(FormatText, &text, levelVar)
+	jh, _ := newHandler(FormatJson, &json_b, levelVar)
+	old := current()
+	setLogger(slog.New(multiHandler{th, jh}))
+	defer setLogger(old)
+
+	Event(LevelNotice, EventServerStarted, SocketType("unix"))
+	if !strings.Contains(text.String(), "Server started: socket_type=unix") ||
+		!strings.Contains(json_b.String(), `"event":"server_started"`) {
+		t.Errorf("Event() = %q and %q, want it in both handlers", text.String(), json_b.String())
+	}
+}
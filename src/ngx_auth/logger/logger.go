@@ -1,12 +1,12 @@
 package logger
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 	"sync"
-	"time"
 )
 
 const (
@@ -27,10 +27,19 @@ func SetProgramName(name string) {
 	mu.Unlock()
 }
 
+// GetProgramName returns the name set by SetProgramName.
+func GetProgramName() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return progName
+}
+
 // SetLoggingLevel sets the logging verbosity level.
 // "minimum" = LevelMinimum (auth failures only)
 // "normal" = LevelNormal (+ auth successes)
 // "maximum" = LevelMaximum (+ authz successes)
+// The structured logger drops events below LevelNotice, LevelInfo
+// and LevelDebug respectively.
 func SetLoggingLevel(level string) {
 	mu.Lock()
 	switch {
@@ -42,9 +51,20 @@ func SetLoggingLevel(level string) {
 		// default to "normal"
 		logLevel = LevelNormal
 	}
+	levelVar.Set(levelOf(logLevel))
 	mu.Unlock()
 }
 
+// IsValidLoggingLevel reports whether level is accepted by SetLoggingLevel.
+// An empty level means "normal".
+func IsValidLoggingLevel(level string) bool {
+	switch level {
+	case "", "minimum", "MINIMUM", "normal", "NORMAL", "maximum", "MAXIMUM":
+		return true
+	}
+	return false
+}
+
 // GetLoggingLevel returns the current logging level.
 func GetLoggingLevel() int {
 	mu.RLock()
@@ -78,20 +98,9 @@ func ExtractClientIP(r *http.Request) string {
 	return clientIP
 }
 
+// LogWithTime logs a free-form message as the "message" event.
+// New code should use Event with a stable event name.
 func LogWithTime(format string, v ...interface{}) {
-	timestamp := time.Now().Format("2006/01/02 15:04:05")
-	msg := fmt.Sprintf(format, v...)
-
-	mu.RLock()
-	pname := progName
-	mu.RUnlock()
-
-	var out string
-	if pname != "" {
-		out = fmt.Sprintf("%s [%s] %s", timestamp, pname, msg)
-	} else {
-		out = fmt.Sprintf("%s %s", timestamp, msg)
-	}
-
-	log.Print(out)
+	current().LogAttrs(context.Background(), LevelNotice,
+		fmt.Sprintf(format, v...), slog.String(EventKey, EventMessage))
 }
@@ -0,0 +1,179 @@
+package logger
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"ngx_auth/metrics"
+)
+
+const DefaultLogfileMode = 0644
+
+// Config is the [logging] part of the module configuration files.
+type Config struct {
+	EnableConsole bool   `toml:"enable_console,omitempty" json:"enable_console,omitempty" yaml:"enable_console,omitempty"`
+	Logfile       string `toml:"logfile,omitempty" json:"logfile,omitempty" yaml:"logfile,omitempty"`
+	LogfileMode   string `toml:"logfile_mode,omitempty" json:"logfile_mode,omitempty" yaml:"logfile_mode,omitempty"`
+	LoggingLevel  string `toml:"logging_level,omitempty" json:"logging_level,omitempty" yaml:"logging_level,omitempty"`
+
+	Format         string `toml:"format,omitempty" json:"format,omitempty" yaml:"format,omitempty"`
+	Syslog         string `toml:"syslog,omitempty" json:"syslog,omitempty" yaml:"syslog,omitempty"`
+	SyslogFacility string `toml:"syslog_facility,omitempty" json:"syslog_facility,omitempty" yaml:"syslog_facility,omitempty"`
+}
+
+var ErrBadLogfileMode = errors.New("bad logfile mode")
+
+// FileMode parses LogfileMode as an octal permission such as "0640".
+func (cfg *Config) FileMode() (os.FileMode, error) {
+	if cfg.LogfileMode == "" {
+		return DefaultLogfileMode, nil
+	}
+
+	mode, err := strconv.ParseUint(cfg.LogfileMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, ErrBadLogfileMode
+	}
+	return os.FileMode(mode), nil
+}
+
+// IsConsole reports whether logs are written to the console (stderr).
+// Without a logfile or syslog, logs always go to the console.
+func (cfg *Config) IsConsole() bool {
+	return cfg.EnableConsole || (cfg.Logfile == "" && cfg.Syslog == "")
+}
+
+type output struct {
+	mu      sync.Mutex
+	console bool
+	path    string
+	mode    os.FileMode
+	file    *os.File
+}
+
+var out = &output{console: true}
+
+func (o *output) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var err error
+	if o.file != nil {
+		_, err = o.file.Write(p)
+	}
+	if o.console {
+		if _, e := os.Stderr.Write(p); e != nil && err == nil {
+			err = e
+		}
+	}
+	return len(p), err
+}
+
+func open_logfile(path string, mode os.FileMode) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, mode)
+}
+
+// Setup applies the [logging] configuration: the logging level,
+// the output format, the console output, the logfile and syslog.
+func Setup(cfg *Config) error {
+	SetLoggingLevel(cfg.LoggingLevel)
+
+	mode, err := cfg.FileMode()
+	if err != nil {
+		return err
+	}
+
+	l, err := build_logger(cfg)
+	if err != nil {
+		return err
+	}
+
+	var f *os.File
+	if cfg.Logfile != "" {
+		f, err = open_logfile(cfg.Logfile, mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	out.mu.Lock()
+	old := out.file
+	out.console = cfg.IsConsole()
+	out.path = cfg.Logfile
+	out.mode = mode
+	out.file = f
+	out.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	log.SetOutput(out)
+	setLogger(l)
+
+	return nil
+}
+
+type reopener struct {
+	target string
+	fn     func() error
+}
+
+var (
+	reopenMu  sync.Mutex
+	reopeners = []reopener{{"logfile", Reopen}}
+)
+
+// AddReopener registers another file to reopen with the logfile,
+// such as the audit log. target names it in the metrics and the logs.
+func AddReopener(target string, fn func() error) {
+	reopenMu.Lock()
+	reopeners = append(reopeners, reopener{target, fn})
+	reopenMu.Unlock()
+}
+
+func reopen_all() {
+	reopenMu.Lock()
+	rs := append([]reopener{}, reopeners...)
+	reopenMu.Unlock()
+
+	for _, r := range rs {
+		if err := r.fn(); err != nil {
+			metrics.ConfigReloads.Inc(r.target, "error")
+			Event(LevelError, EventLogfileReopenError, Target(r.target), Err(err))
+			continue
+		}
+		metrics.ConfigReloads.Inc(r.target, "ok")
+		Event(LevelNotice, EventLogfileReopened, Target(r.target))
+	}
+}
+
+// Reopen reopens the logfile, for log rotation tools such as logrotate.
+// It does nothing if no logfile is configured.
+func Reopen() error {
+	out.mu.Lock()
+	path := out.path
+	mode := out.mode
+	out.mu.Unlock()
+
+	if path == "" {
+		return nil
+	}
+
+	f, err := open_logfile(path, mode)
+	if err != nil {
+		return err
+	}
+
+	out.mu.Lock()
+	old := out.file
+	out.file = f
+	out.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package logger
+
+import (
+	"github.com/l4go/task"
+)
+
+// ReopenOnSignal does nothing on platforms without SIGUSR1.
+func ReopenOnSignal(_ task.Canceller) {
+}
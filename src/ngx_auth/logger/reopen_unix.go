@@ -0,0 +1,31 @@
+//go:build unix
+
+package logger
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/l4go/task"
+)
+
+// ReopenOnSignal reopens the logfile and the files registered with AddReopener
+// on every SIGUSR1 until cc is cancelled.
+func ReopenOnSignal(cc task.Canceller) {
+	sig_chan := make(chan os.Signal, 1)
+	signal.Notify(sig_chan, syscall.SIGUSR1)
+
+	go func() {
+		defer signal.Stop(sig_chan)
+		for {
+			select {
+			case <-cc.RecvCancel():
+				return
+			case <-sig_chan:
+			}
+
+			reopen_all()
+		}
+	}()
+}
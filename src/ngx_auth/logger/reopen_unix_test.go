@@ -0,0 +1,77 @@
+//go:build unix
+
+package logger
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/l4go/task"
+)
+
+// read_events returns the events of a JSON logfile.
+func read_events(t *testing.T, file string) []string {
+	t.Helper()
+	bin, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(bin)), "\n") {
+		rec := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		events = append(events, rec[EventKey].(string))
+	}
+	return events
+}
+
+func TestReopenOnSignal(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ngx_auth.log")
+	if err := Setup(&Config{Logfile: file, Format: FormatJson}); err != nil {
+		t.Fatal(err)
+	}
+	defer Setup(&Config{})
+
+	reopened := make(chan struct{}, 1)
+	AddReopener("test", func() error {
+		select {
+		case reopened <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	cc := task.NewCancel()
+	defer cc.Cancel()
+	ReopenOnSignal(cc)
+
+	Event(LevelNotice, EventServerStarted)
+	// A log rotation tool renames the logfile before the signal.
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reopened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the logfile is not reopened on SIGUSR1")
+	}
+	Event(LevelNotice, EventServerStopping)
+
+	if got := read_events(t, file+".1"); strings.Join(got, ",") != EventServerStarted {
+		t.Errorf("rotated logfile events = %v, want %s", got, EventServerStarted)
+	}
+	// The event of the test reopener may be logged after server_stopping.
+	got := strings.Join(read_events(t, file), ",")
+	if !strings.HasPrefix(got, EventLogfileReopened) || !strings.Contains(got, EventServerStopping) {
+		t.Errorf("reopened logfile events = %s, want %s first and %s", got, EventLogfileReopened, EventServerStopping)
+	}
+}
@@ -0,0 +1,198 @@
+package logger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrBadFacility = errors.New("bad syslog facility")
+
+var syslogFacilities = map[string]int{
+	"user":     1,
+	"daemon":   3,
+	"auth":     4,
+	"authpriv": 10,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+func IsValidFacility(name string) bool {
+	if name == "" {
+		return true
+	}
+	_, ok := syslogFacilities[name]
+	return ok
+}
+
+// SdId is the RFC 5424 structured data ID of the event fields.
+const SdId = "ngx_auth@32473"
+
+func syslog_severity(level slog.Level) int {
+	switch {
+	case level >= LevelError:
+		return 3
+	case level >= LevelWarn:
+		return 4
+	case level >= LevelNotice:
+		return 5
+	case level >= LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+// syslogHandler sends RFC 5424 messages to a local syslog unix socket,
+// such as "/dev/log".
+type syslogHandler struct {
+	path     string
+	facility int
+	lv       slog.Leveler
+	attrs    []slog.Attr
+
+	conn *syslogConn
+}
+
+type syslogConn struct {
+	mu   sync.Mutex
+	path string
+	c    net.Conn
+}
+
+func (sc *syslogConn) dial() error {
+	var err error
+	for _, network := range []string{"unixgram", "unix"} {
+		sc.c, err = net.Dial(network, sc.path)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (sc *syslogConn) write(msg []byte) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.c == nil {
+		if err := sc.dial(); err != nil {
+			return err
+		}
+	}
+	if _, err := sc.c.Write(msg); err == nil {
+		return nil
+	}
+
+	// The syslog daemon may have been restarted.
+	sc.c.Close()
+	if err := sc.dial(); err != nil {
+		sc.c = nil
+		return err
+	}
+	_, err := sc.c.Write(msg)
+	return err
+}
+
+func newSyslogHandler(path string, facility string, lv slog.Leveler) (*syslogHandler, error) {
+	if facility == "" {
+		facility = "daemon"
+	}
+	fac, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, ErrBadFacility
+	}
+
+	return &syslogHandler{
+		path:     path,
+		facility: fac,
+		lv:       lv,
+		conn:     &syslogConn{path: path},
+	}, nil
+}
+
+func (h *syslogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.lv.Level()
+}
+
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func sd_name(key string) string {
+	key = strings.Map(func(r rune) rune {
+		if r <= ' ' || r >= 0x7f || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, key)
+	if len(key) > 32 {
+		key = key[:32]
+	}
+	return key
+}
+
+func nil_value(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+func (h *syslogHandler) Handle(_ context.Context, r slog.Record) error {
+	mu.RLock()
+	app := progName
+	mu.RUnlock()
+
+	host, _ := os.Hostname()
+	msgid := ""
+
+	var sd strings.Builder
+	write_attr := func(a slog.Attr) bool {
+		switch a.Key {
+		case EventKey:
+			msgid = a.Value.String()
+			return true
+		case ProgramKey:
+			return true
+		}
+		sd.WriteString(" " + sd_name(a.Key) + `="` + sdEscaper.Replace(a.Value.String()) + `"`)
+		return true
+	}
+	for _, a := range h.attrs {
+		write_attr(a)
+	}
+	r.Attrs(write_attr)
+
+	sd_str := "-"
+	if sd.Len() > 0 {
+		sd_str = "[" + SdId + sd.String() + "]"
+	}
+
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		h.facility*8+syslog_severity(r.Level),
+		r.Time.Format(time.RFC3339Nano),
+		nil_value(host), nil_value(app), os.Getpid(), nil_value(msgid),
+		sd_str, r.Message)
+
+	return h.conn.write([]byte(msg))
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &nh
+}
+
+func (h *syslogHandler) WithGroup(_ string) slog.Handler {
+	return h
+}
@@ -0,0 +1,86 @@
+//go:build unix
+
+package logger
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSyslog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sh, err := newSyslogHandler(path, "auth", levelVar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := current()
+	SetProgramName("ngx_test")
+	setLogger(slog.New(sh).With(slog.String(ProgramKey, "ngx_test")))
+	defer func() {
+		setLogger(old)
+		SetProgramName("")
+	}()
+
+	tests := []struct {
+		name  string
+		event func()
+		want  string
+	}{
+		{"fields", func() {
+			Event(LevelWarn, EventLdapBindFailed, User(`a"b]c\`), Err(errors.New("bad")))
+		}, `^<36>1 \S+ \S+ ngx_test \d+ ldap_bind_failed \[ngx_auth@32473 user="a\\"b\\]c\\\\" err="bad"\] LDAP bind failed$`},
+		{"no fields", func() {
+			Event(LevelError, EventAdminError)
+		}, `^<35>1 \S+ \S+ ngx_test \d+ admin_error - Admin server error$`},
+		{"message", func() {
+			LogWithTime("hello %s", "world")
+		}, `^<37>1 \S+ \S+ ngx_test \d+ message - hello world$`},
+	}
+	buf := make([]byte, 4096)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.event()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !regexp.MustCompile(tt.want).Match(buf[:n]) {
+				t.Errorf("syslog message = %q, want %s", buf[:n], tt.want)
+			}
+		})
+	}
+}
+
+func TestSyslogFacility(t *testing.T) {
+	tests := []struct {
+		facility string
+		want     int
+		err      error
+	}{
+		{"", 3, nil},
+		{"authpriv", 10, nil},
+		{"local7", 23, nil},
+		{"kern", 0, ErrBadFacility},
+	}
+	for _, tt := range tests {
+		sh, err := newSyslogHandler("/dev/log", tt.facility, levelVar)
+		if !errors.Is(err, tt.err) || err == nil && sh.facility != tt.want {
+			t.Errorf("newSyslogHandler(%q) = %v, %v, want %d, %v", tt.facility, sh, err, tt.want, tt.err)
+		}
+		if IsValidFacility(tt.facility) != (tt.err == nil) {
+			t.Errorf("IsValidFacility(%q) = %v", tt.facility, !(tt.err == nil))
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	OutcomeOk          = "ok"
+	OutcomeUnauth      = "unauth"
+	OutcomeForbidden   = "forbidden"
+	OutcomeNopath      = "nopath"
+	OutcomeNouser      = "nouser"
+	OutcomeNotModified = "not_modified"
+)
+
+var DefaultBuckets = []float64{
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+var (
+	regMu    sync.Mutex
+	registry []collector
+)
+
+func register(c collector) {
+	regMu.Lock()
+	registry = append(registry, c)
+	regMu.Unlock()
+}
+
+// WriteText writes all registered metrics in the Prometheus text format.
+func WriteText(w io.Writer) {
+	regMu.Lock()
+	cs := make([]collector, len(registry))
+	copy(cs, registry)
+	regMu.Unlock()
+
+	for _, c := range cs {
+		c.write(w)
+	}
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		WriteText(w)
+	})
+}
+
+func escape_label(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	return strings.Replace(v, `"`, `\"`, -1)
+}
+
+func format_labels(names []string, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, n := range names {
+		pairs = append(pairs, n+`="`+escape_label(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escape_label(extra[i+1])+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func format_float(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func label_key(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func check_labels(name string, names []string, values []string) {
+	if len(names) != len(values) {
+		panic(fmt.Errorf("metrics: %s: label count mismatch: %d != %d",
+			name, len(names), len(values)))
+	}
+}
+
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: map[string]*counterValue{},
+	}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Add(v float64, values ...string) {
+	check_labels(c.name, c.labels, values)
+	key := label_key(values)
+
+	c.mu.Lock()
+	cv, ok := c.values[key]
+	if !ok {
+		cv = &counterValue{labels: append([]string{}, values...)}
+		c.values[key] = cv
+	}
+	cv.value += v
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+	for _, key := range sorted_keys(c.values) {
+		cv := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name,
+			format_labels(c.labels, cv.labels), format_float(cv.value))
+	}
+}
+
+type GaugeVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: map[string]*counterValue{},
+	}
+	register(g)
+	return g
+}
+
+func (g *GaugeVec) Set(v float64, values ...string) {
+	check_labels(g.name, g.labels, values)
+	key := label_key(values)
+
+	g.mu.Lock()
+	gv, ok := g.values[key]
+	if !ok {
+		gv = &counterValue{labels: append([]string{}, values...)}
+		g.values[key] = gv
+	}
+	gv.value = v
+	g.mu.Unlock()
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", g.name, g.help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+	for _, key := range sorted_keys(g.values) {
+		gv := g.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", g.name,
+			format_labels(g.labels, gv.labels), format_float(gv.value))
+	}
+}
+
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	bs := append([]float64{}, buckets...)
+	sort.Float64s(bs)
+
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: bs,
+		values:  map[string]*histogramValue{},
+	}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	check_labels(h.name, h.labels, values)
+	key := label_key(values)
+
+	h.mu.Lock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{
+			labels: append([]string{}, values...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = hv
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+	h.mu.Unlock()
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+	for _, key := range sorted_keys(h.values) {
+		hv := h.values[key]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				format_labels(h.labels, hv.labels, "le", format_float(b)),
+				hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			format_labels(h.labels, hv.labels, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name,
+			format_labels(h.labels, hv.labels), format_float(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name,
+			format_labels(h.labels, hv.labels), hv.count)
+	}
+}
+
+func sorted_keys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	Requests = NewCounterVec("ngx_auth_requests_total",
+		"Auth requests by profile and outcome.", "profile", "outcome")
+	EtagChecks = NewCounterVec("ngx_auth_etag_checks_total",
+		"If-None-Match validations by result (hit answers 304).", "result")
+	Assertions = NewCounterVec("ngx_auth_assertions_total",
+		"Identity assertions signed by result.", "result")
+	LdapDuration = NewHistogramVec("ngx_auth_ldap_duration_seconds",
+		"LDAP operation latency.", nil, "operation")
+	LdapErrors = NewCounterVec("ngx_auth_ldap_errors_total",
+		"LDAP errors by class.", "class")
+	LdapOffline = NewCounterVec("ngx_auth_ldap_offline_total",
+		"LDAP offline cache operations by result (hit decides while LDAP is unavailable).", "result")
+	Sessions = NewCounterVec("ngx_auth_sessions_total",
+		"Session cookie operations by result (resumed skips the backend).", "result")
+	SignedHeaders = NewCounterVec("ngx_auth_signed_headers_total",
+		"Signed user header checks by result.", "result")
+	ClientCerts = NewCounterVec("ngx_auth_client_certs_total",
+		"Client certificate checks by result.", "result")
+	CrlStale = NewCounterVec("ngx_auth_crl_stale_total",
+		"Client certificate checks with a CRL past its next update by action.", "action")
+	ApiKeys = NewCounterVec("ngx_auth_api_keys_total",
+		"API key checks by result.", "result")
+	Digests = NewCounterVec("ngx_auth_digests_total",
+		"Digest authentication checks by result.", "result")
+	Totp = NewCounterVec("ngx_auth_totp_total",
+		"TOTP code checks by result.", "result")
+	UserMutexWait = NewHistogramVec("ngx_auth_user_mutex_wait_seconds",
+		"Time spent waiting for the per-user lock of use_serialized_auth.", nil)
+	ConfigReloads = NewCounterVec("ngx_auth_config_reloads_total",
+		"Configuration (re)load attempts by target and result.", "target", "result")
+)
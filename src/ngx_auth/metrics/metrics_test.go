@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounterText(t *testing.T) {
+	c := NewCounterVec("test_counter_total", "Test counter.", "profile", "outcome")
+	c.Inc("web", OutcomeOk)
+	c.Inc("web", OutcomeOk)
+	c.Add(0.5, "", OutcomeUnauth)
+	c.Inc("a\"b\\c\nd", OutcomeOk)
+
+	var b bytes.Buffer
+	c.write(&b)
+	want := `# HELP test_counter_total Test counter.
+# TYPE test_counter_total counter
+test_counter_total{profile="a\"b\\c\nd",outcome="ok"} 1
+test_counter_total{profile="web",outcome="ok"} 2
+test_counter_total{profile="",outcome="unauth"} 0.5
+`
+	if b.String() != want {
+		t.Errorf("write() = %q, want %q", b.String(), want)
+	}
+}
+
+func TestGaugeText(t *testing.T) {
+	g := NewGaugeVec("test_gauge", "Test gauge.")
+	g.Set(3)
+	g.Set(-1.25)
+
+	var b bytes.Buffer
+	g.write(&b)
+	want := "# HELP test_gauge Test gauge.\n# TYPE test_gauge gauge\ntest_gauge -1.25\n"
+	if b.String() != want {
+		t.Errorf("write() = %q, want %q", b.String(), want)
+	}
+}
+
+func TestHistogramText(t *testing.T) {
+	h := NewHistogramVec("test_seconds", "Test histogram.", []float64{1, 0.1}, "operation")
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		h.Observe(v, "bind")
+	}
+
+	var b bytes.Buffer
+	h.write(&b)
+	want := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{operation="bind",le="0.1"} 2
+test_seconds_bucket{operation="bind",le="1"} 3
+test_seconds_bucket{operation="bind",le="+Inf"} 4
+test_seconds_sum{operation="bind"} 2.65
+test_seconds_count{operation="bind"} 4
+`
+	if b.String() != want {
+		t.Errorf("write() = %q, want %q", b.String(), want)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	Requests.Inc("multi", OutcomeForbidden)
+
+	var b bytes.Buffer
+	WriteText(&b)
+	for _, line := range []string{
+		"# TYPE ngx_auth_requests_total counter",
+		`ngx_auth_requests_total{profile="multi",outcome="forbidden"} 1`,
+		"# TYPE ngx_auth_ldap_duration_seconds histogram",
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("WriteText() has no line %q", line)
+		}
+	}
+}
+
+func TestCheckLabels(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Inc() with a missing label does not panic")
+		}
+	}()
+	Requests.Inc(OutcomeOk)
+}
@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ngx_auth/authz"
+	"ngx_auth/ldap_auth"
+	"ngx_auth/pipeline"
+	"ngx_auth/profile"
+)
+
+func TestNew(t *testing.T) {
+	password := map[string]string{"user1": "pass1"}
+	rights := profile.PathRights{UserMap: &authz.UserMap{}}
+
+	tests := []struct {
+		name string
+		opts Options
+		err  error
+	}{
+		{"simple", Options{Type: profile.TypeSimple, AuthRealm: "test", Password: password}, nil},
+		{"bad type", Options{Type: "ldap2", AuthRealm: "test"}, ErrBadType},
+		{"no realm", Options{Type: profile.TypeSimple, Password: password}, ErrNoRealm},
+		{"no password", Options{Type: profile.TypeSimple, AuthRealm: "test"}, ErrNoPassword},
+		{"no ldap", Options{Type: profile.TypeLdapPath, AuthRealm: "test", Rights: rights}, ErrNoLdap},
+		{"no user map", Options{Type: profile.TypeLdapPath, AuthRealm: "test", Ldap: &ldap_auth.Config{}}, ErrNoUserMap},
+		{"header path without user map", Options{Type: profile.TypeHeaderPath}, ErrNoUserMap},
+		{"header path without signature", Options{Type: profile.TypeHeaderPath, Rights: rights}, ErrNoSignature},
+		{"no cert", Options{Type: profile.TypeClientCert, Rights: rights}, ErrNoCert},
+		{"no pipeline", Options{Type: profile.TypePipeline}, ErrNoPipeline},
+		{"bearer without jwt", Options{Type: profile.TypePipeline,
+			Credentials: pipeline.Bearer{}, Authenticator: pipeline.PasswordMap(password)}, ErrBearerJwt},
+		{"api key without its authenticator", Options{Type: profile.TypePipeline,
+			Credentials: pipeline.ApiKeyCredentials{}, Authenticator: pipeline.PasswordMap(password)}, ErrApiKeyPair},
+		{"basic pipeline", Options{Type: profile.TypePipeline, AuthRealm: "test",
+			Credentials: pipeline.BasicCredentials{}, Authenticator: pipeline.PasswordMap(password)}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := New(tt.opts)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("New() error = %v, want %v", err, tt.err)
+			}
+			if (h != nil) != (tt.err == nil) {
+				t.Errorf("New() handler = %v, want it only without an error", h)
+			}
+		})
+	}
+}
+
+func TestProtect(t *testing.T) {
+	protect, err := NewMiddleware(Options{Type: profile.TypeSimple, AuthRealm: "test",
+		Password: map[string]string{"user1": "pass1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := IdentityOf(r)
+		if !ok {
+			t.Errorf("IdentityOf() = false in next")
+		}
+		w.Write([]byte("hello " + id.User))
+	}))
+
+	tests := []struct {
+		name      string
+		user      string
+		pass      string
+		code      int
+		body      string
+		challenge bool
+	}{
+		{"allowed", "user1", "pass1", http.StatusOK, "hello user1", false},
+		{"wrong password", "user1", "pass2", http.StatusUnauthorized, "", true},
+		{"no credentials", "", "", http.StatusUnauthorized, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/app/x", nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("Protect() = %d, want %d", w.Code, tt.code)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("Protect() body = %q, want %q", w.Body.String(), tt.body)
+			}
+			if got := w.Header().Get("WWW-Authenticate") != ""; got != tt.challenge {
+				t.Errorf("Protect() WWW-Authenticate %v, want %v", got, tt.challenge)
+			}
+		})
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if _, ok := IdentityOf(r); ok {
+		t.Errorf("IdentityOf() = true outside of Protect")
+	}
+}
+
+func TestProtectHeaders(t *testing.T) {
+	var got http.Header
+	auth := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1"})
+		w.Header().Set("X-Auth", "only for auth")
+	})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != `"v1"` {
+			t.Errorf("next If-None-Match = %q, want %q", r.Header.Get("If-None-Match"), `"v1"`)
+		}
+	})
+
+	tests := []struct {
+		name        string
+		path_header string
+		want        string
+	}{
+		{"default path header", "", profile.DefaultPathHeader},
+		{"path header", "X-Path", "X-Path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/app/x?q=1", nil)
+			r.Header.Set("If-None-Match", `"v1"`)
+			r.Header.Set(tt.want, "/forged")
+			w := httptest.NewRecorder()
+			Protect(auth, tt.path_header, next).ServeHTTP(w, r)
+
+			if got.Get(tt.want) != "/app/x?q=1" {
+				t.Errorf("auth %s = %q, want %q", tt.want, got.Get(tt.want), "/app/x?q=1")
+			}
+			if got.Get(profile.OriginalUriHeader) != "/app/x?q=1" || got.Get(profile.OriginalMethodHeader) != "POST" {
+				t.Errorf("auth original URI and method = %q %q, want %q %q", got.Get(profile.OriginalUriHeader),
+					got.Get(profile.OriginalMethodHeader), "/app/x?q=1", "POST")
+			}
+			if got.Get("If-None-Match") != "" {
+				t.Errorf("auth If-None-Match = %q, want none", got.Get("If-None-Match"))
+			}
+			if w.Header().Get("Set-Cookie") != "session=s1" || w.Header().Get("X-Auth") != "" {
+				t.Errorf("Protect() headers = %v, want only the Set-Cookie of auth", w.Header())
+			}
+		})
+	}
+}
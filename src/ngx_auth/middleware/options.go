@@ -0,0 +1,228 @@
+// Package middleware makes the authentication modules usable as net/http handlers.
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	"ngx_auth/assertion"
+	"ngx_auth/client_cert"
+	"ngx_auth/digest"
+	"ngx_auth/htstat"
+	"ngx_auth/ldap_auth"
+	"ngx_auth/pipeline"
+	"ngx_auth/profile"
+	"ngx_auth/session"
+	"ngx_auth/signed_header"
+)
+
+var (
+	ErrBadType     = errors.New("bad module type")
+	ErrNoRealm     = errors.New("AuthRealm is required")
+	ErrNoPassword  = errors.New("Password is required")
+	ErrDigestRealm = errors.New("Digest.Realm must be AuthRealm")
+	ErrNoLdap      = errors.New("Ldap is required")
+	ErrNoUserMap   = errors.New("Rights.UserMap is required")
+	ErrNoSignature = errors.New("Signature is required")
+	ErrNoPipeline  = errors.New("Credentials and Authenticator are required")
+	ErrBearerJwt   = errors.New("Bearer credentials must be used with the Jwt authenticator")
+	ErrApiKeyPair  = errors.New("ApiKeyCredentials must be used with the ApiKey authenticator")
+	ErrNoCert      = errors.New("Cert is required")
+	ErrBadResponse = errors.New("bad response status code")
+)
+
+// Options are the settings of a handler, as in the configuration file of Type.
+type Options struct {
+	// Type is the module type, such as profile.TypeLdapPath.
+	Type string
+	// Name is recorded as the profile in the audit log.
+	Name string
+
+	CacheSeconds      uint32
+	NegCacheSeconds   uint32
+	UseEtag           bool
+	UseSerializedAuth bool
+	AuthRealm         string
+	// PathHeader and UserHeader are the request headers of the path and
+	// the user. Empty means profile.DefaultPathHeader and profile.DefaultUserHeader.
+	PathHeader string
+	UserHeader string
+	// Response is the status and the message of each result.
+	// Zero entries are the defaults.
+	Response htstat.HttpStatusTbl
+
+	// Password is the users and the passwords of TypeSimple.
+	Password map[string]string
+	// Digest verifies the Digest credentials of TypeSimple, with the
+	// realm of AuthRealm. Nil accepts only Basic credentials.
+	Digest *digest.Server
+	// Ldap is the LDAP server of TypeLdap, TypeLdapPath and TypeLdapPath2Ldap.
+	Ldap *ldap_auth.Config
+	// Rights is the user map authorization of TypeLdapPath, TypeHeaderPath
+	// and TypeClientCert.
+	Rights profile.PathRights
+	// Filters is the LDAP filter authorization of TypeLdapPath2Ldap.
+	Filters profile.PathFilters
+	// Sessions issues the session cookies of TypeLdap, TypeLdapPath and
+	// TypeLdapPath2Ldap. Nil disables them.
+	Sessions *session.Manager
+	// Signature verifies the signed user header of TypeHeaderPath. It is
+	// required, because the client can send any user header.
+	Signature *signed_header.Verifier
+	// Cert extracts the user of the client certificate of TypeClientCert.
+	Cert *client_cert.Extractor
+	// Assertion signs the identity of the authorized requests in a
+	// response header. Nil disables it.
+	Assertion *assertion.Issuer
+
+	// The parts of TypePipeline. Groups and Authorizer may be nil.
+	// pipeline.Bearer must be used with pipeline.Jwt, and
+	// pipeline.ApiKeyCredentials with pipeline.ApiKey.
+	Credentials   pipeline.CredentialExtractor
+	Authenticator pipeline.Authenticator
+	Groups        pipeline.GroupProvider
+	Authorizer    pipeline.Authorizer
+}
+
+func (opts *Options) uses_realm() bool {
+	switch opts.Type {
+	case profile.TypeHeaderPath, profile.TypeClientCert:
+		return false
+	case profile.TypePipeline:
+		return opts.Credentials != nil && opts.Credentials.HasPassword()
+	}
+	return true
+}
+
+func is_bearer(ext pipeline.CredentialExtractor) bool {
+	switch ext.(type) {
+	case pipeline.Bearer, *pipeline.Bearer:
+		return true
+	}
+	return false
+}
+
+func is_apikey(ext pipeline.CredentialExtractor) bool {
+	switch ext.(type) {
+	case pipeline.ApiKeyCredentials, *pipeline.ApiKeyCredentials:
+		return true
+	}
+	return false
+}
+
+// check_pipeline checks that a token is verified by its own authenticator.
+func (opts *Options) check_pipeline() error {
+	_, is_jwt := opts.Authenticator.(*pipeline.Jwt)
+	if is_bearer(opts.Credentials) != is_jwt {
+		return ErrBearerJwt
+	}
+	_, is_key := opts.Authenticator.(*pipeline.ApiKey)
+	if is_apikey(opts.Credentials) != is_key {
+		return ErrApiKeyPair
+	}
+	return nil
+}
+
+func (opts *Options) check() error {
+	if !profile.IsValidType(opts.Type) {
+		return ErrBadType
+	}
+	if opts.uses_realm() && opts.AuthRealm == "" {
+		return ErrNoRealm
+	}
+	if !opts.Response.IsValid() {
+		return ErrBadResponse
+	}
+
+	switch opts.Type {
+	case profile.TypeSimple:
+		if len(opts.Password) == 0 {
+			return ErrNoPassword
+		}
+		if opts.Digest != nil && opts.Digest.Realm != opts.AuthRealm {
+			return ErrDigestRealm
+		}
+	case profile.TypeLdap, profile.TypeLdapPath2Ldap:
+		if opts.Ldap == nil {
+			return ErrNoLdap
+		}
+	case profile.TypeLdapPath:
+		if opts.Ldap == nil {
+			return ErrNoLdap
+		}
+		if opts.Rights.UserMap == nil {
+			return ErrNoUserMap
+		}
+	case profile.TypeHeaderPath:
+		if opts.Rights.UserMap == nil {
+			return ErrNoUserMap
+		}
+		if opts.Signature == nil {
+			return ErrNoSignature
+		}
+	case profile.TypeClientCert:
+		if opts.Cert == nil {
+			return ErrNoCert
+		}
+		if opts.Rights.UserMap == nil {
+			return ErrNoUserMap
+		}
+	case profile.TypePipeline:
+		if opts.Credentials == nil || opts.Authenticator == nil {
+			return ErrNoPipeline
+		}
+		return opts.check_pipeline()
+	}
+	return nil
+}
+
+// New returns the handler of the module of opts.Type.
+func New(opts Options) (http.Handler, error) {
+	opts.Response.SetDefault()
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+
+	c := profile.Common{
+		Name:            opts.Name,
+		CacheSeconds:    opts.CacheSeconds,
+		NegCacheSeconds: opts.NegCacheSeconds,
+		UseEtag:         opts.UseEtag,
+		AuthRealm:       opts.AuthRealm,
+		Response:        opts.Response,
+		Sessions:        opts.Sessions,
+		Assertion:       opts.Assertion,
+	}
+
+	switch opts.Type {
+	case profile.TypeSimple:
+		return profile.NewSimple(c, opts.Password, opts.Digest), nil
+	case profile.TypeLdap:
+		return profile.NewLdap(c, opts.Ldap, opts.UseSerializedAuth), nil
+	case profile.TypeLdapPath:
+		return profile.NewLdapPath(c, opts.Ldap, opts.UseSerializedAuth,
+			opts.PathHeader, opts.Rights), nil
+	case profile.TypeHeaderPath:
+		return profile.NewHeaderPath(c, opts.PathHeader, opts.UserHeader, opts.Rights, opts.Signature), nil
+	case profile.TypeClientCert:
+		return profile.NewClientCert(c, opts.PathHeader, opts.Cert, opts.Rights), nil
+	case profile.TypeLdapPath2Ldap:
+		return profile.NewLdapPath2Ldap(c, opts.Ldap, opts.UseSerializedAuth,
+			opts.PathHeader, opts.Filters), nil
+	case profile.TypePipeline:
+		return profile.NewPipeline(c, opts.PathHeader, opts.UseSerializedAuth,
+			opts.Credentials, opts.Authenticator, opts.Groups, opts.Authorizer), nil
+	}
+	return nil, ErrBadType
+}
+
+// NewMiddleware returns a middleware protecting a handler with the handler of opts.
+func NewMiddleware(opts Options) (func(http.Handler) http.Handler, error) {
+	auth, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	return func(next http.Handler) http.Handler {
+		return Protect(auth, opts.PathHeader, next)
+	}, nil
+}
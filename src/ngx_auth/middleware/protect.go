@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+
+	"ngx_auth/profile"
+)
+
+// recorder keeps the response of auth, which is sent only for a denied request.
+type recorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func new_recorder() *recorder {
+	return &recorder{header: http.Header{}, code: http.StatusOK}
+}
+
+func (rr *recorder) Header() http.Header {
+	return rr.header
+}
+
+func (rr *recorder) WriteHeader(code int) {
+	rr.code = code
+}
+
+func (rr *recorder) Write(b []byte) (int, error) {
+	return rr.body.Write(b)
+}
+
+func (rr *recorder) allowed() bool {
+	return rr.code >= 200 && rr.code < 300
+}
+
+func (rr *recorder) send(w http.ResponseWriter) {
+	for k, v := range rr.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rr.code)
+	w.Write(rr.body.Bytes())
+}
+
+// Protect calls next only for the requests auth allows, like auth_request of nginx.
+// An empty path_header is profile.DefaultPathHeader.
+func Protect(auth http.Handler, path_header string, next http.Handler) http.Handler {
+	if path_header == "" {
+		path_header = profile.DefaultPathHeader
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, id := profile.WithIdentity(r.Context())
+		ar := r.Clone(ctx)
+		// If-None-Match is for next, so auth never answers 304.
+		ar.Header.Del("If-None-Match")
+		ar.Header.Set(path_header, r.URL.RequestURI())
+		ar.Header.Set(profile.OriginalUriHeader, r.URL.RequestURI())
+		ar.Header.Set(profile.OriginalMethodHeader, r.Method)
+
+		rr := new_recorder()
+		auth.ServeHTTP(rr, ar)
+		if !rr.allowed() {
+			rr.send(w)
+			return
+		}
+		// The session cookie issued by auth goes with the response of next.
+		for _, ck := range rr.header["Set-Cookie"] {
+			w.Header().Add("Set-Cookie", ck)
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identity_key{}, *id)))
+	})
+}
+
+type identity_key struct{}
+
+// IdentityOf returns the identity of a request allowed by Protect.
+func IdentityOf(r *http.Request) (profile.Identity, bool) {
+	id, ok := r.Context().Value(identity_key{}).(profile.Identity)
+	return id, ok
+}
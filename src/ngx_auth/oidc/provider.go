@@ -0,0 +1,118 @@
+// Package oidc is an OpenID Connect relying party of the authorization code
+// flow with PKCE. The ID token is verified with the jwt package.
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"ngx_auth/jwt"
+)
+
+var (
+	ErrDiscovery = errors.New("OIDC discovery error")
+	ErrBadIssuer = errors.New("issuer of the discovery document does not match")
+)
+
+// Provider is the metadata of an OpenID provider.
+type Provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// CheckUrl accepts https URLs, and http URLs only for a loopback host,
+// such as a local mock provider.
+func CheckUrl(u string) error {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	switch pu.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := pu.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be an https URL: %q", u)
+}
+
+// Discover fetches the discovery document of issuer.
+func Discover(client *http.Client, issuer string) (*Provider, error) {
+	u := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	res, err := client.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDiscovery, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrDiscovery, res.Status)
+	}
+
+	var p Provider
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&p); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDiscovery, err)
+	}
+	if p.Issuer != issuer {
+		return nil, fmt.Errorf("%w: %q", ErrBadIssuer, p.Issuer)
+	}
+	for _, ep := range []string{p.AuthorizationEndpoint, p.TokenEndpoint, p.JwksUri} {
+		if ep == "" {
+			return nil, fmt.Errorf("%w: missing endpoint", ErrDiscovery)
+		}
+		if err := CheckUrl(ep); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrDiscovery, err)
+		}
+	}
+	return &p, nil
+}
+
+// discovery keeps the provider metadata and its keys. The provider may be
+// down when the server starts, so it is discovered on the first use, and
+// again at most once in jwt.MinRefreshInterval after a failure.
+type discovery struct {
+	issuer    string
+	client    *http.Client
+	cache_ttl time.Duration
+
+	mu       sync.Mutex
+	provider *Provider
+	keys     *jwt.RemoteKeys
+	failed   time.Time
+	fail_err error
+}
+
+func (d *discovery) get() (*Provider, *jwt.RemoteKeys, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.provider != nil {
+		return d.provider, d.keys, nil
+	}
+	if time.Since(d.failed) < jwt.MinRefreshInterval {
+		return nil, nil, d.fail_err
+	}
+
+	p, err := Discover(d.client, d.issuer)
+	if err != nil {
+		d.failed = time.Now()
+		d.fail_err = err
+		return nil, nil, err
+	}
+	d.provider = p
+	d.keys = jwt.NewRemoteKeys(p.JwksUri, d.cache_ttl, d.client.Timeout)
+	return d.provider, d.keys, nil
+}
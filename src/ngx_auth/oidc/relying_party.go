@@ -0,0 +1,264 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"ngx_auth/jwt"
+	"ngx_auth/session"
+)
+
+var (
+	ErrNoLogin       = errors.New("no login in progress")
+	ErrBadState      = errors.New("state does not match")
+	ErrLoginExpired  = errors.New("login is expired")
+	ErrProviderError = errors.New("provider returned an error")
+	ErrTokenExchange = errors.New("token exchange error")
+	ErrBadNonce      = errors.New("nonce does not match")
+	ErrNoUser        = errors.New("no user claim")
+)
+
+// LoginSeconds is the time allowed from the redirect to the callback.
+const LoginSeconds = 600
+
+var DefaultScopes = []string{"openid", "profile", "email"}
+
+// RelyingParty runs the login flow with one provider.
+type RelyingParty struct {
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	// RedirectUrl is the URL of the callback, as the browser sees it.
+	RedirectUrl string
+	Scopes      []string
+	UserClaim   string
+	GroupsClaim string
+
+	// Codec seals the login state into LoginCookie.
+	Codec       *session.Codec
+	LoginCookie session.CookieConfig
+
+	disc *discovery
+}
+
+func NewRelyingParty(rp RelyingParty, timeout time.Duration, jwks_ttl time.Duration) *RelyingParty {
+	if len(rp.Scopes) == 0 {
+		rp.Scopes = DefaultScopes
+	}
+	rp.disc = &discovery{
+		issuer:    rp.Issuer,
+		client:    &http.Client{Timeout: timeout},
+		cache_ttl: jwks_ttl,
+	}
+	return &rp
+}
+
+// loginState is kept in the login cookie between the redirect and the callback.
+type loginState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Return   string `json:"r"`
+	Expires  int64  `json:"exp"`
+}
+
+// Identity is the user of a verified ID token.
+type Identity struct {
+	User   string
+	Groups []string
+	Claims jwt.Claims
+}
+
+func random_string() (string, error) {
+	bin := make([]byte, 32)
+	if _, err := rand.Read(bin); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bin), nil
+}
+
+func pkce_challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// SafeReturn accepts only a local path as the URL to return to after the
+// login, so the login cannot redirect to another site.
+func SafeReturn(rd string) string {
+	if !strings.HasPrefix(rd, "/") || strings.HasPrefix(rd, "//") ||
+		strings.HasPrefix(rd, `/\`) || strings.ContainsAny(rd, "\r\n") {
+		return "/"
+	}
+	return rd
+}
+
+// StartLogin sets the login cookie, and redirects to the authorization
+// endpoint. rd is the path to return to after the login.
+func (rp *RelyingParty) StartLogin(w http.ResponseWriter, rd string) error {
+	p, _, err := rp.disc.get()
+	if err != nil {
+		return err
+	}
+
+	var ls loginState
+	for _, s := range []*string{&ls.State, &ls.Nonce, &ls.Verifier} {
+		if *s, err = random_string(); err != nil {
+			return err
+		}
+	}
+	ls.Return = SafeReturn(rd)
+	expires := time.Now().Add(LoginSeconds * time.Second)
+	ls.Expires = expires.Unix()
+
+	sealed, err := rp.Codec.Seal(&ls)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, rp.LoginCookie.Cookie(sealed, expires))
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", rp.ClientId)
+	q.Set("redirect_uri", rp.RedirectUrl)
+	q.Set("scope", strings.Join(rp.Scopes, " "))
+	q.Set("state", ls.State)
+	q.Set("nonce", ls.Nonce)
+	q.Set("code_challenge", pkce_challenge(ls.Verifier))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	w.Header().Set("Location", p.AuthorizationEndpoint+sep+q.Encode())
+	w.WriteHeader(http.StatusFound)
+	return nil
+}
+
+// Callback checks the state, exchanges the code, and verifies the ID token.
+// It returns the identity and the path to return to. The login cookie is
+// removed in any case.
+func (rp *RelyingParty) Callback(w http.ResponseWriter, r *http.Request) (*Identity, string, error) {
+	http.SetCookie(w, rp.LoginCookie.Clear())
+
+	ck, err := r.Cookie(rp.LoginCookie.Name)
+	if err != nil {
+		return nil, "/", ErrNoLogin
+	}
+	var ls loginState
+	if err := rp.Codec.Open(ck.Value, &ls); err != nil || ls.State == "" {
+		return nil, "/", ErrNoLogin
+	}
+	if time.Now().Unix() >= ls.Expires {
+		return nil, ls.Return, ErrLoginExpired
+	}
+
+	q := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(ls.State)) != 1 {
+		return nil, ls.Return, ErrBadState
+	}
+	if e := q.Get("error"); e != "" {
+		return nil, ls.Return, fmt.Errorf("%w: %s", ErrProviderError, e)
+	}
+
+	id, err := rp.exchange(q.Get("code"), &ls)
+	return id, ls.Return, err
+}
+
+func (rp *RelyingParty) exchange(code string, ls *loginState) (*Identity, error) {
+	p, keys, err := rp.disc.get()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", rp.RedirectUrl)
+	form.Set("code_verifier", ls.Verifier)
+	if rp.ClientSecret == "" {
+		form.Set("client_id", rp.ClientId)
+	}
+	req, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// A public client without a secret is identified by client_id with PKCE.
+	if rp.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(rp.ClientId), url.QueryEscape(rp.ClientSecret))
+	}
+
+	res, err := rp.disc.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTokenExchange, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrTokenExchange, res.Status)
+	}
+	var tr struct {
+		IdToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTokenExchange, err)
+	}
+	if tr.IdToken == "" {
+		return nil, fmt.Errorf("%w: no id_token", ErrTokenExchange)
+	}
+
+	return rp.verify_id_token(tr.IdToken, keys, ls.Nonce)
+}
+
+func (rp *RelyingParty) verify_id_token(token string, keys *jwt.RemoteKeys, nonce string) (*Identity, error) {
+	v := &jwt.Verifier{
+		Keys:     keys,
+		Issuer:   rp.Issuer,
+		Algs:     []string{jwt.AlgRS256, jwt.AlgES256, jwt.AlgEdDSA},
+		Audience: []string{rp.ClientId},
+		Leeway:   30 * time.Second,
+	}
+	claims, err := v.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if _, has := claims["exp"]; !has {
+		return nil, jwt.ErrExpired
+	}
+	if subtle.ConstantTimeCompare([]byte(jwt.String(claims, "nonce")), []byte(nonce)) != 1 {
+		return nil, ErrBadNonce
+	}
+
+	user := jwt.String(claims, rp.UserClaim)
+	if user == "" {
+		return nil, ErrNoUser
+	}
+	return &Identity{
+		User:   user,
+		Groups: jwt.Strings(claims, rp.GroupsClaim),
+		Claims: claims,
+	}, nil
+}
+
+// Check discovers the provider for the readiness check.
+func (rp *RelyingParty) Check() (string, error) {
+	p, keys, err := rp.disc.get()
+	if err != nil {
+		return "", err
+	}
+	if _, err := keys.Check(); err != nil {
+		return "", err
+	}
+	return "issuer=" + p.Issuer, nil
+}
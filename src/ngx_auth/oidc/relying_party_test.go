@@ -0,0 +1,227 @@
+package oidc
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"ngx_auth/session"
+)
+
+const test_secret = "0123456789abcdef0123456789abcdef"
+
+// testIdp is an OpenID provider issuing an ID token for a code registered
+// with the PKCE challenge and the nonce of its authorization request.
+type testIdp struct {
+	*httptest.Server
+	key ed25519.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]url.Values
+}
+
+func (idp *testIdp) serve(w http.ResponseWriter, r *http.Request) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		json.NewEncoder(w).Encode(&Provider{
+			Issuer:                idp.URL,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			JwksUri:               idp.URL + "/jwks",
+		})
+	case "/jwks":
+		pub := idp.key.Public().(ed25519.PublicKey)
+		w.Write([]byte(`{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"k1","x":"` + b64(pub) + `"}]}`))
+	case "/token":
+		idp.mu.Lock()
+		auth, ok := idp.codes[r.PostFormValue("code")]
+		idp.mu.Unlock()
+		if !ok || pkce_challenge(r.PostFormValue("code_verifier")) != auth.Get("code_challenge") {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		hd, _ := json.Marshal(map[string]string{"alg": "EdDSA", "kid": "k1"})
+		cl, _ := json.Marshal(map[string]interface{}{
+			"iss":   idp.URL,
+			"aud":   auth.Get("client_id"),
+			"sub":   auth.Get("sub"),
+			"nonce": auth.Get("nonce"),
+			"exp":   json.Number(strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)),
+		})
+		signed := b64(hd) + "." + b64(cl)
+		sig := ed25519.Sign(idp.key, []byte(signed))
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed + "." + b64(sig)})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorize registers code for the authorization request of a login.
+func (idp *testIdp) authorize(code string, login *httptest.ResponseRecorder, sub string) url.Values {
+	u, _ := url.Parse(login.Header().Get("Location"))
+	q := u.Query()
+	q.Set("sub", sub)
+	idp.mu.Lock()
+	idp.codes[code] = q
+	idp.mu.Unlock()
+	return q
+}
+
+func TestCallback(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdp{key: key, codes: map[string]url.Values{}}
+	idp.Server = httptest.NewServer(http.HandlerFunc(idp.serve))
+	defer idp.Close()
+
+	codec, err := session.NewCodec(test_secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := NewRelyingParty(RelyingParty{
+		Issuer:      idp.URL,
+		ClientId:    "app",
+		RedirectUrl: "https://app.example.com/auth/callback",
+		UserClaim:   "sub",
+		Codec:       codec,
+		LoginCookie: session.CookieConfig{Name: "login"},
+	}, 5*time.Second, time.Minute)
+
+	start := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		if err := rp.StartLogin(w, "/app/page"); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	login, other := start(), start()
+	auth := idp.authorize("code1", login, "user1")
+	other_auth := idp.authorize("code2", other, "user2")
+	// A code issued with the PKCE challenge or the nonce of the other login.
+	idp.authorize("swapped", login, "user1").Set("code_challenge", other_auth.Get("code_challenge"))
+	idp.authorize("bad_nonce", login, "user1").Set("nonce", other_auth.Get("nonce"))
+
+	if auth.Get("code_challenge_method") != "S256" || auth.Get("code_challenge") == "" {
+		t.Fatalf("StartLogin() without a PKCE challenge: %v", auth)
+	}
+	if auth.Get("state") == other_auth.Get("state") || auth.Get("nonce") == other_auth.Get("nonce") {
+		t.Fatalf("StartLogin() reused the state or the nonce")
+	}
+
+	tests := []struct {
+		name  string
+		login *httptest.ResponseRecorder
+		query url.Values
+		user  string
+		rd    string
+		err   error
+	}{
+		{"ok", login, url.Values{"state": {auth.Get("state")}, "code": {"code1"}}, "user1", "/app/page", nil},
+		{"no login cookie", nil, url.Values{"state": {auth.Get("state")}, "code": {"code1"}}, "", "/", ErrNoLogin},
+		{"no state", login, url.Values{"code": {"code1"}}, "", "/app/page", ErrBadState},
+		{"state of other login", login, url.Values{"state": {other_auth.Get("state")}, "code": {"code1"}},
+			"", "/app/page", ErrBadState},
+		{"provider error", login, url.Values{"state": {auth.Get("state")}, "error": {"access_denied"}},
+			"", "/app/page", ErrProviderError},
+		{"verifier of other login", login, url.Values{"state": {auth.Get("state")}, "code": {"swapped"}},
+			"", "/app/page", ErrTokenExchange},
+		{"nonce of other login", login, url.Values{"state": {auth.Get("state")}, "code": {"bad_nonce"}},
+			"", "/app/page", ErrBadNonce},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/auth/callback?"+tt.query.Encode(), nil)
+			if tt.login != nil {
+				for _, c := range tt.login.Result().Cookies() {
+					r.AddCookie(c)
+				}
+			}
+			w := httptest.NewRecorder()
+			id, rd, err := rp.Callback(w, r)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Callback() error = %v, want %v", err, tt.err)
+			}
+			if rd != tt.rd {
+				t.Errorf("Callback() return = %q, want %q", rd, tt.rd)
+			}
+			if err == nil && id.User != tt.user {
+				t.Errorf("Callback() user = %q, want %q", id.User, tt.user)
+			}
+			if cs := w.Result().Cookies(); len(cs) != 1 || cs[0].MaxAge >= 0 {
+				t.Errorf("Callback() did not clear the login cookie")
+			}
+		})
+	}
+}
+
+func TestCallbackTamperedCookie(t *testing.T) {
+	codec, err := session.NewCodec(test_secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := session.NewCodec(test_secret + "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := loginState{State: "s1", Nonce: "n1", Verifier: "v1", Return: "/app",
+		Expires: time.Now().Add(time.Minute).Unix()}
+	expired := valid
+	expired.Expires = time.Now().Unix()
+
+	tests := []struct {
+		name  string
+		codec *session.Codec
+		ls    loginState
+		err   error
+	}{
+		{"other secret", other, valid, ErrNoLogin},
+		{"no state", codec, loginState{Return: "/app", Expires: valid.Expires}, ErrNoLogin},
+		{"expired", codec, expired, ErrLoginExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := NewRelyingParty(RelyingParty{Codec: codec,
+				LoginCookie: session.CookieConfig{Name: "login"}}, time.Second, time.Minute)
+			sealed, err := tt.codec.Seal(&tt.ls)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/auth/callback?state="+tt.ls.State, nil)
+			r.AddCookie(&http.Cookie{Name: "login", Value: sealed})
+			if _, _, err := rp.Callback(httptest.NewRecorder(), r); !errors.Is(err, tt.err) {
+				t.Errorf("Callback() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSafeReturn(t *testing.T) {
+	tests := []struct {
+		rd   string
+		want string
+	}{
+		{"/app/page?q=1", "/app/page?q=1"},
+		{"", "/"},
+		{"https://evil.example.com/", "/"},
+		{"//evil.example.com/", "/"},
+		{`/\evil.example.com/`, "/"},
+		{"/app\r\nSet-Cookie: x=1", "/"},
+	}
+	for _, tt := range tests {
+		if got := SafeReturn(tt.rd); got != tt.want {
+			t.Errorf("SafeReturn(%q) = %q, want %q", tt.rd, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package pipeline
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"ngx_auth/apikey"
+	"ngx_auth/audit"
+	"ngx_auth/jwt"
+	"ngx_auth/logger"
+	"ngx_auth/metrics"
+)
+
+// ApiKeyCredentials takes an unverified API key from "Authorization: Bearer" or Header.
+type ApiKeyCredentials struct {
+	Header string
+	Keys   *apikey.File
+}
+
+func (ac ApiKeyCredentials) token(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	if ac.Header != "" {
+		return strings.TrimSpace(r.Header.Get(ac.Header))
+	}
+	return ""
+}
+
+// Extract returns true for an unknown key too, so that the authenticator rejects it.
+func (ac ApiKeyCredentials) Extract(r *http.Request) (Credentials, bool) {
+	token := ac.token(r)
+	if token == "" {
+		return Credentials{}, false
+	}
+	cred := Credentials{Token: token}
+	if k := ac.Keys.Lookup(token); k != nil {
+		cred.User = k.Owner
+		cred.Claims = k.Claims()
+		cred.Key = k
+	}
+	return cred, true
+}
+
+func (ApiKeyCredentials) MissingOutcome() string {
+	return metrics.OutcomeUnauth
+}
+
+func (ApiKeyCredentials) HasPassword() bool {
+	return false
+}
+
+func (ApiKeyCredentials) Scheme() string {
+	return "Bearer"
+}
+
+// ApiKey verifies the API key taken by ApiKeyCredentials.
+type ApiKey struct {
+	Keys *apikey.File
+}
+
+func (ak *ApiKey) Authenticate(cred Credentials, clientIP string) (bool, error) {
+	if err := apikey.VerifyKey(cred.Key, cred.Token); err != nil {
+		logger.Event(logger.LevelInfo, logger.EventApiKeyRejected,
+			logger.User(cred.User), logger.ClientIP(clientIP), logger.Err(err))
+		return false, nil
+	}
+	return cred.Key.Owner == cred.User, nil
+}
+
+func (*ApiKey) NeedsPassword() bool {
+	return false
+}
+
+// KeyScope denies an API key with a path list outside of its path IDs.
+type KeyScope struct {
+	PathPatternReg *regexp.Regexp
+	Next           Authorizer
+}
+
+func (ks *KeyScope) Authorize(req *Request) (bool, string, error) {
+	paths := jwt.Strings(req.Claims, apikey.ClaimPaths)
+	if len(paths) > 0 {
+		pathid, ok := CheckPath(ks.PathPatternReg, req.Path)
+		if ok {
+			req.Record.SetPathId(pathid)
+		}
+		if !ok || !slices.Contains(paths, pathid) {
+			return false, audit.ReasonKeyScope, nil
+		}
+	}
+	return ks.Next.Authorize(req)
+}
+
+func (ks *KeyScope) NeedsPath() bool {
+	return ks.PathPatternReg != nil || ks.Next.NeedsPath()
+}
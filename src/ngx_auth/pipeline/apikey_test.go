@@ -0,0 +1,114 @@
+package pipeline
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"ngx_auth/apikey"
+	"ngx_auth/audit"
+	"ngx_auth/jwt"
+)
+
+func TestKeyScope(t *testing.T) {
+	re := regexp.MustCompile(`^/([^/]+)/`)
+	scoped := (&apikey.Key{Owner: "ci", Paths: []string{"app"}}).Claims()
+	unscoped := (&apikey.Key{Owner: "ci"}).Claims()
+
+	tests := []struct {
+		name   string
+		ks     KeyScope
+		claims jwt.Claims
+		path   string
+		ok     bool
+		reason string
+	}{
+		{"in scope", KeyScope{PathPatternReg: re, Next: AllowAll{}}, scoped, "/app/x", true, audit.ReasonGranted},
+		{"out of scope", KeyScope{PathPatternReg: re, Next: AllowAll{}}, scoped, "/db/x", false, audit.ReasonKeyScope},
+		{"no path ID", KeyScope{PathPatternReg: re, Next: AllowAll{}}, scoped, "/", false, audit.ReasonKeyScope},
+		{"no path pattern", KeyScope{Next: AllowAll{}}, scoped, "/app/x", false, audit.ReasonKeyScope},
+		{"no path list", KeyScope{Next: AllowAll{}}, unscoped, "/db/x", true, audit.ReasonGranted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{User: "ci", Claims: tt.claims, Path: tt.path, Record: audit.Begin("127.0.0.1")}
+			ok, reason, err := tt.ks.Authorize(req)
+			if ok != tt.ok || reason != tt.reason || err != nil {
+				t.Errorf("Authorize() = %v, %q, %v, want %v, %q, nil", ok, reason, err, tt.ok, tt.reason)
+			}
+		})
+	}
+}
+
+func TestApiKey(t *testing.T) {
+	token, key, err := apikey.Mint("ci", nil, time.Time{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, _, err := apikey.Mint("ci", nil, time.Time{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "keys")
+	if err := apikey.AddKey(file, key); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := apikey.LoadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The secret of the key with one character changed.
+	wrong := token[:len(token)-1] + "A"
+	if strings.HasSuffix(token, "A") {
+		wrong = token[:len(token)-1] + "B"
+	}
+	ac := ApiKeyCredentials{Header: "X-Api-Key", Keys: keys}
+	ak := &ApiKey{Keys: keys}
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		found  bool
+		user   string
+		ok     bool
+	}{
+		{"bearer", "Authorization", "Bearer " + token, true, "ci", true},
+		{"header", "X-Api-Key", token, true, "ci", true},
+		{"wrong secret", "Authorization", "Bearer " + wrong, true, "ci", false},
+		{"unknown key", "Authorization", "Bearer " + unknown, true, "", false},
+		{"no key", "", "", false, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			cred, found := ac.Extract(r)
+			if found != tt.found || cred.User != tt.user {
+				t.Fatalf("Extract() = %q, %v, want %q, %v", cred.User, found, tt.user, tt.found)
+			}
+			if !found {
+				return
+			}
+			if ok, err := ak.Authenticate(cred, "127.0.0.1"); ok != tt.ok || err != nil {
+				t.Errorf("Authenticate() = %v, %v, want %v, nil", ok, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestApiKeyNotExtracted(t *testing.T) {
+	token, _, err := apikey.Mint("ci", nil, time.Time{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ak := &ApiKey{}
+	if ok, err := ak.Authenticate(Credentials{User: "ci", Token: token}, "127.0.0.1"); ok || err != nil {
+		t.Errorf("Authenticate() without the key of Extract = %v, %v, want false, nil", ok, err)
+	}
+}
@@ -0,0 +1,103 @@
+package pipeline
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"ngx_auth/ldap_auth"
+)
+
+// Authenticator names in the configuration.
+const (
+	AuthPassword = "password"
+	AuthHtpasswd = "htpasswd"
+	AuthLdap     = "ldap"
+	AuthNone     = "none"
+	AuthChain    = "chain"
+	AuthJwt      = "jwt"
+	AuthApiKey   = "apikey"
+)
+
+// ErrUnknownUser is returned by an authenticator which does not know the user,
+// so that a chain can try the next authenticator.
+var ErrUnknownUser = errors.New("unknown user")
+
+// PasswordMap authenticates with the passwords in the configuration.
+type PasswordMap map[string]string
+
+func (pm PasswordMap) Authenticate(cred Credentials, _ string) (bool, error) {
+	pw, ok := pm[cred.User]
+	if !ok {
+		return false, ErrUnknownUser
+	}
+	return subtle.ConstantTimeCompare([]byte(pw), []byte(cred.Password)) == 1, nil
+}
+
+func (PasswordMap) NeedsPassword() bool {
+	return true
+}
+
+// LdapBind authenticates with an LDAP bind as the user.
+// With UserFilter, the user is searched with the search account before the
+// bind, and ErrUnknownUser is returned if it is not found.
+type LdapBind struct {
+	Config     *ldap_auth.Config
+	UserFilter string
+}
+
+func (lb *LdapBind) Authenticate(cred Credentials, clientIP string) (bool, error) {
+	if lb.UserFilter != "" {
+		found, err := lb.find_user(cred.User, clientIP)
+		if err != nil {
+			return false, err
+		}
+		if !found {
+			return false, ErrUnknownUser
+		}
+	}
+
+	ok, _, _, err := ldap_auth.AuthenticateUser(lb.Config, cred.User, cred.Password, clientIP)
+	return ok, err
+}
+
+// find_user searches the user with the search account. While the server is
+// unavailable, the user is assumed to exist, so that the offline cache decides.
+func (lb *LdapBind) find_user(user string, clientIP string) (bool, error) {
+	la, err := ldap_auth.NewLdapAuth(lb.Config)
+	if err != nil {
+		return ldap_auth.IsUnavailable(err), ignore_unavailable(err)
+	}
+	defer la.Close()
+
+	if err := la.BindService(); err != nil {
+		return ldap_auth.IsUnavailable(err), ignore_unavailable(err)
+	}
+	found, err := la.FindUser(lb.UserFilter, user, clientIP)
+	if err != nil {
+		return ldap_auth.IsUnavailable(err), ignore_unavailable(err)
+	}
+	return found, nil
+}
+
+func ignore_unavailable(err error) error {
+	if ldap_auth.IsUnavailable(err) {
+		return nil
+	}
+	return err
+}
+
+func (*LdapBind) NeedsPassword() bool {
+	return true
+}
+
+// Trusted accepts the user as is. It is for a user authenticated by
+// another module and passed in a header.
+type Trusted struct{}
+
+func (Trusted) Authenticate(Credentials, string) (bool, error) {
+	return true, nil
+}
+
+func (Trusted) NeedsPassword() bool {
+	return false
+}
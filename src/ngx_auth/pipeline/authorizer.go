@@ -0,0 +1,139 @@
+package pipeline
+
+import (
+	"regexp"
+
+	"ngx_auth/audit"
+	"ngx_auth/authz"
+	"ngx_auth/ldap_auth"
+)
+
+// Authorizer names in the configuration.
+const (
+	AuthzNone       = "none"
+	AuthzPathRight  = "path_right"
+	AuthzLdapFilter = "ldap_filter"
+)
+
+// CheckPath returns the path ID extracted by re.
+func CheckPath(re *regexp.Regexp, rpath string) (string, bool) {
+	if re == nil {
+		return "", false
+	}
+	matchs := re.FindStringSubmatch(rpath)
+	if len(matchs) < 1 {
+		return "", false
+	}
+	return matchs[1], true
+}
+
+// AllowAll allows every authenticated user.
+type AllowAll struct{}
+
+func (AllowAll) Authorize(*Request) (bool, string, error) {
+	return true, audit.ReasonGranted, nil
+}
+
+func (AllowAll) NeedsPath() bool {
+	return false
+}
+
+// PathRight authorizes the path with the rights of the path ID,
+// such as "@admin|user1", checked against the groups of the user.
+type PathRight struct {
+	PathPatternReg *regexp.Regexp
+	NomatchRight   string
+	DefaultRight   string
+	PathRight      map[string]string
+}
+
+func (pr *PathRight) right(rpath string, rec *audit.Record) (string, string) {
+	pathid, ok := CheckPath(pr.PathPatternReg, rpath)
+	if !ok {
+		return pr.NomatchRight, audit.ReasonNomatchRight
+	}
+	rec.SetPathId(pathid)
+
+	right_type, has := pr.PathRight[pathid]
+	if !has {
+		return pr.DefaultRight, audit.ReasonDefaultRight
+	}
+	return right_type, audit.ReasonPathRight
+}
+
+func (pr *PathRight) Authorize(req *Request) (bool, string, error) {
+	right_type, reason := pr.right(req.Path, req.Record)
+	req.Record.SetRight(right_type)
+
+	m, err := req.Membership()
+	if err != nil {
+		return false, audit.ReasonBackendError, err
+	}
+	return authz.Authorize(m, right_type, req.User), reason, nil
+}
+
+func (*PathRight) NeedsPath() bool {
+	return true
+}
+
+// LdapFilter authorizes the path with the LDAP search filter of the path ID,
+// which must match exactly one entry for the user. It searches with the
+// search account, so it works without the user password.
+type LdapFilter struct {
+	Config         *ldap_auth.Config
+	PathPatternReg *regexp.Regexp
+	BanNomatch     bool
+	NomatchFilter  string
+	BanDefault     bool
+	DefaultFilter  string
+	PathFilter     map[string]string
+}
+
+func (lf *LdapFilter) filter(rpath string, rec *audit.Record) (bool, string, string) {
+	pathid, ok := CheckPath(lf.PathPatternReg, rpath)
+	if !ok {
+		if lf.BanNomatch {
+			return false, "", audit.ReasonBanNomatch
+		}
+		return true, lf.NomatchFilter, audit.ReasonAuthzFilter
+	}
+	rec.SetPathId(pathid)
+
+	if flt, has := lf.PathFilter[pathid]; has {
+		return true, flt, audit.ReasonAuthzFilter
+	}
+	if lf.BanDefault {
+		return false, "", audit.ReasonBanDefault
+	}
+	return true, lf.DefaultFilter, audit.ReasonAuthzFilter
+}
+
+func (lf *LdapFilter) Authorize(req *Request) (bool, string, error) {
+	ok, flt, reason := lf.filter(req.Path, req.Record)
+	if !ok {
+		return false, reason, nil
+	}
+	req.Record.SetFilter(flt)
+	if flt == "" {
+		return true, reason, nil
+	}
+
+	la, err := ldap_auth.NewLdapAuth(lf.Config)
+	if err != nil {
+		return false, audit.ReasonBackendError, err
+	}
+	defer la.Close()
+
+	if err := la.BindService(); err != nil {
+		return false, audit.ReasonBackendError, err
+	}
+	ok, err = la.MatchFilter(flt, req.User, req.ClientIP)
+	if err != nil {
+		return false, audit.ReasonBackendError, err
+	}
+	return ok, reason, nil
+}
+
+func (*LdapFilter) NeedsPath() bool {
+	return true
+}
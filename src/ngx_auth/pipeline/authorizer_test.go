@@ -0,0 +1,125 @@
+package pipeline
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"ngx_auth/audit"
+	"ngx_auth/authz"
+	"ngx_auth/jwt"
+)
+
+// failingGroups is a group provider whose backend is down.
+type failingGroups struct{}
+
+func (failingGroups) Membership(string, jwt.Claims) (authz.Membership, error) {
+	return nil, errBackend
+}
+
+// countingGroups counts the lookups of the groups.
+type countingGroups struct {
+	calls *int
+}
+
+func (cg countingGroups) Membership(user string, _ jwt.Claims) (authz.Membership, error) {
+	*cg.calls++
+	return authz.NewGroupSet(user, nil), nil
+}
+
+func TestCheckPath(t *testing.T) {
+	re := regexp.MustCompile(`^/([^/]+)/`)
+	tests := []struct {
+		re     *regexp.Regexp
+		path   string
+		pathid string
+		ok     bool
+	}{
+		{re, "/app/x", "app", true},
+		{re, "/app", "", false},
+		{nil, "/app/x", "", false},
+	}
+	for _, tt := range tests {
+		pathid, ok := CheckPath(tt.re, tt.path)
+		if pathid != tt.pathid || ok != tt.ok {
+			t.Errorf("CheckPath(%q) = %q, %v, want %q, %v", tt.path, pathid, ok, tt.pathid, tt.ok)
+		}
+	}
+}
+
+func TestPathRight(t *testing.T) {
+	pr := &PathRight{
+		PathPatternReg: regexp.MustCompile(`^/([^/]+)/`),
+		NomatchRight:   "",
+		DefaultRight:   "*",
+		PathRight: map[string]string{
+			"admin":  "@admin",
+			"app":    "@dev|user1",
+			"closed": "!",
+		},
+	}
+
+	tests := []struct {
+		name   string
+		user   string
+		groups []interface{}
+		path   string
+		ok     bool
+		reason string
+		pathid string
+		right  string
+	}{
+		{"group", "user2", []interface{}{"admin"}, "/admin/x", true, audit.ReasonPathRight, "admin", "@admin"},
+		{"other group", "user2", []interface{}{"dev"}, "/admin/x", false, audit.ReasonPathRight, "admin", "@admin"},
+		{"user", "user1", nil, "/app/x", true, audit.ReasonPathRight, "app", "@dev|user1"},
+		{"other user", "user2", nil, "/app/x", false, audit.ReasonPathRight, "app", "@dev|user1"},
+		{"closed", "user1", []interface{}{"admin"}, "/closed/x", false, audit.ReasonPathRight, "closed", "!"},
+		{"default right", "user2", nil, "/docs/x", true, audit.ReasonDefaultRight, "docs", "*"},
+		{"no path ID", "user2", nil, "/", true, audit.ReasonNomatchRight, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{
+				User:   tt.user,
+				Claims: jwt.Claims{"groups": tt.groups},
+				Path:   tt.path,
+				Record: audit.Begin("127.0.0.1"),
+				Groups: &ClaimGroups{Claim: "groups"},
+			}
+			ok, reason, err := pr.Authorize(req)
+			if ok != tt.ok || reason != tt.reason || err != nil {
+				t.Fatalf("Authorize() = %v, %q, %v, want %v, %q, nil", ok, reason, err, tt.ok, tt.reason)
+			}
+			pathid := ""
+			if req.Record.PathId != nil {
+				pathid = *req.Record.PathId
+			}
+			if pathid != tt.pathid || req.Record.Right == nil || *req.Record.Right != tt.right {
+				t.Errorf("Authorize() record path ID %q, right %v, want %q, %q", pathid, req.Record.Right, tt.pathid, tt.right)
+			}
+		})
+	}
+
+	req := &Request{User: "user1", Path: "/admin/x", Record: audit.Begin("127.0.0.1"), Groups: failingGroups{}}
+	if ok, reason, err := pr.Authorize(req); ok || reason != audit.ReasonBackendError || !errors.Is(err, errBackend) {
+		t.Errorf("Authorize() with a failing group provider = %v, %q, %v, want false, %q, %v",
+			ok, reason, err, audit.ReasonBackendError, errBackend)
+	}
+	req = &Request{User: "user1", Path: "/admin/x", Record: audit.Begin("127.0.0.1")}
+	if _, _, err := pr.Authorize(req); !errors.Is(err, ErrNoGroupProvider) {
+		t.Errorf("Authorize() without a group provider error = %v, want %v", err, ErrNoGroupProvider)
+	}
+}
+
+func TestMembershipOnce(t *testing.T) {
+	calls := 0
+	req := &Request{User: "user1", Groups: countingGroups{&calls}}
+	for i := 0; i < 2; i++ {
+		if _, err := req.Membership(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Membership() looked up %d times, want 1", calls)
+	}
+}
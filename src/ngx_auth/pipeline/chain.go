@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"errors"
+	"strings"
+
+	"ngx_auth/logger"
+)
+
+// ChainStep is one authenticator of a chain.
+type ChainStep struct {
+	// Name identifies the step in the log.
+	Name          string
+	Authenticator Authenticator
+
+	// Suffix routes only the users ending with it, such as "@a.example.com".
+	// Realm routes only the users written as "REALM\user".
+	// Both are compared without case, and Strip removes them from the user
+	// passed to the authenticator.
+	Suffix string
+	Realm  string
+	Strip  bool
+
+	// ContinueOnUnknown tries the next step if the user is unknown, and
+	// ContinueOnError if the backend fails. A wrong password always stops.
+	ContinueOnUnknown bool
+	ContinueOnError   bool
+}
+
+func (st *ChainStep) route(user string) (string, bool) {
+	switch {
+	case st.Suffix != "":
+		n := len(user) - len(st.Suffix)
+		if n <= 0 || !strings.EqualFold(user[n:], st.Suffix) {
+			return "", false
+		}
+		if st.Strip {
+			return user[:n], true
+		}
+	case st.Realm != "":
+		realm, name, ok := strings.Cut(user, `\`)
+		if !ok || name == "" || !strings.EqualFold(realm, st.Realm) {
+			return "", false
+		}
+		if st.Strip {
+			return name, true
+		}
+	}
+	return user, true
+}
+
+// Chain tries the authenticators of the steps in order, such as the local
+// accounts, then LDAP domain A, then LDAP domain B.
+type Chain struct {
+	Steps []ChainStep
+}
+
+func (ch *Chain) Authenticate(cred Credentials, clientIP string) (bool, error) {
+	var last_err error
+	for i := range ch.Steps {
+		st := &ch.Steps[i]
+		user, ok := st.route(cred.User)
+		if !ok {
+			continue
+		}
+
+		ok, err := st.Authenticator.Authenticate(
+			Credentials{User: user, Password: cred.Password}, clientIP)
+		switch {
+		case err == nil:
+			return ok, nil
+		case errors.Is(err, ErrUnknownUser):
+			if !st.ContinueOnUnknown {
+				return false, err
+			}
+			logger.Event(logger.LevelDebug, logger.EventAuthChainNext,
+				logger.Step(st.Name), logger.User(cred.User),
+				logger.ClientIP(clientIP), logger.Err(err))
+		default:
+			if !st.ContinueOnError {
+				return false, err
+			}
+			logger.Event(logger.LevelWarn, logger.EventAuthChainNext,
+				logger.Step(st.Name), logger.User(cred.User),
+				logger.ClientIP(clientIP), logger.Err(err))
+			last_err = err
+		}
+	}
+
+	// The user may be in a failed backend, so it is not unknown.
+	if last_err != nil {
+		return false, last_err
+	}
+	return false, ErrUnknownUser
+}
+
+func (ch *Chain) NeedsPassword() bool {
+	for _, st := range ch.Steps {
+		if st.Authenticator.NeedsPassword() {
+			return true
+		}
+	}
+	return false
+}
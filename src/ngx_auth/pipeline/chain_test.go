@@ -0,0 +1,148 @@
+package pipeline
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"ngx_auth/ldap_auth"
+)
+
+var errBackend = errors.New("backend failed")
+
+// failing is an authenticator whose backend is down.
+type failing struct{}
+
+func (failing) Authenticate(Credentials, string) (bool, error) {
+	return false, errBackend
+}
+
+func (failing) NeedsPassword() bool {
+	return true
+}
+
+func TestChainStepRoute(t *testing.T) {
+	tests := []struct {
+		name string
+		st   ChainStep
+		user string
+		want string
+		ok   bool
+	}{
+		{"no route", ChainStep{}, "user1", "user1", true},
+		{"suffix", ChainStep{Suffix: "@a.example.com"}, "user1@a.example.com", "user1@a.example.com", true},
+		{"suffix stripped", ChainStep{Suffix: "@a.example.com", Strip: true}, "user1@A.Example.com", "user1", true},
+		{"other suffix", ChainStep{Suffix: "@a.example.com"}, "user1@b.example.com", "", false},
+		{"suffix only", ChainStep{Suffix: "@a.example.com", Strip: true}, "@a.example.com", "", false},
+		{"realm", ChainStep{Realm: "CORP"}, `corp\user1`, `corp\user1`, true},
+		{"realm stripped", ChainStep{Realm: "CORP", Strip: true}, `corp\user1`, "user1", true},
+		{"other realm", ChainStep{Realm: "CORP"}, `LAB\user1`, "", false},
+		{"no realm", ChainStep{Realm: "CORP"}, "user1", "", false},
+		{"realm only", ChainStep{Realm: "CORP"}, `CORP\`, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.st.route(tt.user)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("route(%q) = %q, %v, want %q, %v", tt.user, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestChainAuthenticate(t *testing.T) {
+	local := PasswordMap{"admin": "pass1", "user1": "local1"}
+	domain_a := PasswordMap{"user1": "pass_a", "user2": "pass_a"}
+	domain_b := PasswordMap{"user3": "pass_b"}
+
+	tests := []struct {
+		name  string
+		steps []ChainStep
+		user  string
+		pass  string
+		ok    bool
+		err   error
+	}{
+		{"first step", []ChainStep{
+			{Authenticator: local, ContinueOnUnknown: true},
+			{Authenticator: domain_a},
+		}, "admin", "pass1", true, nil},
+		{"unknown user continues", []ChainStep{
+			{Authenticator: local, ContinueOnUnknown: true},
+			{Authenticator: domain_a},
+		}, "user2", "pass_a", true, nil},
+		{"unknown user stops", []ChainStep{
+			{Authenticator: local},
+			{Authenticator: domain_a},
+		}, "user2", "pass_a", false, ErrUnknownUser},
+		{"wrong password stops", []ChainStep{
+			{Authenticator: local, ContinueOnUnknown: true, ContinueOnError: true},
+			{Authenticator: domain_a},
+		}, "user1", "pass_a", false, nil},
+		{"unknown in every step", []ChainStep{
+			{Authenticator: local, ContinueOnUnknown: true},
+			{Authenticator: domain_a, ContinueOnUnknown: true},
+		}, "user9", "pass", false, ErrUnknownUser},
+		{"error continues", []ChainStep{
+			{Authenticator: failing{}, ContinueOnError: true},
+			{Authenticator: domain_a},
+		}, "user2", "pass_a", true, nil},
+		{"error stops", []ChainStep{
+			{Authenticator: failing{}, ContinueOnUnknown: true},
+			{Authenticator: domain_a},
+		}, "user2", "pass_a", false, errBackend},
+		{"error is kept after unknown", []ChainStep{
+			{Authenticator: failing{}, ContinueOnError: true},
+			{Authenticator: domain_a, ContinueOnUnknown: true},
+		}, "user9", "pass", false, errBackend},
+		{"suffix routes", []ChainStep{
+			{Authenticator: domain_a, Suffix: "@a.example.com", Strip: true},
+			{Authenticator: domain_b, Suffix: "@b.example.com", Strip: true},
+		}, "user3@b.example.com", "pass_b", true, nil},
+		{"suffix skips", []ChainStep{
+			{Authenticator: domain_a, Suffix: "@a.example.com", Strip: true},
+			{Authenticator: domain_b, Suffix: "@b.example.com", Strip: true},
+		}, "user3@a.example.com", "pass_b", false, ErrUnknownUser},
+		{"suffix not stripped", []ChainStep{
+			{Authenticator: domain_b, Suffix: "@b.example.com"},
+		}, "user3@b.example.com", "pass_b", false, ErrUnknownUser},
+		{"no step routes", []ChainStep{
+			{Authenticator: domain_a, Realm: "A", Strip: true},
+		}, `B\user1`, "pass_a", false, ErrUnknownUser},
+		{"realm routes", []ChainStep{
+			{Authenticator: local, Realm: "LOCAL", Strip: true, ContinueOnUnknown: true},
+			{Authenticator: domain_a, Realm: "A", Strip: true},
+		}, `a\user1`, "pass_a", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := &Chain{Steps: tt.steps}
+			ok, err := ch.Authenticate(Credentials{User: tt.user, Password: tt.pass}, "127.0.0.1")
+			if ok != tt.ok || !errors.Is(err, tt.err) {
+				t.Errorf("Authenticate() = %v, %v, want %v, %v", ok, err, tt.ok, tt.err)
+			}
+		})
+	}
+}
+
+// An LDAP step without user_filter cannot tell an unknown user from a wrong
+// password, so the chain never continues to the next step by the user.
+func TestChainLdapWithoutUserFilter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := "ldap://" + ln.Addr().String()
+	ln.Close()
+
+	ldap := &LdapBind{Config: &ldap_auth.Config{HostUrl: closed, BaseDn: "dc=example,dc=com",
+		BindDn: "uid=%s,dc=example,dc=com", Timeout: 100}}
+	ch := &Chain{Steps: []ChainStep{
+		{Authenticator: ldap, ContinueOnUnknown: true},
+		{Authenticator: PasswordMap{"user1": "pass1"}},
+	}}
+	ok, err := ch.Authenticate(Credentials{User: "user1", Password: "pass1"}, "127.0.0.1")
+	if ok || err == nil || errors.Is(err, ErrUnknownUser) {
+		t.Errorf("Authenticate() = %v, %v, want false with a backend error", ok, err)
+	}
+}
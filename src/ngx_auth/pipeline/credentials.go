@@ -0,0 +1,109 @@
+package pipeline
+
+import (
+	"net/http"
+	"strings"
+
+	"ngx_auth/jwt"
+	"ngx_auth/metrics"
+)
+
+// Credential extractor names in the configuration.
+const (
+	CredentialsBasic  = "basic"
+	CredentialsHeader = "header"
+	CredentialsBearer = "bearer"
+	CredentialsApiKey = "apikey"
+)
+
+// BasicCredentials takes the user and the password of Basic authentication.
+type BasicCredentials struct{}
+
+func (BasicCredentials) Extract(r *http.Request) (Credentials, bool) {
+	user, pass, ok := r.BasicAuth()
+	return Credentials{User: user, Password: pass}, ok
+}
+
+func (BasicCredentials) MissingOutcome() string {
+	return metrics.OutcomeUnauth
+}
+
+func (BasicCredentials) HasPassword() bool {
+	return true
+}
+
+func (BasicCredentials) Scheme() string {
+	return "Basic"
+}
+
+// HeaderUser takes the user authenticated by another module from a request header.
+type HeaderUser struct {
+	Header string
+}
+
+func (hu HeaderUser) Extract(r *http.Request) (Credentials, bool) {
+	user := r.Header.Get(hu.Header)
+	return Credentials{User: user}, user != ""
+}
+
+func (HeaderUser) MissingOutcome() string {
+	return metrics.OutcomeNouser
+}
+
+func (HeaderUser) HasPassword() bool {
+	return false
+}
+
+// Scheme is Basic like the other modules, though the user is rarely asked
+// for with a header.
+func (HeaderUser) Scheme() string {
+	return "Basic"
+}
+
+// Bearer takes a JWT from "Authorization: Bearer", or from Cookie if it is set.
+// The user is read from UserClaim before the token is verified, so Bearer
+// must be used with the jwt authenticator.
+type Bearer struct {
+	UserClaim string
+	Cookie    string
+}
+
+func (br Bearer) token(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	if br.Cookie != "" {
+		if c, err := r.Cookie(br.Cookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// Extract returns true for any token, even malformed, so that a bad token
+// is rejected by the authenticator, not taken as no credentials.
+func (br Bearer) Extract(r *http.Request) (Credentials, bool) {
+	token := br.token(r)
+	if token == "" {
+		return Credentials{}, false
+	}
+	claims, _ := jwt.Parse(token)
+	return Credentials{
+		User:   jwt.String(claims, br.UserClaim),
+		Token:  token,
+		Claims: claims,
+	}, true
+}
+
+func (Bearer) MissingOutcome() string {
+	return metrics.OutcomeUnauth
+}
+
+func (Bearer) HasPassword() bool {
+	return false
+}
+
+func (Bearer) Scheme() string {
+	return "Bearer"
+}
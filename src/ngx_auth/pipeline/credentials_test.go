@@ -0,0 +1,101 @@
+package pipeline
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasicCredentials(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString
+	tests := []struct {
+		name   string
+		header string
+		user   string
+		pass   string
+		found  bool
+	}{
+		{"basic", "Basic " + b64([]byte("user1:pass1")), "user1", "pass1", true},
+		{"colon in the password", "Basic " + b64([]byte("user1:pa:ss")), "user1", "pa:ss", true},
+		{"lower case scheme", "basic " + b64([]byte("user1:pass1")), "user1", "pass1", true},
+		{"empty password", "Basic " + b64([]byte("user1:")), "user1", "", true},
+		{"no colon", "Basic " + b64([]byte("user1")), "", "", false},
+		{"bad base64", "Basic !!!", "", "", false},
+		{"bearer", "Bearer " + b64([]byte("user1:pass1")), "", "", false},
+		{"no header", "", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			cred, found := BasicCredentials{}.Extract(r)
+			if found != tt.found || found && (cred.User != tt.user || cred.Password != tt.pass) {
+				t.Errorf("Extract() = %q, %q, %v, want %q, %q, %v",
+					cred.User, cred.Password, found, tt.user, tt.pass, tt.found)
+			}
+		})
+	}
+}
+
+func TestHeaderUser(t *testing.T) {
+	hu := HeaderUser{Header: "X-Forwarded-User"}
+	r := httptest.NewRequest("GET", "/", nil)
+	if _, found := hu.Extract(r); found {
+		t.Errorf("Extract() without the header = true, want false")
+	}
+	r.Header.Set("X-Forwarded-User", "user1")
+	if cred, found := hu.Extract(r); !found || cred.User != "user1" || cred.Password != "" {
+		t.Errorf("Extract() = %+v, %v, want user1", cred, found)
+	}
+}
+
+func TestBearer(t *testing.T) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	token := b64([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		b64([]byte(`{"sub":"user1","preferred_username":"u1"}`)) + ".c2ln"
+	br := Bearer{UserClaim: "sub", Cookie: "token"}
+
+	tests := []struct {
+		name   string
+		header string
+		cookie string
+		token  string
+		user   string
+		found  bool
+	}{
+		{"bearer", "Bearer " + token, "", token, "user1", true},
+		{"lower case scheme", "bearer  " + token + " ", "", token, "user1", true},
+		{"cookie", "", token, token, "user1", true},
+		{"header before cookie", "Bearer " + token, "other", token, "user1", true},
+		{"malformed token", "Bearer abc", "", "abc", "", true},
+		{"bad payload", "Bearer " + b64([]byte(`{}`)) + ".!!!.c2ln", "", b64([]byte(`{}`)) + ".!!!.c2ln", "", true},
+		{"basic", "Basic dXNlcjE6cGFzczE=", "", "", "", false},
+		{"no scheme", token, "", "", "", false},
+		{"no token", "", "", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "token", Value: tt.cookie})
+			}
+			cred, found := br.Extract(r)
+			if found != tt.found || cred.Token != tt.token || cred.User != tt.user {
+				t.Errorf("Extract() = %q, %q, %v, want %q, %q, %v",
+					cred.User, cred.Token, found, tt.user, tt.token, tt.found)
+			}
+		})
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if cred, _ := (Bearer{UserClaim: "preferred_username"}).Extract(r); cred.User != "u1" {
+		t.Errorf("Extract() user of preferred_username = %q, want %q", cred.User, "u1")
+	}
+}
@@ -0,0 +1,68 @@
+package pipeline
+
+import (
+	"ngx_auth/authz"
+	"ngx_auth/jwt"
+	"ngx_auth/ldap_auth"
+)
+
+// Group provider names in the configuration.
+const (
+	GroupsUserMap = "usermap"
+	GroupsLdap    = "ldap"
+	GroupsClaims  = "claims"
+	GroupsApiKey  = "apikey"
+)
+
+const DefaultGroupAttr = "cn"
+
+// UserMapGroups takes the groups from a user map file.
+type UserMapGroups struct {
+	UserMap *authz.UserMap
+}
+
+func (ug *UserMapGroups) Membership(string, jwt.Claims) (authz.Membership, error) {
+	return ug.UserMap, nil
+}
+
+// LdapGroups searches the groups of the user with the search account.
+// Filter is a search filter with %s for the user, such as
+// "(&(objectClass=posixGroup)(memberUid=%s))", and Attr is the attribute
+// of the group name.
+type LdapGroups struct {
+	Config *ldap_auth.Config
+	Filter string
+	Attr   string
+}
+
+func (lg *LdapGroups) Membership(user string, _ jwt.Claims) (authz.Membership, error) {
+	la, err := ldap_auth.NewLdapAuth(lg.Config)
+	if err != nil {
+		return nil, err
+	}
+	defer la.Close()
+
+	if err := la.BindService(); err != nil {
+		return nil, err
+	}
+
+	attr := lg.Attr
+	if attr == "" {
+		attr = DefaultGroupAttr
+	}
+	groups, err := la.SearchValues(lg.Filter, user, attr)
+	if err != nil {
+		return nil, err
+	}
+	return authz.NewGroupSet(user, groups), nil
+}
+
+// ClaimGroups takes the groups from a claim of the bearer token,
+// such as "groups" or "realm_access.roles".
+type ClaimGroups struct {
+	Claim string
+}
+
+func (cg *ClaimGroups) Membership(user string, claims jwt.Claims) (authz.Membership, error) {
+	return authz.NewGroupSet(user, jwt.Strings(claims, cg.Claim)), nil
+}
@@ -0,0 +1,177 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrBadHtpasswdLine = errors.New("bad htpasswd line")
+	ErrUnsupportedHash = errors.New("unsupported password hash, use bcrypt, apr1 or SHA")
+)
+
+// Htpasswd authenticates with an htpasswd file made by the htpasswd command of
+// Apache httpd. bcrypt ($2y$), MD5 ($apr1$) and SHA1 ({SHA}) hashes are supported.
+type Htpasswd struct {
+	hash map[string]string
+}
+
+func is_supported_hash(h string) bool {
+	switch {
+	case strings.HasPrefix(h, "$2a$"), strings.HasPrefix(h, "$2b$"), strings.HasPrefix(h, "$2y$"):
+		return true
+	case strings.HasPrefix(h, "$apr1$"):
+		return true
+	case strings.HasPrefix(h, "{SHA}"):
+		return true
+	}
+	return false
+}
+
+func parse_htpasswd(file string) (map[string]string, []error) {
+	bin, err := os.ReadFile(file)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	hash := map[string]string{}
+	errs := []error{}
+	for i, ln := range bytes.Split(bin, []byte{'\n'}) {
+		line := strings.TrimSpace(string(ln))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		user, h, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			errs = append(errs, fmt.Errorf("%s:%d: %w", file, i+1, ErrBadHtpasswdLine))
+			continue
+		}
+		if !is_supported_hash(h) {
+			errs = append(errs, fmt.Errorf("%s:%d: %w", file, i+1, ErrUnsupportedHash))
+			continue
+		}
+		hash[user] = h
+	}
+
+	return hash, errs
+}
+
+// VerifyHtpasswd reports every bad line of the htpasswd file.
+func VerifyHtpasswd(file string) []error {
+	_, errs := parse_htpasswd(file)
+	return errs
+}
+
+func NewHtpasswd(file string) (*Htpasswd, error) {
+	hash, errs := parse_htpasswd(file)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return &Htpasswd{hash: hash}, nil
+}
+
+func (hp *Htpasswd) Authenticate(cred Credentials, _ string) (bool, error) {
+	h, ok := hp.hash[cred.User]
+	if !ok {
+		return false, ErrUnknownUser
+	}
+	return check_hash(h, cred.Password), nil
+}
+
+func (*Htpasswd) NeedsPassword() bool {
+	return true
+}
+
+func check_hash(h string, pass string) bool {
+	switch {
+	case strings.HasPrefix(h, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		return equal_string(h[len("{SHA}"):], base64.StdEncoding.EncodeToString(sum[:]))
+	case strings.HasPrefix(h, "$apr1$"):
+		salt, _, _ := strings.Cut(h[len("$apr1$"):], "$")
+		return equal_string(h, apr1(pass, salt))
+	}
+	return bcrypt.CompareHashAndPassword([]byte(h), []byte(pass)) == nil
+}
+
+func equal_string(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+const apr1_itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 is the MD5 based crypt of Apache httpd.
+func apr1(pass string, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(pass)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	fin := alt.Sum(nil)
+
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic))
+	d.Write([]byte(salt))
+	for n := len(pw); n > 0; n -= 16 {
+		d.Write(fin[:min(n, 16)])
+	}
+	for i := len(pw); i != 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	fin = d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		r := md5.New()
+		if i&1 != 0 {
+			r.Write(pw)
+		} else {
+			r.Write(fin)
+		}
+		if i%3 != 0 {
+			r.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			r.Write(pw)
+		}
+		if i&1 != 0 {
+			r.Write(fin)
+		} else {
+			r.Write(pw)
+		}
+		fin = r.Sum(nil)
+	}
+
+	var b strings.Builder
+	b.WriteString(magic + salt + "$")
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(apr1_itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, idx := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(fin[idx[0]])<<16|uint32(fin[idx[1]])<<8|uint32(fin[idx[2]]), 4)
+	}
+	to64(uint32(fin[11]), 2)
+
+	return b.String()
+}
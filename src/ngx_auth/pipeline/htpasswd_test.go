@@ -0,0 +1,96 @@
+package pipeline
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswd(t *testing.T) {
+	bhash, err := bcrypt.GenerateFromPassword([]byte("pass1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Join([]string{
+		"# users",
+		"",
+		"bcrypt:" + string(bhash),
+		"bcrypt2y:$2y$" + strings.TrimPrefix(string(bhash), "$2a$"),
+		"apr1:$apr1$abcdefgh$XOrUlPES3mQqWxFr80mh8/",
+		"apr1long:$apr1$xy$ydi4vLfD5LxrQlAISGcwV/",
+		"sha:{SHA}8FePHnF0saQcTqjG4X96ijuIySo=",
+	}, "\n")
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hp, err := NewHtpasswd(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user string
+		pass string
+		ok   bool
+		err  error
+	}{
+		{"bcrypt", "pass1", true, nil},
+		{"bcrypt", "pass2", false, nil},
+		{"bcrypt2y", "pass1", true, nil},
+		{"apr1", "pass1", true, nil},
+		{"apr1", "pass2", false, nil},
+		{"apr1long", "a longer password than sixteen bytes", true, nil},
+		{"sha", "pass1", true, nil},
+		{"sha", "", false, nil},
+		{"nobody", "pass1", false, ErrUnknownUser},
+	}
+	for _, tt := range tests {
+		ok, err := hp.Authenticate(Credentials{User: tt.user, Password: tt.pass}, "127.0.0.1")
+		if ok != tt.ok || !errors.Is(err, tt.err) {
+			t.Errorf("Authenticate(%q, %q) = %v, %v, want %v, %v", tt.user, tt.pass, ok, err, tt.ok, tt.err)
+		}
+	}
+}
+
+func TestVerifyHtpasswd(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		errs    []error
+	}{
+		{"ok", "user1:{SHA}8FePHnF0saQcTqjG4X96ijuIySo=\n", nil},
+		{"no colon", "user1\n", []error{ErrBadHtpasswdLine}},
+		{"no user", ":{SHA}8FePHnF0saQcTqjG4X96ijuIySo=\n", []error{ErrBadHtpasswdLine}},
+		{"crypt", "user1:rl0uE1nYyN1PA\nuser2:$1$salt$hash\n", []error{ErrUnsupportedHash, ErrUnsupportedHash}},
+		{"plain text", "user1:pass1\nuser2\n", []error{ErrUnsupportedHash, ErrBadHtpasswdLine}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "htpasswd")
+			if err := os.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			errs := VerifyHtpasswd(file)
+			if len(errs) != len(tt.errs) {
+				t.Fatalf("VerifyHtpasswd() = %v, want %v", errs, tt.errs)
+			}
+			for i, err := range errs {
+				if !errors.Is(err, tt.errs[i]) {
+					t.Errorf("VerifyHtpasswd()[%d] = %v, want %v", i, err, tt.errs[i])
+				}
+			}
+			if _, err := NewHtpasswd(file); (err == nil) != (len(tt.errs) == 0) {
+				t.Errorf("NewHtpasswd() error = %v", err)
+			}
+		})
+	}
+
+	if errs := VerifyHtpasswd(filepath.Join(t.TempDir(), "none")); len(errs) != 1 {
+		t.Errorf("VerifyHtpasswd() of no file = %v, want 1 error", errs)
+	}
+}
@@ -0,0 +1,39 @@
+package pipeline
+
+import (
+	"errors"
+
+	"ngx_auth/jwt"
+	"ngx_auth/logger"
+)
+
+// Jwt verifies the bearer token taken by Bearer. The user is the UserClaim
+// of the token, and a token without it is rejected.
+type Jwt struct {
+	Verifier  *jwt.Verifier
+	UserClaim string
+}
+
+func (jt *Jwt) Authenticate(cred Credentials, clientIP string) (bool, error) {
+	if cred.Token == "" {
+		return false, nil
+	}
+
+	claims, err := jt.Verifier.Verify(cred.Token)
+	if errors.Is(err, jwt.ErrJwksFetch) {
+		return false, err
+	}
+	if err == nil && jwt.String(claims, jt.UserClaim) == "" {
+		err = jwt.ErrNoUser
+	}
+	if err != nil {
+		logger.Event(logger.LevelInfo, logger.EventJwtRejected,
+			logger.User(cred.User), logger.ClientIP(clientIP), logger.Err(err))
+		return false, nil
+	}
+	return jwt.String(claims, jt.UserClaim) == cred.User, nil
+}
+
+func (*Jwt) NeedsPassword() bool {
+	return false
+}
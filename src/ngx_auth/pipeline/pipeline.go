@@ -0,0 +1,91 @@
+// Package pipeline has the parts of an authentication pipeline:
+// a credential extractor, an authenticator, a group provider and an authorizer.
+// A pipeline profile combines one of each by its configuration.
+package pipeline
+
+import (
+	"errors"
+	"net/http"
+
+	"ngx_auth/apikey"
+	"ngx_auth/audit"
+	"ngx_auth/authz"
+	"ngx_auth/jwt"
+)
+
+// Credentials are the user name and the password of a request.
+// Password is empty for a user passed in a header.
+// A bearer token has the claims not verified until it is authenticated,
+// and an API key has its key found by ApiKeyCredentials, so that it is looked up once.
+type Credentials struct {
+	User     string
+	Password string
+	Token    string
+	Claims   jwt.Claims
+	Key      *apikey.Key
+}
+
+// CredentialExtractor takes the credentials from a request.
+type CredentialExtractor interface {
+	// Extract returns the credentials, or false if the request has none.
+	Extract(r *http.Request) (Credentials, bool)
+	// MissingOutcome is the outcome of a request without credentials,
+	// metrics.OutcomeUnauth or metrics.OutcomeNouser.
+	MissingOutcome() string
+	// HasPassword reports whether the credentials have a password.
+	HasPassword() bool
+	// Scheme is the scheme of WWW-Authenticate asking for the credentials.
+	Scheme() string
+}
+
+// Authenticator checks the credentials. An error means the backend failed.
+type Authenticator interface {
+	Authenticate(cred Credentials, clientIP string) (bool, error)
+	// NeedsPassword reports whether the authenticator checks a password.
+	NeedsPassword() bool
+}
+
+// GroupProvider looks up the groups of a user for the authorization rights.
+// claims are the verified claims of a bearer token, or nil.
+type GroupProvider interface {
+	Membership(user string, claims jwt.Claims) (authz.Membership, error)
+}
+
+// Request is what an authorizer decides on.
+type Request struct {
+	User     string
+	Claims   jwt.Claims
+	Path     string
+	ClientIP string
+	Record   *audit.Record
+	Groups   GroupProvider
+
+	member authz.Membership
+}
+
+var ErrNoGroupProvider = errors.New("no group provider")
+
+// Membership looks up the groups of the user with the group provider.
+// The groups are looked up only once for a request.
+func (req *Request) Membership() (authz.Membership, error) {
+	if req.member != nil {
+		return req.member, nil
+	}
+	if req.Groups == nil {
+		return nil, ErrNoGroupProvider
+	}
+	m, err := req.Groups.Membership(req.User, req.Claims)
+	if err != nil {
+		return nil, err
+	}
+	req.member = m
+	return m, nil
+}
+
+// Authorizer decides whether the user may access the path.
+// The reason is recorded in the audit log. An error means the backend failed.
+type Authorizer interface {
+	Authorize(req *Request) (bool, string, error)
+	// NeedsPath reports whether the authorizer uses the request path.
+	NeedsPath() bool
+}
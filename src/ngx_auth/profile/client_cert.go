@@ -0,0 +1,90 @@
+package profile
+
+import (
+	"errors"
+	"net/http"
+
+	"ngx_auth/assertion"
+	"ngx_auth/audit"
+	"ngx_auth/client_cert"
+	"ngx_auth/etag"
+	"ngx_auth/logger"
+	"ngx_auth/metrics"
+)
+
+// ClientCert authorizes the path for the user of a client certificate,
+// which nginx verified and passed in a request header, with a user map.
+type ClientCert struct {
+	Common
+	PathHeader string
+	Cert       *client_cert.Extractor
+	PathRights
+}
+
+func NewClientCert(c Common, path_header string, cert *client_cert.Extractor,
+	rights PathRights) *ClientCert {
+	c.init()
+	if path_header == "" {
+		path_header = DefaultPathHeader
+	}
+	return &ClientCert{
+		Common:     c,
+		PathHeader: path_header,
+		Cert:       cert,
+		PathRights: rights,
+	}
+}
+
+func (h *ClientCert) makeEtag(user, rpath string) string {
+	tm := time_bin(h.StartTimeMS)
+	return etag.Make(tm, etag.Crypt(tm, []byte(user)), path_tag(h.PathPatternReg, rpath))
+}
+
+func (h *ClientCert) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec, clientIP := h.begin(w, r)
+
+	rpath := r.Header.Get(h.PathHeader)
+	rec.SetPath(rpath)
+	if rpath == "" {
+		h.finish(rec, metrics.OutcomeNopath, audit.ReasonNoPath)
+		h.Response.Nopath.Error(w)
+		return
+	}
+
+	user, err := h.Cert.User(r)
+	rec.User = user
+	switch {
+	case errors.Is(err, client_cert.ErrNoCert):
+		h.finish(rec, metrics.OutcomeNouser, audit.ReasonNoUser)
+		h.Response.Nouser.Error(w)
+		return
+	case err != nil:
+		logger.Event(logger.LevelWarn, logger.EventClientCertRejected,
+			logger.User(user), logger.ClientIP(clientIP), logger.Err(err))
+		reason := audit.ReasonBadCert
+		if errors.Is(err, client_cert.ErrRevoked) {
+			reason = audit.ReasonRevokedCert
+		}
+		h.finish(rec, metrics.OutcomeNouser, reason)
+		h.Response.Nouser.Error(w)
+		return
+	}
+
+	set_max_age(w, h.NegCacheSeconds)
+	if h.check_etag(w, r, rec, h.makeEtag(user, rpath)) {
+		return
+	}
+
+	ok_path, reason := h.get_path_right(rpath, user, rec)
+	log_path_authz(h.PathPatternReg, rpath, user, clientIP, ok_path)
+	if !ok_path {
+		h.finish(rec, metrics.OutcomeForbidden, reason)
+		h.Response.Forbidden.Error(w)
+		return
+	}
+
+	set_max_age(w, h.CacheSeconds)
+	h.assert(w, rec, assertion.MethodCert, false, h.UserMap)
+	h.finish(rec, metrics.OutcomeOk, audit.ReasonGranted)
+	h.Response.Ok.Error(w)
+}
@@ -0,0 +1,302 @@
+package profile
+
+import (
+	"ngx_auth/client_cert"
+	"ngx_auth/digest"
+	"ngx_auth/htstat"
+	"ngx_auth/ldap_auth"
+	"ngx_auth/pipeline"
+	"ngx_auth/session"
+	"ngx_auth/signed_header"
+	"ngx_auth/totp"
+)
+
+// LdapConfig is one [ldap.NAME] server of the multi profile configuration.
+// The profiles using the same server share its connection pool.
+type LdapConfig struct {
+	HostUrl        string   `json:"host_url" yaml:"host_url"`
+	StartTls       int      `toml:",omitempty" json:"start_tls,omitempty" yaml:"start_tls,omitempty"`
+	SkipCertVerify int      `toml:",omitempty" json:"skip_cert_verify,omitempty" yaml:"skip_cert_verify,omitempty"`
+	RootCaFiles    []string `toml:",omitempty" json:"root_ca_files,omitempty" yaml:"root_ca_files,omitempty"`
+	BaseDn         string   `json:"base_dn" yaml:"base_dn"`
+	BindDn         string   `json:"bind_dn" yaml:"bind_dn"`
+	UniqFilter     string   `toml:",omitempty" json:"uniq_filter,omitempty" yaml:"uniq_filter,omitempty"`
+	Timeout        int      `toml:",omitempty" json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	PoolSize       int      `toml:",omitempty" json:"pool_size,omitempty" yaml:"pool_size,omitempty"`
+	SearchBindDn   string   `toml:",omitempty" json:"search_bind_dn,omitempty" yaml:"search_bind_dn,omitempty"`
+	SearchPassword string   `toml:",omitempty" json:"search_password,omitempty" yaml:"search_password,omitempty" secret:"true" expand:"true"`
+
+	OfflineCacheSeconds int `toml:",omitempty" json:"offline_cache_seconds,omitempty" yaml:"offline_cache_seconds,omitempty"`
+}
+
+func (cfg *LdapConfig) AuthConfig() *ldap_auth.Config {
+	return &ldap_auth.Config{
+		HostUrl:        cfg.HostUrl,
+		StartTls:       cfg.StartTls != 0,
+		SkipCertVerify: cfg.SkipCertVerify != 0,
+		RootCaFiles:    cfg.RootCaFiles,
+		BaseDn:         cfg.BaseDn,
+		BindDn:         cfg.BindDn,
+		UniqueFilter:   cfg.UniqFilter,
+		Timeout:        cfg.Timeout,
+		PoolSize:       cfg.PoolSize,
+		SearchBindDn:   cfg.SearchBindDn,
+		SearchPassword: cfg.SearchPassword,
+
+		OfflineCacheSeconds: cfg.OfflineCacheSeconds,
+	}
+}
+
+// AuthzConfig is the [profiles.NAME.authz] part of the user map and the filters.
+type AuthzConfig struct {
+	UserMapConfig string            `toml:",omitempty" json:"usermap_config,omitempty" yaml:"usermap_config,omitempty"`
+	UserMap       string            `toml:",omitempty" json:"usermap,omitempty" yaml:"usermap,omitempty"`
+	PathPattern   string            `json:"path_pattern" yaml:"path_pattern"`
+	NomatchRight  string            `toml:",omitempty" json:"nomatch_right,omitempty" yaml:"nomatch_right,omitempty"`
+	DefaultRight  string            `toml:",omitempty" json:"default_right,omitempty" yaml:"default_right,omitempty"`
+	PathRight     map[string]string `toml:",omitempty" json:"path_right,omitempty" yaml:"path_right,omitempty"`
+	NomatchMfa    bool              `toml:",omitempty" json:"nomatch_mfa,omitempty" yaml:"nomatch_mfa,omitempty"`
+	DefaultMfa    bool              `toml:",omitempty" json:"default_mfa,omitempty" yaml:"default_mfa,omitempty"`
+	PathMfa       map[string]bool   `toml:",omitempty" json:"path_mfa,omitempty" yaml:"path_mfa,omitempty"`
+	BanNomatch    bool              `toml:",omitempty" json:"ban_nomatch,omitempty" yaml:"ban_nomatch,omitempty"`
+	NomatchFilter string            `toml:",omitempty" json:"nomatch_filter,omitempty" yaml:"nomatch_filter,omitempty"`
+	BanDefault    bool              `toml:",omitempty" json:"ban_default,omitempty" yaml:"ban_default,omitempty"`
+	DefaultFilter string            `toml:",omitempty" json:"default_filter,omitempty" yaml:"default_filter,omitempty"`
+	PathFilter    map[string]string `toml:",omitempty" json:"path_filter,omitempty" yaml:"path_filter,omitempty"`
+}
+
+// ChainStepConfig is one [[profiles.NAME.pipeline.chain]] step of the chain authenticator.
+type ChainStepConfig struct {
+	Authenticator string `json:"authenticator" yaml:"authenticator"`
+	Ldap          string `toml:",omitempty" json:"ldap,omitempty" yaml:"ldap,omitempty"`
+	Htpasswd      string `toml:",omitempty" json:"htpasswd,omitempty" yaml:"htpasswd,omitempty"`
+	UserFilter    string `toml:",omitempty" json:"user_filter,omitempty" yaml:"user_filter,omitempty"`
+	Suffix        string `toml:",omitempty" json:"suffix,omitempty" yaml:"suffix,omitempty"`
+	Realm         string `toml:",omitempty" json:"realm,omitempty" yaml:"realm,omitempty"`
+	Strip         bool   `toml:",omitempty" json:"strip,omitempty" yaml:"strip,omitempty"`
+	OnUnknown     string `toml:",omitempty" json:"on_unknown,omitempty" yaml:"on_unknown,omitempty"`
+	OnError       string `toml:",omitempty" json:"on_error,omitempty" yaml:"on_error,omitempty"`
+}
+
+// Actions of a chain step on an unknown user or a backend error.
+const (
+	ChainContinue = "continue"
+	ChainStop     = "stop"
+)
+
+// SetDefault continues on an unknown user and stops on a backend error.
+func (sc *ChainStepConfig) SetDefault() {
+	if sc.OnUnknown == "" {
+		sc.OnUnknown = ChainContinue
+	}
+	if sc.OnError == "" {
+		sc.OnError = ChainStop
+	}
+}
+
+// JwtConfig is the [profiles.NAME.pipeline.jwt] part of the bearer credentials
+// and the jwt authenticator. One of JwksFile, JwksUrl and HmacSecret is the keys.
+type JwtConfig struct {
+	JwksFile         string   `toml:",omitempty" json:"jwks_file,omitempty" yaml:"jwks_file,omitempty"`
+	JwksUrl          string   `toml:",omitempty" json:"jwks_url,omitempty" yaml:"jwks_url,omitempty"`
+	JwksCacheSeconds uint32   `toml:",omitempty" json:"jwks_cache_seconds,omitempty" yaml:"jwks_cache_seconds,omitempty"`
+	HmacSecret       string   `toml:",omitempty" json:"hmac_secret,omitempty" yaml:"hmac_secret,omitempty" secret:"true" expand:"true"`
+	Algorithms       []string `toml:",omitempty" json:"algorithms,omitempty" yaml:"algorithms,omitempty"`
+	Issuer           string   `toml:",omitempty" json:"issuer,omitempty" yaml:"issuer,omitempty"`
+	Audience         []string `toml:",omitempty" json:"audience,omitempty" yaml:"audience,omitempty"`
+	LeewaySeconds    uint32   `toml:",omitempty" json:"leeway_seconds,omitempty" yaml:"leeway_seconds,omitempty"`
+	AllowNoExp       bool     `toml:",omitempty" json:"allow_no_exp,omitempty" yaml:"allow_no_exp,omitempty"`
+	UserClaim        string   `toml:",omitempty" json:"user_claim,omitempty" yaml:"user_claim,omitempty"`
+	GroupsClaim      string   `toml:",omitempty" json:"groups_claim,omitempty" yaml:"groups_claim,omitempty"`
+	Cookie           string   `toml:",omitempty" json:"cookie,omitempty" yaml:"cookie,omitempty"`
+}
+
+const (
+	DefaultJwksCacheSeconds = 3600
+	DefaultUserClaim        = "sub"
+	DefaultGroupsClaim      = "groups"
+)
+
+func (jc *JwtConfig) SetDefault() {
+	if jc.JwksCacheSeconds == 0 {
+		jc.JwksCacheSeconds = DefaultJwksCacheSeconds
+	}
+	if jc.UserClaim == "" {
+		jc.UserClaim = DefaultUserClaim
+	}
+	if jc.GroupsClaim == "" {
+		jc.GroupsClaim = DefaultGroupsClaim
+	}
+}
+
+// OidcConfig is the [profiles.NAME.oidc] part of the oidc type.
+type OidcConfig struct {
+	Issuer         string   `json:"issuer" yaml:"issuer"`
+	ClientId       string   `json:"client_id" yaml:"client_id"`
+	ClientSecret   string   `toml:",omitempty" json:"client_secret,omitempty" yaml:"client_secret,omitempty" secret:"true" expand:"true"`
+	RedirectUrl    string   `json:"redirect_url" yaml:"redirect_url"`
+	LoginUrl       string   `toml:",omitempty" json:"login_url,omitempty" yaml:"login_url,omitempty"`
+	Scopes         []string `toml:",omitempty" json:"scopes,omitempty" yaml:"scopes,omitempty"`
+	UserClaim      string   `toml:",omitempty" json:"user_claim,omitempty" yaml:"user_claim,omitempty"`
+	GroupsClaim    string   `toml:",omitempty" json:"groups_claim,omitempty" yaml:"groups_claim,omitempty"`
+	SessionSecret  string   `json:"session_secret" yaml:"session_secret" secret:"true" expand:"true"`
+	SessionSeconds uint32   `toml:",omitempty" json:"session_seconds,omitempty" yaml:"session_seconds,omitempty"`
+	Cookie         string   `toml:",omitempty" json:"cookie,omitempty" yaml:"cookie,omitempty"`
+	CookieDomain   string   `toml:",omitempty" json:"cookie_domain,omitempty" yaml:"cookie_domain,omitempty"`
+	InsecureCookie bool     `toml:",omitempty" json:"insecure_cookie,omitempty" yaml:"insecure_cookie,omitempty"`
+	TimeoutSeconds uint32   `toml:",omitempty" json:"timeout_seconds,omitempty" yaml:"timeout_seconds,omitempty"`
+}
+
+const (
+	DefaultSessionSeconds     = 8 * 3600
+	DefaultSessionCookie      = "ngx_auth_session"
+	DefaultOidcTimeoutSeconds = 10
+)
+
+func (oc *OidcConfig) SetDefault() {
+	if oc.UserClaim == "" {
+		oc.UserClaim = DefaultUserClaim
+	}
+	if oc.GroupsClaim == "" {
+		oc.GroupsClaim = DefaultGroupsClaim
+	}
+	if oc.SessionSeconds == 0 {
+		oc.SessionSeconds = DefaultSessionSeconds
+	}
+	if oc.Cookie == "" {
+		oc.Cookie = DefaultSessionCookie
+	}
+	if oc.TimeoutSeconds == 0 {
+		oc.TimeoutSeconds = DefaultOidcTimeoutSeconds
+	}
+}
+
+// LoginConfig is the [login] part of the login form. It needs the sessions.
+type LoginConfig struct {
+	// LoginUrl is the login endpoint as the browser sees it, such as
+	// "/auth/login". The form is enabled only with it.
+	LoginUrl string `toml:",omitempty" json:"login_url,omitempty" yaml:"login_url,omitempty"`
+	// Prefix is the path of the endpoints on the socket of a single module
+	// program. A profile of ngx_multi_auth uses its own prefix.
+	Prefix   string `toml:",omitempty" json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Template string `toml:",omitempty" json:"template,omitempty" yaml:"template,omitempty"`
+}
+
+func (lc *LoginConfig) IsEnabled() bool {
+	return lc.LoginUrl != ""
+}
+
+// PipelineConfig is the [profiles.NAME.pipeline] part of the pipeline type.
+type PipelineConfig struct {
+	Credentials   string `toml:",omitempty" json:"credentials,omitempty" yaml:"credentials,omitempty"`
+	Authenticator string `json:"authenticator" yaml:"authenticator"`
+	Groups        string `toml:",omitempty" json:"groups,omitempty" yaml:"groups,omitempty"`
+	Authorizer    string `toml:",omitempty" json:"authorizer,omitempty" yaml:"authorizer,omitempty"`
+	Htpasswd      string `toml:",omitempty" json:"htpasswd,omitempty" yaml:"htpasswd,omitempty"`
+	GroupFilter   string `toml:",omitempty" json:"group_filter,omitempty" yaml:"group_filter,omitempty"`
+	GroupAttr     string `toml:",omitempty" json:"group_attr,omitempty" yaml:"group_attr,omitempty"`
+
+	Chain []ChainStepConfig `toml:",omitempty" json:"chain,omitempty" yaml:"chain,omitempty"`
+	Jwt   JwtConfig         `toml:",omitempty" json:"jwt,omitempty" yaml:"jwt,omitempty"`
+
+	ApiKey ApiKeyConfig `toml:",omitempty" json:"apikey,omitempty" yaml:"apikey,omitempty"`
+}
+
+// ApiKeyConfig is the [profiles.NAME.pipeline.apikey] part.
+type ApiKeyConfig struct {
+	KeyFile string `toml:",omitempty" json:"key_file,omitempty" yaml:"key_file,omitempty"`
+	Header  string `toml:",omitempty" json:"header,omitempty" yaml:"header,omitempty"`
+}
+
+// SetDefault fills the default extractor and authorizer.
+func (pc *PipelineConfig) SetDefault() {
+	if pc.Credentials == "" {
+		pc.Credentials = pipeline.CredentialsBasic
+	}
+	if pc.Authorizer == "" {
+		pc.Authorizer = pipeline.AuthzNone
+	}
+	for i := range pc.Chain {
+		pc.Chain[i].SetDefault()
+	}
+	pc.Jwt.SetDefault()
+}
+
+// UsesLdap reports whether any part of the pipeline uses the LDAP server
+// of the profile. The chain steps name their own servers.
+func (pc *PipelineConfig) UsesLdap() bool {
+	return pc.Authenticator == pipeline.AuthLdap || pc.Groups == pipeline.GroupsLdap ||
+		pc.Authorizer == pipeline.AuthzLdapFilter
+}
+
+// Config is one [profiles.NAME] of the multi profile configuration.
+type Config struct {
+	Type              string            `json:"type" yaml:"type"`
+	Listeners         []string          `toml:",omitempty" json:"listeners,omitempty" yaml:"listeners,omitempty"`
+	Prefix            string            `toml:",omitempty" json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	CacheSeconds      uint32            `toml:",omitempty" json:"cache_seconds,omitempty" yaml:"cache_seconds,omitempty"`
+	NegCacheSeconds   uint32            `toml:",omitempty" json:"neg_cache_seconds,omitempty" yaml:"neg_cache_seconds,omitempty"`
+	UseEtag           bool              `toml:",omitempty" json:"use_etag,omitempty" yaml:"use_etag,omitempty"`
+	UseSerializedAuth bool              `toml:",omitempty" json:"use_serialized_auth,omitempty" yaml:"use_serialized_auth,omitempty"`
+	AuthRealm         string            `toml:",omitempty" json:"auth_realm,omitempty" yaml:"auth_realm,omitempty"`
+	PathHeader        string            `toml:",omitempty" json:"path_header,omitempty" yaml:"path_header,omitempty"`
+	UserHeader        string            `toml:",omitempty" json:"user_header,omitempty" yaml:"user_header,omitempty"`
+	Password          map[string]string `toml:",omitempty" json:"password,omitempty" yaml:"password,omitempty" secret:"true" expand:"true"`
+	Ldap              string            `toml:",omitempty" json:"ldap,omitempty" yaml:"ldap,omitempty"`
+
+	Authz    AuthzConfig          `toml:",omitempty" json:"authz,omitempty" yaml:"authz,omitempty"`
+	Pipeline PipelineConfig       `toml:",omitempty" json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+	Oidc     OidcConfig           `toml:",omitempty" json:"oidc,omitempty" yaml:"oidc,omitempty"`
+	Session  session.Config       `toml:",omitempty" json:"session,omitempty" yaml:"session,omitempty"`
+	Login    LoginConfig          `toml:",omitempty" json:"login,omitempty" yaml:"login,omitempty"`
+	Totp     totp.Config          `toml:",omitempty" json:"totp,omitempty" yaml:"totp,omitempty"`
+	Response htstat.HttpStatusTbl `toml:",omitempty" json:"response,omitempty" yaml:"response,omitempty"`
+
+	Signature signed_header.Config `toml:",omitempty" json:"signature,omitempty" yaml:"signature,omitempty"`
+	Cert      client_cert.Config   `toml:",omitempty" json:"cert,omitempty" yaml:"cert,omitempty"`
+
+	Digest digest.Config `toml:",omitempty" json:"digest,omitempty" yaml:"digest,omitempty"`
+}
+
+// LdapNames returns the LDAP servers used by the chain steps.
+func (pc *PipelineConfig) LdapNames() []string {
+	names := []string{}
+	for _, sc := range pc.Chain {
+		if sc.Ldap != "" {
+			names = append(names, sc.Ldap)
+		}
+	}
+	return names
+}
+
+// UsesLdap reports whether the module type authenticates with LDAP.
+func (cfg *Config) UsesLdap() bool {
+	switch cfg.Type {
+	case TypeLdap, TypeLdapPath, TypeLdapPath2Ldap:
+		return true
+	case TypePipeline:
+		return cfg.Pipeline.UsesLdap()
+	}
+	return false
+}
+
+// UsesSession reports whether the module type issues the session cookies
+// of [profiles.NAME.session].
+func (cfg *Config) UsesSession() bool {
+	switch cfg.Type {
+	case TypeSimple, TypeLdap, TypeLdapPath, TypeLdapPath2Ldap:
+		return true
+	}
+	return false
+}
+
+// UsesRealm reports whether the module type asks for Basic credentials.
+func (cfg *Config) UsesRealm() bool {
+	switch cfg.Type {
+	case TypeHeaderPath, TypeClientCert, TypeOidc:
+		return false
+	case TypePipeline:
+		return cfg.Pipeline.Credentials != pipeline.CredentialsHeader
+	}
+	return true
+}
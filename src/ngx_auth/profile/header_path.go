@@ -0,0 +1,90 @@
+package profile
+
+import (
+	"net/http"
+
+	"ngx_auth/assertion"
+	"ngx_auth/audit"
+	"ngx_auth/etag"
+	"ngx_auth/logger"
+	"ngx_auth/metrics"
+	"ngx_auth/signed_header"
+)
+
+// HeaderPath authorizes the path for the user header set by another module.
+type HeaderPath struct {
+	Common
+	PathHeader string
+	UserHeader string
+	PathRights
+	Signature *signed_header.Verifier
+}
+
+func NewHeaderPath(c Common, path_header string, user_header string,
+	rights PathRights, sig *signed_header.Verifier) *HeaderPath {
+	c.init()
+	if path_header == "" {
+		path_header = DefaultPathHeader
+	}
+	if user_header == "" {
+		user_header = DefaultUserHeader
+	}
+	return &HeaderPath{
+		Common:     c,
+		PathHeader: path_header,
+		UserHeader: user_header,
+		PathRights: rights,
+		Signature:  sig,
+	}
+}
+
+func (h *HeaderPath) makeEtag(user, rpath string) string {
+	tm := time_bin(h.StartTimeMS)
+	return etag.Make(tm, etag.Crypt(tm, []byte(user)), path_tag(h.PathPatternReg, rpath))
+}
+
+func (h *HeaderPath) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec, clientIP := h.begin(w, r)
+
+	rpath := r.Header.Get(h.PathHeader)
+	rec.SetPath(rpath)
+	if rpath == "" {
+		h.finish(rec, metrics.OutcomeNopath, audit.ReasonNoPath)
+		h.Response.Nopath.Error(w)
+		return
+	}
+
+	user := r.Header.Get(h.UserHeader)
+	rec.User = user
+	if user == "" {
+		h.finish(rec, metrics.OutcomeNouser, audit.ReasonNoUser)
+		h.Response.Nouser.Error(w)
+		return
+	}
+
+	if err := h.Signature.Verify(r, user, rpath); err != nil {
+		logger.Event(logger.LevelWarn, logger.EventSignedHeaderRejected,
+			logger.User(user), logger.ClientIP(clientIP), logger.Err(err))
+		h.finish(rec, metrics.OutcomeNouser, audit.ReasonBadSignature)
+		h.Response.Nouser.Error(w)
+		return
+	}
+
+	set_max_age(w, h.NegCacheSeconds)
+	if h.check_etag(w, r, rec, h.makeEtag(user, rpath)) {
+		return
+	}
+
+	ok_path, reason := h.get_path_right(rpath, user, rec)
+	log_path_authz(h.PathPatternReg, rpath, user, clientIP, ok_path)
+	if !ok_path {
+		h.finish(rec, metrics.OutcomeForbidden, reason)
+		h.Response.Forbidden.Error(w)
+		return
+	}
+
+	set_max_age(w, h.CacheSeconds)
+	h.assert(w, rec, assertion.MethodHeader, false, h.UserMap)
+	h.finish(rec, metrics.OutcomeOk, audit.ReasonGranted)
+	h.Response.Ok.Error(w)
+}
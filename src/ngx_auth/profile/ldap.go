@@ -0,0 +1,113 @@
+package profile
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/l4go/var_mtx"
+
+	"ngx_auth/audit"
+	"ngx_auth/etag"
+	"ngx_auth/ldap_auth"
+	"ngx_auth/metrics"
+	"ngx_auth/session"
+)
+
+// Ldap authenticates the users with an LDAP bind.
+type Ldap struct {
+	Common
+	LdapAuthConfig    *ldap_auth.Config
+	UseSerializedAuth bool
+
+	userMtx *var_mtx.VarMutex
+}
+
+func NewLdap(c Common, ldap_cfg *ldap_auth.Config, serialized bool) *Ldap {
+	c.init()
+	return &Ldap{
+		Common:            c,
+		LdapAuthConfig:    ldap_cfg,
+		UseSerializedAuth: serialized,
+		userMtx:           var_mtx.NewVarMutex(),
+	}
+}
+
+// lock_user serializes the authentication of the same user, if enabled.
+// The returned function releases the lock.
+func lock_user(enabled bool, mtx *var_mtx.VarMutex, user string) func() {
+	if !enabled {
+		return func() {}
+	}
+
+	wait_start := time.Now()
+	mtx.Lock(user)
+	metrics.UserMutexWait.Observe(time.Since(wait_start).Seconds())
+	return func() { mtx.Unlock(user) }
+}
+
+func (h *Ldap) auth(user string, pass string, clientIP string) (bool, string) {
+	defer lock_user(h.UseSerializedAuth, h.userMtx, user)()
+
+	ok_auth, _, offline, err := ldap_auth.AuthenticateUser(h.LdapAuthConfig, user, pass, clientIP)
+	if err != nil {
+		return false, audit.ReasonBackendError
+	}
+	if !ok_auth {
+		return false, audit.ReasonBadCredentials
+	}
+
+	return true, granted(offline)
+}
+
+func (h *Ldap) form_login(user string, pass string, clientIP string) (*session.Session, string) {
+	ok, reason := h.auth(user, pass, clientIP)
+	if !ok {
+		return nil, reason
+	}
+	return &session.Session{User: user}, reason
+}
+
+func (h *Ldap) makeEtag(user, pass string) string {
+	tm := time_bin(h.StartTimeMS)
+	return etag.Make(tm, etag.Crypt(tm, []byte(user)),
+		etag.Hmac([]byte(user), []byte(pass)))
+}
+
+func (h *Ldap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec, clientIP := h.begin(w, r)
+
+	if s := h.Sessions.Resume(w, r); s != nil {
+		rec.User = s.User
+		set_max_age(w, h.CacheSeconds)
+		h.assert(w, rec, s.Method, s.Mfa, session_member(s))
+		h.finish(rec, metrics.OutcomeOk, audit.ReasonSession)
+		h.Response.Ok.Error(w)
+		return
+	}
+
+	user, pass, ok := r.BasicAuth()
+	rec.User = user
+	if !ok {
+		h.finish(rec, metrics.OutcomeUnauth, audit.ReasonNoCredentials)
+		h.not_auth(w, r)
+		return
+	}
+
+	set_max_age(w, h.NegCacheSeconds)
+	if h.check_etag(w, r, rec, h.makeEtag(user, pass)) {
+		return
+	}
+
+	ok_auth, reason := h.auth(user, pass, clientIP)
+	if !ok_auth {
+		h.finish(rec, metrics.OutcomeUnauth, reason)
+		h.not_auth(w, r)
+		return
+	}
+
+	h.Sessions.Issue(w, &session.Session{User: user, Method: session.MethodBasic}, pass)
+	set_max_age(w, h.CacheSeconds)
+	h.assert(w, rec, session.MethodBasic, false, nil)
+	h.finish(rec, metrics.OutcomeOk, audit.ReasonGranted)
+	h.Response.Ok.Error(w)
+}
@@ -0,0 +1,186 @@
+package profile
+
+import (
+	"net/http"
+
+	"github.com/l4go/var_mtx"
+
+	"ngx_auth/audit"
+	"ngx_auth/etag"
+	"ngx_auth/ldap_auth"
+	"ngx_auth/logger"
+	"ngx_auth/metrics"
+	"ngx_auth/session"
+	"ngx_auth/totp"
+)
+
+// LdapPath authenticates the users with an LDAP bind, and authorizes
+// the path with a user map.
+type LdapPath struct {
+	Common
+	LdapAuthConfig    *ldap_auth.Config
+	UseSerializedAuth bool
+	PathHeader        string
+	PathRights
+
+	userMtx *var_mtx.VarMutex
+}
+
+func NewLdapPath(c Common, ldap_cfg *ldap_auth.Config, serialized bool,
+	path_header string, rights PathRights) *LdapPath {
+	c.init()
+	if path_header == "" {
+		path_header = DefaultPathHeader
+	}
+	return &LdapPath{
+		Common:            c,
+		LdapAuthConfig:    ldap_cfg,
+		UseSerializedAuth: serialized,
+		PathHeader:        path_header,
+		PathRights:        rights,
+		userMtx:           var_mtx.NewVarMutex(),
+	}
+}
+
+// auth_path authenticates the user, and authorizes the path. With mfa,
+// pass must end with the TOTP code.
+func (h *LdapPath) auth_path(user string, pass string, rpath string, clientIP string,
+	mfa bool, rec *audit.Record) (bool, bool, string) {
+	code := ""
+	if mfa {
+		var ok bool
+		if pass, code, ok = totp.SplitCode(pass); !ok {
+			return false, false, audit.ReasonTotp
+		}
+	}
+
+	defer lock_user(h.UseSerializedAuth, h.userMtx, user)()
+
+	ok_auth, ok_authz, offline, err := ldap_auth.AuthenticateUser(h.LdapAuthConfig, user, pass, clientIP)
+	if err != nil {
+		return false, false, audit.ReasonBackendError
+	}
+	if !ok_auth {
+		return false, false, audit.ReasonBadCredentials
+	}
+	if mfa {
+		if err := h.Totp.Verify(user, code); err != nil {
+			logger.Event(logger.LevelWarn, logger.EventTotpRejected,
+				logger.User(user), logger.ClientIP(clientIP), logger.Err(err))
+			return false, false, audit.ReasonTotp
+		}
+	}
+	if !ok_authz {
+		rec.SetFilter(h.LdapAuthConfig.AuthzFilter)
+		return true, false, audit.ReasonAuthzFilter
+	}
+
+	ok_path, reason := h.get_path_right(rpath, user, rec)
+	log_path_authz(h.PathPatternReg, rpath, user, clientIP, ok_path)
+	if !ok_path {
+		return true, false, reason
+	}
+
+	return true, true, granted(offline)
+}
+
+// form_login requires the authorization filter, like a session issued
+// after a Basic login.
+func (h *LdapPath) form_login(user string, pass string, clientIP string) (*session.Session, string) {
+	defer lock_user(h.UseSerializedAuth, h.userMtx, user)()
+
+	ok_auth, ok_authz, offline, err := ldap_auth.AuthenticateUser(h.LdapAuthConfig, user, pass, clientIP)
+	switch {
+	case err != nil:
+		return nil, audit.ReasonBackendError
+	case !ok_auth:
+		return nil, audit.ReasonBadCredentials
+	case !ok_authz:
+		return nil, audit.ReasonAuthzFilter
+	}
+	return &session.Session{User: user}, granted(offline)
+}
+
+// session_path authorizes the path for a session, unless it lacks the second factor.
+func (h *LdapPath) session_path(w http.ResponseWriter, rec *audit.Record,
+	s *session.Session, rpath string, clientIP string) bool {
+	if !s.Mfa && h.needs_mfa(rpath) {
+		return false
+	}
+	user := s.User
+	ok_path, reason := h.get_path_right(rpath, user, rec)
+	log_path_authz(h.PathPatternReg, rpath, user, clientIP, ok_path)
+	if !ok_path {
+		set_max_age(w, h.NegCacheSeconds)
+		h.finish(rec, metrics.OutcomeForbidden, reason)
+		h.Response.Forbidden.Error(w)
+		return true
+	}
+
+	set_max_age(w, h.CacheSeconds)
+	h.assert(w, rec, s.Method, s.Mfa, h.UserMap)
+	h.finish(rec, metrics.OutcomeOk, audit.ReasonSession)
+	h.Response.Ok.Error(w)
+	return true
+}
+
+func (h *LdapPath) makeEtag(user, pass, rpath string) string {
+	tm := time_bin(h.StartTimeMS)
+	return etag.Make(tm, etag.Crypt(tm, []byte(user)),
+		etag.Hmac([]byte(user), []byte(pass)), path_tag(h.PathPatternReg, rpath))
+}
+
+func (h *LdapPath) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec, clientIP := h.begin(w, r)
+
+	rpath := r.Header.Get(h.PathHeader)
+	rec.SetPath(rpath)
+	if rpath == "" {
+		h.finish(rec, metrics.OutcomeNopath, audit.ReasonNoPath)
+		h.Response.Nopath.Error(w)
+		return
+	}
+
+	if s := h.Sessions.Resume(w, r); s != nil {
+		rec.User = s.User
+		if h.session_path(w, rec, s, rpath, clientIP) {
+			return
+		}
+	}
+
+	user, pass, ok := r.BasicAuth()
+	rec.User = user
+	if !ok {
+		h.finish(rec, metrics.OutcomeUnauth, audit.ReasonNoCredentials)
+		h.not_auth(w, r)
+		return
+	}
+
+	// The code of the second factor is accepted only once, so such a
+	// request is never answered with 304.
+	set_max_age(w, h.NegCacheSeconds)
+	mfa := h.needs_mfa(rpath)
+	if !mfa && h.check_etag(w, r, rec, h.makeEtag(user, pass, rpath)) {
+		return
+	}
+
+	ok_auth, ok_authz, reason := h.auth_path(user, pass, rpath, clientIP, mfa, rec)
+	if !ok_auth {
+		h.finish(rec, metrics.OutcomeUnauth, reason)
+		h.not_auth(w, r)
+		return
+	}
+	if !ok_authz {
+		h.finish(rec, metrics.OutcomeForbidden, reason)
+		h.Response.Forbidden.Error(w)
+		return
+	}
+
+	// The fingerprint is of the password with the code, which the client
+	// sends again with the cookie.
+	h.Sessions.Issue(w, &session.Session{User: user, Method: session.MethodBasic, Mfa: mfa}, pass)
+	set_max_age(w, h.CacheSeconds)
+	h.assert(w, rec, session.MethodBasic, mfa, h.UserMap)
+	h.finish(rec, metrics.OutcomeOk, audit.ReasonGranted)
+	h.Response.Ok.Error(w)
+}
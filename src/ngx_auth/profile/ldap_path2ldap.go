@@ -0,0 +1,184 @@
+package profile
+
+import (
+	"net/http"
+
+	"github.com/l4go/var_mtx"
+
+	"ngx_auth/audit"
+	"ngx_auth/etag"
+	"ngx_auth/ldap_auth"
+	"ngx_auth/metrics"
+	"ngx_auth/session"
+)
+
+// LdapPath2Ldap authenticates the users with an LDAP bind, and authorizes
+// the path with an LDAP search filter of the path.
+type LdapPath2Ldap struct {
+	Common
+	LdapAuthConfig    *ldap_auth.Config
+	UseSerializedAuth bool
+	PathHeader        string
+	PathFilters
+
+	userMtx *var_mtx.VarMutex
+}
+
+func NewLdapPath2Ldap(c Common, ldap_cfg *ldap_auth.Config, serialized bool,
+	path_header string, filters PathFilters) *LdapPath2Ldap {
+	c.init()
+	if path_header == "" {
+		path_header = DefaultPathHeader
+	}
+	return &LdapPath2Ldap{
+		Common:            c,
+		LdapAuthConfig:    ldap_cfg,
+		UseSerializedAuth: serialized,
+		PathHeader:        path_header,
+		PathFilters:       filters,
+		userMtx:           var_mtx.NewVarMutex(),
+	}
+}
+
+func (h *LdapPath2Ldap) auth_path(user string, pass string, path string, clientIP string,
+	ok_path bool, path_filter string, path_reason string) (bool, bool, string) {
+	ldap_cfg := *h.LdapAuthConfig
+
+	defer lock_user(h.UseSerializedAuth, h.userMtx, user)()
+
+	ldap_cfg.AuthzFilter = path_filter
+	ok_auth, ok_authz, offline, err := ldap_auth.AuthenticateUser(&ldap_cfg, user, pass, clientIP)
+	if err != nil {
+		return false, false, audit.ReasonBackendError
+	}
+	if !ok_auth {
+		return false, false, audit.ReasonBadCredentials
+	}
+	if !ok_path {
+		ok_authz = false
+	}
+	log_path_authz(h.PathPatternReg, path, user, clientIP, ok_authz)
+	if !ok_authz {
+		return true, false, path_reason
+	}
+
+	return true, true, granted(offline)
+}
+
+// form_login evaluates all the path filters at the login, because the
+// session has no password to evaluate them later.
+func (h *LdapPath2Ldap) form_login(user string, pass string, clientIP string) (*session.Session, string) {
+	defer lock_user(h.UseSerializedAuth, h.userMtx, user)()
+
+	ok_auth, authz, err := ldap_auth.AuthenticateFilters(h.LdapAuthConfig, user, pass, clientIP, h.Filters())
+	switch {
+	case err != nil:
+		return nil, audit.ReasonBackendError
+	case !ok_auth:
+		return nil, audit.ReasonBadCredentials
+	}
+	s := &session.Session{User: user}
+	for flt, ok := range authz {
+		s.SetAuthz(flt, ok)
+	}
+	return s, audit.ReasonGranted
+}
+
+// session_path authorizes the path by the filter result in the session, if it has one.
+func (h *LdapPath2Ldap) session_path(w http.ResponseWriter, rec *audit.Record,
+	s *session.Session, rpath string, clientIP string,
+	ok_path bool, path_filter string, path_reason string) bool {
+	ok_authz := false
+	if ok_path {
+		var has bool
+		if ok_authz, has = s.GetAuthz(path_filter); !has {
+			return false
+		}
+	}
+	log_path_authz(h.PathPatternReg, rpath, s.User, clientIP, ok_authz)
+	if !ok_authz {
+		set_max_age(w, h.NegCacheSeconds)
+		h.finish(rec, metrics.OutcomeForbidden, path_reason)
+		h.Response.Forbidden.Error(w)
+		return true
+	}
+
+	set_max_age(w, h.CacheSeconds)
+	h.assert(w, rec, s.Method, s.Mfa, nil)
+	h.finish(rec, metrics.OutcomeOk, audit.ReasonSession)
+	h.Response.Ok.Error(w)
+	return true
+}
+
+func (h *LdapPath2Ldap) makeEtag(user, pass, rpath string) string {
+	tm := time_bin(h.StartTimeMS)
+	return etag.Make(tm, etag.Crypt(tm, []byte(user)),
+		etag.Hmac([]byte(user), []byte(pass)), path_tag(h.PathPatternReg, rpath))
+}
+
+func (h *LdapPath2Ldap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec, clientIP := h.begin(w, r)
+
+	rpath := r.Header.Get(h.PathHeader)
+	rec.SetPath(rpath)
+	if rpath == "" {
+		h.finish(rec, metrics.OutcomeNopath, audit.ReasonNoPath)
+		h.Response.Nopath.Error(w)
+		return
+	}
+	ok_path, path_filter, path_reason := h.get_path_filter(rpath, rec)
+	if !ok_path {
+		path_filter = ""
+	}
+
+	s := h.Sessions.Resume(w, r)
+	if s != nil {
+		rec.User = s.User
+		if h.session_path(w, rec, s, rpath, clientIP, ok_path, path_filter, path_reason) {
+			return
+		}
+	}
+
+	user, pass, ok := r.BasicAuth()
+	rec.User = user
+	if !ok {
+		h.finish(rec, metrics.OutcomeUnauth, audit.ReasonNoCredentials)
+		h.not_auth(w, r)
+		return
+	}
+
+	set_max_age(w, h.NegCacheSeconds)
+	if h.check_etag(w, r, rec, h.makeEtag(user, pass, rpath)) {
+		return
+	}
+
+	ok_auth, ok_authz, reason := h.auth_path(user, pass, rpath, clientIP,
+		ok_path, path_filter, path_reason)
+	if ok_auth && ok_path {
+		// A session of the user, or a new one after a grant, records
+		// the result of the filter.
+		if s != nil {
+			s.SetAuthz(path_filter, ok_authz)
+			h.Sessions.Update(w, s)
+		} else if ok_authz {
+			s = &session.Session{User: user, Method: session.MethodBasic}
+			s.SetAuthz(path_filter, ok_authz)
+			h.Sessions.Issue(w, s, pass)
+		}
+	}
+	if !ok_auth {
+		h.finish(rec, metrics.OutcomeUnauth, reason)
+		h.not_auth(w, r)
+		return
+	}
+	if !ok_authz {
+		h.finish(rec, metrics.OutcomeForbidden, reason)
+		h.Response.Forbidden.Error(w)
+		return
+	}
+
+	set_max_age(w, h.CacheSeconds)
+	h.assert(w, rec, session.MethodBasic, false, nil)
+	h.finish(rec, metrics.OutcomeOk, audit.ReasonGranted)
+	h.Response.Ok.Error(w)
+}
@@ -0,0 +1,392 @@
+package profile
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"ngx_auth/audit"
+	"ngx_auth/logger"
+	"ngx_auth/metrics"
+	"ngx_auth/oidc"
+	"ngx_auth/session"
+	"ngx_auth/totp"
+)
+
+var (
+	ErrNoFormLogin = errors.New("module type does not support the login form")
+	ErrNoSessions  = errors.New("login form needs the sessions")
+)
+
+// Paths of the login form endpoints under the prefix.
+const (
+	LoginPath  = "/login"
+	LogoutPath = "/logout"
+)
+
+// CsrfSeconds is how long a login form can be submitted.
+const CsrfSeconds = 3600
+
+// maxFormSize is the limit of a submitted login form.
+const maxFormSize = 16 << 10
+
+// formBackend is an auth handler whose users can log in with the form.
+type formBackend interface {
+	http.Handler
+	// form_login authenticates the user, and returns the session to issue,
+	// or nil and the audit reason.
+	form_login(user string, pass string, clientIP string) (*session.Session, string)
+}
+
+// LoginPage is the data of the login form template.
+type LoginPage struct {
+	Realm  string
+	User   string
+	Return string
+	Csrf   string
+	Error  string
+	// Totp is true if the form can have the TOTP code.
+	Totp bool
+}
+
+// DefaultLoginForm is the login form without a template file.
+const DefaultLoginForm = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Realm}}</title>
+<style>
+body { font-family: sans-serif; background: #f4f4f4; }
+form { max-width: 20em; margin: 4em auto; padding: 2em; background: #fff; border-radius: 4px; }
+label, input { display: block; width: 100%; box-sizing: border-box; }
+input { margin: 0.3em 0 1em; padding: 0.5em; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<form method="post">
+<h1>{{.Realm}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<label for="username">User name</label>
+<input id="username" name="username" value="{{.User}}" autocomplete="username" required autofocus>
+<label for="password">Password</label>
+<input id="password" name="password" type="password" autocomplete="current-password" required>
+{{if .Totp}}<label for="otp">One-time code (if required)</label>
+<input id="otp" name="otp" inputmode="numeric" autocomplete="one-time-code" pattern="[0-9]*">
+{{end}}<input type="hidden" name="rd" value="{{.Return}}">
+<input type="hidden" name="csrf" value="{{.Csrf}}">
+<input type="submit" value="Log in">
+</form>
+</body>
+</html>
+`
+
+// logoutForm posts the logout with the CSRF token.
+var logoutForm = template.Must(template.New("logout").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Realm}}</title>
+<style>
+body { font-family: sans-serif; background: #f4f4f4; }
+form { max-width: 20em; margin: 4em auto; padding: 2em; background: #fff; border-radius: 4px; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<form method="post">
+<h1>{{.Realm}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<input type="hidden" name="rd" value="{{.Return}}">
+<input type="hidden" name="csrf" value="{{.Csrf}}">
+<input type="submit" value="Log out">
+</form>
+</body>
+</html>
+`))
+
+// LoadLoginForm parses the login form template file, or the default form
+// without a file. The template must have the CSRF token of the page.
+func LoadLoginForm(file string) (*template.Template, error) {
+	src := DefaultLoginForm
+	if file != "" {
+		bin, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		src = string(bin)
+	}
+	form, err := template.New("login").Parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var sb strings.Builder
+	probe := LoginPage{Csrf: "csrf-token-probe"}
+	if err := form.Execute(&sb, &probe); err != nil {
+		return nil, err
+	}
+	if !strings.Contains(sb.String(), probe.Csrf) {
+		return nil, errors.New("template has no {{.Csrf}}")
+	}
+	return form, nil
+}
+
+// Login serves the login and logout forms, and passes the other requests to auth.
+type Login struct {
+	Common
+	Prefix     string
+	Form       *template.Template
+	CsrfCookie session.CookieConfig
+
+	auth formBackend
+}
+
+// csrfState is kept in the CSRF cookie, and the token is also in the form.
+type csrfState struct {
+	Token   string `json:"t"`
+	Expires int64  `json:"exp"`
+}
+
+// NewLogin wraps auth, which must be a simple or an LDAP handler made with
+// the same c. c.LoginUrl is the login endpoint as the browser sees it.
+func NewLogin(c Common, prefix string, form *template.Template, auth http.Handler) (*Login, error) {
+	c.init()
+	fb, ok := auth.(formBackend)
+	if !ok {
+		return nil, ErrNoFormLogin
+	}
+	if c.Sessions == nil {
+		return nil, ErrNoSessions
+	}
+
+	// The CSRF cookie is sent to both the login and the logout.
+	csrf_path := "/"
+	if u, err := url.Parse(c.LoginUrl); err == nil && u.Path != "" {
+		csrf_path = path.Dir(u.Path)
+	}
+	return &Login{
+		Common: c,
+		Prefix: strings.TrimSuffix(prefix, "/"),
+		Form:   form,
+		CsrfCookie: session.CookieConfig{
+			Name:     c.Sessions.Cookie.Name + "_csrf",
+			Path:     csrf_path,
+			Domain:   c.Sessions.Cookie.Domain,
+			Insecure: c.Sessions.Cookie.Insecure,
+		},
+		auth: fb,
+	}, nil
+}
+
+func (h *Login) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, h.Prefix) {
+	case LoginPath:
+		h.login(w, r)
+	case LogoutPath:
+		h.logout(w, r)
+	default:
+		h.auth.ServeHTTP(w, r)
+	}
+}
+
+func random_token() (string, error) {
+	bin := make([]byte, 24)
+	if _, err := rand.Read(bin); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bin), nil
+}
+
+// show renders the login form with a new CSRF token.
+func (h *Login) show(w http.ResponseWriter, code int, page *LoginPage) {
+	page.Totp = h.Totp != nil
+	h.render(w, code, h.Form, page)
+}
+
+func (h *Login) render(w http.ResponseWriter, code int, form *template.Template, page *LoginPage) {
+	token, err := random_token()
+	if err != nil {
+		http.Error(w, "Login error", http.StatusInternalServerError)
+		return
+	}
+	expires := time.Now().Add(CsrfSeconds * time.Second)
+	sealed, err := h.Sessions.Codec.Seal(&csrfState{Token: token, Expires: expires.Unix()})
+	if err != nil {
+		http.Error(w, "Login error", http.StatusInternalServerError)
+		return
+	}
+	ck := h.CsrfCookie.Cookie(sealed, expires)
+	ck.SameSite = http.SameSiteStrictMode
+	http.SetCookie(w, ck)
+
+	page.Realm = h.AuthRealm
+	page.Return = oidc.SafeReturn(page.Return)
+	page.Csrf = token
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(code)
+	form.Execute(w, page)
+}
+
+// record starts the audit record of a posted form.
+func (h *Login) record(r *http.Request, clientIP string) *audit.Record {
+	rec := audit.Begin(clientIP)
+	rec.Profile = h.Name
+	rec.SetPath(r.URL.Path)
+	return rec
+}
+
+// check_csrf compares the token of the form with the CSRF cookie.
+func (h *Login) check_csrf(r *http.Request) bool {
+	ck, err := r.Cookie(h.CsrfCookie.Name)
+	if err != nil {
+		return false
+	}
+	var cs csrfState
+	if err := h.Sessions.Codec.Open(ck.Value, &cs); err != nil || cs.Token == "" {
+		return false
+	}
+	if time.Now().Unix() >= cs.Expires {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.PostForm.Get("csrf")), []byte(cs.Token)) == 1
+}
+
+func (h *Login) login(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.show(w, http.StatusOK, &LoginPage{Return: r.URL.Query().Get("rd")})
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientIP := logger.ExtractClientIP(r)
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	user := r.PostForm.Get("username")
+	pass := r.PostForm.Get("password")
+	page := &LoginPage{User: user, Return: r.PostForm.Get("rd")}
+	rec := h.record(r, clientIP)
+	rec.User = user
+
+	if !h.check_csrf(r) {
+		logger.Event(logger.LevelWarn, logger.EventFormLoginFailed,
+			logger.User(user), logger.ClientIP(clientIP), logger.Result(audit.ReasonCsrf))
+		h.finish(rec, metrics.OutcomeForbidden, audit.ReasonCsrf)
+		page.Error = "The login form has expired. Please try again."
+		h.show(w, http.StatusForbidden, page)
+		return
+	}
+	if user == "" || pass == "" {
+		h.finish(rec, metrics.OutcomeUnauth, audit.ReasonNoCredentials)
+		page.Error = "Enter the user name and the password."
+		h.show(w, http.StatusUnauthorized, page)
+		return
+	}
+
+	s, reason := h.auth.form_login(user, pass, clientIP)
+	if s == nil {
+		logger.Event(logger.LevelWarn, logger.EventFormLoginFailed,
+			logger.User(user), logger.ClientIP(clientIP), logger.Result(reason))
+		h.finish(rec, metrics.OutcomeUnauth, reason)
+		// A user denied by the authorization filter gets the same answer as
+		// a wrong password, which does not tell that the password is right.
+		code := http.StatusUnauthorized
+		page.Error = "The user name or the password is incorrect."
+		if reason == audit.ReasonBackendError {
+			code = http.StatusServiceUnavailable
+			page.Error = "The login service is unavailable. Please try again later."
+		}
+		h.show(w, code, page)
+		return
+	}
+
+	// The code is optional, and only the paths requiring the second
+	// factor need it.
+	if code := r.PostForm.Get("otp"); code != "" && h.Totp != nil {
+		if err := h.Totp.Verify(user, code); err != nil {
+			logger.Event(logger.LevelWarn, logger.EventTotpRejected,
+				logger.User(user), logger.ClientIP(clientIP), logger.Err(err))
+			logger.Event(logger.LevelWarn, logger.EventFormLoginFailed,
+				logger.User(user), logger.ClientIP(clientIP), logger.Result(audit.ReasonTotp))
+			h.finish(rec, metrics.OutcomeUnauth, audit.ReasonTotp)
+			page.Error = "The one-time code is incorrect."
+			if errors.Is(err, totp.ErrLocked) {
+				page.Error = "Too many incorrect one-time codes. Please try again later."
+			}
+			h.show(w, http.StatusUnauthorized, page)
+			return
+		}
+		s.Mfa = true
+	}
+
+	s.Method = session.MethodForm
+	h.Sessions.Issue(w, s, pass)
+	http.SetCookie(w, h.CsrfCookie.Clear())
+	logger.Event(logger.LevelInfo, logger.EventFormLogin,
+		logger.User(user), logger.ClientIP(clientIP))
+	h.finish(rec, metrics.OutcomeOk, reason)
+	http.Redirect(w, r, oidc.SafeReturn(page.Return), http.StatusSeeOther)
+}
+
+// logout shows the logout form, and removes the session cookie when the
+// form is posted.
+func (h *Login) logout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.render(w, http.StatusOK, logoutForm, &LoginPage{Return: r.URL.Query().Get("rd")})
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientIP := logger.ExtractClientIP(r)
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	page := &LoginPage{Return: r.PostForm.Get("rd")}
+	rec := h.record(r, clientIP)
+	if s, err := h.Sessions.Load(r); err == nil {
+		rec.User = s.User
+	}
+
+	if !h.check_csrf(r) {
+		h.finish(rec, metrics.OutcomeForbidden, audit.ReasonCsrf)
+		page.Error = "The logout form has expired. Please try again."
+		h.render(w, http.StatusForbidden, logoutForm, page)
+		return
+	}
+
+	h.Sessions.Clear(w)
+	http.SetCookie(w, h.CsrfCookie.Clear())
+	logger.Event(logger.LevelInfo, logger.EventFormLogout,
+		logger.User(rec.User), logger.ClientIP(clientIP))
+	h.finish(rec, metrics.OutcomeOk, audit.ReasonLogout)
+	http.Redirect(w, r, oidc.SafeReturn(page.Return), http.StatusSeeOther)
+}
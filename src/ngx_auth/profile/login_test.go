@@ -0,0 +1,309 @@
+package profile
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ngx_auth/audit"
+	"ngx_auth/session"
+	"ngx_auth/totp"
+)
+
+const test_secret = "0123456789abcdef0123456789abcdef"
+
+// csrf_form renders the CSRF token and the error of the page.
+var csrf_form = template.Must(template.New("login").Parse("{{.Csrf}}\n{{.Error}}"))
+
+// show_form gets the login form, and returns its CSRF cookie and token.
+func show_form(t *testing.T, h *Login) (*http.Cookie, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login", nil))
+	cs := w.Result().Cookies()
+	if w.Code != http.StatusOK || len(cs) != 1 {
+		t.Fatalf("GET login = %d with %d cookies, want 200 with 1", w.Code, len(cs))
+	}
+	body, _ := io.ReadAll(w.Body)
+	token, _, _ := strings.Cut(string(body), "\n")
+	return cs[0], token
+}
+
+// post_form posts form to the path with the cookies.
+func post_form(h *Login, rpath string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", rpath, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, ck := range cookies {
+		if ck != nil {
+			r.AddCookie(ck)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// last_audit returns the last record of the audit log.
+func last_audit(t *testing.T, file string) audit.Record {
+	t.Helper()
+	bin, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(bin), []byte("\n"))
+	var rec audit.Record
+	if err := json.Unmarshal(lines[len(lines)-1], &rec); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+// denied is a form backend denying every user by its reason.
+type denied string
+
+func (denied) ServeHTTP(http.ResponseWriter, *http.Request) {}
+
+func (d denied) form_login(string, string, string) (*session.Session, string) {
+	return nil, string(d)
+}
+
+func TestLoginCsrf(t *testing.T) {
+	audit_file := filepath.Join(t.TempDir(), "audit.log")
+	if err := audit.Setup("test", &audit.Config{Logfile: audit_file}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := session.Config{Secret: test_secret}
+	cfg.SetDefault()
+	sessions, err := session.NewManager(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other_codec, err := session.NewCodec(test_secret + "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Common{Sessions: sessions, LoginUrl: "/auth/login"}
+	h, err := NewLogin(c, "/auth", csrf_form,
+		&Simple{Common: c, Password: map[string]string{"user1": "pass1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookie, token := show_form(t, h)
+	_, other_token := show_form(t, h)
+	seal := func(codec *session.Codec, cs csrfState) *http.Cookie {
+		sealed, err := codec.Seal(&cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Cookie{Name: cookie.Name, Value: sealed}
+	}
+	valid := time.Now().Add(time.Minute).Unix()
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		token  string
+		pass   string
+		code   int
+		reason string
+	}{
+		{"ok", cookie, token, "pass1", http.StatusSeeOther, audit.ReasonGranted},
+		{"wrong password", cookie, token, "pass2", http.StatusUnauthorized, audit.ReasonBadCredentials},
+		{"no password", cookie, token, "", http.StatusUnauthorized, audit.ReasonNoCredentials},
+		{"no cookie", nil, token, "pass1", http.StatusForbidden, audit.ReasonCsrf},
+		{"no token", cookie, "", "pass1", http.StatusForbidden, audit.ReasonCsrf},
+		{"token of other form", cookie, other_token, "pass1", http.StatusForbidden, audit.ReasonCsrf},
+		{"cookie of other secret", seal(other_codec, csrfState{Token: token, Expires: valid}),
+			token, "pass1", http.StatusForbidden, audit.ReasonCsrf},
+		{"expired cookie", seal(sessions.Codec, csrfState{Token: token, Expires: time.Now().Unix()}),
+			token, "pass1", http.StatusForbidden, audit.ReasonCsrf},
+		{"empty token", seal(sessions.Codec, csrfState{Expires: valid}), "", "pass1", http.StatusForbidden, audit.ReasonCsrf},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := post_form(h, "/auth/login", url.Values{"username": {"user1"}, "password": {tt.pass},
+				"rd": {"/app"}, "csrf": {tt.token}}, tt.cookie)
+			if w.Code != tt.code {
+				t.Fatalf("POST login = %d, want %d", w.Code, tt.code)
+			}
+
+			issued := false
+			for _, ck := range w.Result().Cookies() {
+				issued = issued || (ck.Name == sessions.Cookie.Name && ck.Value != "")
+			}
+			if issued != (tt.code == http.StatusSeeOther) {
+				t.Errorf("POST login issued a session %v, want %v", issued, !issued)
+			}
+			if tt.code == http.StatusSeeOther && w.Header().Get("Location") != "/app" {
+				t.Errorf("POST login Location = %q, want %q", w.Header().Get("Location"), "/app")
+			}
+			if rec := last_audit(t, audit_file); rec.Reason != tt.reason || rec.User != "user1" {
+				t.Errorf("audit = %q of %q, want %q of %q", rec.Reason, rec.User, tt.reason, "user1")
+			}
+		})
+	}
+}
+
+func TestLoginDenied(t *testing.T) {
+	cfg := session.Config{Secret: test_secret}
+	cfg.SetDefault()
+	sessions, err := session.NewManager(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Common{Sessions: sessions, LoginUrl: "/auth/login"}
+	const incorrect = "The user name or the password is incorrect."
+
+	tests := []struct {
+		reason string
+		code   int
+		msg    string
+	}{
+		{audit.ReasonBadCredentials, http.StatusUnauthorized, incorrect},
+		{audit.ReasonAuthzFilter, http.StatusUnauthorized, incorrect},
+		{audit.ReasonBackendError, http.StatusServiceUnavailable,
+			"The login service is unavailable. Please try again later."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			h, err := NewLogin(c, "/auth", csrf_form, denied(tt.reason))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cookie, token := show_form(t, h)
+			w := post_form(h, "/auth/login", url.Values{"username": {"user1"}, "password": {"pass1"},
+				"csrf": {token}}, cookie)
+			_, msg, _ := strings.Cut(w.Body.String(), "\n")
+			if w.Code != tt.code || msg != tt.msg {
+				t.Errorf("POST login = %d %q, want %d %q", w.Code, msg, tt.code, tt.msg)
+			}
+		})
+	}
+}
+
+func TestLogoutCsrf(t *testing.T) {
+	audit_file := filepath.Join(t.TempDir(), "audit.log")
+	if err := audit.Setup("test", &audit.Config{Logfile: audit_file}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := session.Config{Secret: test_secret}
+	cfg.SetDefault()
+	sessions, err := session.NewManager(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Common{Sessions: sessions, LoginUrl: "/auth/login"}
+	h, err := NewLogin(c, "/auth", csrf_form,
+		&Simple{Common: c, Password: map[string]string{"user1": "pass1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	sessions.Issue(w, &session.Session{User: "user1", Method: session.MethodForm}, "")
+	sess := w.Result().Cookies()[0]
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/auth/logout?rd=/bye", nil))
+	cs := w.Result().Cookies()
+	if w.Code != http.StatusOK || len(cs) != 1 || cs[0].Name != h.CsrfCookie.Name || cs[0].Path != "/auth" {
+		t.Fatalf("GET logout = %d with %v, want 200 with the CSRF cookie of /auth", w.Code, cs)
+	}
+	if !strings.Contains(w.Body.String(), `value="/bye"`) {
+		t.Errorf("GET logout has no rd field")
+	}
+	cookie, token := show_form(t, h)
+	_, other_token := show_form(t, h)
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		token  string
+		code   int
+		reason string
+	}{
+		{"no cookie", nil, token, http.StatusForbidden, audit.ReasonCsrf},
+		{"no token", cookie, "", http.StatusForbidden, audit.ReasonCsrf},
+		{"token of other form", cookie, other_token, http.StatusForbidden, audit.ReasonCsrf},
+		{"ok", cookie, token, http.StatusSeeOther, audit.ReasonLogout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := post_form(h, "/auth/logout", url.Values{"rd": {"/bye"}, "csrf": {tt.token}}, sess, tt.cookie)
+			if w.Code != tt.code {
+				t.Fatalf("POST logout = %d, want %d", w.Code, tt.code)
+			}
+
+			cleared := false
+			for _, ck := range w.Result().Cookies() {
+				cleared = cleared || (ck.Name == sessions.Cookie.Name && ck.MaxAge < 0)
+			}
+			if cleared != (tt.code == http.StatusSeeOther) {
+				t.Errorf("POST logout cleared the session %v, want %v", cleared, !cleared)
+			}
+			if tt.code == http.StatusSeeOther && w.Header().Get("Location") != "/bye" {
+				t.Errorf("POST logout Location = %q, want %q", w.Header().Get("Location"), "/bye")
+			}
+			if rec := last_audit(t, audit_file); rec.Reason != tt.reason || rec.User != "user1" {
+				t.Errorf("audit = %q of %q, want %q of %q", rec.Reason, rec.User, tt.reason, "user1")
+			}
+		})
+	}
+
+	r := httptest.NewRequest("DELETE", "/auth/logout", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE logout = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestLoginTotpLocked(t *testing.T) {
+	secret_file := filepath.Join(t.TempDir(), "totp")
+	if err := os.WriteFile(secret_file, []byte("user1 GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := totp.LoadSecretFile(secret_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := session.Config{Secret: test_secret}
+	cfg.SetDefault()
+	sessions, err := session.NewManager(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Common{Sessions: sessions, LoginUrl: "/auth/login", Totp: totp.NewVerifier(secrets)}
+	h, err := NewLogin(c, "/auth", csrf_form,
+		&Simple{Common: c, Password: map[string]string{"user1": "pass1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totp.DecodeSecret("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	bad := totp.Code(key, totp.Step(time.Now())+totp.Skew+2)
+
+	const incorrect = "The one-time code is incorrect."
+	const locked = "Too many incorrect one-time codes. Please try again later."
+	for i := 1; i <= totp.MaxFailures+1; i++ {
+		cookie, token := show_form(t, h)
+		w := post_form(h, "/auth/login", url.Values{"username": {"user1"}, "password": {"pass1"},
+			"otp": {bad}, "csrf": {token}}, cookie)
+		want := incorrect
+		if i > totp.MaxFailures {
+			want = locked
+		}
+		if _, msg, _ := strings.Cut(w.Body.String(), "\n"); w.Code != http.StatusUnauthorized || msg != want {
+			t.Errorf("POST login %d = %d %q, want %d %q", i, w.Code, msg, http.StatusUnauthorized, want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package profile
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"ngx_auth/audit"
+	"ngx_auth/authz"
+	"ngx_auth/jwt"
+	"ngx_auth/logger"
+	"ngx_auth/metrics"
+	"ngx_auth/oidc"
+	"ngx_auth/pipeline"
+	"ngx_auth/session"
+)
+
+// Paths of the login endpoints under the prefix of an oidc profile.
+const (
+	OidcLoginPath    = "/login"
+	OidcCallbackPath = "/callback"
+	OidcLogoutPath   = "/logout"
+)
+
+// Oidc authorizes the users logged in with an OpenID Connect provider.
+type Oidc struct {
+	Common
+	Prefix         string
+	PathHeader     string
+	LoginUrl       string
+	RelyingParty   *oidc.RelyingParty
+	Sessions       *session.Codec
+	SessionCookie  session.CookieConfig
+	SessionSeconds uint32
+	Authorizer     pipeline.Authorizer
+}
+
+func NewOidc(c Common, prefix string, path_header string, login_url string,
+	rp *oidc.RelyingParty, sessions *session.Codec, cookie session.CookieConfig,
+	session_sec uint32, authzr pipeline.Authorizer) *Oidc {
+	c.init()
+	prefix = strings.TrimSuffix(prefix, "/")
+	if path_header == "" {
+		path_header = DefaultPathHeader
+	}
+	if login_url == "" {
+		login_url = prefix + OidcLoginPath
+	}
+	if authzr == nil {
+		authzr = pipeline.AllowAll{}
+	}
+	return &Oidc{
+		Common:         c,
+		Prefix:         prefix,
+		PathHeader:     path_header,
+		LoginUrl:       login_url,
+		RelyingParty:   rp,
+		Sessions:       sessions,
+		SessionCookie:  cookie,
+		SessionSeconds: session_sec,
+		Authorizer:     authzr,
+	}
+}
+
+// sessionGroups is the groups kept in a session.
+type sessionGroups []string
+
+func (sg sessionGroups) Membership(user string, _ jwt.Claims) (authz.Membership, error) {
+	return authz.NewGroupSet(user, sg), nil
+}
+
+func (h *Oidc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, h.Prefix) {
+	case OidcLoginPath:
+		h.login(w, r)
+	case OidcCallbackPath:
+		h.callback(w, r)
+	case OidcLogoutPath:
+		h.logout(w, r)
+	default:
+		h.check(w, r)
+	}
+}
+
+// not_logged_in answers 401 with the login URL returning to rd.
+func (h *Oidc) not_logged_in(w http.ResponseWriter, rd string) {
+	w.Header().Set("Location", login_redirect(h.LoginUrl, rd))
+	h.Response.Unauth.Error(w)
+}
+
+func (h *Oidc) check(w http.ResponseWriter, r *http.Request) {
+	rec, clientIP := h.begin(w, r)
+
+	rpath := r.Header.Get(h.PathHeader)
+	if h.Authorizer.NeedsPath() {
+		rec.SetPath(rpath)
+		if rpath == "" {
+			h.finish(rec, metrics.OutcomeNopath, audit.ReasonNoPath)
+			h.Response.Nopath.Error(w)
+			return
+		}
+	}
+
+	s, err := h.Sessions.Load(r, h.SessionCookie.Name, h.Name)
+	if err != nil {
+		reason := audit.ReasonBadCredentials
+		if errors.Is(err, http.ErrNoCookie) {
+			reason = audit.ReasonNoCredentials
+		}
+		set_max_age(w, h.NegCacheSeconds)
+		h.finish(rec, metrics.OutcomeUnauth, reason)
+		h.not_logged_in(w, rpath)
+		return
+	}
+	rec.User = s.User
+
+	// The backends log their errors, and an error denies with backend_error.
+	req := &pipeline.Request{
+		User:     s.User,
+		Path:     rpath,
+		ClientIP: clientIP,
+		Record:   rec,
+		Groups:   sessionGroups(s.Groups),
+	}
+	ok_authz, reason, _ := h.Authorizer.Authorize(req)
+	if h.Authorizer.NeedsPath() {
+		var pathid string
+		if rec.PathId != nil {
+			pathid = *rec.PathId
+		}
+		log_pathid_authz(pathid, s.User, clientIP, ok_authz)
+	}
+	if !ok_authz {
+		set_max_age(w, h.NegCacheSeconds)
+		h.finish(rec, metrics.OutcomeForbidden, reason)
+		h.Response.Forbidden.Error(w)
+		return
+	}
+
+	set_max_age(w, h.CacheSeconds)
+	if h.Assertion != nil {
+		m, _ := req.Membership()
+		h.assert(w, rec, s.Method, s.Mfa, m)
+	}
+	h.finish(rec, metrics.OutcomeOk, audit.ReasonGranted)
+	h.Response.Ok.Error(w)
+}
+
+func (h *Oidc) login(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err := h.RelyingParty.StartLogin(w, r.URL.Query().Get("rd")); err != nil {
+		logger.Event(logger.LevelError, logger.EventOidcLoginFailed,
+			logger.ClientIP(logger.ExtractClientIP(r)), logger.Err(err))
+		http.Error(w, "Login provider unavailable", http.StatusServiceUnavailable)
+	}
+}
+
+func (h *Oidc) callback(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	clientIP := logger.ExtractClientIP(r)
+
+	id, rd, err := h.RelyingParty.Callback(w, r)
+	if err != nil {
+		logger.Event(logger.LevelWarn, logger.EventOidcLoginFailed,
+			logger.ClientIP(clientIP), logger.Err(err))
+		h.Response.Unauth.Error(w)
+		return
+	}
+
+	max_age := time.Duration(h.SessionSeconds) * time.Second
+	s := session.New(id.User, id.Groups, session.MethodOidc, max_age)
+	s.Profile = h.Name
+	sealed, err := h.Sessions.Seal(s)
+	if err != nil {
+		http.Error(w, "Session error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, h.SessionCookie.Cookie(sealed, time.Unix(s.Expires, 0)))
+	logger.Event(logger.LevelInfo, logger.EventOidcLogin,
+		logger.User(id.User), logger.ClientIP(clientIP))
+
+	http.Redirect(w, r, rd, http.StatusFound)
+}
+
+func (h *Oidc) logout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.SetCookie(w, h.SessionCookie.Clear())
+	http.Redirect(w, r, oidc.SafeReturn(r.URL.Query().Get("rd")), http.StatusFound)
+}
@@ -0,0 +1,177 @@
+package profile
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/l4go/var_mtx"
+
+	"ngx_auth/assertion"
+	"ngx_auth/audit"
+	"ngx_auth/etag"
+	"ngx_auth/jwt"
+	"ngx_auth/metrics"
+	"ngx_auth/pipeline"
+	"ngx_auth/session"
+)
+
+// Pipeline combines a credential extractor, an authenticator, a group provider
+// and an authorizer chosen by the configuration.
+type Pipeline struct {
+	Common
+	PathHeader        string
+	UseSerializedAuth bool
+	Extractor         pipeline.CredentialExtractor
+	Authenticator     pipeline.Authenticator
+	Groups            pipeline.GroupProvider
+	Authorizer        pipeline.Authorizer
+
+	userMtx *var_mtx.VarMutex
+}
+
+func NewPipeline(c Common, path_header string, serialized bool,
+	ext pipeline.CredentialExtractor, authn pipeline.Authenticator,
+	groups pipeline.GroupProvider, authzr pipeline.Authorizer) *Pipeline {
+	c.init()
+	if path_header == "" {
+		path_header = DefaultPathHeader
+	}
+	if authzr == nil {
+		authzr = pipeline.AllowAll{}
+	}
+	return &Pipeline{
+		Common:            c,
+		PathHeader:        path_header,
+		UseSerializedAuth: serialized,
+		Extractor:         ext,
+		Authenticator:     authn,
+		Groups:            groups,
+		Authorizer:        authzr,
+		userMtx:           var_mtx.NewVarMutex(),
+	}
+}
+
+func (h *Pipeline) makeEtag(cred pipeline.Credentials, rpath string) string {
+	tm := time_bin(h.StartTimeMS)
+	ids := [][]byte{tm, etag.Crypt(tm, []byte(cred.User))}
+	if h.Extractor.HasPassword() {
+		ids = append(ids, etag.Hmac([]byte(cred.User), []byte(cred.Password)))
+	}
+	if cred.Token != "" {
+		ids = append(ids, etag.Hmac([]byte(cred.User), []byte(cred.Token)))
+	}
+	if h.Authorizer.NeedsPath() {
+		ids = append(ids, etag.Crypt(tm, []byte(rpath)))
+	}
+	return etag.Make(ids...)
+}
+
+// method is the authentication method of the assertion.
+func (h *Pipeline) method(cred pipeline.Credentials) string {
+	switch {
+	case cred.Token != "":
+		if _, ok := h.Extractor.(pipeline.ApiKeyCredentials); ok {
+			return assertion.MethodApiKey
+		}
+		return assertion.MethodBearer
+	case h.Extractor.HasPassword():
+		return session.MethodBasic
+	}
+	return assertion.MethodHeader
+}
+
+func (h *Pipeline) missing(w http.ResponseWriter, rec *audit.Record) {
+	outcome := h.Extractor.MissingOutcome()
+	if outcome == metrics.OutcomeNouser {
+		h.finish(rec, outcome, audit.ReasonNoUser)
+		h.Response.Nouser.Error(w)
+		return
+	}
+	h.finish(rec, outcome, audit.ReasonNoCredentials)
+	h.challenge(w, h.Extractor.Scheme())
+}
+
+func (h *Pipeline) authenticate(cred pipeline.Credentials, clientIP string) (bool, string) {
+	defer lock_user(h.UseSerializedAuth, h.userMtx, cred.User)()
+
+	ok, err := h.Authenticator.Authenticate(cred, clientIP)
+	if errors.Is(err, pipeline.ErrUnknownUser) {
+		return false, audit.ReasonUnknownUser
+	}
+	if err != nil {
+		return false, audit.ReasonBackendError
+	}
+	if !ok {
+		return false, audit.ReasonBadCredentials
+	}
+	return true, audit.ReasonGranted
+}
+
+func (h *Pipeline) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec, clientIP := h.begin(w, r)
+
+	var rpath string
+	if h.Authorizer.NeedsPath() {
+		rpath = r.Header.Get(h.PathHeader)
+		rec.SetPath(rpath)
+		if rpath == "" {
+			h.finish(rec, metrics.OutcomeNopath, audit.ReasonNoPath)
+			h.Response.Nopath.Error(w)
+			return
+		}
+	}
+
+	cred, ok := h.Extractor.Extract(r)
+	rec.User = cred.User
+	if !ok {
+		h.missing(w, rec)
+		return
+	}
+
+	// An expired token, and a credential without a user such as a revoked
+	// API key, is not revalidated by its ETag.
+	set_max_age(w, h.NegCacheSeconds)
+	if cred.User != "" && !jwt.Expired(cred.Claims) &&
+		h.check_etag(w, r, rec, h.makeEtag(cred, rpath)) {
+		return
+	}
+
+	ok_auth, reason := h.authenticate(cred, clientIP)
+	if !ok_auth {
+		h.finish(rec, metrics.OutcomeUnauth, reason)
+		h.challenge(w, h.Extractor.Scheme())
+		return
+	}
+
+	// The backends log their errors, and an error denies with backend_error.
+	req := &pipeline.Request{
+		User:     cred.User,
+		Claims:   cred.Claims,
+		Path:     rpath,
+		ClientIP: clientIP,
+		Record:   rec,
+		Groups:   h.Groups,
+	}
+	ok_authz, reason, _ := h.Authorizer.Authorize(req)
+	if h.Authorizer.NeedsPath() {
+		var pathid string
+		if rec.PathId != nil {
+			pathid = *rec.PathId
+		}
+		log_pathid_authz(pathid, cred.User, clientIP, ok_authz)
+	}
+	if !ok_authz {
+		h.finish(rec, metrics.OutcomeForbidden, reason)
+		h.Response.Forbidden.Error(w)
+		return
+	}
+
+	set_max_age(w, h.CacheSeconds)
+	if h.Assertion != nil {
+		// The groups are looked up again only if the authorizer did not.
+		m, _ := req.Membership()
+		h.assert(w, rec, h.method(cred), false, m)
+	}
+	h.finish(rec, metrics.OutcomeOk, audit.ReasonGranted)
+	h.Response.Ok.Error(w)
+}
@@ -0,0 +1,283 @@
+// Package profile has the request handlers of the authentication modules.
+package profile
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"ngx_auth/assertion"
+	"ngx_auth/audit"
+	"ngx_auth/authz"
+	"ngx_auth/etag"
+	"ngx_auth/htstat"
+	"ngx_auth/logger"
+	"ngx_auth/metrics"
+	"ngx_auth/oidc"
+	"ngx_auth/pipeline"
+	"ngx_auth/session"
+	"ngx_auth/totp"
+)
+
+// Module types of the profiles.
+const (
+	TypeSimple        = "simple"
+	TypeLdap          = "ldap"
+	TypeLdapPath      = "ldap_path"
+	TypeHeaderPath    = "header_path"
+	TypeLdapPath2Ldap = "ldap_path2ldap"
+	TypePipeline      = "pipeline"
+	TypeOidc          = "oidc"
+	TypeClientCert    = "client_cert"
+)
+
+const DefaultPathHeader = "X-Authz-Path"
+const DefaultUserHeader = "X-Forwarded-User"
+
+// Headers of the original URL and of the login URL of a 401 answer.
+const OriginalUriHeader = "X-Original-URI"
+const LoginRedirectHeader = "X-Auth-Redirect"
+
+// OriginalMethodHeader is the request header of the method of the original
+// request, which the Digest response is computed with.
+const OriginalMethodHeader = "X-Original-Method"
+
+func IsValidType(t string) bool {
+	switch t {
+	case TypeSimple, TypeLdap, TypeLdapPath, TypeHeaderPath, TypeLdapPath2Ldap,
+		TypePipeline, TypeOidc, TypeClientCert:
+		return true
+	}
+	return false
+}
+
+// Common is the settings shared by all module types.
+type Common struct {
+	// Name is the profile name recorded in the audit log and the metrics.
+	// It is empty in the single module programs.
+	Name            string
+	CacheSeconds    uint32
+	NegCacheSeconds uint32
+	UseEtag         bool
+	AuthRealm       string
+	Response        htstat.HttpStatusTbl
+	StartTimeMS     int64
+	// Sessions issues the session cookies skipping the authentication
+	// backend. It is nil if the sessions are disabled.
+	Sessions *session.Manager
+	// Totp verifies the second factor of the paths requiring it, and of
+	// the login form. It is nil without the [totp] part.
+	Totp *totp.Verifier
+	// LoginUrl is the login form sent in LoginRedirectHeader instead of
+	// asking for Basic credentials, if not empty.
+	LoginUrl string
+	// Assertion signs the identity of the authorized requests for the
+	// upstream applications. It is nil without the [assertion] part.
+	Assertion *assertion.Issuer
+}
+
+func (c *Common) init() {
+	if c.StartTimeMS == 0 {
+		c.StartTimeMS = time.Now().UnixMicro()
+	}
+}
+
+// Identity is the user of a request allowed by a handler, and the path ID
+// of the authorization if any.
+type Identity struct {
+	User   string
+	PathId string
+}
+
+type identity_key struct{}
+
+// WithIdentity returns ctx with an Identity, which the handler serving a
+// request of the context fills if the request is allowed.
+func WithIdentity(ctx context.Context) (context.Context, *Identity) {
+	id := &Identity{}
+	return context.WithValue(ctx, identity_key{}, id), id
+}
+
+// begin sets the default response headers and starts the audit record.
+func (c *Common) begin(w http.ResponseWriter, r *http.Request) (*audit.Record, string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	// Extract client IP, accounting for proxies (X-Forwarded-For, X-Real-IP)
+	clientIP := logger.ExtractClientIP(r)
+	rec := audit.Begin(clientIP)
+	rec.Profile = c.Name
+
+	if id, ok := r.Context().Value(identity_key{}).(*Identity); ok {
+		rec.OnFinish(func(rec *audit.Record) {
+			if rec.Decision != audit.Allow {
+				return
+			}
+			id.User = rec.User
+			if rec.PathId != nil {
+				id.PathId = *rec.PathId
+			}
+		})
+	}
+
+	return rec, clientIP
+}
+
+func (c *Common) finish(rec *audit.Record, outcome string, reason string) {
+	metrics.Requests.Inc(c.Name, outcome)
+	rec.Finish(outcome, reason)
+}
+
+// granted is the reason of an allowed request, marking a decision of the
+// LDAP offline cache.
+func granted(offline bool) string {
+	if offline {
+		return audit.ReasonOfflineCache
+	}
+	return audit.ReasonGranted
+}
+
+// assert sets the identity assertion of an authorized request, with the
+// groups of m if not nil.
+func (c *Common) assert(w http.ResponseWriter, rec *audit.Record,
+	method string, mfa bool, m authz.Membership) {
+	if c.Assertion == nil {
+		return
+	}
+	id := &assertion.Identity{
+		User:    rec.User,
+		Method:  method,
+		Mfa:     mfa,
+		Profile: c.Name,
+	}
+	if m != nil {
+		id.Groups = m.Groups(rec.User)
+	}
+	if rec.PathId != nil {
+		id.PathId = *rec.PathId
+	}
+	c.Assertion.Set(w, id)
+}
+
+// session_member is the groups kept in a session, or nil without them.
+func session_member(s *session.Session) authz.Membership {
+	if s.Groups == nil {
+		return nil
+	}
+	return authz.NewGroupSet(s.User, s.Groups)
+}
+
+// not_auth answers 401 asking for Basic credentials, or with the login URL.
+func (c *Common) not_auth(w http.ResponseWriter, r *http.Request) {
+	if c.LoginUrl != "" {
+		w.Header().Set(LoginRedirectHeader, login_redirect(c.LoginUrl, r.Header.Get(OriginalUriHeader)))
+		c.Response.Unauth.Error(w)
+		return
+	}
+	c.challenge(w, "Basic")
+}
+
+// login_redirect returns the login URL returning to rd.
+func login_redirect(login_url string, rd string) string {
+	sep := "?"
+	if strings.Contains(login_url, "?") {
+		sep = "&"
+	}
+	return login_url + sep + "rd=" + url.QueryEscape(oidc.SafeReturn(rd))
+}
+
+// challenge answers 401 asking for the credentials of scheme.
+func (c *Common) challenge(w http.ResponseWriter, scheme string) {
+	realm := strings.Replace(c.AuthRealm, `"`, `\"`, -1)
+	w.Header().Add("WWW-Authenticate", scheme+` realm="`+realm+`"`)
+	c.Response.Unauth.Error(w)
+}
+
+func set_max_age(w http.ResponseWriter, sec uint32) {
+	if sec > 0 {
+		w.Header().Set("Cache-Control",
+			fmt.Sprintf("max-age=%d, must-revalidate", sec))
+	}
+}
+
+// check_etag sets the Etag header, and answers 304 if the request has the
+// same tag. It returns true if the request is answered.
+func (c *Common) check_etag(w http.ResponseWriter, r *http.Request,
+	rec *audit.Record, tag string) bool {
+	w.Header().Set("Etag", tag)
+	if !c.UseEtag {
+		return false
+	}
+
+	if !isModified(r.Header, tag) {
+		metrics.EtagChecks.Inc("hit")
+		rec.Cache = audit.CacheHit
+		c.finish(rec, metrics.OutcomeNotModified, audit.ReasonEtagMatch)
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	metrics.EtagChecks.Inc("miss")
+	rec.Cache = audit.CacheMiss
+	return false
+}
+
+func set_int64bin(bin []byte, v int64) {
+	binary.LittleEndian.PutUint64(bin, uint64(v))
+}
+
+func time_bin(ms int64) []byte {
+	tm := make([]byte, 8)
+	set_int64bin(tm, ms)
+	return tm
+}
+
+func path_tag(re *regexp.Regexp, rpath string) []byte {
+	pathid, ok := pipeline.CheckPath(re, rpath)
+	if !ok {
+		return []byte("N")
+	}
+	return []byte("M" + pathid)
+}
+
+func isModified(hd http.Header, org_tag string) bool {
+	if_nmatch := hd.Get("If-None-Match")
+
+	if if_nmatch != "" {
+		return !isEtagMatch(if_nmatch, org_tag)
+	}
+
+	return true
+}
+
+func isEtagMatch(tag_str string, org_tag string) bool {
+	tags, _ := etag.Split(tag_str)
+	for _, tag := range tags {
+		if tag == org_tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func log_path_authz(re *regexp.Regexp, rpath string, user string, clientIP string, ok bool) {
+	pathid, _ := pipeline.CheckPath(re, rpath)
+	log_pathid_authz(pathid, user, clientIP, ok)
+}
+
+func log_pathid_authz(pathid string, user string, clientIP string, ok bool) {
+	if !ok {
+		logger.Event(logger.LevelWarn, logger.EventPathAuthzDenied,
+			logger.User(user), logger.ClientIP(clientIP),
+			logger.PathId(pathid), logger.Outcome(metrics.OutcomeForbidden))
+		return
+	}
+	logger.Event(logger.LevelDebug, logger.EventPathAuthzGranted,
+		logger.User(user), logger.ClientIP(clientIP),
+		logger.PathId(pathid), logger.Outcome(metrics.OutcomeOk))
+}
@@ -0,0 +1,120 @@
+package profile
+
+import (
+	"regexp"
+	"sort"
+
+	"ngx_auth/audit"
+	"ngx_auth/authz"
+	"ngx_auth/pipeline"
+)
+
+// PathRights is the [authz] settings of the modules authorizing with a user map.
+type PathRights struct {
+	PathPatternReg *regexp.Regexp
+	UserMap        *authz.UserMap
+	NomatchRight   string
+	DefaultRight   string
+	PathRight      map[string]string
+	// NomatchMfa, DefaultMfa and PathMfa require the second factor for
+	// the paths like the rights.
+	NomatchMfa bool
+	DefaultMfa bool
+	PathMfa    map[string]bool
+}
+
+func (pr *PathRights) get_path_right(rpath string, user string, rec *audit.Record) (bool, string) {
+	pathid, ok := pipeline.CheckPath(pr.PathPatternReg, rpath)
+	if !ok {
+		rec.SetRight(pr.NomatchRight)
+		return pr.UserMap.Authz(pr.NomatchRight, user), audit.ReasonNomatchRight
+	}
+	rec.SetPathId(pathid)
+
+	right_type, has := pr.PathRight[pathid]
+	if !has {
+		rec.SetRight(pr.DefaultRight)
+		return pr.UserMap.Authz(pr.DefaultRight, user), audit.ReasonDefaultRight
+	}
+
+	rec.SetRight(right_type)
+	return pr.UserMap.Authz(right_type, user), audit.ReasonPathRight
+}
+
+// needs_mfa reports whether the path requires the second factor.
+func (pr *PathRights) needs_mfa(rpath string) bool {
+	pathid, ok := pipeline.CheckPath(pr.PathPatternReg, rpath)
+	if !ok {
+		return pr.NomatchMfa
+	}
+	if mfa, has := pr.PathMfa[pathid]; has {
+		return mfa
+	}
+	return pr.DefaultMfa
+}
+
+// UsesMfa reports whether any path requires the second factor.
+func (pr *PathRights) UsesMfa() bool {
+	if pr.NomatchMfa || pr.DefaultMfa {
+		return true
+	}
+	for _, mfa := range pr.PathMfa {
+		if mfa {
+			return true
+		}
+	}
+	return false
+}
+
+// PathFilters is the [authz] settings of the modules authorizing with LDAP filters.
+type PathFilters struct {
+	PathPatternReg *regexp.Regexp
+	BanNomatch     bool
+	NomatchFilter  string
+	BanDefault     bool
+	DefaultFilter  string
+	PathFilter     map[string]string
+}
+
+func (pf *PathFilters) get_path_filter(rpath string, rec *audit.Record) (bool, string, string) {
+	pathid, ok := pipeline.CheckPath(pf.PathPatternReg, rpath)
+	if !ok {
+		if pf.BanNomatch {
+			return false, "", audit.ReasonBanNomatch
+		}
+		rec.SetFilter(pf.NomatchFilter)
+		return true, pf.NomatchFilter, audit.ReasonAuthzFilter
+	}
+	rec.SetPathId(pathid)
+
+	filter, has := pf.PathFilter[pathid]
+	if has {
+		rec.SetFilter(filter)
+		return true, filter, audit.ReasonAuthzFilter
+	}
+	if pf.BanDefault {
+		return false, "", audit.ReasonBanDefault
+	}
+	rec.SetFilter(pf.DefaultFilter)
+	return true, pf.DefaultFilter, audit.ReasonAuthzFilter
+}
+
+// Filters returns the distinct filters, which may be applied to a path.
+func (pf *PathFilters) Filters() []string {
+	set := map[string]bool{}
+	if !pf.BanNomatch {
+		set[pf.NomatchFilter] = true
+	}
+	if !pf.BanDefault {
+		set[pf.DefaultFilter] = true
+	}
+	for _, flt := range pf.PathFilter {
+		set[flt] = true
+	}
+	filters := make([]string, 0, len(set))
+	for flt := range set {
+		filters = append(filters, flt)
+	}
+	sort.Strings(filters)
+	return filters
+}
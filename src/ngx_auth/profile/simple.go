@@ -0,0 +1,142 @@
+package profile
+
+import (
+	"errors"
+	"net/http"
+
+	"ngx_auth/assertion"
+	"ngx_auth/audit"
+	"ngx_auth/digest"
+	"ngx_auth/etag"
+	"ngx_auth/logger"
+	"ngx_auth/metrics"
+	"ngx_auth/session"
+)
+
+// Simple authenticates the users with the passwords in the configuration.
+type Simple struct {
+	Common
+	Password map[string]string
+	Digest   *digest.Server
+}
+
+func NewSimple(c Common, password map[string]string, dg *digest.Server) *Simple {
+	c.init()
+	return &Simple{Common: c, Password: password, Digest: dg}
+}
+
+func (h *Simple) auth(user string, pass string) bool {
+	pw, ok := h.Password[user]
+	return ok && pw == pass
+}
+
+func (h *Simple) password(user string) (string, bool) {
+	pw, ok := h.Password[user]
+	return pw, ok
+}
+
+// not_auth answers 401 with the challenges of Digest, or as Common does.
+func (h *Simple) not_auth(w http.ResponseWriter, r *http.Request, stale bool) {
+	if h.Digest == nil || h.LoginUrl != "" {
+		h.Common.not_auth(w, r)
+		return
+	}
+	h.Digest.Challenge(w.Header(), stale)
+	h.Response.Unauth.Error(w)
+}
+
+func digest_reason(err error) string {
+	switch {
+	case errors.Is(err, digest.ErrStale):
+		return audit.ReasonStaleNonce
+	case errors.Is(err, digest.ErrReplay):
+		return audit.ReasonReplay
+	}
+	return audit.ReasonBadCredentials
+}
+
+// serve_digest authenticates Digest credentials, which differ in every request, without the ETag.
+func (h *Simple) serve_digest(w http.ResponseWriter, r *http.Request,
+	rec *audit.Record, clientIP string) {
+	method := r.Header.Get(OriginalMethodHeader)
+	if method == "" {
+		method = r.Method
+	}
+	user, err := h.Digest.Verify(r.Header.Get("Authorization"), method,
+		r.Header.Get(OriginalUriHeader), h.password)
+	rec.User = user
+
+	set_max_age(w, h.NegCacheSeconds)
+	if err != nil {
+		if !errors.Is(err, digest.ErrStale) {
+			logger.Event(logger.LevelInfo, logger.EventDigestRejected,
+				logger.User(user), logger.ClientIP(clientIP), logger.Err(err))
+		}
+		h.finish(rec, metrics.OutcomeUnauth, digest_reason(err))
+		h.not_auth(w, r, errors.Is(err, digest.ErrStale))
+		return
+	}
+
+	h.Sessions.Issue(w, &session.Session{User: user, Method: assertion.MethodDigest}, h.Password[user])
+	set_max_age(w, h.CacheSeconds)
+	h.assert(w, rec, assertion.MethodDigest, false, nil)
+	h.finish(rec, metrics.OutcomeOk, audit.ReasonGranted)
+	h.Response.Ok.Error(w)
+}
+
+func (h *Simple) form_login(user string, pass string, _ string) (*session.Session, string) {
+	if !h.auth(user, pass) {
+		return nil, audit.ReasonBadCredentials
+	}
+	return &session.Session{User: user}, audit.ReasonGranted
+}
+
+func (h *Simple) makeEtag(user, pass string) string {
+	tm := time_bin(h.StartTimeMS)
+	return etag.Make(tm, etag.Crypt(tm, []byte(user)),
+		etag.Hmac([]byte(user), []byte(pass)))
+}
+
+func (h *Simple) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec, clientIP := h.begin(w, r)
+
+	if s := h.Sessions.Resume(w, r); s != nil {
+		rec.User = s.User
+		set_max_age(w, h.CacheSeconds)
+		h.assert(w, rec, s.Method, s.Mfa, session_member(s))
+		h.finish(rec, metrics.OutcomeOk, audit.ReasonSession)
+		h.Response.Ok.Error(w)
+		return
+	}
+
+	if h.Digest != nil && digest.IsDigest(r.Header.Get("Authorization")) {
+		h.serve_digest(w, r, rec, clientIP)
+		return
+	}
+
+	// Basic credentials are ignored if Basic is not offered.
+	user, pass, ok := r.BasicAuth()
+	if !ok || !h.Digest.OffersBasic() {
+		h.finish(rec, metrics.OutcomeUnauth, audit.ReasonNoCredentials)
+		h.not_auth(w, r, false)
+		return
+	}
+	rec.User = user
+
+	set_max_age(w, h.NegCacheSeconds)
+	if h.check_etag(w, r, rec, h.makeEtag(user, pass)) {
+		return
+	}
+
+	if !h.auth(user, pass) {
+		h.finish(rec, metrics.OutcomeUnauth, audit.ReasonBadCredentials)
+		h.not_auth(w, r, false)
+		return
+	}
+
+	h.Sessions.Issue(w, &session.Session{User: user, Method: session.MethodBasic}, pass)
+	set_max_age(w, h.CacheSeconds)
+	h.assert(w, rec, session.MethodBasic, false, nil)
+	h.finish(rec, metrics.OutcomeOk, audit.ReasonGranted)
+	h.Response.Ok.Error(w)
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package server
+
+import (
+	"errors"
+)
+
+var ErrPrivilegeDropUnsupported = errors.New("privilege drop is not supported on this platform")
+
+// DropPrivileges is not supported on platforms without setuid.
+func DropPrivileges(user_name string, group_name string) error {
+	if user_name == "" && group_name == "" {
+		return nil
+	}
+	return ErrPrivilegeDropUnsupported
+}
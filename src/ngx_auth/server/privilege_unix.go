@@ -0,0 +1,62 @@
+//go:build unix
+
+package server
+
+import (
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// DropPrivileges changes the process user and group after the sockets are bound.
+// Without a group, the primary group of the user is used.
+// It does nothing if no user and no group are given.
+func DropPrivileges(user_name string, group_name string) error {
+	if user_name == "" && group_name == "" {
+		return nil
+	}
+
+	uid, err := LookupUser(user_name)
+	if err != nil {
+		return err
+	}
+	gid, err := LookupGroup(group_name)
+	if err != nil {
+		return err
+	}
+	if gid < 0 && user_name != "" {
+		gid, err = primary_gid(user_name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return err
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return err
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func primary_gid(user_name string) (int, error) {
+	u, err := user.Lookup(user_name)
+	if err != nil {
+		if _, nerr := strconv.Atoi(user_name); nerr == nil {
+			u, err = user.LookupId(user_name)
+		}
+		if err != nil {
+			return -1, err
+		}
+	}
+	return strconv.Atoi(u.Gid)
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/l4go/task"
+
+	logger "ngx_auth/logger"
+)
+
+const DefaultDrainSeconds = 10
+
+var ErrUnsupportedSocketType = errors.New("unsupported socket type.")
+
+var (
+	ownedMu sync.Mutex
+	owned   = map[net.Listener]bool{}
+)
+
+// Listen returns the listener of the socket. A listener passed by systemd
+// socket activation is used if it has the name or listens on the address.
+// A stale UNIX domain socket file is removed before listening.
+func Listen(cc task.Canceller, name string, stype string, spath string) (net.Listener, error) {
+	switch stype {
+	default:
+		return nil, ErrUnsupportedSocketType
+	case "unix":
+	case "tcp":
+	}
+
+	if lstn := take_inherited(name, stype, spath); lstn != nil {
+		return lstn, nil
+	}
+
+	if stype == "unix" {
+		if err := RemoveStaleSocket(spath); err != nil {
+			return nil, err
+		}
+	}
+
+	lcnf := &net.ListenConfig{}
+	lstn, err := lcnf.Listen(cc.AsContext(), stype, spath)
+	if err != nil {
+		return nil, err
+	}
+
+	ownedMu.Lock()
+	owned[lstn] = true
+	ownedMu.Unlock()
+
+	return lstn, nil
+}
+
+// IsInherited reports whether the listener was passed by systemd.
+// The socket file of an inherited unix listener belongs to systemd,
+// and must be neither changed nor removed.
+func IsInherited(lstn net.Listener) bool {
+	ownedMu.Lock()
+	defer ownedMu.Unlock()
+	return !owned[lstn]
+}
+
+// DrainTimeout converts drain_seconds, using the default for 0.
+func DrainTimeout(sec uint32) time.Duration {
+	if sec == 0 {
+		sec = DefaultDrainSeconds
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// Serve serves srv on lstn until cc is cancelled. Then it stops accepting,
+// and waits up to drain for in-flight requests before closing them.
+func Serve(cc task.Canceller, srv *http.Server, lstn net.Listener, drain time.Duration) error {
+	serr_chan := make(chan error, 1)
+	go func() {
+		serr_chan <- srv.Serve(lstn)
+	}()
+
+	select {
+	case serr := <-serr_chan:
+		if serr == http.ErrServerClosed {
+			return nil
+		}
+		return serr
+	case <-cc.RecvCancel():
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Event(logger.LevelWarn, logger.EventServerDrainTimeout,
+			logger.SocketPath(lstn.Addr().String()), logger.Err(err))
+		srv.Close()
+	}
+	<-serr_chan
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/l4go/task"
+)
+
+func TestServeDrain(t *testing.T) {
+	cc := task.NewCancel()
+	lstn, err := Listen(cc, NameAuth, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsInherited(lstn) {
+		t.Errorf("IsInherited() = true, want false for a new listener")
+	}
+
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, "done")
+	})}
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(cc, srv, lstn, 5*time.Second)
+	}()
+
+	body := make(chan string, 1)
+	go func() {
+		res, err := http.Get("http://" + lstn.Addr().String() + "/")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		bin, _ := io.ReadAll(res.Body)
+		body <- string(bin)
+	}()
+	<-started
+	cc.Cancel()
+
+	if got := <-body; got != "done" {
+		t.Errorf("in-flight request = %q, want %q", got, "done")
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve() error = %v", err)
+	}
+	if _, err := http.Get("http://" + lstn.Addr().String() + "/"); err == nil {
+		t.Errorf("Get() after Serve() error = nil, want the listener closed")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	if got := DrainTimeout(0); got != DefaultDrainSeconds*time.Second {
+		t.Errorf("DrainTimeout(0) = %v, want %v", got, DefaultDrainSeconds*time.Second)
+	}
+	if got := DrainTimeout(3); got != 3*time.Second {
+		t.Errorf("DrainTimeout(3) = %v, want 3s", got)
+	}
+}
+
+func TestListenBadType(t *testing.T) {
+	if _, err := Listen(task.NewCancel(), NameAuth, "udp", "127.0.0.1:0"); err != ErrUnsupportedSocketType {
+		t.Errorf("Listen() error = %v, want %v", err, ErrUnsupportedSocketType)
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const DefaultSocketMode = 0777
+
+var (
+	ErrBadSocketMode = errors.New("bad socket mode")
+	ErrNotSocket     = errors.New("not a socket file")
+	ErrSocketInUse   = errors.New("socket is in use by another process")
+)
+
+// SocketOwnership is the permission and the owner of a UNIX domain socket file.
+type SocketOwnership struct {
+	Mode  string
+	Owner string
+	Group string
+}
+
+// FileMode parses Mode as an octal permission such as "0660".
+func (so *SocketOwnership) FileMode() (os.FileMode, error) {
+	if so.Mode == "" {
+		return DefaultSocketMode, nil
+	}
+
+	mode, err := strconv.ParseUint(so.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, ErrBadSocketMode
+	}
+	return os.FileMode(mode), nil
+}
+
+// Apply changes the permission and the owner of the socket file.
+func (so *SocketOwnership) Apply(path string) error {
+	mode, err := so.FileMode()
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+
+	if so.Owner == "" && so.Group == "" {
+		return nil
+	}
+	uid, err := LookupUser(so.Owner)
+	if err != nil {
+		return err
+	}
+	gid, err := LookupGroup(so.Group)
+	if err != nil {
+		return err
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// LookupUser returns the uid of a user name or a numeric uid.
+// An empty name returns -1, which means no change for os.Chown.
+func LookupUser(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// LookupGroup returns the gid of a group name or a numeric gid.
+// An empty name returns -1, which means no change for os.Chown.
+func LookupGroup(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// RemoveStaleSocket removes a socket file left by a process that has exited.
+// It keeps the file, and returns an error, if it is not a socket or
+// another process still accepts connections on it.
+func RemoveStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return &os.PathError{Op: "listen", Path: path, Err: ErrNotSocket}
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return &os.PathError{Op: "listen", Path: path, Err: ErrSocketInUse}
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/l4go/task"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	stale := filepath.Join(dir, "stale.sock")
+	lstn := listen(t, "unix", stale)
+	lstn.(*net.UnixListener).SetUnlinkOnClose(false)
+	lstn.Close()
+
+	live := filepath.Join(dir, "live.sock")
+	defer listen(t, "unix", live).Close()
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		err  error
+		kept bool
+	}{
+		{"stale socket", stale, nil, false},
+		{"no file", filepath.Join(dir, "none.sock"), nil, false},
+		{"live socket", live, ErrSocketInUse, true},
+		{"not a socket", file, ErrNotSocket, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RemoveStaleSocket(tt.path)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("RemoveStaleSocket() error = %v, want %v", err, tt.err)
+			}
+			if _, err := os.Lstat(tt.path); (err == nil) != tt.kept {
+				t.Errorf("RemoveStaleSocket() kept the file %v, want %v", err == nil, tt.kept)
+			}
+		})
+	}
+}
+
+func TestListenStaleSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "auth.sock")
+	old := listen(t, "unix", sock)
+	old.(*net.UnixListener).SetUnlinkOnClose(false)
+	old.Close()
+
+	cc := task.NewCancel()
+	defer cc.Cancel()
+	lstn, err := Listen(cc, NameAuth, "unix", sock)
+	if err != nil {
+		t.Fatalf("Listen() on a stale socket error = %v", err)
+	}
+	defer lstn.Close()
+	if IsInherited(lstn) {
+		t.Errorf("IsInherited() = true, want false")
+	}
+
+	if _, err := Listen(cc, NameAuth, "unix", sock); !errors.Is(err, ErrSocketInUse) {
+		t.Errorf("Listen() on a live socket error = %v, want %v", err, ErrSocketInUse)
+	}
+}
+
+func TestSocketFileMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		want os.FileMode
+		err  error
+	}{
+		{"", DefaultSocketMode, nil},
+		{"0660", 0660, nil},
+		{"600", 0600, nil},
+		{"0800", 0, ErrBadSocketMode},
+		{"1777", 0, ErrBadSocketMode},
+		{"rw", 0, ErrBadSocketMode},
+	}
+	for _, tt := range tests {
+		mode, err := (&SocketOwnership{Mode: tt.mode}).FileMode()
+		if mode != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("FileMode(%q) = %v, %v, want %v, %v", tt.mode, mode, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "auth.sock")
+	defer listen(t, "unix", sock).Close()
+
+	uid := strconv.Itoa(os.Getuid())
+	gid := strconv.Itoa(os.Getgid())
+	tests := []struct {
+		name string
+		so   SocketOwnership
+		mode os.FileMode
+		ok   bool
+	}{
+		{"mode", SocketOwnership{Mode: "0660"}, 0660, true},
+		{"numeric owner", SocketOwnership{Mode: "0600", Owner: uid, Group: gid}, 0600, true},
+		{"bad mode", SocketOwnership{Mode: "0999"}, 0600, false},
+		{"unknown owner", SocketOwnership{Mode: "0640", Owner: "ngx-auth-no-such-user"}, 0640, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.so.Apply(sock)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Apply() error = %v, want ok %v", err, tt.ok)
+			}
+			if st, err := os.Stat(sock); err != nil || st.Mode().Perm() != tt.mode {
+				t.Errorf("Apply() mode = %v, %v, want %v", st.Mode().Perm(), err, tt.mode)
+			}
+		})
+	}
+}
+
+func TestLookupUser(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+
+	tests := []struct {
+		name string
+		want int
+		ok   bool
+	}{
+		{"", -1, true},
+		{"1234", 1234, true},
+		{u.Username, uid, true},
+		{"ngx-auth-no-such-user", -1, false},
+	}
+	for _, tt := range tests {
+		id, err := LookupUser(tt.name)
+		if id != tt.want || (err == nil) != tt.ok {
+			t.Errorf("LookupUser(%q) = %d, %v, want %d, ok %v", tt.name, id, err, tt.want, tt.ok)
+		}
+	}
+	if id, err := LookupGroup(""); id != -1 || err != nil {
+		t.Errorf("LookupGroup(\"\") = %d, %v, want -1, nil", id, err)
+	}
+	if id, err := LookupGroup("4321"); id != 4321 || err != nil {
+		t.Errorf("LookupGroup(\"4321\") = %d, %v, want 4321, nil", id, err)
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/l4go/task"
+)
+
+// The file descriptor names for systemd socket units (FileDescriptorName=).
+const (
+	NameAuth  = "auth"
+	NameAdmin = "admin"
+)
+
+const listenFdsStart = 3
+
+type inherited struct {
+	name string
+	lstn net.Listener
+	used bool
+}
+
+var (
+	inheritOnce sync.Once
+	inheritMu   sync.Mutex
+	inheritList []*inherited
+)
+
+// load_inherited reads the listeners passed by systemd socket activation
+// (LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES), only once.
+// The variables are cleared, so child processes do not take them.
+func load_inherited() {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < nfds; i++ {
+		fd := listenFdsStart + i
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		lstn, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		inheritList = append(inheritList, &inherited{name: name, lstn: lstn})
+	}
+}
+
+// take_inherited returns the inherited listener for the name, or the
+// one listening on the address. A single unnamed listener is taken
+// for the auth socket.
+func take_inherited(name string, stype string, spath string) net.Listener {
+	inheritOnce.Do(load_inherited)
+
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+
+	take := func(ih *inherited) net.Listener {
+		ih.used = true
+		return ih.lstn
+	}
+
+	for _, ih := range inheritList {
+		if !ih.used && ih.name == name {
+			return take(ih)
+		}
+	}
+	for _, ih := range inheritList {
+		if !ih.used && is_same_addr(ih.lstn.Addr(), stype, spath) {
+			return take(ih)
+		}
+	}
+	if name == NameAuth && len(inheritList) == 1 && !inheritList[0].used {
+		return take(inheritList[0])
+	}
+
+	return nil
+}
+
+func is_same_addr(addr net.Addr, stype string, spath string) bool {
+	switch stype {
+	case "unix":
+		return addr.Network() == "unix" && addr.String() == spath
+	case "tcp":
+		taddr, ok := addr.(*net.TCPAddr)
+		if !ok {
+			return false
+		}
+		caddr, err := net.ResolveTCPAddr("tcp", spath)
+		if err != nil || caddr.Port != taddr.Port {
+			return false
+		}
+		if caddr.IP == nil || caddr.IP.IsUnspecified() {
+			return taddr.IP.IsUnspecified()
+		}
+		return caddr.IP.Equal(taddr.IP)
+	}
+	return false
+}
+
+// Notify sends a state such as "READY=1" to the systemd service manager.
+// It does nothing without NOTIFY_SOCKET.
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Ready notifies systemd that the service is ready, and sends the
+// watchdog keep-alive until cc is cancelled if WatchdogSec= is set.
+func Ready(cc task.Canceller) {
+	Notify("READY=1")
+
+	interval := watchdog_interval()
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cc.RecvCancel():
+				return
+			case <-ticker.C:
+			}
+			Notify("WATCHDOG=1")
+		}
+	}()
+}
+
+// Stopping notifies systemd that the service is shutting down.
+func Stopping() {
+	Notify("STOPPING=1")
+}
+
+// watchdog_interval returns half of WATCHDOG_USEC, as sd_watchdog_enabled(3) recommends.
+func watchdog_interval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/l4go/task"
+)
+
+// inherit replaces the inherited listeners, as if systemd passed them.
+func inherit(t *testing.T, list ...*inherited) {
+	inheritOnce.Do(func() {})
+	inheritMu.Lock()
+	old := inheritList
+	inheritList = list
+	inheritMu.Unlock()
+	t.Cleanup(func() {
+		inheritMu.Lock()
+		inheritList = old
+		inheritMu.Unlock()
+		for _, ih := range list {
+			ih.lstn.Close()
+		}
+	})
+}
+
+func listen(t *testing.T, stype string, spath string) net.Listener {
+	t.Helper()
+	lstn, err := net.Listen(stype, spath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lstn
+}
+
+func TestTakeInherited(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "auth.sock")
+	unix_lstn := listen(t, "unix", sock)
+	tcp_lstn := listen(t, "tcp", "127.0.0.1:0")
+	admin_lstn := listen(t, "tcp", "127.0.0.1:0")
+	inherit(t, &inherited{lstn: unix_lstn}, &inherited{lstn: tcp_lstn}, &inherited{name: NameAdmin, lstn: admin_lstn})
+
+	steps := []struct {
+		name  string
+		lname string
+		stype string
+		spath string
+		want  net.Listener
+	}{
+		{"by name", NameAdmin, "tcp", "127.0.0.1:1", admin_lstn},
+		{"name taken", NameAdmin, "tcp", "127.0.0.1:1", nil},
+		{"by unix path", NameAuth, "unix", sock, unix_lstn},
+		{"by tcp address", "other", "tcp", tcp_lstn.Addr().String(), tcp_lstn},
+		{"address taken", "other", "tcp", tcp_lstn.Addr().String(), nil},
+		{"other address", NameAuth, "unix", sock + ".other", nil},
+	}
+	for _, st := range steps {
+		if got := take_inherited(st.lname, st.stype, st.spath); got != st.want {
+			t.Errorf("%s: take_inherited() = %v, want %v", st.name, got, st.want)
+		}
+	}
+}
+
+func TestTakeSingleInherited(t *testing.T) {
+	lstn := listen(t, "tcp", "127.0.0.1:0")
+	inherit(t, &inherited{lstn: lstn})
+
+	if got := take_inherited(NameAdmin, "tcp", "127.0.0.1:1"); got != nil {
+		t.Errorf("take_inherited() for admin = %v, want nil", got)
+	}
+	if got := take_inherited(NameAuth, "tcp", "127.0.0.1:1"); got != lstn {
+		t.Errorf("take_inherited() for auth = %v, want the single listener", got)
+	}
+}
+
+func TestIsSameAddr(t *testing.T) {
+	any_addr := &net.TCPAddr{IP: net.IPv4zero, Port: 8080}
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+	unix_addr := &net.UnixAddr{Name: "/run/auth.sock", Net: "unix"}
+
+	tests := []struct {
+		addr  net.Addr
+		stype string
+		spath string
+		want  bool
+	}{
+		{local, "tcp", "127.0.0.1:8080", true},
+		{local, "tcp", "127.0.0.1:8081", false},
+		{local, "tcp", "127.0.0.2:8080", false},
+		{local, "tcp", ":8080", false},
+		{any_addr, "tcp", ":8080", true},
+		{any_addr, "tcp", "0.0.0.0:8080", true},
+		{any_addr, "tcp", "127.0.0.1:8080", false},
+		{unix_addr, "unix", "/run/auth.sock", true},
+		{unix_addr, "unix", "/run/other.sock", false},
+		{unix_addr, "tcp", "127.0.0.1:8080", false},
+		{local, "unix", "/run/auth.sock", false},
+	}
+	for _, tt := range tests {
+		if got := is_same_addr(tt.addr, tt.stype, tt.spath); got != tt.want {
+			t.Errorf("is_same_addr(%v, %s, %s) = %v, want %v", tt.addr, tt.stype, tt.spath, got, tt.want)
+		}
+	}
+}
+
+// TestSocketActivation runs the test binary with a listener on fd 3,
+// like systemd does.
+func TestSocketActivation(t *testing.T) {
+	if os.Getenv("NGX_AUTH_TEST_ACTIVATED") != "" {
+		activated()
+		return
+	}
+
+	lstn := listen(t, "tcp", "127.0.0.1:0")
+	defer lstn.Close()
+	f, err := lstn.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSocketActivation$")
+	cmd.Env = append(os.Environ(), "NGX_AUTH_TEST_ACTIVATED=1",
+		"LISTEN_FDS=1", "LISTEN_FDNAMES="+NameAuth, "NGX_AUTH_TEST_ADDR="+lstn.Addr().String())
+	cmd.ExtraFiles = []*os.File{f}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("activated process: %v\n%s", err, out)
+	}
+
+	// The connection of the activated process waits on the same socket.
+	lstn.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := lstn.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v, want the connection of the activated process", err)
+	}
+	conn.Close()
+}
+
+// activated is the process started by TestSocketActivation.
+// systemd sets LISTEN_PID to the process it starts.
+func activated() {
+	fail := func(format string, v ...interface{}) {
+		fmt.Fprintf(os.Stderr, format+"\n", v...)
+		os.Exit(1)
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	cc := task.NewCancel()
+	defer cc.Cancel()
+	lstn, err := Listen(cc, NameAuth, "tcp", "127.0.0.1:0")
+	if err != nil {
+		fail("Listen() error = %v", err)
+	}
+	if !IsInherited(lstn) || lstn.Addr().String() != os.Getenv("NGX_AUTH_TEST_ADDR") {
+		fail("Listen() = %v, want the inherited listener", lstn.Addr())
+	}
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if os.Getenv(name) != "" {
+			fail("%s is not cleared", name)
+		}
+	}
+	conn, err := net.DialTimeout("tcp", lstn.Addr().String(), time.Second)
+	if err != nil {
+		fail("Dial() error = %v", err)
+	}
+	conn.Close()
+}
+
+func TestNoSocketActivation(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	inheritMu.Lock()
+	old := inheritList
+	inheritList = nil
+	inheritMu.Unlock()
+	defer func() { inheritList = old }()
+
+	load_inherited()
+	if len(inheritList) != 0 {
+		t.Errorf("load_inherited() of another process = %d listeners, want none", len(inheritList))
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("LISTEN_FDS is not cleared")
+	}
+}
+
+func TestNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("WATCHDOG_USEC", "100000")
+
+	cc := task.NewCancel()
+	Ready(cc)
+	buf := make([]byte, 64)
+	for _, want := range []string{"READY=1", "WATCHDOG=1"} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("notified %q, %v, want %q", buf[:n], err, want)
+		}
+	}
+	cc.Cancel()
+
+	Stopping()
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A keep-alive may be sent before the watchdog stops.
+		if string(buf[:n]) == "STOPPING=1" {
+			break
+		}
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := Notify("READY=1"); err != nil {
+		t.Errorf("Notify() without NOTIFY_SOCKET error = %v", err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		pid  string
+		usec string
+		want time.Duration
+	}{
+		{"", "2000000", time.Second},
+		{pid, "2000000", time.Second},
+		{"1", "2000000", 0},
+		{"", "", 0},
+		{"", "-1", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("WATCHDOG_PID", tt.pid)
+		t.Setenv("WATCHDOG_USEC", tt.usec)
+		if got := watchdog_interval(); got != tt.want {
+			t.Errorf("watchdog_interval(%q, %q) = %v, want %v", tt.pid, tt.usec, got, tt.want)
+		}
+	}
+}
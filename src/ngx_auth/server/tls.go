@@ -0,0 +1,207 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	logger "ngx_auth/logger"
+	"ngx_auth/metrics"
+)
+
+// CertCheckInterval is how often the certificate files are checked for changes.
+const CertCheckInterval = 10 * time.Second
+
+var (
+	ErrBadTlsVersion = errors.New("bad TLS version")
+	ErrNoCertificate = errors.New("no certificate found")
+	ErrClientName    = errors.New("client certificate name is not allowed")
+)
+
+// TlsConfig is the optional [tls] part of the module configuration files.
+type TlsConfig struct {
+	CertFile      string   `toml:"cert_file,omitempty" json:"cert_file,omitempty" yaml:"cert_file,omitempty"`
+	KeyFile       string   `toml:"key_file,omitempty" json:"key_file,omitempty" yaml:"key_file,omitempty"`
+	MinVersion    string   `toml:"min_version,omitempty" json:"min_version,omitempty" yaml:"min_version,omitempty"`
+	ClientCaFiles []string `toml:"client_ca_files,omitempty" json:"client_ca_files,omitempty" yaml:"client_ca_files,omitempty"`
+	ClientNames   []string `toml:"client_names,omitempty" json:"client_names,omitempty" yaml:"client_names,omitempty"`
+}
+
+func (cfg *TlsConfig) IsEnabled() bool {
+	return cfg.CertFile != ""
+}
+
+// TlsVersion parses MinVersion, "1.2" or "1.3". The default is TLS 1.2.
+func (cfg *TlsConfig) TlsVersion() (uint16, error) {
+	switch cfg.MinVersion {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, ErrBadTlsVersion
+}
+
+// ClientCaPool reads the client CA files.
+func (cfg *TlsConfig) ClientCaPool() (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, fn := range cfg.ClientCaFiles {
+		ca_pem, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(ca_pem) {
+			return nil, fmt.Errorf("%s: %w", fn, ErrNoCertificate)
+		}
+	}
+	return pool, nil
+}
+
+// NewTlsConfig returns the server TLS configuration, or nil if TLS is disabled.
+// The certificate is reloaded when the files change, so a renewed
+// certificate is used without a restart.
+func NewTlsConfig(cfg *TlsConfig) (*tls.Config, error) {
+	if !cfg.IsEnabled() {
+		return nil, nil
+	}
+
+	ver, err := cfg.TlsVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &certReloader{cert_file: cfg.CertFile, key_file: cfg.KeyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+
+	tls_cfg := &tls.Config{
+		MinVersion:     ver,
+		GetCertificate: cr.GetCertificate,
+	}
+
+	if len(cfg.ClientCaFiles) > 0 {
+		pool, err := cfg.ClientCaPool()
+		if err != nil {
+			return nil, err
+		}
+		tls_cfg.ClientCAs = pool
+		tls_cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		if len(cfg.ClientNames) > 0 {
+			tls_cfg.VerifyPeerCertificate = verify_client_name(cfg.ClientNames)
+		}
+	}
+
+	return tls_cfg, nil
+}
+
+// verify_client_name allows the client certificates with one of the names
+// as the subject common name or a DNS name.
+func verify_client_name(names []string) func([][]byte, [][]*x509.Certificate) error {
+	allowed := map[string]bool{}
+	for _, n := range names {
+		allowed[n] = true
+	}
+
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			if len(chain) == 0 {
+				continue
+			}
+			leaf := chain[0]
+			if allowed[leaf.Subject.CommonName] {
+				return nil
+			}
+			for _, dns := range leaf.DNSNames {
+				if allowed[dns] {
+					return nil
+				}
+			}
+		}
+		return ErrClientName
+	}
+}
+
+type certReloader struct {
+	cert_file string
+	key_file  string
+
+	mu         sync.Mutex
+	cert       *tls.Certificate
+	cert_mtime time.Time
+	key_mtime  time.Time
+	checked    time.Time
+}
+
+func file_mtime(fn string) (time.Time, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+func (cr *certReloader) load() error {
+	cert_mtime, err := file_mtime(cr.cert_file)
+	if err != nil {
+		return err
+	}
+	key_mtime, err := file_mtime(cr.key_file)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.cert_file, cr.key_file)
+	if err != nil {
+		return err
+	}
+
+	cr.cert = &cert
+	cr.cert_mtime = cert_mtime
+	cr.key_mtime = key_mtime
+	cr.checked = time.Now()
+	return nil
+}
+
+// is_changed reports whether the files are modified after the last load.
+func (cr *certReloader) is_changed() bool {
+	cert_mtime, err := file_mtime(cr.cert_file)
+	if err != nil {
+		return false
+	}
+	key_mtime, err := file_mtime(cr.key_file)
+	if err != nil {
+		return false
+	}
+	return !cert_mtime.Equal(cr.cert_mtime) || !key_mtime.Equal(cr.key_mtime)
+}
+
+func (cr *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if time.Since(cr.checked) < CertCheckInterval {
+		return cr.cert, nil
+	}
+	cr.checked = time.Now()
+	if !cr.is_changed() {
+		return cr.cert, nil
+	}
+
+	// Keep the current certificate if the new one cannot be loaded,
+	// such as while the files are half written.
+	if err := cr.load(); err != nil {
+		metrics.ConfigReloads.Inc("tls_cert", "error")
+		logger.Event(logger.LevelError, logger.EventTlsCertReloadError,
+			logger.File(cr.cert_file), logger.Err(err))
+		return cr.cert, nil
+	}
+
+	metrics.ConfigReloads.Inc("tls_cert", "ok")
+	logger.Event(logger.LevelNotice, logger.EventTlsCertReloaded, logger.File(cr.cert_file))
+	return cr.cert, nil
+}
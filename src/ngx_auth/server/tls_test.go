@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCa is a certificate authority issuing the server and client certificates.
+type testCa struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func make_ca(t *testing.T, cn string) *testCa {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCa{cert: cert, key: key}
+}
+
+// issue returns the PEM of a certificate of cn and its key.
+func (ca *testCa) issue(t *testing.T, cn string, dns []string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dns,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if usage == x509.ExtKeyUsageServerAuth {
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der})
+}
+
+// client returns a client certificate of cn.
+func (ca *testCa) client(t *testing.T, cn string, dns ...string) *tls.Certificate {
+	t.Helper()
+	cert_pem, key_pem := ca.issue(t, cn, dns, x509.ExtKeyUsageClientAuth)
+	cert, err := tls.X509KeyPair(cert_pem, key_pem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cert
+}
+
+func write_file(t *testing.T, dir string, name string, bin []byte) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, bin, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestNewTlsConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := make_ca(t, "Test CA")
+	cert_pem, key_pem := ca.issue(t, "auth.example.com", nil, x509.ExtKeyUsageServerAuth)
+	cert_file := write_file(t, dir, "cert.pem", cert_pem)
+	key_file := write_file(t, dir, "key.pem", key_pem)
+	ca_file := write_file(t, dir, "ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+	empty_file := write_file(t, dir, "empty.pem", []byte("no certificate\n"))
+
+	tests := []struct {
+		name    string
+		cfg     TlsConfig
+		err     error
+		ok      bool
+		version uint16
+		auth    tls.ClientAuthType
+	}{
+		{"disabled", TlsConfig{}, nil, true, 0, tls.NoClientCert},
+		{"server", TlsConfig{CertFile: cert_file, KeyFile: key_file}, nil, true, tls.VersionTLS12, tls.NoClientCert},
+		{"client CA", TlsConfig{CertFile: cert_file, KeyFile: key_file, MinVersion: "1.3", ClientCaFiles: []string{ca_file}},
+			nil, true, tls.VersionTLS13, tls.RequireAndVerifyClientCert},
+		{"bad version", TlsConfig{CertFile: cert_file, KeyFile: key_file, MinVersion: "1.1"}, ErrBadTlsVersion, false, 0, 0},
+		{"no key", TlsConfig{CertFile: cert_file, KeyFile: filepath.Join(dir, "none.pem")}, nil, false, 0, 0},
+		{"key of another certificate", TlsConfig{CertFile: cert_file, KeyFile: ca_file}, nil, false, 0, 0},
+		{"client CA without certificate", TlsConfig{CertFile: cert_file, KeyFile: key_file, ClientCaFiles: []string{empty_file}},
+			ErrNoCertificate, false, 0, 0},
+		{"no client CA", TlsConfig{CertFile: cert_file, KeyFile: key_file, ClientCaFiles: []string{filepath.Join(dir, "none.pem")}},
+			nil, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tls_cfg, err := NewTlsConfig(&tt.cfg)
+			if (err == nil) != tt.ok || tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("NewTlsConfig() error = %v, want ok %v, %v", err, tt.ok, tt.err)
+			}
+			if err != nil || !tt.cfg.IsEnabled() {
+				if tls_cfg != nil {
+					t.Errorf("NewTlsConfig() = %v, want nil", tls_cfg)
+				}
+				return
+			}
+			if tls_cfg.MinVersion != tt.version || tls_cfg.ClientAuth != tt.auth {
+				t.Errorf("NewTlsConfig() version %x, client auth %v, want %x, %v",
+					tls_cfg.MinVersion, tls_cfg.ClientAuth, tt.version, tt.auth)
+			}
+		})
+	}
+}
+
+// handshake connects with the client certificate, and returns the error of
+// the server side.
+func handshake(t *testing.T, server *tls.Config, roots *x509.CertPool, cert *tls.Certificate) error {
+	t.Helper()
+	lstn, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	go func() {
+		client := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+		if cert != nil {
+			client.Certificates = []tls.Certificate{*cert}
+		}
+		conn, err := tls.Dial("tcp", lstn.Addr().String(), client)
+		if err != nil {
+			return
+		}
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}()
+
+	conn, err := lstn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn.(*tls.Conn).Handshake()
+}
+
+func TestClientNames(t *testing.T) {
+	dir := t.TempDir()
+	ca := make_ca(t, "Test CA")
+	other := make_ca(t, "Other CA")
+	cert_pem, key_pem := ca.issue(t, "auth.example.com", nil, x509.ExtKeyUsageServerAuth)
+	tls_cfg, err := NewTlsConfig(&TlsConfig{
+		CertFile:      write_file(t, dir, "cert.pem", cert_pem),
+		KeyFile:       write_file(t, dir, "key.pem", key_pem),
+		ClientCaFiles: []string{write_file(t, dir, "ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))},
+		ClientNames:   []string{"nginx", "proxy.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		name string
+		cert *tls.Certificate
+		err  error
+		ok   bool
+	}{
+		{"common name", ca.client(t, "nginx"), nil, true},
+		{"DNS name", ca.client(t, "proxy", "proxy.example.com"), nil, true},
+		{"other name", ca.client(t, "other", "other.example.com"), ErrClientName, false},
+		{"other CA", other.client(t, "nginx"), nil, false},
+		{"no certificate", nil, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := handshake(t, tls_cfg, roots, tt.cert)
+			if (err == nil) != tt.ok || tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("Handshake() error = %v, want ok %v, %v", err, tt.ok, tt.err)
+			}
+		})
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := make_ca(t, "Test CA")
+	cert_pem, key_pem := ca.issue(t, "auth.example.com", nil, x509.ExtKeyUsageServerAuth)
+	cr := &certReloader{
+		cert_file: write_file(t, dir, "cert.pem", cert_pem),
+		key_file:  write_file(t, dir, "key.pem", key_pem),
+	}
+	if err := cr.load(); err != nil {
+		t.Fatal(err)
+	}
+	first := cr.cert
+
+	// The files are checked only every CertCheckInterval, so the check
+	// time and the modification times are moved back.
+	renew := func(cert_pem []byte, key_pem []byte) {
+		write_file(t, dir, "cert.pem", cert_pem)
+		write_file(t, dir, "key.pem", key_pem)
+		mtime := time.Now().Add(time.Minute)
+		os.Chtimes(cr.cert_file, mtime, mtime)
+		os.Chtimes(cr.key_file, mtime, mtime)
+		cr.checked = time.Time{}
+	}
+
+	new_cert, new_key := ca.issue(t, "auth.example.com", nil, x509.ExtKeyUsageServerAuth)
+	steps := []struct {
+		name  string
+		setup func()
+		want  func() []byte
+	}{
+		{"not changed", func() { cr.checked = time.Time{} }, func() []byte { return first.Certificate[0] }},
+		{"changed within the interval", func() {
+			write_file(t, dir, "cert.pem", new_cert)
+			write_file(t, dir, "key.pem", new_key)
+		}, func() []byte { return first.Certificate[0] }},
+		{"renewed", func() { renew(new_cert, new_key) }, func() []byte {
+			block, _ := pem.Decode(new_cert)
+			return block.Bytes
+		}},
+		{"half written", func() { renew(cert_pem, new_key) }, func() []byte {
+			block, _ := pem.Decode(new_cert)
+			return block.Bytes
+		}},
+	}
+	for _, st := range steps {
+		st.setup()
+		cert, err := cr.GetCertificate(nil)
+		if err != nil || !bytes.Equal(cert.Certificate[0], st.want()) {
+			t.Errorf("%s: GetCertificate() = %v, want the expected certificate", st.name, err)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"ngx_auth/metrics"
+)
+
+var (
+	ErrIdle       = errors.New("session is idle too long")
+	ErrGeneration = errors.New("session is of an old generation")
+	ErrRevoked    = errors.New("session is revoked")
+	ErrMismatch   = errors.New("session does not match the credentials")
+)
+
+const (
+	MethodBasic = "basic"
+	MethodForm  = "form"
+)
+
+// Config is the [session] part enabling the session cookies issued after
+// a successful login. It is disabled without a secret.
+type Config struct {
+	Secret         string `toml:",omitempty" json:"secret,omitempty" yaml:"secret,omitempty" secret:"true" expand:"true"`
+	Cookie         string `toml:",omitempty" json:"cookie,omitempty" yaml:"cookie,omitempty"`
+	CookiePath     string `toml:",omitempty" json:"cookie_path,omitempty" yaml:"cookie_path,omitempty"`
+	CookieDomain   string `toml:",omitempty" json:"cookie_domain,omitempty" yaml:"cookie_domain,omitempty"`
+	InsecureCookie bool   `toml:",omitempty" json:"insecure_cookie,omitempty" yaml:"insecure_cookie,omitempty"`
+	MaxAgeSeconds  uint32 `toml:",omitempty" json:"max_age_seconds,omitempty" yaml:"max_age_seconds,omitempty"`
+	IdleSeconds    uint32 `toml:",omitempty" json:"idle_seconds,omitempty" yaml:"idle_seconds,omitempty"`
+	Generation     uint32 `toml:",omitempty" json:"generation,omitempty" yaml:"generation,omitempty"`
+	RevokeFile     string `toml:",omitempty" json:"revoke_file,omitempty" yaml:"revoke_file,omitempty"`
+}
+
+const (
+	DefaultCookie        = "ngx_auth_session"
+	DefaultMaxAgeSeconds = 8 * 3600
+	DefaultIdleSeconds   = 30 * 60
+)
+
+func (cfg *Config) IsEnabled() bool {
+	return cfg.Secret != ""
+}
+
+func (cfg *Config) SetDefault() {
+	if !cfg.IsEnabled() {
+		return
+	}
+	if cfg.Cookie == "" {
+		cfg.Cookie = DefaultCookie
+	}
+	if cfg.MaxAgeSeconds == 0 {
+		cfg.MaxAgeSeconds = DefaultMaxAgeSeconds
+	}
+	if cfg.IdleSeconds == 0 {
+		cfg.IdleSeconds = DefaultIdleSeconds
+	}
+}
+
+// Manager issues and resumes the sessions of one configuration.
+// The methods of a nil Manager do nothing, so a handler can call them
+// whether the sessions are enabled or not.
+type Manager struct {
+	// Profile is recorded in the sessions, and only the sessions of it
+	// are resumed.
+	Profile    string
+	Codec      *Codec
+	Cookie     CookieConfig
+	MaxAge     time.Duration
+	Idle       time.Duration
+	Generation uint32
+	Revoked    *RevokeList
+}
+
+func NewManager(cfg *Config) (*Manager, error) {
+	codec, err := NewCodec(cfg.Secret)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		Codec: codec,
+		Cookie: CookieConfig{
+			Name:     cfg.Cookie,
+			Path:     cfg.CookiePath,
+			Domain:   cfg.CookieDomain,
+			Insecure: cfg.InsecureCookie,
+		},
+		MaxAge:     time.Duration(cfg.MaxAgeSeconds) * time.Second,
+		Idle:       time.Duration(cfg.IdleSeconds) * time.Second,
+		Generation: cfg.Generation,
+	}
+	if cfg.RevokeFile != "" {
+		if m.Revoked, err = LoadRevokeList(cfg.RevokeFile); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func count(result string) {
+	metrics.Sessions.Inc(result)
+}
+
+// Fingerprint binds a session to the password of its login, so that
+// a changed password of the Basic credentials ends the session.
+func (m *Manager) Fingerprint(pass string) string {
+	hm := hmac.New(sha256.New, m.Codec.mac_key)
+	hm.Write([]byte("password\x00" + pass))
+	return base64.RawURLEncoding.EncodeToString(hm.Sum(nil)[:16])
+}
+
+// FilterKey is the short name of an authorization filter in a session.
+func FilterKey(flt string) string {
+	sum := sha256.Sum256([]byte(flt))
+	return base64.RawURLEncoding.EncodeToString(sum[:9])
+}
+
+// MaxAuthz is the number of filter results kept in a session, so that
+// the cookie stays small.
+const MaxAuthz = 32
+
+// SetAuthz records the result of the authorization filter flt.
+func (s *Session) SetAuthz(flt string, ok bool) {
+	if s.Authz == nil {
+		s.Authz = map[string]bool{}
+	}
+	key := FilterKey(flt)
+	if _, has := s.Authz[key]; !has && len(s.Authz) >= MaxAuthz {
+		return
+	}
+	s.Authz[key] = ok
+}
+
+// GetAuthz returns the recorded result of the authorization filter flt.
+func (s *Session) GetAuthz(flt string) (bool, bool) {
+	ok, has := s.Authz[FilterKey(flt)]
+	return ok, has
+}
+
+// Issue sets the cookie of a new session of user, logged in with pass.
+func (m *Manager) Issue(w http.ResponseWriter, s *Session, pass string) {
+	if m == nil {
+		return
+	}
+	now := time.Now()
+	s.Issued = now.Unix()
+	s.Seen = now.Unix()
+	s.Expires = now.Add(m.MaxAge).Unix()
+	s.Gen = m.Generation
+	s.Profile = m.Profile
+	if pass != "" {
+		s.Fp = m.Fingerprint(pass)
+	}
+	if m.set_cookie(w, s) {
+		count("issued")
+	}
+}
+
+// Update sets the cookie of a changed session, keeping its expiry.
+func (m *Manager) Update(w http.ResponseWriter, s *Session) {
+	if m == nil {
+		return
+	}
+	s.Seen = time.Now().Unix()
+	m.set_cookie(w, s)
+}
+
+func (m *Manager) set_cookie(w http.ResponseWriter, s *Session) bool {
+	sealed, err := m.Codec.Seal(s)
+	if err != nil {
+		return false
+	}
+	m.replace_cookie(w, m.Cookie.Cookie(sealed, time.Unix(s.Expires, 0)))
+	return true
+}
+
+// replace_cookie sets ck in place of an earlier one of the same name.
+// nginx passes only one Set-Cookie of the auth response to the client.
+func (m *Manager) replace_cookie(w http.ResponseWriter, ck *http.Cookie) {
+	hdr := w.Header()
+	kept := hdr["Set-Cookie"][:0]
+	for _, v := range hdr["Set-Cookie"] {
+		if !strings.HasPrefix(v, ck.Name+"=") {
+			kept = append(kept, v)
+		}
+	}
+	hdr["Set-Cookie"] = append(kept, ck.String())
+}
+
+// Clear removes the session cookie.
+func (m *Manager) Clear(w http.ResponseWriter) {
+	if m == nil {
+		return
+	}
+	m.replace_cookie(w, m.Cookie.Clear())
+}
+
+// Load opens the session cookie of the request, and checks its profile,
+// expiry, idle time, generation and the revocation list.
+func (m *Manager) Load(r *http.Request) (*Session, error) {
+	ck, err := r.Cookie(m.Cookie.Name)
+	if err != nil {
+		return nil, err
+	}
+	var s Session
+	if err := m.Codec.Open(ck.Value, &s); err != nil || s.User == "" {
+		return nil, ErrBadCookie
+	}
+
+	now := time.Now()
+	switch {
+	case s.Profile != m.Profile:
+		return nil, ErrProfile
+	case !s.Valid(now):
+		return nil, ErrExpired
+	case m.Idle > 0 && now.Sub(time.Unix(s.Seen, 0)) >= m.Idle:
+		return nil, ErrIdle
+	case s.Gen != m.Generation:
+		return nil, ErrGeneration
+	case m.Revoked.IsRevoked(s.User, time.Unix(s.Issued, 0)):
+		return nil, ErrRevoked
+	}
+	return &s, nil
+}
+
+func result_of(err error) string {
+	switch err {
+	case ErrExpired:
+		return "expired"
+	case ErrIdle:
+		return "idle"
+	case ErrGeneration:
+		return "generation"
+	case ErrRevoked:
+		return "revoked"
+	case ErrMismatch:
+		return "mismatch"
+	case ErrProfile:
+		return "profile"
+	}
+	return "invalid"
+}
+
+// Resume returns the valid session of the request, or nil. If the request
+// also has Basic credentials, they must be of the session user and of
+// the password of the login. The cookie is renewed for the idle timeout
+// when it is older than a tenth of the idle timeout, or a minute.
+func (m *Manager) Resume(w http.ResponseWriter, r *http.Request) *Session {
+	if m == nil {
+		return nil
+	}
+	s, err := m.Load(r)
+	if err == nil {
+		if user, pass, ok := r.BasicAuth(); ok &&
+			(user != s.User || (s.Fp != "" && !hmac.Equal([]byte(m.Fingerprint(pass)), []byte(s.Fp)))) {
+			err = ErrMismatch
+		}
+	}
+	if err != nil {
+		if err != http.ErrNoCookie {
+			count(result_of(err))
+			m.Clear(w)
+		}
+		return nil
+	}
+
+	refresh := m.Idle / 10
+	if refresh > time.Minute {
+		refresh = time.Minute
+	}
+	if time.Since(time.Unix(s.Seen, 0)) >= refresh {
+		m.Update(w, s)
+	}
+	count("resumed")
+	return s
+}
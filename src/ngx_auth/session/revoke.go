@@ -0,0 +1,137 @@
+package session
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	logger "ngx_auth/logger"
+	"ngx_auth/metrics"
+)
+
+// RevokeCheckInterval is how often the revocation file is checked for
+// a change.
+const RevokeCheckInterval = 5 * time.Second
+
+// RevokeAll is the user of a line revoking the sessions of all users.
+const RevokeAll = "*"
+
+// RevokeList is the revocation file of the sessions. Each line is a user,
+// or "*" for all users, optionally followed by an RFC 3339 time. The
+// sessions issued before the time are revoked, or all the sessions of the
+// user without a time. Empty lines and lines starting with # are ignored.
+type RevokeList struct {
+	file string
+
+	mu      sync.Mutex
+	mtime   time.Time
+	checked time.Time
+	before  map[string]time.Time
+}
+
+// LoadRevokeList reads the revocation file. The file is read again when it
+// is modified, and the current list is kept if it cannot be read.
+func LoadRevokeList(file string) (*RevokeList, error) {
+	rl := &RevokeList{file: file}
+	if err := rl.load(); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// never is the time of a line without a time, after every session.
+var never = time.Unix(1<<62, 0)
+
+func parse_revoke(f *os.File) (map[string]time.Time, error) {
+	before := map[string]time.Time{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		tm := never
+		switch len(fields) {
+		case 1:
+		case 2:
+			var err error
+			if tm, err = time.Parse(time.RFC3339, fields[1]); err != nil {
+				return nil, fmt.Errorf("line %d: bad time: %q", n, fields[1])
+			}
+		default:
+			return nil, fmt.Errorf("line %d: too many fields", n)
+		}
+		if cur, has := before[fields[0]]; !has || tm.After(cur) {
+			before[fields[0]] = tm
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return before, nil
+}
+
+func (rl *RevokeList) load() error {
+	f, err := os.Open(rl.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	before, err := parse_revoke(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", rl.file, err)
+	}
+
+	rl.before = before
+	rl.mtime = st.ModTime()
+	rl.checked = time.Now()
+	return nil
+}
+
+func (rl *RevokeList) reload() {
+	if time.Since(rl.checked) < RevokeCheckInterval {
+		return
+	}
+	rl.checked = time.Now()
+	st, err := os.Stat(rl.file)
+	if err == nil && st.ModTime().Equal(rl.mtime) {
+		return
+	}
+	if err == nil {
+		err = rl.load()
+	}
+	if err != nil {
+		metrics.ConfigReloads.Inc("session_revoke", "error")
+		logger.Event(logger.LevelError, logger.EventSessionRevokeError,
+			logger.File(rl.file), logger.Err(err))
+		return
+	}
+	metrics.ConfigReloads.Inc("session_revoke", "ok")
+	logger.Event(logger.LevelNotice, logger.EventSessionRevokeReloaded,
+		logger.File(rl.file), logger.Entries(len(rl.before)))
+}
+
+// IsRevoked reports whether the session of user issued at issued is revoked.
+func (rl *RevokeList) IsRevoked(user string, issued time.Time) bool {
+	if rl == nil {
+		return false
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.reload()
+
+	for _, u := range []string{user, RevokeAll} {
+		if tm, has := rl.before[u]; has && issued.Before(tm) {
+			return true
+		}
+	}
+	return false
+}
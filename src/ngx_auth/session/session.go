@@ -0,0 +1,203 @@
+// Package session seals small values, such as the user of a login session,
+// into cookies. A value is encrypted with AES-256-CTR and signed with
+// HMAC-SHA256, so the client can neither read nor change it.
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrShortSecret = errors.New("session secret is shorter than 32 bytes")
+	ErrBadCookie   = errors.New("bad session cookie")
+	ErrExpired     = errors.New("session is expired")
+	ErrProfile     = errors.New("session is of another profile")
+)
+
+// MinSecretLen is the minimum length of a session secret.
+const MinSecretLen = 32
+
+const (
+	format_version = 1
+	iv_len         = aes.BlockSize
+	mac_len        = sha256.Size
+)
+
+// Codec seals and opens values with the keys derived from one secret.
+type Codec struct {
+	enc_key []byte
+	mac_key []byte
+}
+
+func derive(secret []byte, label string) []byte {
+	hm := hmac.New(sha256.New, secret)
+	hm.Write([]byte("ngx_auth session " + label))
+	return hm.Sum(nil)
+}
+
+func NewCodec(secret string) (*Codec, error) {
+	if len(secret) < MinSecretLen {
+		return nil, ErrShortSecret
+	}
+	return &Codec{
+		enc_key: derive([]byte(secret), "enc"),
+		mac_key: derive([]byte(secret), "mac"),
+	}, nil
+}
+
+func (c *Codec) sign(bin []byte) []byte {
+	hm := hmac.New(sha256.New, c.mac_key)
+	hm.Write(bin)
+	return hm.Sum(nil)
+}
+
+func (c *Codec) xor(iv []byte, src []byte) []byte {
+	block, err := aes.NewCipher(c.enc_key)
+	if err != nil {
+		panic(err)
+	}
+	dst := make([]byte, len(src))
+	cipher.NewCTR(block, iv).XORKeyStream(dst, src)
+	return dst
+}
+
+// Seal encodes v as JSON, and returns the encrypted and signed string.
+func (c *Codec) Seal(v interface{}) (string, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	bin := make([]byte, 1+iv_len, 1+iv_len+len(plain)+mac_len)
+	bin[0] = format_version
+	if _, err := rand.Read(bin[1 : 1+iv_len]); err != nil {
+		return "", err
+	}
+	bin = append(bin, c.xor(bin[1:1+iv_len], plain)...)
+	bin = append(bin, c.sign(bin)...)
+	return base64.RawURLEncoding.EncodeToString(bin), nil
+}
+
+// Open checks the signature of a sealed string, and decodes it into v.
+func (c *Codec) Open(s string, v interface{}) error {
+	bin, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(bin) < 1+iv_len+mac_len || bin[0] != format_version {
+		return ErrBadCookie
+	}
+
+	n := len(bin) - mac_len
+	if !hmac.Equal(c.sign(bin[:n]), bin[n:]) {
+		return ErrBadCookie
+	}
+	if err := json.Unmarshal(c.xor(bin[1:1+iv_len], bin[1+iv_len:n]), v); err != nil {
+		return ErrBadCookie
+	}
+	return nil
+}
+
+// Login methods of the sessions.
+const (
+	MethodOidc = "oidc"
+)
+
+// Session is a login session kept in a cookie.
+type Session struct {
+	User   string   `json:"u"`
+	Groups []string `json:"g,omitempty"`
+	// Method is how the user logged in, such as "oidc".
+	Method  string `json:"m,omitempty"`
+	Issued  int64  `json:"iat"`
+	Expires int64  `json:"exp"`
+	// Seen is the time of the last use, for the idle timeout.
+	Seen int64 `json:"seen,omitempty"`
+	// Gen is the generation of the Manager issuing the session.
+	Gen uint32 `json:"gen,omitempty"`
+	// Fp is the fingerprint of the password of the login.
+	Fp string `json:"fp,omitempty"`
+	// Mfa is true if the login was with a second factor.
+	Mfa bool `json:"mfa,omitempty"`
+	// Authz is the results of the authorization filters, by FilterKey.
+	Authz map[string]bool `json:"a,omitempty"`
+	// Profile is the profile issuing the session. The profiles sharing
+	// a secret do not accept the sessions of each other.
+	Profile string `json:"p,omitempty"`
+}
+
+func New(user string, groups []string, method string, max_age time.Duration) *Session {
+	now := time.Now()
+	return &Session{
+		User:    user,
+		Groups:  groups,
+		Method:  method,
+		Issued:  now.Unix(),
+		Expires: now.Add(max_age).Unix(),
+	}
+}
+
+// Valid reports whether the session is not expired at now.
+func (s *Session) Valid(now time.Time) bool {
+	return s.User != "" && now.Unix() < s.Expires
+}
+
+// CookieConfig is the attributes of a session cookie.
+type CookieConfig struct {
+	Name   string
+	Path   string
+	Domain string
+	// Insecure drops the Secure attribute, only for a test without TLS.
+	Insecure bool
+}
+
+// Cookie returns the cookie of value, expiring at expires.
+func (cc *CookieConfig) Cookie(value string, expires time.Time) *http.Cookie {
+	path := cc.Path
+	if path == "" {
+		path = "/"
+	}
+	return &http.Cookie{
+		Name:     cc.Name,
+		Value:    value,
+		Path:     path,
+		Domain:   cc.Domain,
+		Expires:  expires,
+		MaxAge:   int(time.Until(expires).Seconds()),
+		Secure:   !cc.Insecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Clear returns the cookie removing the session cookie.
+func (cc *CookieConfig) Clear() *http.Cookie {
+	c := cc.Cookie("", time.Unix(0, 0))
+	c.MaxAge = -1
+	return c
+}
+
+// Load opens the session of profile in the cookie of the request.
+func (c *Codec) Load(r *http.Request, name string, profile string) (*Session, error) {
+	ck, err := r.Cookie(name)
+	if err != nil {
+		return nil, err
+	}
+	var s Session
+	if err := c.Open(ck.Value, &s); err != nil {
+		return nil, err
+	}
+	if s.Profile != profile {
+		return nil, ErrProfile
+	}
+	if !s.Valid(time.Now()) {
+		return nil, ErrExpired
+	}
+	return &s, nil
+}
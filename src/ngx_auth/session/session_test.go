@@ -0,0 +1,189 @@
+package session
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const test_secret = "0123456789abcdef0123456789abcdef"
+
+// flip changes one bit of the byte at off of a sealed string.
+func flip(t *testing.T, sealed string, off int) string {
+	t.Helper()
+	bin, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off < 0 {
+		off += len(bin)
+	}
+	bin[off] ^= 1
+	return base64.RawURLEncoding.EncodeToString(bin)
+}
+
+func TestCodecOpen(t *testing.T) {
+	c, err := NewCodec(test_secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewCodec(test_secret + "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := c.Seal(&Session{User: "user1", Expires: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		codec  *Codec
+		sealed string
+		err    error
+	}{
+		{"sealed", c, sealed, nil},
+		{"other secret", other, sealed, ErrBadCookie},
+		{"version", c, flip(t, sealed, 0), ErrBadCookie},
+		{"iv", c, flip(t, sealed, 1), ErrBadCookie},
+		{"payload", c, flip(t, sealed, 1+iv_len), ErrBadCookie},
+		{"mac", c, flip(t, sealed, -1), ErrBadCookie},
+		{"truncated", c, sealed[:len(sealed)-4], ErrBadCookie},
+		{"not base64", c, "!" + sealed[1:], ErrBadCookie},
+		{"empty", c, "", ErrBadCookie},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s Session
+			err := tt.codec.Open(tt.sealed, &s)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Open() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && s.User != "user1" {
+				t.Errorf("Open() user = %q, want %q", s.User, "user1")
+			}
+		})
+	}
+}
+
+func TestNewCodecShortSecret(t *testing.T) {
+	if _, err := NewCodec(test_secret[:MinSecretLen-1]); !errors.Is(err, ErrShortSecret) {
+		t.Errorf("NewCodec() error = %v, want %v", err, ErrShortSecret)
+	}
+}
+
+func TestManagerLoad(t *testing.T) {
+	revoke_file := filepath.Join(t.TempDir(), "revoked")
+	err := os.WriteFile(revoke_file, []byte("revoked\nold 2020-01-01T00:00:00Z\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Secret: test_secret, Generation: 2, RevokeFile: revoke_file}
+	cfg.SetDefault()
+	m, err := NewManager(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Profile = "app"
+
+	now := time.Now()
+	valid := func(user string) *Session {
+		return &Session{User: user, Issued: now.Unix(), Seen: now.Unix(),
+			Expires: now.Add(time.Hour).Unix(), Gen: 2, Profile: "app"}
+	}
+	with := func(s *Session, f func(s *Session)) *Session {
+		f(s)
+		return s
+	}
+
+	tests := []struct {
+		name string
+		s    *Session
+		err  error
+	}{
+		{"valid", valid("user1"), nil},
+		{"no user", valid(""), ErrBadCookie},
+		{"expired", with(valid("user1"), func(s *Session) { s.Expires = now.Unix() }), ErrExpired},
+		{"idle", with(valid("user1"), func(s *Session) {
+			s.Seen = now.Add(-DefaultIdleSeconds * time.Second).Unix()
+		}), ErrIdle},
+		{"old generation", with(valid("user1"), func(s *Session) { s.Gen = 1 }), ErrGeneration},
+		{"revoked user", valid("revoked"), ErrRevoked},
+		{"issued before revocation", with(valid("old"), func(s *Session) {
+			s.Issued = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+		}), ErrRevoked},
+		{"issued after revocation", valid("old"), nil},
+		{"other profile", with(valid("user1"), func(s *Session) { s.Profile = "admin" }), ErrProfile},
+		{"no profile", with(valid("user1"), func(s *Session) { s.Profile = "" }), ErrProfile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := m.Codec.Seal(tt.s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: m.Cookie.Name, Value: sealed})
+			if _, err := m.Load(r); !errors.Is(err, tt.err) {
+				t.Errorf("Load() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	if _, err := m.Load(httptest.NewRequest("GET", "/", nil)); !errors.Is(err, http.ErrNoCookie) {
+		t.Errorf("Load() without cookie error = %v, want %v", err, http.ErrNoCookie)
+	}
+}
+
+func TestManagerResume(t *testing.T) {
+	cfg := Config{Secret: test_secret}
+	cfg.SetDefault()
+	m, err := NewManager(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	m.Issue(w, &Session{User: "user1", Method: MethodBasic}, "pass1")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Issue() set %d cookies, want 1", len(cookies))
+	}
+
+	tests := []struct {
+		name       string
+		user, pass string
+		want       bool
+	}{
+		{"cookie only", "", "", true},
+		{"same credentials", "user1", "pass1", true},
+		{"other password", "user1", "pass2", false},
+		{"other user", "user2", "pass1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(cookies[0])
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+			w := httptest.NewRecorder()
+			s := m.Resume(w, r)
+			if (s != nil) != tt.want {
+				t.Fatalf("Resume() = %v, want a session %v", s, tt.want)
+			}
+			if !tt.want && len(w.Result().Cookies()) != 1 {
+				t.Errorf("Resume() did not clear the cookie")
+			}
+		})
+	}
+
+	var nm *Manager
+	if s := nm.Resume(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)); s != nil {
+		t.Errorf("nil Resume() = %v, want nil", s)
+	}
+}
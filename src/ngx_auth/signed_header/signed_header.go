@@ -0,0 +1,240 @@
+// Package signed_header verifies the user headers signed by the upstream authenticator.
+package signed_header
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ngx_auth/jwt"
+	"ngx_auth/metrics"
+)
+
+// Formats of the signature header.
+const (
+	FormatHmac = "hmac"
+	FormatJws  = "jws"
+)
+
+const (
+	DefaultHeader        = "X-Auth-Signature"
+	DefaultMaxAgeSeconds = 60
+)
+
+// MinSecretLen is the minimum length of a HMAC secret.
+const MinSecretLen = 32
+
+// MaxNonceLen is the maximum length of a nonce or a jti.
+const MaxNonceLen = 128
+
+var (
+	ErrNoSignature  = errors.New("no signature")
+	ErrMalformed    = errors.New("malformed signature")
+	ErrBadSignature = errors.New("bad signature")
+	ErrStale        = errors.New("stale signature")
+	ErrReplay       = errors.New("signature is already used")
+	ErrMismatch     = errors.New("signature is for another user or path")
+	ErrShortSecret  = errors.New("hmac_secret is shorter than 32 bytes")
+)
+
+// Config is the [signature] part.
+type Config struct {
+	Format        string `toml:"format,omitempty" json:"format,omitempty" yaml:"format,omitempty"`
+	Header        string `toml:"header,omitempty" json:"header,omitempty" yaml:"header,omitempty"`
+	HmacSecret    string `toml:"hmac_secret,omitempty" json:"hmac_secret,omitempty" yaml:"hmac_secret,omitempty" secret:"true" expand:"true"`
+	JwksFile      string `toml:"jwks_file,omitempty" json:"jwks_file,omitempty" yaml:"jwks_file,omitempty"`
+	MaxAgeSeconds uint32 `toml:"max_age_seconds,omitempty" json:"max_age_seconds,omitempty" yaml:"max_age_seconds,omitempty"`
+}
+
+func (cfg *Config) IsEnabled() bool {
+	return cfg.Format != ""
+}
+
+func (cfg *Config) SetDefault() {
+	if cfg.Header == "" {
+		cfg.Header = DefaultHeader
+	}
+	if cfg.MaxAgeSeconds == 0 {
+		cfg.MaxAgeSeconds = DefaultMaxAgeSeconds
+	}
+}
+
+// Verifier checks the signature header of the user and the path.
+type Verifier struct {
+	Format string
+	Header string
+	Secret []byte
+	Jwt    *jwt.Verifier
+	MaxAge time.Duration
+
+	mu     sync.Mutex
+	seen   map[string]int64
+	pruned int64
+}
+
+func NewVerifier(cfg *Config) (*Verifier, error) {
+	v := &Verifier{
+		Format: cfg.Format,
+		Header: cfg.Header,
+		MaxAge: time.Duration(cfg.MaxAgeSeconds) * time.Second,
+		seen:   map[string]int64{},
+	}
+
+	switch cfg.Format {
+	case FormatHmac:
+		if len(cfg.HmacSecret) < MinSecretLen {
+			return nil, ErrShortSecret
+		}
+		v.Secret = []byte(cfg.HmacSecret)
+	case FormatJws:
+		ks := &jwt.KeySet{}
+		if cfg.JwksFile != "" {
+			var err error
+			if ks, err = jwt.LoadJWKSFile(cfg.JwksFile); err != nil {
+				return nil, err
+			}
+		}
+		if cfg.HmacSecret != "" {
+			if len(cfg.HmacSecret) < MinSecretLen {
+				return nil, ErrShortSecret
+			}
+			ks.Keys = append(ks.Keys, jwt.Key{Alg: jwt.AlgHS256, Public: []byte(cfg.HmacSecret)})
+		}
+		if len(ks.Keys) == 0 {
+			return nil, errors.New("jwks_file or hmac_secret is required")
+		}
+		// The freshness is checked by iat and MaxAge.
+		v.Jwt = &jwt.Verifier{Keys: &jwt.StaticKeys{Keys: ks}, AllowNoExp: true}
+	default:
+		return nil, fmt.Errorf("bad format: %q", cfg.Format)
+	}
+	return v, nil
+}
+
+// Mac returns the HMAC signature of the hmac format.
+func Mac(secret []byte, ts int64, nonce string, user string, path string) string {
+	hm := hmac.New(sha256.New, secret)
+	fmt.Fprintf(hm, "%d\n%s\n%s\n%s", ts, nonce, user, path)
+	return base64.RawURLEncoding.EncodeToString(hm.Sum(nil))
+}
+
+func count(result string) {
+	metrics.SignedHeaders.Inc(result)
+}
+
+func result_of(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrNoSignature):
+		return "missing"
+	case errors.Is(err, ErrStale), errors.Is(err, jwt.ErrExpired), errors.Is(err, jwt.ErrNotYetValid):
+		return "stale"
+	case errors.Is(err, ErrReplay):
+		return "replay"
+	case errors.Is(err, ErrMismatch):
+		return "mismatch"
+	case errors.Is(err, ErrBadSignature), errors.Is(err, jwt.ErrBadSignature), errors.Is(err, jwt.ErrBadAlg):
+		return "bad_signature"
+	}
+	return "malformed"
+}
+
+// Verify checks the signature header of r. A nil Verifier accepts every request.
+func (v *Verifier) Verify(r *http.Request, user string, path string) error {
+	if v == nil {
+		return nil
+	}
+	sig := r.Header.Get(v.Header)
+	var err error
+	switch {
+	case sig == "":
+		err = ErrNoSignature
+	case v.Format == FormatJws:
+		err = v.verify_jws(sig, user, path)
+	default:
+		err = v.verify_hmac(sig, user, path)
+	}
+	count(result_of(err))
+	return err
+}
+
+// verify_hmac checks "t=UNIX_TIME,n=NONCE,s=MAC".
+func (v *Verifier) verify_hmac(sig string, user string, path string) error {
+	var ts_str, nonce, mac string
+	for _, kv := range strings.Split(sig, ",") {
+		k, val, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		switch k {
+		case "t":
+			ts_str = val
+		case "n":
+			nonce = val
+		case "s":
+			mac = val
+		}
+	}
+	ts, err := strconv.ParseInt(ts_str, 10, 64)
+	if err != nil || nonce == "" || len(nonce) > MaxNonceLen || mac == "" {
+		return ErrMalformed
+	}
+	if !hmac.Equal([]byte(Mac(v.Secret, ts, nonce, user, path)), []byte(mac)) {
+		return ErrBadSignature
+	}
+	return v.check_fresh("n:"+nonce, time.Unix(ts, 0))
+}
+
+// verify_jws checks a compact JWS with the claims sub, path, iat and jti.
+func (v *Verifier) verify_jws(token string, user string, path string) error {
+	claims, err := v.Jwt.Verify(token)
+	if err != nil {
+		return err
+	}
+	if jwt.String(claims, "sub") != user || jwt.String(claims, "path") != path {
+		return ErrMismatch
+	}
+	jti := jwt.String(claims, "jti")
+	if jti == "" || len(jti) > MaxNonceLen {
+		return fmt.Errorf("%w: no jti", ErrMalformed)
+	}
+	num, ok := claims["iat"].(json.Number)
+	if !ok {
+		return fmt.Errorf("%w: no iat", ErrMalformed)
+	}
+	iat, err := num.Int64()
+	if err != nil {
+		return fmt.Errorf("%w: bad iat", ErrMalformed)
+	}
+	return v.check_fresh("j:"+jti, time.Unix(iat, 0))
+}
+
+// check_fresh accepts a signature made within MaxAge, and only once.
+func (v *Verifier) check_fresh(id string, signed time.Time) error {
+	now := time.Now()
+	if now.Sub(signed) > v.MaxAge || signed.Sub(now) > v.MaxAge {
+		return ErrStale
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.pruned != now.Unix() {
+		for k, exp := range v.seen {
+			if exp < now.Unix() {
+				delete(v.seen, k)
+			}
+		}
+		v.pruned = now.Unix()
+	}
+	if _, has := v.seen[id]; has {
+		return ErrReplay
+	}
+	v.seen[id] = signed.Add(v.MaxAge).Unix()
+	return nil
+}
@@ -0,0 +1,180 @@
+package signed_header
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"ngx_auth/jwt"
+)
+
+const test_secret = "0123456789abcdef0123456789abcdef"
+
+// hmac_header returns the hmac format header signed at ts.
+func hmac_header(secret string, ts int64, nonce string, user string, path string) string {
+	return "t=" + strconv.FormatInt(ts, 10) + ",n=" + nonce +
+		",s=" + Mac([]byte(secret), ts, nonce, user, path)
+}
+
+// hs256 returns a compact JWS of claims signed with secret.
+func hs256(alg string, claims map[string]interface{}, secret string) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	hd, _ := json.Marshal(map[string]string{"alg": alg})
+	cl, _ := json.Marshal(claims)
+	signed := b64(hd) + "." + b64(cl)
+	hm := hmac.New(sha256.New, []byte(secret))
+	hm.Write([]byte(signed))
+	return signed + "." + b64(hm.Sum(nil))
+}
+
+func TestVerifyHmac(t *testing.T) {
+	cfg := &Config{Format: FormatHmac, HmacSecret: test_secret}
+	cfg.SetDefault()
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name   string
+		header string
+		err    error
+	}{
+		{"ok", hmac_header(test_secret, now, "n1", "user1", "/app"), nil},
+		{"with spaces", strings.ReplaceAll(hmac_header(test_secret, now, "n2", "user1", "/app"), ",", ", "), nil},
+		{"skew within max age", hmac_header(test_secret, now+30, "n3", "user1", "/app"), nil},
+		{"no header", "", ErrNoSignature},
+		{"no time", "n=n4,s=" + Mac([]byte(test_secret), 0, "n4", "user1", "/app"), ErrMalformed},
+		{"bad time", "t=now,n=n4,s=x", ErrMalformed},
+		{"no nonce", hmac_header(test_secret, now, "", "user1", "/app"), ErrMalformed},
+		{"long nonce", hmac_header(test_secret, now, strings.Repeat("n", MaxNonceLen+1), "user1", "/app"), ErrMalformed},
+		{"no mac", "t=" + strconv.FormatInt(now, 10) + ",n=n4", ErrMalformed},
+		{"other secret", hmac_header(test_secret+"x", now, "n4", "user1", "/app"), ErrBadSignature},
+		{"other user", hmac_header(test_secret, now, "n4", "user2", "/app"), ErrBadSignature},
+		{"other path", hmac_header(test_secret, now, "n4", "user1", "/admin"), ErrBadSignature},
+		{"stale", hmac_header(test_secret, now-DefaultMaxAgeSeconds-1, "n4", "user1", "/app"), ErrStale},
+		{"future", hmac_header(test_secret, now+DefaultMaxAgeSeconds+1, "n4", "user1", "/app"), ErrStale},
+	}
+	v, err := NewVerifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set(DefaultHeader, tt.header)
+			}
+			if err := v.Verify(r, "user1", "/app"); !errors.Is(err, tt.err) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifyJws(t *testing.T) {
+	cfg := &Config{Format: FormatJws, HmacSecret: test_secret}
+	cfg.SetDefault()
+	now := json.Number(strconv.FormatInt(time.Now().Unix(), 10))
+	old := json.Number(strconv.FormatInt(time.Now().Unix()-DefaultMaxAgeSeconds-1, 10))
+	claims := func(jti string, sub string, path string, iat interface{}) map[string]interface{} {
+		cl := map[string]interface{}{"sub": sub, "path": path, "jti": jti}
+		if iat != nil {
+			cl["iat"] = iat
+		}
+		return cl
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"ok", hs256("HS256", claims("j1", "user1", "/app", now), test_secret), nil},
+		{"other secret", hs256("HS256", claims("j2", "user1", "/app", now), test_secret+"x"), jwt.ErrBadSignature},
+		{"alg none", hs256("none", claims("j2", "user1", "/app", now), test_secret), jwt.ErrBadAlg},
+		{"other user", hs256("HS256", claims("j2", "user2", "/app", now), test_secret), ErrMismatch},
+		{"other path", hs256("HS256", claims("j2", "user1", "/admin", now), test_secret), ErrMismatch},
+		{"no jti", hs256("HS256", claims("", "user1", "/app", now), test_secret), ErrMalformed},
+		{"no iat", hs256("HS256", claims("j2", "user1", "/app", nil), test_secret), ErrMalformed},
+		{"iat not a number", hs256("HS256", claims("j2", "user1", "/app", "now"), test_secret), ErrMalformed},
+		{"stale", hs256("HS256", claims("j2", "user1", "/app", old), test_secret), ErrStale},
+		{"replay", hs256("HS256", claims("j1", "user1", "/app", now), test_secret), ErrReplay},
+		{"not a token", "t=1,n=n1,s=x", jwt.ErrMalformed},
+	}
+	v, err := NewVerifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set(DefaultHeader, tt.token)
+			if err := v.Verify(r, "user1", "/app"); !errors.Is(err, tt.err) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	cfg := &Config{Format: FormatHmac, HmacSecret: test_secret}
+	cfg.SetDefault()
+	v, err := NewVerifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+
+	steps := []struct {
+		name   string
+		header string
+		err    error
+	}{
+		{"first use", hmac_header(test_secret, now, "n1", "user1", "/app"), nil},
+		{"same header", hmac_header(test_secret, now, "n1", "user1", "/app"), ErrReplay},
+		{"same nonce at other time", hmac_header(test_secret, now-1, "n1", "user1", "/app"), ErrReplay},
+		{"other nonce", hmac_header(test_secret, now, "n2", "user1", "/app"), nil},
+	}
+	for _, st := range steps {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(DefaultHeader, st.header)
+		if err := v.Verify(r, "user1", "/app"); !errors.Is(err, st.err) {
+			t.Errorf("%s: Verify() error = %v, want %v", st.name, err, st.err)
+		}
+	}
+
+	var nv *Verifier
+	if err := nv.Verify(httptest.NewRequest("GET", "/", nil), "user1", "/app"); err != nil {
+		t.Errorf("nil Verify() error = %v, want nil", err)
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		err  error
+	}{
+		{"hmac", Config{Format: FormatHmac, HmacSecret: test_secret}, nil},
+		{"hmac short secret", Config{Format: FormatHmac, HmacSecret: "secret"}, ErrShortSecret},
+		{"jws short secret", Config{Format: FormatJws, HmacSecret: "secret"}, ErrShortSecret},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewVerifier(&tt.cfg); !errors.Is(err, tt.err) {
+				t.Errorf("NewVerifier() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	for _, cfg := range []Config{{Format: FormatJws}, {Format: "plain", HmacSecret: test_secret}} {
+		if _, err := NewVerifier(&cfg); err == nil {
+			t.Errorf("NewVerifier(%q) error = nil, want an error", cfg.Format)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package totp
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"ngx_auth/ldap_auth"
+	logger "ngx_auth/logger"
+	"ngx_auth/metrics"
+)
+
+// SecretCheckInterval is how often the secret file is checked for a change.
+const SecretCheckInterval = 5 * time.Second
+
+// SecretFile is the file of the secret keys. Each line is a user and its
+// base32 key. Empty lines and lines starting with # are ignored.
+type SecretFile struct {
+	file string
+
+	mu      sync.Mutex
+	mtime   time.Time
+	checked time.Time
+	keys    map[string][]byte
+}
+
+// LoadSecretFile reads the secret file. The file is read again when it is
+// modified, and the current keys are kept if it cannot be read.
+func LoadSecretFile(file string) (*SecretFile, error) {
+	sf := &SecretFile{file: file}
+	if err := sf.load(); err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+func parse_secrets(f *os.File) (map[string][]byte, error) {
+	keys := map[string][]byte{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: must be a user and a secret", n)
+		}
+		key, err := DecodeSecret(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		keys[fields[0]] = key
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (sf *SecretFile) load() error {
+	f, err := os.Open(sf.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	keys, err := parse_secrets(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", sf.file, err)
+	}
+
+	sf.keys = keys
+	sf.mtime = st.ModTime()
+	sf.checked = time.Now()
+	return nil
+}
+
+func (sf *SecretFile) reload() {
+	if time.Since(sf.checked) < SecretCheckInterval {
+		return
+	}
+	sf.checked = time.Now()
+	st, err := os.Stat(sf.file)
+	if err == nil && st.ModTime().Equal(sf.mtime) {
+		return
+	}
+	if err == nil {
+		err = sf.load()
+	}
+	if err != nil {
+		metrics.ConfigReloads.Inc("totp_secrets", "error")
+		logger.Event(logger.LevelError, logger.EventTotpSecretsError,
+			logger.File(sf.file), logger.Err(err))
+		return
+	}
+	metrics.ConfigReloads.Inc("totp_secrets", "ok")
+	logger.Event(logger.LevelNotice, logger.EventTotpSecretsReloaded,
+		logger.File(sf.file), logger.Entries(len(sf.keys)))
+}
+
+func (sf *SecretFile) Secret(user string) ([]byte, error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.reload()
+
+	return sf.keys[user], nil
+}
+
+// LdapSecrets searches the secret keys with the search account.
+// Filter is a search filter with %s for the user, such as "(uid=%s)",
+// and Attr is the attribute of the base32 key.
+type LdapSecrets struct {
+	Config *ldap_auth.Config
+	Filter string
+	Attr   string
+}
+
+func (ls *LdapSecrets) Secret(user string) ([]byte, error) {
+	la, err := ldap_auth.NewLdapAuth(ls.Config)
+	if err != nil {
+		return nil, err
+	}
+	defer la.Close()
+
+	if err := la.BindService(); err != nil {
+		return nil, err
+	}
+	vals, err := la.SearchValues(ls.Filter, user, ls.Attr)
+	if err != nil {
+		return nil, err
+	}
+	switch len(vals) {
+	case 0:
+		return nil, nil
+	case 1:
+		return DecodeSecret(vals[0])
+	}
+	return nil, fmt.Errorf("%d values of %s", len(vals), ls.Attr)
+}
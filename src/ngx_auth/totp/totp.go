@@ -0,0 +1,244 @@
+// Package totp verifies the time-based one-time passwords of RFC 6238,
+// the 6 digit codes of the authenticator apps, as a second factor.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"ngx_auth/logger"
+	"ngx_auth/metrics"
+)
+
+var (
+	ErrNoSecret  = errors.New("user has no TOTP secret")
+	ErrBadSecret = errors.New("bad TOTP secret")
+	ErrBadCode   = errors.New("bad TOTP code")
+	ErrReplay    = errors.New("TOTP code is already used")
+	ErrLocked    = errors.New("TOTP codes of the user are locked after failures")
+)
+
+// The parameters of the codes, the defaults of the authenticator apps.
+const (
+	Digits = 6
+	Period = 30
+	// Skew is the number of periods accepted before and after the current
+	// one, for the clock difference of the devices.
+	Skew = 1
+)
+
+// The limit of the failed codes of a user, as in RFC 6238 section 5.2.
+// After MaxFailures failures in a row, the codes of the user are rejected
+// for Lockout, doubled at each further failure up to MaxLockout.
+const (
+	MaxFailures = 5
+	Lockout     = 30 * time.Second
+	MaxLockout  = 15 * time.Minute
+)
+
+// MinSecretLen is the minimum length of a secret key in bytes.
+const MinSecretLen = 10
+
+// Config is the [totp] part. The secrets are in SecretFile, or in LdapAttr
+// of the entry found by LdapFilter.
+type Config struct {
+	SecretFile string `toml:"secret_file,omitempty" json:"secret_file,omitempty" yaml:"secret_file,omitempty"`
+	LdapFilter string `toml:"ldap_filter,omitempty" json:"ldap_filter,omitempty" yaml:"ldap_filter,omitempty"`
+	LdapAttr   string `toml:"ldap_attr,omitempty" json:"ldap_attr,omitempty" yaml:"ldap_attr,omitempty"`
+}
+
+func (cfg *Config) IsEnabled() bool {
+	return cfg.SecretFile != "" || cfg.LdapAttr != ""
+}
+
+// DecodeSecret decodes a base32 secret key, as in the otpauth URIs.
+// Spaces, padding and lower case letters are allowed.
+func DecodeSecret(str string) ([]byte, error) {
+	str = strings.ToUpper(strings.Join(strings.Fields(str), ""))
+	str = strings.TrimRight(str, "=")
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(str)
+	if err != nil || len(key) < MinSecretLen {
+		return nil, ErrBadSecret
+	}
+	return key, nil
+}
+
+// Step returns the time step of t.
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Code returns the code of key at the time step.
+func Code(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	hm := hmac.New(sha1.New, key)
+	hm.Write(msg[:])
+	sum := hm.Sum(nil)
+
+	off := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, bin%1000000)
+}
+
+// SplitCode splits the code from the end of a Basic password.
+// It returns false if the password does not end with a code.
+func SplitCode(pass string) (string, string, bool) {
+	n := len(pass) - Digits
+	if n <= 0 {
+		return pass, "", false
+	}
+	for _, c := range pass[n:] {
+		if c < '0' || c > '9' {
+			return pass, "", false
+		}
+	}
+	return pass[:n], pass[n:], true
+}
+
+// Store has the secret keys of the users.
+type Store interface {
+	// Secret returns the key of user, or nil if the user has none.
+	Secret(user string) ([]byte, error)
+}
+
+// Verifier checks the codes with the keys of Store. A code is accepted
+// only once, and no code older than the last accepted one of the user.
+type Verifier struct {
+	Store Store
+
+	mu     sync.Mutex
+	used   map[string]int64
+	pruned int64
+	fails  map[string]*failures
+	now    func() time.Time
+}
+
+// failures are the failed codes of a user since the last accepted one.
+type failures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+func NewVerifier(store Store) *Verifier {
+	return &Verifier{Store: store, used: map[string]int64{},
+		fails: map[string]*failures{}, now: time.Now}
+}
+
+func count(result string) {
+	metrics.Totp.Inc(result)
+}
+
+// Verify checks the code of user. A nil Verifier has no secrets.
+func (v *Verifier) Verify(user string, code string) error {
+	if v == nil {
+		return ErrNoSecret
+	}
+	key, err := v.Store.Secret(user)
+	if err != nil {
+		count("error")
+		return err
+	}
+	if key == nil {
+		count("no_secret")
+		return ErrNoSecret
+	}
+	t := v.now()
+	if v.locked(user, t) {
+		count("locked")
+		return ErrLocked
+	}
+	if len(code) != Digits {
+		count("bad_code")
+		v.fail(user, t)
+		return ErrBadCode
+	}
+
+	now := Step(t)
+	for step := now - Skew; step <= now+Skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(Code(key, step)), []byte(code)) != 1 {
+			continue
+		}
+		if !v.use(user, step, now) {
+			count("replay")
+			v.fail(user, t)
+			return ErrReplay
+		}
+		count("ok")
+		return nil
+	}
+	count("bad_code")
+	v.fail(user, t)
+	return ErrBadCode
+}
+
+// locked returns true while the codes of user are locked.
+func (v *Verifier) locked(user string, t time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	f := v.fails[user]
+	return f != nil && t.Before(f.until)
+}
+
+// fail counts a failed code of user, and locks the codes after MaxFailures.
+// The failures of a user without one for MaxLockout are forgotten.
+func (v *Verifier) fail(user string, t time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for u, f := range v.fails {
+		if t.Sub(f.last) > MaxLockout && !t.Before(f.until) {
+			delete(v.fails, u)
+		}
+	}
+	f := v.fails[user]
+	if f == nil {
+		f = &failures{}
+		v.fails[user] = f
+	}
+	f.count++
+	f.last = t
+	if n := f.count - MaxFailures; n >= 0 {
+		d := MaxLockout
+		if n < 10 && Lockout<<n < MaxLockout {
+			d = Lockout << n
+		}
+		f.until = t.Add(d)
+		if n == 0 {
+			logger.Event(logger.LevelWarn, logger.EventTotpLocked,
+				logger.User(user), logger.Failures(f.count))
+		}
+	}
+}
+
+// use records the step of an accepted code. The steps out of the skew
+// are forgotten, because their codes are not accepted any more.
+func (v *Verifier) use(user string, step int64, now int64) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.pruned != now {
+		for u, s := range v.used {
+			if s < now-Skew {
+				delete(v.used, u)
+			}
+		}
+		v.pruned = now
+	}
+	if last, has := v.used[user]; has && step <= last {
+		return false
+	}
+	v.used[user] = step
+	delete(v.fails, user)
+	return true
+}
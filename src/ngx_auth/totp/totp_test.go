@@ -0,0 +1,202 @@
+package totp
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type map_store map[string][]byte
+
+func (ms map_store) Secret(user string) ([]byte, error) {
+	return ms[user], nil
+}
+
+// The SHA-1 test vectors of RFC 6238 Appendix B, with the last 6 digits.
+func TestCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := Code(key, Step(time.Unix(tt.unix, 0))); got != tt.want {
+			t.Errorf("Code(%d) = %q, want %q", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeSecret(t *testing.T) {
+	tests := []struct {
+		name string
+		str  string
+		err  error
+	}{
+		{"plain", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", nil},
+		{"lower case with spaces", "gezd gnbv gy3t qojq gezd gnbv gy3t qojq", nil},
+		{"padding", "GEZDGNBVGY3TQOJQ====", nil},
+		{"too short", "GEZDGNBV", ErrBadSecret},
+		{"not base32", "GEZDGNBVGY3TQOJ1", ErrBadSecret},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeSecret(tt.str); !errors.Is(err, tt.err) {
+				t.Errorf("DecodeSecret() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSplitCode(t *testing.T) {
+	tests := []struct {
+		pass, rest, code string
+		ok               bool
+	}{
+		{"secret123456", "secret", "123456", true},
+		{"secret12345x", "secret12345x", "", false},
+		{"123456", "123456", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		rest, code, ok := SplitCode(tt.pass)
+		if rest != tt.rest || code != tt.code || ok != tt.ok {
+			t.Errorf("SplitCode(%q) = %q, %q, %v, want %q, %q, %v",
+				tt.pass, rest, code, ok, tt.rest, tt.code, tt.ok)
+		}
+	}
+}
+
+// wait_step waits for a new time step if the current one ends soon, so
+// that a test runs within one step.
+func wait_step(t *testing.T) int64 {
+	t.Helper()
+	now := time.Now()
+	if left := Period - now.Unix()%Period; left < 3 {
+		time.Sleep(time.Duration(left) * time.Second)
+	}
+	return Step(time.Now())
+}
+
+func TestVerifyWindow(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		name   string
+		offset int64
+		err    error
+	}{
+		{"current", 0, nil},
+		{"previous", -Skew, nil},
+		{"next", Skew, nil},
+		{"too old", -Skew - 1, ErrBadCode},
+		{"too new", Skew + 1, ErrBadCode},
+	}
+	now := wait_step(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewVerifier(map_store{"user1": key})
+			if err := v.Verify("user1", Code(key, now+tt.offset)); !errors.Is(err, tt.err) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	v := NewVerifier(map_store{"user1": key})
+	now := wait_step(t)
+
+	tests := []struct {
+		name string
+		user string
+		code string
+		err  error
+	}{
+		{"no secret", "user2", Code(key, now), ErrNoSecret},
+		{"short code", "user1", "12345", ErrBadCode},
+		{"wrong key", "user1", Code([]byte("another key of 20 by"), now), ErrBadCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := v.Verify(tt.user, tt.code); !errors.Is(err, tt.err) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	var nv *Verifier
+	if err := nv.Verify("user1", Code(key, now)); !errors.Is(err, ErrNoSecret) {
+		t.Errorf("nil Verify() error = %v, want %v", err, ErrNoSecret)
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	key := []byte("12345678901234567890")
+	other := []byte("another key of 20 by")
+	v := NewVerifier(map_store{"user1": key, "user2": other})
+	now := wait_step(t)
+
+	steps := []struct {
+		name string
+		user string
+		code string
+		err  error
+	}{
+		{"first use", "user1", Code(key, now), nil},
+		{"same code", "user1", Code(key, now), ErrReplay},
+		{"older code", "user1", Code(key, now-1), ErrReplay},
+		{"other user", "user2", Code(other, now), nil},
+		{"newer code", "user1", Code(key, now+1), nil},
+		{"code before newer", "user1", Code(key, now), ErrReplay},
+	}
+	for _, st := range steps {
+		if err := v.Verify(st.user, st.code); !errors.Is(err, st.err) {
+			t.Errorf("%s: Verify() error = %v, want %v", st.name, err, st.err)
+		}
+	}
+}
+
+func TestVerifyLockout(t *testing.T) {
+	key := []byte("12345678901234567890")
+	v := NewVerifier(map_store{"user1": key, "user2": key})
+	now := time.Unix(1700000010, 0)
+	v.now = func() time.Time { return now }
+	bad := func() string { return Code(key, Step(now)+Skew+1) }
+	good := func() string { return Code(key, Step(now)) }
+
+	for i := 1; i < MaxFailures; i++ {
+		if err := v.Verify("user1", bad()); !errors.Is(err, ErrBadCode) {
+			t.Fatalf("failure %d: Verify() error = %v, want %v", i, err, ErrBadCode)
+		}
+	}
+	steps := []struct {
+		name  string
+		after time.Duration
+		user  string
+		code  func() string
+		err   error
+	}{
+		{"last failure", 0, "user1", bad, ErrBadCode},
+		{"locked", 0, "user1", good, ErrLocked},
+		{"other user", 0, "user2", good, nil},
+		{"still locked", Lockout - time.Second, "user1", good, ErrLocked},
+		{"failure after lockout", time.Second, "user1", bad, ErrBadCode},
+		{"doubled lockout", Lockout, "user1", good, ErrLocked},
+		{"lockout expired", Lockout, "user1", good, nil},
+		{"failure after reset", Period * time.Second, "user1", bad, ErrBadCode},
+		{"not locked after reset", 0, "user1", good, nil},
+	}
+	for _, st := range steps {
+		now = now.Add(st.after)
+		if err := v.Verify(st.user, st.code()); !errors.Is(err, st.err) {
+			t.Errorf("%s: Verify() error = %v, want %v", st.name, err, st.err)
+		}
+	}
+}